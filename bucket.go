@@ -1,8 +1,14 @@
 package s2
 
 import (
+	"bytes"
 	"encoding/xml"
+	"io/ioutil"
+	"net"
 	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -21,6 +27,18 @@ const (
 	VersioningEnabled string = "Enabled"
 )
 
+var (
+	// dnsBucketNameValidator is a regex for validating bucket names against
+	// S3's DNS-compatible naming rules
+	dnsBucketNameValidator = regexp.MustCompile(`^[a-z0-9][a-z0-9\.\-]{1,61}[a-z0-9]$`)
+	// legacyBucketNameValidator is a regex for validating bucket names
+	// against S3's legacy naming rules, which are what the router accepts
+	legacyBucketNameValidator = regexp.MustCompile(`^[a-zA-Z0-9\-_\.]{1,255}$`)
+	// locationConstraintValidator is a regex for validating location
+	// constraints
+	locationConstraintValidator = regexp.MustCompile(`^[a-zA-Z0-9\-]+$`)
+)
+
 // Contents is an individual file/object
 type Contents struct {
 	// Key specifies the object key
@@ -104,6 +122,23 @@ type ListObjectVersionsResult struct {
 	DeleteMarkers []*DeleteMarker
 	// IsTruncated specifies whether this is the end of the list or not
 	IsTruncated bool
+	// NextKeyMarker and NextVersionIDMarker specify where the next page of
+	// a truncated listing starts. They should be set to the key and version
+	// of the last entry returned. If they're empty, they're inferred from
+	// the highest key and version returned, which is only correct for
+	// version IDs that sort in listing order.
+	NextKeyMarker       string
+	NextVersionIDMarker string
+}
+
+// CreateBucketOptions are the options a bucket is created with
+type CreateBucketOptions struct {
+	// LocationConstraint is the region the bucket should be created in, or
+	// an empty string for the default region
+	LocationConstraint string
+	// ObjectLockEnabled specifies whether object lock should be enabled on
+	// the bucket
+	ObjectLockEnabled bool
 }
 
 // BucketController is an interface that specifies bucket-level functionality.
@@ -118,7 +153,7 @@ type BucketController interface {
 	ListObjectVersions(r *http.Request, bucket, prefix, keyMarker, versionMarker string, delimiter string, maxKeys int) (*ListObjectVersionsResult, error)
 
 	// CreateBucket creates a bucket
-	CreateBucket(r *http.Request, bucket string) error
+	CreateBucket(r *http.Request, bucket string, options *CreateBucketOptions) error
 
 	// DeleteBucket deletes a bucket
 	DeleteBucket(r *http.Request, bucket string) error
@@ -130,6 +165,23 @@ type BucketController interface {
 	SetBucketVersioning(r *http.Request, bucket, status string) error
 }
 
+// HeadBucketResult is a response from a HeadBucket call
+type HeadBucketResult struct {
+	// Region is the region the bucket lives in, or an empty string if
+	// unknown.
+	Region string
+}
+
+// HeadBucketController is an optional interface that a `BucketController`
+// can implement to cheaply check that a bucket exists, and to discover its
+// region. If it's not implemented, or `HeadBucket` returns
+// `NotImplementedError`, HEAD bucket requests fall back to `GetLocation`.
+type HeadBucketController interface {
+	// HeadBucket checks that a bucket exists, returning
+	// `NoSuchBucketError` if it doesn't
+	HeadBucket(r *http.Request, bucket string) (*HeadBucketResult, error)
+}
+
 // unimplementedBucketController defines a controller that returns
 // `NotImplementedError` for all functionality
 type unimplementedBucketController struct{}
@@ -146,7 +198,7 @@ func (c unimplementedBucketController) ListObjectVersions(r *http.Request, bucke
 	return nil, NotImplementedError(r)
 }
 
-func (c unimplementedBucketController) CreateBucket(r *http.Request, bucket string) error {
+func (c unimplementedBucketController) CreateBucket(r *http.Request, bucket string, options *CreateBucketOptions) error {
 	return NotImplementedError(r)
 }
 
@@ -163,8 +215,20 @@ func (c unimplementedBucketController) SetBucketVersioning(r *http.Request, buck
 }
 
 type bucketHandler struct {
-	controller BucketController
-	logger     *logrus.Entry
+	controller        BucketController
+	objects           ObjectController
+	legacyBucketNames bool
+	regions           []string
+	logger            *logrus.Entry
+}
+
+// defaultRegion returns the first configured region, or an empty string if
+// no regions are configured
+func (h *bucketHandler) defaultRegion() string {
+	if len(h.regions) == 0 {
+		return ""
+	}
+	return h.regions[0]
 }
 
 func (h *bucketHandler) location(w http.ResponseWriter, r *http.Request) {
@@ -173,8 +237,13 @@ func (h *bucketHandler) location(w http.ResponseWriter, r *http.Request) {
 
 	location, err := h.controller.GetLocation(r, bucket)
 	if err != nil {
-		WriteError(h.logger, w, r, err)
-		return
+		// fall back to the default region for controllers that don't track
+		// bucket locations
+		if s3Err, ok := err.(*Error); !ok || s3Err.Code != "NotImplemented" || h.defaultRegion() == "" {
+			WriteError(h.logger, w, r, err)
+			return
+		}
+		location = h.defaultRegion()
 	}
 
 	writeXML(h.logger, w, r, http.StatusOK, struct {
@@ -185,6 +254,55 @@ func (h *bucketHandler) location(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+func (h *bucketHandler) head(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	bucket := vars["bucket"]
+
+	result, err := h.headBucket(r, bucket)
+	if err != nil {
+		WriteError(h.logger, w, r, err)
+		return
+	}
+
+	if result.Region != "" {
+		w.Header().Set("x-amz-bucket-region", result.Region)
+
+		// let clients that signed for the wrong region discover the right
+		// one, as S3 does
+		if signedRegion := vars["authRegion"]; signedRegion != "" && signedRegion != result.Region {
+			WriteError(h.logger, w, r, PermanentRedirectError(r, result.Region))
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// headBucket checks that a bucket exists and gets its region, using the
+// controller's `HeadBucket` implementation if available
+func (h *bucketHandler) headBucket(r *http.Request, bucket string) (*HeadBucketResult, error) {
+	if controller, ok := h.controller.(HeadBucketController); ok {
+		result, err := controller.HeadBucket(r, bucket)
+		if s3Err, ok := err.(*Error); !ok || s3Err.Code != "NotImplemented" {
+			return result, err
+		}
+	}
+
+	location, err := h.controller.GetLocation(r, bucket)
+	if err == nil {
+		return &HeadBucketResult{Region: location}, nil
+	}
+	if s3Err, ok := err.(*Error); !ok || s3Err.Code != "NotImplemented" {
+		return nil, err
+	}
+
+	// as a last resort, list the bucket to check that it exists
+	if _, err := h.controller.ListObjects(r, bucket, "", "", "", 0); err != nil {
+		return nil, err
+	}
+	return &HeadBucketResult{Region: h.defaultRegion()}, nil
+}
+
 func (h *bucketHandler) get(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	bucket := vars["bucket"]
@@ -214,6 +332,7 @@ func (h *bucketHandler) get(w http.ResponseWriter, r *http.Request) {
 
 	for _, c := range result.Contents {
 		c.ETag = addETagQuotes(c.ETag)
+		c.Size = uint64(listedPlaintextSize(r, h.objects, h.logger, bucket, c.Key, "", int64(c.Size)))
 	}
 
 	marshallable := struct {
@@ -262,7 +381,22 @@ func (h *bucketHandler) put(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	bucket := vars["bucket"]
 
-	if err := h.controller.CreateBucket(r, bucket); err != nil {
+	if !validBucketName(bucket, h.legacyBucketNames) {
+		WriteError(h.logger, w, r, InvalidBucketNameError(r))
+		return
+	}
+
+	options, err := createBucketOptions(r)
+	if err != nil {
+		WriteError(h.logger, w, r, err)
+		return
+	}
+	if options.LocationConstraint != "" && len(h.regions) > 0 && !containsString(h.regions, options.LocationConstraint) {
+		WriteError(h.logger, w, r, InvalidLocationConstraintError(r))
+		return
+	}
+
+	if err := h.controller.CreateBucket(r, bucket, options); err != nil {
 		WriteError(h.logger, w, r, err)
 		return
 	}
@@ -270,6 +404,60 @@ func (h *bucketHandler) put(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
 
+// createBucketOptions parses the optional configuration body and headers of
+// a create bucket request
+func createBucketOptions(r *http.Request) (*CreateBucketOptions, error) {
+	options := &CreateBucketOptions{}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	if len(bytes.TrimSpace(body)) > 0 {
+		payload := struct {
+			XMLName            xml.Name `xml:"CreateBucketConfiguration"`
+			LocationConstraint string   `xml:"LocationConstraint"`
+		}{}
+		if err := xml.Unmarshal(body, &payload); err != nil {
+			return nil, MalformedXMLError(r)
+		}
+		if payload.LocationConstraint != "" && !locationConstraintValidator.MatchString(payload.LocationConstraint) {
+			return nil, InvalidLocationConstraintError(r)
+		}
+		options.LocationConstraint = payload.LocationConstraint
+	}
+
+	if objectLock := r.Header.Get("x-amz-bucket-object-lock-enabled"); objectLock != "" {
+		enabled, err := strconv.ParseBool(objectLock)
+		if err != nil {
+			return nil, InvalidArgumentError(r)
+		}
+		options.ObjectLockEnabled = enabled
+	}
+
+	return options, nil
+}
+
+// validBucketName checks whether a bucket name can be used for a new
+// bucket. Unless `legacy` is set, names must follow S3's DNS-compatible
+// naming rules.
+func validBucketName(name string, legacy bool) bool {
+	if legacy {
+		return legacyBucketNameValidator.MatchString(name)
+	}
+	if !dnsBucketNameValidator.MatchString(name) {
+		return false
+	}
+	if strings.Contains(name, "..") || strings.Contains(name, ".-") || strings.Contains(name, "-.") {
+		return false
+	}
+	if strings.HasPrefix(name, "xn--") || strings.HasSuffix(name, "-s3alias") {
+		return false
+	}
+	// names formatted as IP addresses aren't allowed
+	return net.ParseIP(name) == nil
+}
+
 func (h *bucketHandler) del(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	bucket := vars["bucket"]
@@ -361,6 +549,7 @@ func (h *bucketHandler) listVersions(w http.ResponseWriter, r *http.Request) {
 
 	for _, v := range result.Versions {
 		v.ETag = addETagQuotes(v.ETag)
+		v.Size = uint64(listedPlaintextSize(r, h.objects, h.logger, bucket, v.Key, v.Version, int64(v.Size)))
 	}
 
 	marshallable := struct {
@@ -371,8 +560,8 @@ func (h *bucketHandler) listVersions(w http.ResponseWriter, r *http.Request) {
 		NextKeyMarker       string          `xml:"NextKeyMarker,omitempty"`
 		MaxKeys             int             `xml:"MaxKeys"`
 		Name                string          `xml:"Name"`
-		VersionIDMarker     string          `xml:"VersionIdKeyMarker"`
-		NextVersionIDMarker string          `xml:"NextVersionIdKeyMarker,omitempty"`
+		VersionIDMarker     string          `xml:"VersionIdMarker"`
+		NextVersionIDMarker string          `xml:"NextVersionIdMarker,omitempty"`
 		Prefix              string          `xml:"Prefix"`
 		Versions            []*Version      `xml:"Version"`
 		DeleteMarkers       []*DeleteMarker `xml:"DeleteMarker"`
@@ -387,7 +576,10 @@ func (h *bucketHandler) listVersions(w http.ResponseWriter, r *http.Request) {
 		DeleteMarkers:   result.DeleteMarkers,
 	}
 
-	if marshallable.IsTruncated {
+	if marshallable.IsTruncated && result.NextKeyMarker != "" {
+		marshallable.NextKeyMarker = result.NextKeyMarker
+		marshallable.NextVersionIDMarker = result.NextVersionIDMarker
+	} else if marshallable.IsTruncated {
 		highKey := ""
 		highVersion := ""
 
@@ -395,15 +587,21 @@ func (h *bucketHandler) listVersions(w http.ResponseWriter, r *http.Request) {
 			if version.Key > highKey {
 				highKey = version.Key
 			}
-			if version.Version > highVersion {
-				highVersion = version.Version
-			}
 		}
 		for _, deleteMarker := range marshallable.DeleteMarkers {
 			if deleteMarker.Key > highKey {
 				highKey = deleteMarker.Key
 			}
-			if deleteMarker.Version > highVersion {
+		}
+		// only versions of the last key matter; earlier keys won't be
+		// listed again
+		for _, version := range marshallable.Versions {
+			if version.Key == highKey && version.Version > highVersion {
+				highVersion = version.Version
+			}
+		}
+		for _, deleteMarker := range marshallable.DeleteMarkers {
+			if deleteMarker.Key == highKey && deleteMarker.Version > highVersion {
 				highVersion = deleteMarker.Version
 			}
 		}
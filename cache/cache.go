@@ -0,0 +1,317 @@
+// Package cache implements a read-through cache of object content on local
+// disk, for backends that are slow to read from. It wraps an
+// `s2.ObjectController`:
+//
+//	c, err := cache.New(backend, "/var/cache/s2", 10<<30)
+//	s.Object = c
+//	s.Multipart = c.WrapMultipart(backend)
+//
+// Objects are cached by bucket, key and version the first time they're
+// read, with their content written to a file named after the bucket, key,
+// version and ETag. Later reads, including range reads, are served from
+// that file without calling the wrapped controller. Entries are evicted in
+// least-recently-used order once the total size of cached content exceeds
+// the cache's limit.
+//
+// Entries are invalidated when an object is written or deleted through the
+// cache (including as the destination of a copy, or by completing a
+// multipart upload through `WrapMultipart`.) Changes made to the backend
+// by other means aren't noticed, so they may be served stale. Content is
+// cached as the wrapped controller stores it, so encrypted objects stay
+// encrypted on disk, but they're counted towards the cache's limits by
+// their plaintext size.
+package cache
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/pachyderm/s2"
+)
+
+// objectID identifies an object, across all of its versions
+type objectID struct {
+	bucket string
+	key    string
+}
+
+// entry is a cached version of an object
+type entry struct {
+	id      objectID
+	version string
+	// result is the controller's result, without its content
+	result s2.GetObjectResult
+	path   string
+	size   int64
+	// element is the entry's position in the LRU list
+	element *list.Element
+}
+
+// Cache is an `s2.ObjectController` that caches the content of the objects
+// read through it on local disk
+type Cache struct {
+	// MaxObjectSize is the size of the largest object that's cached, or 0
+	// to cache objects of any size up to the cache's limit. Larger objects
+	// are read from the wrapped controller on every request.
+	MaxObjectSize int64
+
+	controller s2.ObjectController
+	dir        string
+	maxSize    int64
+
+	lock    sync.Mutex
+	entries map[objectID]map[string]*entry
+	// lru holds every entry, from most to least recently used
+	lru  *list.List
+	size int64
+	// epoch is incremented whenever entries are invalidated, so that reads
+	// that were in flight at the time aren't cached
+	epoch uint64
+}
+
+// New creates a cache of the objects of `controller`, which stores up to
+// `maxSize` bytes of content in a new temporary directory under `dir`.
+// The directory is removed by `Close`.
+func New(controller s2.ObjectController, dir string, maxSize int64) (*Cache, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	cacheDir, err := ioutil.TempDir(dir, "s2-cache")
+	if err != nil {
+		return nil, err
+	}
+	return &Cache{
+		MaxObjectSize: 0,
+		controller:    controller,
+		dir:           cacheDir,
+		maxSize:       maxSize,
+		entries:       map[objectID]map[string]*entry{},
+		lru:           list.New(),
+	}, nil
+}
+
+// Close removes all cached content. The cache must not be used afterwards.
+func (c *Cache) Close() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.entries = map[objectID]map[string]*entry{}
+	c.lru.Init()
+	c.size = 0
+	return os.RemoveAll(c.dir)
+}
+
+// Size returns the total size of the cached content
+func (c *Cache) Size() int64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.size
+}
+
+// GetObject serves an object from the cache if possible. Otherwise, it's
+// read from the wrapped controller and, unless it's a HEAD request or the
+// object is too large, cached.
+func (c *Cache) GetObject(r *http.Request, bucket, key, version string) (*s2.GetObjectResult, error) {
+	id := objectID{bucket: bucket, key: key}
+	if result, err := c.get(id, version); result != nil || err != nil {
+		return result, err
+	}
+
+	c.lock.Lock()
+	epoch := c.epoch
+	c.lock.Unlock()
+
+	result, err := c.controller.GetObject(r, bucket, key, version)
+	if err != nil || result.DeleteMarker || result.Content == nil || r.Method == "HEAD" {
+		return result, err
+	}
+
+	size, err := s2.PlaintextSize(result.Content)
+	if err != nil {
+		return nil, err
+	}
+	if size > c.maxSize || (c.MaxObjectSize > 0 && size > c.MaxObjectSize) {
+		return result, nil
+	}
+
+	content, err := c.fill(id, version, result, size, epoch)
+	if err != nil {
+		return nil, err
+	}
+	result.Content = content
+	return result, nil
+}
+
+// get serves a cached object, or returns nil if it's not cached
+func (c *Cache) get(id objectID, version string) (*s2.GetObjectResult, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	e := c.entries[id][version]
+	if e == nil {
+		return nil, nil
+	}
+	f, err := os.Open(e.path)
+	if err != nil {
+		return nil, err
+	}
+	c.lru.MoveToFront(e.element)
+
+	result := e.result
+	result.Content = f
+	return &result, nil
+}
+
+// fill writes an object's content into the cache, and returns a reader of
+// the cached copy. The content is only cached if no entries have been
+// invalidated since `epoch`, when the object was read.
+func (c *Cache) fill(id objectID, version string, result *s2.GetObjectResult, size int64, epoch uint64) (*os.File, error) {
+	defer func() {
+		if closer, ok := result.Content.(io.Closer); ok {
+			closer.Close()
+		}
+	}()
+
+	f, err := ioutil.TempFile(c.dir, "fill")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(f, result.Content); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.epoch != epoch {
+		// the object may have changed since it was read, so serve the
+		// content without caching it
+		os.Remove(f.Name())
+		return f, nil
+	}
+
+	e := &entry{
+		id:      id,
+		version: version,
+		result:  *result,
+		path:    filepath.Join(c.dir, contentName(id, version, result.ETag)),
+		size:    size,
+	}
+	e.result.Content = nil
+	if err := os.Rename(f.Name(), e.path); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+
+	if existing := c.entries[id][version]; existing != nil {
+		c.remove(existing)
+	}
+	if c.entries[id] == nil {
+		c.entries[id] = map[string]*entry{}
+	}
+	c.entries[id][version] = e
+	e.element = c.lru.PushFront(e)
+	c.size += e.size
+
+	for c.size > c.maxSize {
+		c.remove(c.lru.Back().Value.(*entry))
+	}
+	return f, nil
+}
+
+// contentName gets the name of the file that caches the content of an
+// object version with the given ETag
+func contentName(id objectID, version, etag string) string {
+	hash := sha256.New()
+	for _, s := range []string{id.bucket, id.key, version, etag} {
+		hash.Write([]byte(s))
+		hash.Write([]byte{0})
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// remove removes an entry and its content. The cache's lock must be held.
+// Content that's currently being read remains readable until it's closed.
+func (c *Cache) remove(e *entry) {
+	os.Remove(e.path)
+	c.lru.Remove(e.element)
+	c.size -= e.size
+
+	delete(c.entries[e.id], e.version)
+	if len(c.entries[e.id]) == 0 {
+		delete(c.entries, e.id)
+	}
+}
+
+// invalidate removes the cached versions of an object
+func (c *Cache) invalidate(bucket, key string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.epoch++
+	for _, e := range c.entries[objectID{bucket: bucket, key: key}] {
+		c.remove(e)
+	}
+}
+
+// CopyObject copies an object using the wrapped controller, and invalidates
+// the destination
+func (c *Cache) CopyObject(r *http.Request, srcBucket, srcKey string, getResult *s2.GetObjectResult, destBucket, destKey string) (string, error) {
+	defer c.invalidate(destBucket, destKey)
+	return c.controller.CopyObject(r, srcBucket, srcKey, getResult, destBucket, destKey)
+}
+
+// PutObject writes an object using the wrapped controller, and invalidates
+// it
+func (c *Cache) PutObject(r *http.Request, bucket, key string, reader io.Reader, preconditions *s2.Preconditions) (*s2.PutObjectResult, error) {
+	defer c.invalidate(bucket, key)
+	return c.controller.PutObject(r, bucket, key, reader, preconditions)
+}
+
+// DeleteObject deletes an object using the wrapped controller, and
+// invalidates it
+func (c *Cache) DeleteObject(r *http.Request, bucket, key, version string) (*s2.DeleteObjectResult, error) {
+	defer c.invalidate(bucket, key)
+	return c.controller.DeleteObject(r, bucket, key, version)
+}
+
+// WrapMultipart wraps a multipart controller, so that objects created by
+// completing multipart uploads are invalidated
+func (c *Cache) WrapMultipart(controller s2.MultipartController) s2.MultipartController {
+	return &multipartController{MultipartController: controller, cache: c}
+}
+
+// multipartController invalidates the objects created by a wrapped
+// multipart controller
+type multipartController struct {
+	s2.MultipartController
+	cache *Cache
+}
+
+func (c *multipartController) CompleteMultipart(r *http.Request, bucket, key, uploadID string, parts []*s2.Part, preconditions *s2.Preconditions) (*s2.CompleteMultipartResult, error) {
+	defer c.cache.invalidate(bucket, key)
+	return c.MultipartController.CompleteMultipart(r, bucket, key, uploadID, parts, preconditions)
+}
+
+// GetMultipartChunk uses the wrapped controller's `GetMultipartChunk`, if
+// it implements `s2.MultipartChunkController`
+func (c *multipartController) GetMultipartChunk(r *http.Request, bucket, key, uploadID string, partNumber int) (io.ReadSeeker, error) {
+	if controller, ok := c.MultipartController.(s2.MultipartChunkController); ok {
+		return controller.GetMultipartChunk(r, bucket, key, uploadID, partNumber)
+	}
+	return nil, s2.NotImplementedError(r)
+}
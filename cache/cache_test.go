@@ -0,0 +1,388 @@
+package cache
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/pachyderm/s2"
+	"github.com/pachyderm/s2/client"
+	"github.com/pachyderm/s2/memory"
+	"github.com/pachyderm/s2/s2test"
+	"github.com/sirupsen/logrus"
+)
+
+// countingController counts the reads made of a wrapped object controller
+type countingController struct {
+	s2.ObjectController
+	lock sync.Mutex
+	gets int
+}
+
+func (c *countingController) GetObject(r *http.Request, bucket, key, version string) (*s2.GetObjectResult, error) {
+	c.lock.Lock()
+	c.gets++
+	c.lock.Unlock()
+	return c.ObjectController.GetObject(r, bucket, key, version)
+}
+
+// reads returns the number of reads made of the wrapped controller
+func (c *countingController) reads() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.gets
+}
+
+func TestConformance(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	dir, err := ioutil.TempDir("", "s2-cache-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s2test.RunConformance(t, func() *s2.S2 {
+		backend := memory.New()
+		c, err := New(backend, dir, 1<<20)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := backend.S2(logrus.NewEntry(logger))
+		s.Object = c
+		s.Multipart = c.WrapMultipart(backend)
+		return s
+	})
+}
+
+func TestCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "s2-cache-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	backend := memory.New()
+	r := httptest.NewRequest("GET", "/", nil)
+	if err := backend.CreateBucket(r, "bucket", nil); err != nil {
+		t.Fatal(err)
+	}
+	controller := &countingController{ObjectController: backend}
+	c, err := New(controller, dir, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	put := func(key, content string) {
+		t.Helper()
+		if _, err := c.PutObject(r, "bucket", key, strings.NewReader(content), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	read := func(key string, offset int64, expected string, gets int) {
+		t.Helper()
+		result, err := c.GetObject(r, "bucket", key, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if closer, ok := result.Content.(io.Closer); ok {
+			defer closer.Close()
+		}
+		if _, err := result.Content.Seek(offset, io.SeekStart); err != nil {
+			t.Fatal(err)
+		}
+		content, err := ioutil.ReadAll(result.Content)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(content, []byte(expected)) {
+			t.Fatalf("expected content %q, got %q", expected, content)
+		}
+		if n := controller.reads(); n != gets {
+			t.Fatalf("expected %d reads of the backend, got %d", gets, n)
+		}
+	}
+
+	put("a", "hello")
+	read("a", 0, "hello", 1)
+	read("a", 2, "llo", 1)
+
+	// writes through the cache invalidate it
+	put("a", "world")
+	read("a", 0, "world", 2)
+	read("a", 0, "world", 2)
+
+	// the least recently used object is evicted to stay within the limit
+	put("b", "12345")
+	read("b", 0, "12345", 3)
+	read("a", 0, "world", 3)
+	put("c", "abc")
+	read("c", 0, "abc", 4)
+	read("a", 0, "world", 4)
+	read("b", 0, "12345", 5)
+	if size := c.Size(); size != 10 {
+		t.Fatalf("expected 10 bytes to be cached, got %d", size)
+	}
+
+	// objects larger than the cache aren't cached
+	put("big", "0123456789a")
+	read("big", 0, "0123456789a", 6)
+	read("big", 0, "0123456789a", 7)
+
+	if _, err := c.DeleteObject(r, "bucket", "b", ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.GetObject(r, "bucket", "b", ""); err == nil {
+		t.Fatal("expected a deleted object to be invalidated")
+	}
+}
+
+func TestConcurrentEviction(t *testing.T) {
+	dir, err := ioutil.TempDir("", "s2-cache-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	backend := memory.New()
+	r := httptest.NewRequest("GET", "/", nil)
+	if err := backend.CreateBucket(r, "bucket", nil); err != nil {
+		t.Fatal(err)
+	}
+	controller := &countingController{ObjectController: backend}
+	c, err := New(controller, dir, 30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	keys := []string{"a", "b", "c", "d", "e"}
+	for _, key := range keys {
+		content := strings.Repeat(key, 10)
+		if _, err := c.PutObject(r, "bucket", key, strings.NewReader(content), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	read := func(key string) error {
+		result, err := c.GetObject(r, "bucket", key, "")
+		if err != nil {
+			return err
+		}
+		if closer, ok := result.Content.(io.Closer); ok {
+			defer closer.Close()
+		}
+		content, err := ioutil.ReadAll(result.Content)
+		if err != nil {
+			return err
+		}
+		if expected := strings.Repeat(key, 10); string(content) != expected {
+			return fmt.Errorf("expected content %q, got %q", expected, content)
+		}
+		return nil
+	}
+
+	// readers racing over more content than fits always get the right
+	// content, and never leave the cache over its limit
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				if err := read(keys[(i+j)%len(keys)]); err != nil {
+					errs <- err
+					return
+				}
+				if size := c.Size(); size > 30 {
+					errs <- fmt.Errorf("expected at most 30 bytes to be cached, got %d", size)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	// once the readers are done, eviction still follows the order of use
+	for _, key := range []string{"a", "b", "c"} {
+		if err := read(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expectReads := func(key string, reads int) {
+		t.Helper()
+		before := controller.reads()
+		if err := read(key); err != nil {
+			t.Fatal(err)
+		}
+		if n := controller.reads() - before; n != reads {
+			t.Fatalf("expected %d reads of the backend for %s, got %d", reads, key, n)
+		}
+	}
+	expectReads("b", 0)
+	expectReads("a", 0)
+	expectReads("c", 0)
+	// b is now the least recently used, so reading d evicts it
+	expectReads("d", 1)
+	expectReads("a", 0)
+	expectReads("c", 0)
+	expectReads("b", 1)
+	if size := c.Size(); size != 30 {
+		t.Fatalf("expected 30 bytes to be cached, got %d", size)
+	}
+}
+
+func TestRangeReads(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	dir, err := ioutil.TempDir("", "s2-cache-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	backend := memory.New()
+	backend.AddCredentials("access", "secret")
+	controller := &countingController{ObjectController: backend}
+	c, err := New(controller, dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	s := backend.S2(logrus.NewEntry(logger))
+	s.Object = c
+	server := httptest.NewServer(s.Router())
+	defer server.Close()
+
+	cl := client.New(server.URL, client.Credentials{AccessKey: "access", SecretKey: "secret", Region: "us-east-1"})
+	do := func(method, path string, query url.Values, header http.Header, body string, status int) *client.Response {
+		t.Helper()
+		res, err := cl.Do(method, path, query, header, []byte(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != status {
+			t.Fatalf("%s %s: expected status %d, got %d: %s", method, path, status, res.StatusCode, res.Body)
+		}
+		return res
+	}
+
+	content := "0123456789abcdefghij"
+	do("PUT", "/bucket", nil, nil, "", http.StatusOK)
+	do("PUT", "/bucket/key", nil, nil, content, http.StatusOK)
+
+	// the first read fills the cache, even though it only asks for a range
+	res := do("GET", "/bucket/key", nil, http.Header{"Range": {"bytes=5-9"}}, "", http.StatusPartialContent)
+	if string(res.Body) != "56789" {
+		t.Fatalf("expected content %q, got %q", "56789", res.Body)
+	}
+	if n := controller.reads(); n != 1 {
+		t.Fatalf("expected 1 read of the backend, got %d", n)
+	}
+
+	tests := []struct {
+		rangeHeader string
+		expected    string
+	}{
+		{"bytes=0-3", "0123"},
+		{"bytes=15-", "fghij"},
+		{"bytes=-3", "hij"},
+		{"bytes=18-100", "ij"},
+	}
+	for _, test := range tests {
+		res := do("GET", "/bucket/key", nil, http.Header{"Range": {test.rangeHeader}}, "", http.StatusPartialContent)
+		if string(res.Body) != test.expected {
+			t.Fatalf("%s: expected content %q, got %q", test.rangeHeader, test.expected, res.Body)
+		}
+		if contentRange := res.Header.Get("Content-Range"); !strings.HasSuffix(contentRange, "/20") {
+			t.Fatalf("%s: expected a content range of the whole object, got %q", test.rangeHeader, contentRange)
+		}
+	}
+	do("GET", "/bucket/key", nil, http.Header{"Range": {"bytes=20-"}}, "", http.StatusRequestedRangeNotSatisfiable)
+	res = do("GET", "/bucket/key", nil, nil, "", http.StatusOK)
+	if string(res.Body) != content {
+		t.Fatalf("expected content %q, got %q", content, res.Body)
+	}
+	if n := controller.reads(); n != 1 {
+		t.Fatalf("expected range reads to be served from the cache, got %d reads of the backend", n)
+	}
+}
+
+func TestEncryptedSize(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	dir, err := ioutil.TempDir("", "s2-cache-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	backend := memory.New()
+	backend.AddCredentials("access", "secret")
+	controller := &countingController{ObjectController: backend}
+	c, err := New(controller, dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.MaxObjectSize = 20
+	s := backend.S2(logrus.NewEntry(logger))
+	s.Object = c
+	server := httptest.NewServer(s.Router())
+	defer server.Close()
+
+	cl := client.New(server.URL, client.Credentials{AccessKey: "access", SecretKey: "secret", Region: "us-east-1"})
+	customerKey := bytes.Repeat([]byte{1}, 32)
+	sum := md5.Sum(customerKey)
+	encrypted := http.Header{
+		"x-amz-server-side-encryption-customer-algorithm": {"AES256"},
+		"x-amz-server-side-encryption-customer-key":       {base64.StdEncoding.EncodeToString(customerKey)},
+		"x-amz-server-side-encryption-customer-key-MD5":   {base64.StdEncoding.EncodeToString(sum[:])},
+	}
+	do := func(method, path string, header http.Header, body string) *client.Response {
+		t.Helper()
+		res, err := cl.Do(method, path, nil, header, []byte(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("%s %s: expected status %d, got %d: %s", method, path, http.StatusOK, res.StatusCode, res.Body)
+		}
+		return res
+	}
+
+	// the object is stored larger than `MaxObjectSize`, but it's cached,
+	// since it's counted by its plaintext size
+	content := "0123456789abcdefghij"
+	do("PUT", "/bucket", nil, "")
+	do("PUT", "/bucket/key", encrypted, content)
+	for i := 0; i < 2; i++ {
+		if res := do("GET", "/bucket/key", encrypted, ""); string(res.Body) != content {
+			t.Fatalf("expected content %q, got %q", content, res.Body)
+		}
+	}
+	if n := controller.reads(); n != 1 {
+		t.Fatalf("expected the object to be cached, got %d reads of the backend", n)
+	}
+	if size := c.Size(); size != int64(len(content)) {
+		t.Fatalf("expected a cache size of %d, got %d", len(content), size)
+	}
+}
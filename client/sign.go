@@ -0,0 +1,129 @@
+package client
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pachyderm/s2/internal/signing"
+)
+
+// Credentials are the keys that requests are signed with
+type Credentials struct {
+	AccessKey string
+	SecretKey string
+	// Region is the region that auth V4 signatures are scoped to
+	Region string
+}
+
+// SignV2 signs a request using AWS' auth V2, with `t` as the request's
+// timestamp. The request shouldn't be modified after it's signed.
+func (c Credentials) SignV2(r *http.Request, t time.Time) {
+	date := t.UTC().Format(http.TimeFormat)
+	r.Header.Set("Date", date)
+	r.Header.Del("Authorization")
+
+	stringToSign := signing.V2StringToSign(r, date)
+	signature := base64.StdEncoding.EncodeToString(signing.HMACSHA1([]byte(c.SecretKey), stringToSign))
+	r.Header.Set("Authorization", fmt.Sprintf("AWS %s:%s", c.AccessKey, signature))
+}
+
+// SignV4 signs a request and its payload using AWS' auth V4, with `t` as
+// the request's timestamp. Every header that's been set on the request is
+// signed, so the request shouldn't be modified after it's signed. `body`
+// must be the content of the request's body.
+func (c Credentials) SignV4(r *http.Request, body []byte, t time.Time) {
+	c.signV4(r, fmt.Sprintf("%x", sha256.Sum256(body)), t)
+}
+
+// SignV4UnsignedPayload signs a request using AWS' auth V4, without signing
+// its payload, so that the body can be streamed. The request shouldn't be
+// modified after it's signed.
+func (c Credentials) SignV4UnsignedPayload(r *http.Request, t time.Time) {
+	c.signV4(r, signing.UnsignedPayload, t)
+}
+
+// SignStreamingV4 signs a request using AWS' streaming auth V4, replacing
+// its body with `body`, split into signed chunks of up to `chunkSize`
+// bytes.
+func (c Credentials) SignStreamingV4(r *http.Request, body []byte, chunkSize int, t time.Time) {
+	if chunkSize <= 0 {
+		chunkSize = DefaultChunkSize
+	}
+	r.Header.Set("Content-Encoding", "aws-chunked")
+	r.Header.Set("x-amz-decoded-content-length", fmt.Sprint(len(body)))
+
+	signingKey, timestamp, signature := c.signV4(r, signing.StreamingPayload, t)
+	date := timestamp[:8]
+
+	var encoded bytes.Buffer
+	for {
+		n := len(body)
+		if n > chunkSize {
+			n = chunkSize
+		}
+		chunk := body[:n]
+		body = body[n:]
+
+		stringToSign := signing.ChunkStringToSign(timestamp, date, c.Region, signature, chunk)
+		signature = fmt.Sprintf("%x", signing.HMACSHA256(signingKey, stringToSign))
+		fmt.Fprintf(&encoded, "%x;chunk-signature=%s\r\n", len(chunk), signature)
+		encoded.Write(chunk)
+		encoded.WriteString("\r\n")
+
+		// the body is terminated by an empty chunk
+		if len(chunk) == 0 {
+			break
+		}
+	}
+
+	setBody(r, encoded.Bytes())
+}
+
+// signV4 signs a request using AWS' auth V4, with the given payload hash.
+// It returns the signing key, the formatted timestamp and the signature, for
+// signing the chunks of streaming requests.
+func (c Credentials) signV4(r *http.Request, payloadHash string, t time.Time) ([]byte, string, string) {
+	timestamp := t.UTC().Format(signing.TimeFormat)
+	date := timestamp[:8]
+	r.Header.Set("x-amz-date", timestamp)
+	r.Header.Set("x-amz-content-sha256", payloadHash)
+	r.Header.Del("Authorization")
+
+	signedHeaderKeys := []string{"host"}
+	for key := range r.Header {
+		signedHeaderKeys = append(signedHeaderKeys, strings.ToLower(key))
+	}
+	sort.Strings(signedHeaderKeys)
+
+	canonicalRequest := signing.V4CanonicalRequest(r, signedHeaderKeys)
+	stringToSign := signing.V4StringToSign(timestamp, date, c.Region, canonicalRequest)
+	signingKey := signing.V4SigningKey(c.SecretKey, date, c.Region)
+	signature := fmt.Sprintf("%x", signing.HMACSHA256(signingKey, stringToSign))
+
+	r.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s/%s/s3/aws4_request, SignedHeaders=%s, Signature=%s",
+		c.AccessKey,
+		date,
+		c.Region,
+		strings.Join(signedHeaderKeys, ";"),
+		signature,
+	))
+	return signingKey, timestamp, signature
+}
+
+// setBody replaces the body of a request
+func setBody(r *http.Request, body []byte) {
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+	r.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(body)), nil
+	}
+}
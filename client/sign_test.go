@@ -0,0 +1,146 @@
+package client
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pachyderm/s2/memory"
+	"github.com/sirupsen/logrus"
+)
+
+// tamperSignature changes the last character of a signed request's
+// signature
+func tamperSignature(r *http.Request) {
+	auth := r.Header.Get("Authorization")
+	last := "0"
+	if strings.HasSuffix(auth, last) {
+		last = "1"
+	}
+	r.Header.Set("Authorization", auth[:len(auth)-1]+last)
+}
+
+// tamperBody changes the first byte of content in a signed request's body,
+// skipping the first chunk header of streaming requests
+func tamperBody(r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		panic(err)
+	}
+	i := 0
+	if r.Header.Get("Content-Encoding") == "aws-chunked" {
+		i = bytes.Index(body, []byte("\r\n")) + 2
+	}
+	body[i] ^= 1
+	setBody(r, body)
+}
+
+func TestSignatures(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	backend := memory.New()
+	backend.AddCredentials("access", "secret")
+	server := httptest.NewServer(backend.S2(logrus.NewEntry(logger)).Router())
+	defer server.Close()
+
+	c := New(server.URL, Credentials{AccessKey: "access", SecretKey: "secret", Region: "us-east-1"})
+	c.HTTPClient = server.Client()
+	// the body spans several chunks when it's streamed
+	c.ChunkSize = 8
+	if res, err := c.Do("PUT", "/bucket", nil, nil, nil); err != nil || res.Err() != nil {
+		t.Fatalf("could not create the bucket: %v %v", err, res.Err())
+	}
+
+	key := "/bucket/dir/a key+with ~odd=chars%.txt"
+	body := []byte("content that's signed with every signature version")
+	header := http.Header{"X-Amz-Meta-Note": {"  spaced   value "}}
+	query := url.Values{"response-content-type": {"text/plain; charset=utf-8"}, "empty": {""}}
+
+	send := func(method string, query url.Values, body []byte, tamper func(r *http.Request)) *Response {
+		t.Helper()
+		req, err := c.NewRequest(method, key, query, body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		c.Sign(req, body)
+		if tamper != nil {
+			tamper(req)
+		}
+		res, err := c.Send(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	tests := []struct {
+		name      string
+		signature SignatureVersion
+		// bodyCode is the error that tampering with the body is reported
+		// with, or empty if the signature doesn't cover the body
+		bodyCode string
+		// code is the error that other tampering is reported with
+		code string
+	}{
+		{"V2", SignatureV2, "", "AccessDenied"},
+		{"V4", SignatureV4, "BadDigest", "SignatureDoesNotMatch"},
+		{"StreamingV4", SignatureStreamingV4, "SignatureDoesNotMatch", "SignatureDoesNotMatch"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c.Signature = test.signature
+			expectCode := func(res *Response, code string) {
+				t.Helper()
+				if err := res.Err(); err == nil || err.Code != code {
+					t.Fatalf("expected %s, got status %d: %s", code, res.StatusCode, res.Body)
+				}
+			}
+
+			// requests signed by the client are verified by s2
+			if err := send("PUT", nil, body, nil).Err(); err != nil {
+				t.Fatalf("expected the write to be verified, got %v", err)
+			}
+			res := send("GET", query, nil, nil)
+			if err := res.Err(); err != nil {
+				t.Fatalf("expected the read to be verified, got %v", err)
+			}
+			if !bytes.Equal(res.Body, body) {
+				t.Fatalf("expected content %q, got %q", body, res.Body)
+			}
+
+			// but not once they're tampered with
+			expectCode(send("PUT", nil, body, tamperSignature), test.code)
+			expectCode(send("GET", query, nil, func(r *http.Request) {
+				r.URL.RawQuery = url.Values{"response-content-type": {"text/html"}}.Encode()
+			}), test.code)
+			expectCode(send("GET", nil, nil, func(r *http.Request) {
+				r.Header.Set("X-Amz-Meta-Note", "other")
+			}), test.code)
+			if test.bodyCode != "" {
+				expectCode(send("PUT", nil, body, tamperBody), test.bodyCode)
+			}
+
+			// or signed with another key
+			other := c.Credentials
+			other.SecretKey = "other"
+			res = send("GET", nil, nil, func(r *http.Request) {
+				switch test.signature {
+				case SignatureV2:
+					other.SignV2(r, time.Now())
+				default:
+					other.SignV4(r, nil, time.Now())
+				}
+			})
+			expectCode(res, test.code)
+		})
+	}
+}
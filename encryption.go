@@ -0,0 +1,562 @@
+package s2
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// SSEAlgorithmAES256 is the algorithm for server-side encryption with
+	// keys managed by the server (SSE-S3)
+	SSEAlgorithmAES256 = "AES256"
+	// SSEAlgorithmKMS is the algorithm for server-side encryption with keys
+	// managed by a key management service (SSE-KMS)
+	SSEAlgorithmKMS = "aws:kms"
+
+	// sseHeader is the header used to request server-side encryption, and
+	// to report it in responses
+	sseHeader = "x-amz-server-side-encryption"
+	// sseKMSKeyIDHeader is the header used to select the KMS key for
+	// SSE-KMS, and to report it in responses
+	sseKMSKeyIDHeader = "x-amz-server-side-encryption-aws-kms-key-id"
+)
+
+// BucketEncryption is a bucket's default encryption configuration, which
+// is applied to objects written without any encryption headers
+type BucketEncryption struct {
+	// Algorithm is either `SSEAlgorithmAES256` or `SSEAlgorithmKMS`
+	Algorithm string
+	// KMSMasterKeyID is the key to use with `SSEAlgorithmKMS`. If empty,
+	// the key provider's default key is used.
+	KMSMasterKeyID string
+	// BucketKeyEnabled is stored and reported, but otherwise has no effect
+	BucketKeyEnabled bool
+}
+
+// EncryptionController is an interface that specifies bucket encryption
+// configuration functionality
+type EncryptionController interface {
+	// GetBucketEncryption gets a bucket's default encryption configuration.
+	// If the bucket has no configuration, implementations should return
+	// nil or `ServerSideEncryptionConfigurationNotFoundError`.
+	GetBucketEncryption(r *http.Request, bucket string) (*BucketEncryption, error)
+	// SetBucketEncryption sets a bucket's default encryption configuration
+	SetBucketEncryption(r *http.Request, bucket string, config *BucketEncryption) error
+	// DeleteBucketEncryption removes a bucket's default encryption
+	// configuration
+	DeleteBucketEncryption(r *http.Request, bucket string) error
+}
+
+// unimplementedEncryptionController defines a controller that returns
+// `NotImplementedError` for all functionality
+type unimplementedEncryptionController struct{}
+
+func (c unimplementedEncryptionController) GetBucketEncryption(r *http.Request, bucket string) (*BucketEncryption, error) {
+	return nil, NotImplementedError(r)
+}
+
+func (c unimplementedEncryptionController) SetBucketEncryption(r *http.Request, bucket string, config *BucketEncryption) error {
+	return NotImplementedError(r)
+}
+
+func (c unimplementedEncryptionController) DeleteBucketEncryption(r *http.Request, bucket string) error {
+	return NotImplementedError(r)
+}
+
+// DataKey is a key used to encrypt a single object or part
+type DataKey struct {
+	// KeyID identifies the master key that wraps the data key
+	KeyID string
+	// Plaintext is the 256-bit data key
+	Plaintext []byte
+	// Ciphertext is the data key wrapped by the master key. It's stored
+	// alongside the encrypted content.
+	Ciphertext []byte
+}
+
+// KeyProvider is an interface for managing the master keys used for
+// server-side encryption. Content is encrypted with per-object data keys,
+// which are wrapped with a master key and stored alongside the content.
+type KeyProvider interface {
+	// GenerateDataKey creates a new data key wrapped by the given master
+	// key. If `keyID` is empty, the provider's default key should be used.
+	GenerateDataKey(r *http.Request, keyID string) (*DataKey, error)
+	// DecryptDataKey unwraps a data key that was wrapped by the given
+	// master key
+	DecryptDataKey(r *http.Request, keyID string, ciphertext []byte) ([]byte, error)
+}
+
+// FileKeyProvider is a `KeyProvider` backed by a single master key read
+// from a local file. It's intended for testing and simple deployments.
+type FileKeyProvider struct {
+	keyID     string
+	masterKey []byte
+}
+
+// NewFileKeyProvider creates a new `FileKeyProvider`. The file at `path`
+// should contain a 256-bit key, either raw or encoded as hex or base64.
+// `keyID` is the ID the key is referred to by.
+func NewFileKeyProvider(keyID, path string) (*FileKeyProvider, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var masterKey []byte
+	trimmed := bytes.TrimSpace(contents)
+	if decoded, err := hex.DecodeString(string(trimmed)); err == nil && len(decoded) == 32 {
+		masterKey = decoded
+	} else if decoded, err := base64.StdEncoding.DecodeString(string(trimmed)); err == nil && len(decoded) == 32 {
+		masterKey = decoded
+	} else if len(contents) == 32 {
+		masterKey = contents
+	} else {
+		return nil, fmt.Errorf("master key in %q is not 256 bits", path)
+	}
+
+	return &FileKeyProvider{
+		keyID:     keyID,
+		masterKey: masterKey,
+	}, nil
+}
+
+// GenerateDataKey creates a random data key, wrapped with the master key
+// using AES-256-GCM. Only the provider's own key ID (or an empty one, for
+// the default key) is accepted.
+func (p *FileKeyProvider) GenerateDataKey(r *http.Request, keyID string) (*DataKey, error) {
+	if keyID == "" {
+		keyID = p.keyID
+	}
+	if keyID != p.keyID {
+		return nil, InvalidArgumentError(r)
+	}
+
+	aead, err := newAEAD(p.masterKey)
+	if err != nil {
+		return nil, err
+	}
+	plaintext := make([]byte, 32)
+	if _, err := rand.Read(plaintext); err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return &DataKey{
+		KeyID:      keyID,
+		Plaintext:  plaintext,
+		Ciphertext: aead.Seal(nonce, nonce, plaintext, []byte(keyID)),
+	}, nil
+}
+
+// DecryptDataKey unwraps a data key created by `GenerateDataKey`, failing
+// if it was wrapped by another key or has been tampered with
+func (p *FileKeyProvider) DecryptDataKey(r *http.Request, keyID string, ciphertext []byte) ([]byte, error) {
+	if keyID != p.keyID {
+		return nil, fmt.Errorf("unknown master key %q", keyID)
+	}
+
+	aead, err := newAEAD(p.masterKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, errEncryptedContentCorrupt
+	}
+	nonce, sealed := ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, sealed, []byte(keyID))
+	if err != nil {
+		return nil, errors.New("failed to unwrap data key")
+	}
+	return plaintext, nil
+}
+
+// objectEncryption describes how an object is encrypted at rest. Either
+// `customerKey` is set (SSE-C), or `algorithm` is set (SSE-S3 or SSE-KMS.)
+type objectEncryption struct {
+	customerKey *customerKey
+	algorithm   string
+	keyID       string
+}
+
+// setHeaders reports the encryption of an object in a response
+func (e *objectEncryption) setHeaders(w http.ResponseWriter) {
+	if e == nil {
+		return
+	}
+	if e.customerKey != nil {
+		setCustomerKeyHeaders(w, e.customerKey)
+		return
+	}
+	w.Header().Set(sseHeader, e.algorithm)
+	if e.algorithm == SSEAlgorithmKMS && e.keyID != "" {
+		w.Header().Set(sseKMSKeyIDHeader, e.keyID)
+	}
+}
+
+// encryptor applies server-side encryption to content as it's written to,
+// and read from, controllers
+type encryptor struct {
+	controller EncryptionController
+	keys       KeyProvider
+	logger     *logrus.Entry
+}
+
+// forWrite determines how content written by a request should be
+// encrypted, from the request's encryption headers or, failing that, the
+// bucket's default encryption. If the content shouldn't be encrypted, nil
+// is returned.
+func (e *encryptor) forWrite(r *http.Request, bucket string) (*objectEncryption, error) {
+	customerKey, err := customerKeyFromRequest(r, sseCustomerHeaderPrefix)
+	if err != nil {
+		return nil, err
+	}
+	algorithm := r.Header.Get(sseHeader)
+	keyID := r.Header.Get(sseKMSKeyIDHeader)
+
+	if customerKey != nil {
+		if algorithm != "" || keyID != "" {
+			return nil, InvalidArgumentError(r)
+		}
+		return &objectEncryption{customerKey: customerKey}, nil
+	}
+
+	if algorithm == "" {
+		if keyID != "" {
+			return nil, InvalidArgumentError(r)
+		}
+		config, err := e.bucketDefault(r, bucket)
+		if err != nil {
+			return nil, err
+		}
+		if config == nil {
+			return nil, nil
+		}
+		algorithm = config.Algorithm
+		keyID = config.KMSMasterKeyID
+	}
+
+	if algorithm != SSEAlgorithmAES256 && algorithm != SSEAlgorithmKMS {
+		return nil, InvalidArgumentError(r)
+	}
+	if keyID != "" && algorithm != SSEAlgorithmKMS {
+		return nil, InvalidArgumentError(r)
+	}
+	if e.keys == nil {
+		return nil, NotImplementedError(r)
+	}
+	return &objectEncryption{algorithm: algorithm, keyID: keyID}, nil
+}
+
+// forUpload gets the encryption requested by a request that initiates a
+// multipart upload. Uploads carry no metadata, so each part is encrypted
+// according to its own request headers, or the bucket default. Clients
+// resend customer keys with every part, but not SSE-S3 or SSE-KMS headers,
+// so those are only accepted if the bucket default applies the same
+// encryption to the parts.
+func (e *encryptor) forUpload(r *http.Request, bucket string) (*objectEncryption, error) {
+	encryption, err := e.forWrite(r, bucket)
+	if err != nil || encryption == nil || encryption.customerKey != nil || r.Header.Get(sseHeader) == "" {
+		return encryption, err
+	}
+	config, err := e.bucketDefault(r, bucket)
+	if err != nil {
+		return nil, err
+	}
+	if config == nil || config.Algorithm != encryption.algorithm || config.KMSMasterKeyID != encryption.keyID {
+		return nil, NotImplementedError(r)
+	}
+	return encryption, nil
+}
+
+// bucketDefault gets a bucket's default encryption configuration, or nil
+// if there is none. Buckets have no default encryption if no key provider
+// is set, or if the controller doesn't implement encryption configuration.
+func (e *encryptor) bucketDefault(r *http.Request, bucket string) (*BucketEncryption, error) {
+	if e.keys == nil {
+		return nil, nil
+	}
+	config, err := e.controller.GetBucketEncryption(r, bucket)
+	if err != nil {
+		if s3Err, ok := err.(*Error); ok && (s3Err.Code == "NotImplemented" || s3Err.Code == "ServerSideEncryptionConfigurationNotFoundError") {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return config, nil
+}
+
+// segmentKey creates the key and segment header for newly encrypted
+// content. For envelope encryption, the key ID is resolved in `enc`.
+func (e *encryptor) segmentKey(r *http.Request, enc *objectEncryption) ([]byte, *segmentHeader, error) {
+	if enc.customerKey != nil {
+		header, err := newCustomerSegmentHeader(enc.customerKey.key)
+		return enc.customerKey.key, header, err
+	}
+
+	dataKey, err := e.keys.GenerateDataKey(r, enc.keyID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if enc.algorithm == SSEAlgorithmKMS {
+		enc.keyID = dataKey.KeyID
+	}
+	header, err := newEnvelopeSegmentHeader(enc.algorithm, dataKey.KeyID, dataKey.Ciphertext)
+	return dataKey.Plaintext, header, err
+}
+
+// encrypt encrypts the body of a request that is about to be stored. The
+// body's declared length is recorded in the segment header, so that it can
+// be decrypted without reading every package header.
+//
+// Encryption is detected from the content when it's read back, so
+// unencrypted content that starts like an encrypted segment is rejected.
+func (e *encryptor) encrypt(r *http.Request, reader io.Reader, enc *objectEncryption) (io.Reader, error) {
+	if enc == nil {
+		buffered := bufio.NewReader(reader)
+		// errors are left for the controller to see when it reads
+		if magic, _ := buffered.Peek(len(encryptedSegmentMagic)); string(magic) == encryptedSegmentMagic {
+			return nil, InvalidRequestError(r, "Unencrypted content cannot start with the encrypted content marker.")
+		}
+		return buffered, nil
+	}
+	key, header, err := e.segmentKey(r, enc)
+	if err != nil {
+		return nil, err
+	}
+	header.plaintextSize = declaredContentLength(r)
+	return newEncryptReader(reader, key, header)
+}
+
+// encryptSeekable encrypts seekable content that is about to be stored
+func (e *encryptor) encryptSeekable(r *http.Request, rs io.ReadSeeker, enc *objectEncryption) (io.ReadSeeker, error) {
+	if enc == nil {
+		return rs, nil
+	}
+	size, err := rs.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := rs.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	key, header, err := e.segmentKey(r, enc)
+	if err != nil {
+		return nil, err
+	}
+	header.plaintextSize = size
+	return newEncryptReadSeeker(rs, key, header)
+}
+
+// decrypt decrypts content that was read from a controller, returning the
+// plaintext and how it was encrypted. Content that was stored with SSE-C
+// can only be read with the same key, and a key can only be provided for
+// content that was stored with SSE-C. Content stored with SSE-S3 or SSE-KMS
+// is decrypted transparently.
+func (e *encryptor) decrypt(r *http.Request, content io.ReadSeeker, customerKey *customerKey) (io.ReadSeeker, *objectEncryption, error) {
+	header, err := peekSegmentHeader(content)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if header == nil || header.version == encryptedSegmentVersionEnvelope {
+		if customerKey != nil {
+			return nil, nil, InvalidRequestError(r, "The encryption parameters are not applicable to this object.")
+		}
+		if header == nil {
+			return content, nil, nil
+		}
+		if e.keys == nil {
+			return nil, nil, errors.New("object is encrypted, but no key provider is set")
+		}
+
+		decrypted, err := newDecryptReadSeeker(content, func(segment *segmentHeader) error {
+			if segment.version != encryptedSegmentVersionEnvelope {
+				return errEncryptedContentCorrupt
+			}
+			return nil
+		}, func(segment *segmentHeader) ([]byte, error) {
+			return e.keys.DecryptDataKey(r, segment.keyID, segment.wrappedKey)
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		return decrypted, &objectEncryption{algorithm: header.algorithm, keyID: header.keyID}, nil
+	}
+
+	if customerKey == nil {
+		return nil, nil, InvalidRequestError(r, "The object was stored using a form of Server Side Encryption. The correct parameters must be provided to retrieve the object.")
+	}
+	fingerprint := keyFingerprint(customerKey.key)
+	decrypted, err := newDecryptReadSeeker(content, func(segment *segmentHeader) error {
+		if segment.version != encryptedSegmentVersionCustomer {
+			return errEncryptedContentCorrupt
+		}
+		if !bytes.Equal(segment.fingerprint, fingerprint) {
+			return errEncryptionKeyMismatch
+		}
+		return nil
+	}, func(segment *segmentHeader) ([]byte, error) {
+		return customerKey.key, nil
+	})
+	if err == errEncryptionKeyMismatch {
+		return nil, nil, AccessDeniedError(r)
+	} else if err != nil {
+		return nil, nil, err
+	}
+	return decrypted, &objectEncryption{customerKey: customerKey}, nil
+}
+
+// declaredContentLength gets the length of a request's body, as declared
+// by its headers, or -1 if it's unknown. The body of a streaming upload
+// declares its decoded length separately.
+func declaredContentLength(r *http.Request) int64 {
+	if decoded := r.Header.Get("x-amz-decoded-content-length"); decoded != "" {
+		length, err := strconv.ParseInt(decoded, 10, 64)
+		if err != nil || length < 0 {
+			return -1
+		}
+		return length
+	}
+	if r.ContentLength < 0 {
+		return -1
+	}
+	return r.ContentLength
+}
+
+// listedPlaintextSize gets the plaintext size of a listed object version
+// from the size the controller stored. Encryption is only detected from
+// content, so objects large enough to be encrypted are read, as if for a
+// HEAD request, to measure them. Objects that can't be read are reported
+// with their stored size, since they may have been removed since they were
+// listed.
+func listedPlaintextSize(r *http.Request, objects ObjectController, logger *logrus.Entry, bucket, key, version string, size int64) int64 {
+	if size < int64(minEncryptedSize) {
+		return size
+	}
+	head := r.WithContext(r.Context())
+	head.Method = "HEAD"
+	result, err := objects.GetObject(head, bucket, key, version)
+	if err != nil || result.Content == nil {
+		if err != nil {
+			logger.Warnf("could not get the size of %s/%s: %v", bucket, key, err)
+		}
+		return size
+	}
+	defer closeContent(result.Content)
+	plaintext, err := PlaintextSize(result.Content)
+	if err != nil {
+		logger.Warnf("could not get the size of %s/%s: %v", bucket, key, err)
+		return size
+	}
+	return plaintext
+}
+
+// encryptionRule is the XML form of `BucketEncryption`
+type encryptionRule struct {
+	ApplyServerSideEncryptionByDefault struct {
+		SSEAlgorithm   string `xml:"SSEAlgorithm"`
+		KMSMasterKeyID string `xml:"KMSMasterKeyID,omitempty"`
+	} `xml:"ApplyServerSideEncryptionByDefault"`
+	BucketKeyEnabled bool `xml:"BucketKeyEnabled"`
+}
+
+type encryptionHandler struct {
+	controller EncryptionController
+	logger     *logrus.Entry
+}
+
+func (h *encryptionHandler) get(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	bucket := vars["bucket"]
+
+	config, err := h.controller.GetBucketEncryption(r, bucket)
+	if err != nil {
+		WriteError(h.logger, w, r, err)
+		return
+	}
+	if config == nil {
+		WriteError(h.logger, w, r, ServerSideEncryptionConfigurationNotFoundError(r))
+		return
+	}
+
+	rule := encryptionRule{BucketKeyEnabled: config.BucketKeyEnabled}
+	rule.ApplyServerSideEncryptionByDefault.SSEAlgorithm = config.Algorithm
+	rule.ApplyServerSideEncryptionByDefault.KMSMasterKeyID = config.KMSMasterKeyID
+
+	result := struct {
+		XMLName xml.Name         `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ServerSideEncryptionConfiguration"`
+		Rules   []encryptionRule `xml:"Rule"`
+	}{
+		Rules: []encryptionRule{rule},
+	}
+
+	writeXML(h.logger, w, r, http.StatusOK, result)
+}
+
+func (h *encryptionHandler) put(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	bucket := vars["bucket"]
+
+	payload := struct {
+		XMLName xml.Name         `xml:"ServerSideEncryptionConfiguration"`
+		Rules   []encryptionRule `xml:"Rule"`
+	}{}
+	if err := readXMLBody(r, &payload); err != nil {
+		WriteError(h.logger, w, r, err)
+		return
+	}
+	if len(payload.Rules) != 1 {
+		WriteError(h.logger, w, r, MalformedXMLError(r))
+		return
+	}
+
+	rule := payload.Rules[0]
+	config := &BucketEncryption{
+		Algorithm:        rule.ApplyServerSideEncryptionByDefault.SSEAlgorithm,
+		KMSMasterKeyID:   rule.ApplyServerSideEncryptionByDefault.KMSMasterKeyID,
+		BucketKeyEnabled: rule.BucketKeyEnabled,
+	}
+	if config.Algorithm != SSEAlgorithmAES256 && config.Algorithm != SSEAlgorithmKMS {
+		WriteError(h.logger, w, r, MalformedXMLError(r))
+		return
+	}
+	if config.KMSMasterKeyID != "" && config.Algorithm != SSEAlgorithmKMS {
+		WriteError(h.logger, w, r, InvalidArgumentError(r))
+		return
+	}
+
+	if err := h.controller.SetBucketEncryption(r, bucket, config); err != nil {
+		WriteError(h.logger, w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (h *encryptionHandler) del(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	bucket := vars["bucket"]
+
+	if err := h.controller.DeleteBucketEncryption(r, bucket); err != nil {
+		WriteError(h.logger, w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
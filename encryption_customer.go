@@ -0,0 +1,71 @@
+package s2
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"net/http"
+)
+
+const (
+	// sseCustomerHeaderPrefix prefixes the headers used to provide an SSE-C
+	// key for the object a request operates on
+	sseCustomerHeaderPrefix = "x-amz-server-side-encryption-customer-"
+	// sseCopySourceCustomerHeaderPrefix prefixes the headers used to provide
+	// an SSE-C key for the source object of a copy
+	sseCopySourceCustomerHeaderPrefix = "x-amz-copy-source-server-side-encryption-customer-"
+	// sseCustomerAlgorithm is the only supported SSE-C algorithm
+	sseCustomerAlgorithm = "AES256"
+)
+
+// customerKey is an encryption key provided by the client via SSE-C
+// headers
+type customerKey struct {
+	key    []byte
+	keyMD5 string
+}
+
+// customerKeyFromRequest parses and validates the SSE-C headers with the
+// given prefix. If no SSE-C headers are set, nil is returned.
+func customerKeyFromRequest(r *http.Request, prefix string) (*customerKey, error) {
+	algorithm := r.Header.Get(prefix + "algorithm")
+	encodedKey := r.Header.Get(prefix + "key")
+	encodedKeyMD5 := r.Header.Get(prefix + "key-MD5")
+
+	if algorithm == "" && encodedKey == "" && encodedKeyMD5 == "" {
+		return nil, nil
+	}
+	if algorithm != sseCustomerAlgorithm {
+		return nil, InvalidEncryptionAlgorithmError(r)
+	}
+	if encodedKey == "" || encodedKeyMD5 == "" {
+		return nil, InvalidRequestError(r, "Requests specifying Server Side Encryption with Customer provided keys must provide an appropriate secret key and its MD5.")
+	}
+
+	key, err := base64.StdEncoding.DecodeString(encodedKey)
+	if err != nil || len(key) != 32 {
+		return nil, InvalidArgumentError(r)
+	}
+	expectedMD5, err := base64.StdEncoding.DecodeString(encodedKeyMD5)
+	if err != nil {
+		return nil, InvalidArgumentError(r)
+	}
+	actualMD5 := md5.Sum(key)
+	if string(expectedMD5) != string(actualMD5[:]) {
+		return nil, InvalidArgumentError(r)
+	}
+
+	return &customerKey{
+		key:    key,
+		keyMD5: encodedKeyMD5,
+	}, nil
+}
+
+// setCustomerKeyHeaders echoes the SSE-C algorithm and key MD5 back in a
+// response
+func setCustomerKeyHeaders(w http.ResponseWriter, key *customerKey) {
+	if key == nil {
+		return
+	}
+	w.Header().Set(sseCustomerHeaderPrefix+"algorithm", sseCustomerAlgorithm)
+	w.Header().Set(sseCustomerHeaderPrefix+"key-MD5", key.keyMD5)
+}
@@ -16,6 +16,10 @@ type Error struct {
 	Message   string `xml:"Message"`
 	Resource  string `xml:"Resource"`
 	RequestID string `xml:"RequestId"`
+
+	// Region is the region the request should have been made to, for
+	// errors caused by a region mismatch
+	Region string `xml:"Region,omitempty"`
 }
 
 // NewError creates a new S3 error, to be serialized in a response
@@ -60,6 +64,16 @@ func AuthorizationHeaderMalformedError(r *http.Request) *Error {
 	return NewError(r, http.StatusBadRequest, "AuthorizationHeaderMalformed", "The authorization header you provided is invalid.")
 }
 
+// AuthorizationHeaderRegionError creates a new S3 error with a standard
+// AuthorizationHeaderMalformed S3 code, for requests signed for the wrong
+// region. `expectedRegion` is reported so that clients can correct
+// themselves.
+func AuthorizationHeaderRegionError(r *http.Request, region, expectedRegion string) *Error {
+	err := NewError(r, http.StatusBadRequest, "AuthorizationHeaderMalformed", fmt.Sprintf("The authorization header is malformed; the region '%s' is wrong; expecting '%s'", region, expectedRegion))
+	err.Region = expectedRegion
+	return err
+}
+
 // BadDigestError creates a new S3 error with a standard BadDigest S3 code.
 func BadDigestError(r *http.Request) *Error {
 	return NewError(r, http.StatusBadRequest, "BadDigest", "The Content-MD5 you specified did not match what we received.")
@@ -77,6 +91,12 @@ func BucketAlreadyOwnedByYouError(r *http.Request) *Error {
 	return NewError(r, http.StatusConflict, "BucketAlreadyOwnedByYou", "The bucket you tried to create already exists, and you own it.")
 }
 
+// ConditionalRequestConflictError creates a new S3 error with a standard
+// ConditionalRequestConflict S3 code.
+func ConditionalRequestConflictError(r *http.Request) *Error {
+	return NewError(r, http.StatusConflict, "ConditionalRequestConflict", "A conflicting conditional operation is currently in progress against this resource. Please try again.")
+}
+
 // EntityTooLargeError creates a new S3 error with a standard EntityTooLarge
 // S3 code.
 func EntityTooLargeError(r *http.Request) *Error {
@@ -123,18 +143,48 @@ func InvalidArgumentError(r *http.Request) *Error {
 	return NewError(r, http.StatusBadRequest, "InvalidArgument", "Invalid Argument")
 }
 
+// InvalidCompressionFormatError creates a new S3 error with a standard
+// InvalidCompressionFormat S3 code.
+func InvalidCompressionFormatError(r *http.Request) *Error {
+	return NewError(r, http.StatusBadRequest, "InvalidCompressionFormat", "The file is not in a supported compression format. Only GZIP and BZIP2 are supported.")
+}
+
 // InvalidDigestError creates a new S3 error with a standard InvalidDigest S3
 // code.
 func InvalidDigestError(r *http.Request) *Error {
 	return NewError(r, http.StatusBadRequest, "InvalidDigest", "The Content-MD5 you specified is not valid.")
 }
 
+// InvalidEncryptionAlgorithmError creates a new S3 error with a standard
+// InvalidEncryptionAlgorithmError S3 code.
+func InvalidEncryptionAlgorithmError(r *http.Request) *Error {
+	return NewError(r, http.StatusBadRequest, "InvalidEncryptionAlgorithmError", "The encryption request you specified is not valid. The valid value is AES256.")
+}
+
+// InvalidExpressionTypeError creates a new S3 error with a standard
+// InvalidExpressionType S3 code.
+func InvalidExpressionTypeError(r *http.Request) *Error {
+	return NewError(r, http.StatusBadRequest, "InvalidExpressionType", "The ExpressionType is invalid. Only SQL expressions are supported.")
+}
+
+// InvalidLocationConstraintError creates a new S3 error with a standard
+// InvalidLocationConstraint S3 code.
+func InvalidLocationConstraintError(r *http.Request) *Error {
+	return NewError(r, http.StatusBadRequest, "InvalidLocationConstraint", "The specified location-constraint is not valid.")
+}
+
 // InvalidPartError creates a new S3 error with a standard InvalidPart S3
 // code.
 func InvalidPartError(r *http.Request) *Error {
 	return NewError(r, http.StatusBadRequest, "InvalidPart", "One or more of the specified parts could not be found. The part might not have been uploaded, or the specified entity tag might not have matched the part's entity tag.")
 }
 
+// InvalidPartNumberError creates a new S3 error with a standard
+// InvalidPartNumber S3 code.
+func InvalidPartNumberError(r *http.Request) *Error {
+	return NewError(r, http.StatusRequestedRangeNotSatisfiable, "InvalidPartNumber", "The requested partnumber is not satisfiable.")
+}
+
 // InvalidPartOrderError creates a new S3 error with a standard
 // InvalidPartOrder S3 code.
 func InvalidPartOrderError(w http.ResponseWriter, r *http.Request) *Error {
@@ -200,12 +250,27 @@ func NotImplementedError(r *http.Request) *Error {
 	return NewError(r, http.StatusNotImplemented, "NotImplemented", "This functionality is not implemented.")
 }
 
+// PermanentRedirectError creates a new S3 error with a standard
+// PermanentRedirect S3 code. `region` is the region the bucket lives in.
+func PermanentRedirectError(r *http.Request, region string) *Error {
+	err := NewError(r, http.StatusMovedPermanently, "PermanentRedirect", "The bucket you are attempting to access must be addressed using the specified endpoint. Please send all future requests to this endpoint.")
+	err.Region = region
+	return err
+}
+
 // PreconditionFailedError creates a new S3 error with a standard
 // PreconditionFailed S3 code.
 func PreconditionFailedError(r *http.Request) *Error {
 	return NewError(r, http.StatusPreconditionFailed, "PreconditionFailed", "At least one of the preconditions you specified did not hold.")
 }
 
+// QuotaExceededError creates a new S3 error with a QuotaExceeded code, for
+// writes that would take a bucket or access key over its storage quota. S3
+// doesn't have quotas, so this isn't a standard code.
+func QuotaExceededError(r *http.Request) *Error {
+	return NewError(r, http.StatusForbidden, "QuotaExceeded", "The request would exceed the storage quota.")
+}
+
 // RequestTimeoutError creates a new S3 error with a standard RequestTimeout
 // S3 code.
 func RequestTimeoutError(r *http.Request) *Error {
@@ -218,6 +283,12 @@ func RequestTimeTooSkewedError(r *http.Request) *Error {
 	return NewError(r, http.StatusForbidden, "RequestTimeTooSkewed", "The difference between the request time and the server's time is too large.")
 }
 
+// ServerSideEncryptionConfigurationNotFoundError creates a new S3 error
+// with a standard ServerSideEncryptionConfigurationNotFoundError S3 code.
+func ServerSideEncryptionConfigurationNotFoundError(r *http.Request) *Error {
+	return NewError(r, http.StatusNotFound, "ServerSideEncryptionConfigurationNotFoundError", "The server side encryption configuration was not found.")
+}
+
 // SignatureDoesNotMatchError creates a new S3 error with a standard
 // SignatureDoesNotMatch S3 code.
 func SignatureDoesNotMatchError(r *http.Request) *Error {
@@ -16,6 +16,28 @@ func (c *Controller) GetLocation(r *http.Request, name string) (string, error) {
 	return models.Location, nil
 }
 
+func (c *Controller) HeadBucket(r *http.Request, name string) (*s2.HeadBucketResult, error) {
+	c.logger.Tracef("HeadBucket: %+v", name)
+
+	err := c.transaction(func(tx *gorm.DB) error {
+		_, err := models.GetBucket(tx, name)
+		if err != nil {
+			if gorm.IsRecordNotFoundError(err) {
+				return s2.NoSuchBucketError(r)
+			}
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// no region is reported, since requests signed for any region are
+	// accepted
+	return &s2.HeadBucketResult{}, nil
+}
+
 // Lists bucket contents. Note that this doesn't support common prefixes or
 // delimiters.
 func (c *Controller) ListObjects(r *http.Request, name, prefix, marker, delimiter string, maxKeys int) (*s2.ListObjectsResult, error) {
@@ -164,8 +186,8 @@ func (c *Controller) ListObjectVersions(r *http.Request, name, prefix, keyMarker
 	return &result, err
 }
 
-func (c *Controller) CreateBucket(r *http.Request, name string) error {
-	c.logger.Tracef("CreateBucket: %+v", name)
+func (c *Controller) CreateBucket(r *http.Request, name string, options *s2.CreateBucketOptions) error {
+	c.logger.Tracef("CreateBucket: name=%+v, options=%+v", name, options)
 
 	return c.transaction(func(tx *gorm.DB) error {
 		_, err := models.GetBucket(tx, name)
@@ -5,6 +5,7 @@ import (
 	"io"
 	"io/ioutil"
 	"net/http"
+	"strings"
 
 	"github.com/jinzhu/gorm"
 	"github.com/pachyderm/s2"
@@ -12,11 +13,14 @@ import (
 	"github.com/pachyderm/s2/examples/sql/util"
 )
 
-func (c *Controller) ListMultipart(r *http.Request, name, keyMarker, uploadIDMarker string, maxUploads int) (*s2.ListMultipartResult, error) {
-	c.logger.Tracef("ListMultipart: name=%+v, keyMarker=%+v, uploadIDMarker=%+v, maxUploads=%+v", name, keyMarker, uploadIDMarker, maxUploads)
+// Lists in-progress uploads. Note that this doesn't support common prefixes
+// or delimiters.
+func (c *Controller) ListMultipart(r *http.Request, name, prefix, keyMarker, uploadIDMarker, delimiter string, maxUploads int) (*s2.ListMultipartResult, error) {
+	c.logger.Tracef("ListMultipart: name=%+v, prefix=%+v, keyMarker=%+v, uploadIDMarker=%+v, delimiter=%+v, maxUploads=%+v", name, prefix, keyMarker, uploadIDMarker, delimiter, maxUploads)
 
 	result := s2.ListMultipartResult{
-		Uploads: []*s2.Upload{},
+		Uploads:        []*s2.Upload{},
+		CommonPrefixes: []*s2.CommonPrefixes{},
 	}
 
 	err := c.transaction(func(tx *gorm.DB) error {
@@ -34,6 +38,10 @@ func (c *Controller) ListMultipart(r *http.Request, name, keyMarker, uploadIDMar
 		}
 
 		for _, upload := range uploads {
+			if !strings.HasPrefix(upload.Key, prefix) || isDelimiterFiltered(upload.Key, prefix, delimiter) {
+				continue
+			}
+
 			if len(result.Uploads) >= maxUploads {
 				if maxUploads > 0 {
 					result.IsTruncated = true
@@ -106,8 +114,8 @@ func (c *Controller) AbortMultipart(r *http.Request, name, key, uploadID string)
 	})
 }
 
-func (c *Controller) CompleteMultipart(r *http.Request, name, key, uploadID string, parts []*s2.Part) (*s2.CompleteMultipartResult, error) {
-	c.logger.Tracef("CompleteMultipart: name=%+v, key=%+v, uploadID=%+v, parts=%+v", name, key, uploadID, parts)
+func (c *Controller) CompleteMultipart(r *http.Request, name, key, uploadID string, parts []*s2.Part, preconditions *s2.Preconditions) (*s2.CompleteMultipartResult, error) {
+	c.logger.Tracef("CompleteMultipart: name=%+v, key=%+v, uploadID=%+v, parts=%+v, preconditions=%+v", name, key, uploadID, parts, preconditions)
 
 	result := s2.CompleteMultipartResult{
 		Location: models.Location,
@@ -130,6 +138,10 @@ func (c *Controller) CompleteMultipart(r *http.Request, name, key, uploadID stri
 			return err
 		}
 
+		if err := checkPreconditions(r, tx, bucket.ID, key, preconditions); err != nil {
+			return err
+		}
+
 		content := []byte{}
 
 		for i, part := range parts {
@@ -208,8 +220,10 @@ func (c *Controller) ListMultipartChunks(r *http.Request, name, key, uploadID st
 			}
 
 			result.Parts = append(result.Parts, &s2.Part{
-				PartNumber: uploadPart.Number,
-				ETag:       uploadPart.ETag,
+				PartNumber:   uploadPart.Number,
+				ETag:         uploadPart.ETag,
+				Size:         int64(len(uploadPart.Content)),
+				LastModified: models.Epoch,
 			})
 		}
 
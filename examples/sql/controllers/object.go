@@ -64,13 +64,13 @@ func (c *Controller) GetObject(r *http.Request, name, key, version string) (*s2.
 
 func (c *Controller) CopyObject(r *http.Request, srcBucket, srcKey string, obj *s2.GetObjectResult, destBucket, destKey string) (string, error) {
 	c.logger.Tracef("CopyObject: srcBucket=%+v, srcKey=%+v, obj=%+v, destBucket=%+v, destKey=%+v", srcBucket, srcKey, obj, destBucket, destKey)
-	version, _, err := c.putObject(r, destBucket, destKey, obj.Content)
+	version, _, err := c.putObject(r, destBucket, destKey, obj.Content, nil)
 	return version, err
 }
 
-func (c *Controller) PutObject(r *http.Request, name, key string, reader io.Reader) (*s2.PutObjectResult, error) {
-	c.logger.Tracef("PutObject: name=%+v, key=%+v", name, key)
-	version, etag, err := c.putObject(r, name, key, reader)
+func (c *Controller) PutObject(r *http.Request, name, key string, reader io.Reader, preconditions *s2.Preconditions) (*s2.PutObjectResult, error) {
+	c.logger.Tracef("PutObject: name=%+v, key=%+v, preconditions=%+v", name, key, preconditions)
+	version, etag, err := c.putObject(r, name, key, reader, preconditions)
 	if err != nil {
 		return nil, err
 	}
@@ -134,7 +134,7 @@ func (c *Controller) DeleteObject(r *http.Request, name, key, version string) (*
 	return &result, err
 }
 
-func (c *Controller) putObject(r *http.Request, name, key string, reader io.Reader) (string, string, error) {
+func (c *Controller) putObject(r *http.Request, name, key string, reader io.Reader, preconditions *s2.Preconditions) (string, string, error) {
 	bytes, err := ioutil.ReadAll(reader)
 	if err != nil {
 		return "", "", err
@@ -152,6 +152,10 @@ func (c *Controller) putObject(r *http.Request, name, key string, reader io.Read
 			return err
 		}
 
+		if err := checkPreconditions(r, tx, bucket.ID, key, preconditions); err != nil {
+			return err
+		}
+
 		if bucket.Versioning == s2.VersioningEnabled {
 			object, err := models.CreateObjectContent(tx, bucket.ID, key, util.RandomString(10), bytes)
 			if err != nil {
@@ -183,3 +187,18 @@ func (c *Controller) putObject(r *http.Request, name, key string, reader io.Read
 
 	return version, etag, err
 }
+
+// checkPreconditions checks conditional write preconditions against the
+// latest version of an object, within the write's transaction
+func checkPreconditions(r *http.Request, tx *gorm.DB, bucketID uint, key string, preconditions *s2.Preconditions) error {
+	if preconditions == nil {
+		return nil
+	}
+
+	object, err := models.GetLatestObject(tx, bucketID, key)
+	if err != nil && !gorm.IsRecordNotFoundError(err) {
+		return err
+	}
+	exists := err == nil && !object.DeleteMarker
+	return preconditions.Check(r, exists, object.ETag)
+}
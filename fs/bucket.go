@@ -0,0 +1,405 @@
+package fs
+
+import (
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/pachyderm/s2"
+)
+
+// GetLocation gets the region a bucket was created in
+func (b *Backend) GetLocation(r *http.Request, name string) (string, error) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	config, err := b.bucket(r, name)
+	if err != nil {
+		return "", err
+	}
+	return config.Region, nil
+}
+
+// HeadBucket checks that a bucket exists, and reports its region
+func (b *Backend) HeadBucket(r *http.Request, name string) (*s2.HeadBucketResult, error) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	config, err := b.bucket(r, name)
+	if err != nil {
+		return nil, err
+	}
+	return &s2.HeadBucketResult{Region: config.Region}, nil
+}
+
+// commonPrefix returns the common prefix that a key is rolled up into, or an
+// empty string if it isn't rolled up.
+func commonPrefix(key, prefix, delimiter string) string {
+	if delimiter == "" {
+		return ""
+	}
+	i := strings.Index(key[len(prefix):], delimiter)
+	if i < 0 {
+		return ""
+	}
+	return key[:len(prefix)+i+len(delimiter)]
+}
+
+// ListObjects lists the latest versions of objects by walking the bucket's
+// directory tree in order, skipping directories that are entirely before
+// the marker, outside of the prefix, or rolled up into a common prefix.
+func (b *Backend) ListObjects(r *http.Request, name, prefix, marker, delimiter string, maxKeys int) (*s2.ListObjectsResult, error) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	if _, err := b.bucket(r, name); err != nil {
+		return nil, err
+	}
+
+	result := s2.ListObjectsResult{
+		Contents:       []*s2.Contents{},
+		CommonPrefixes: []*s2.CommonPrefixes{},
+	}
+	lastPrefix := ""
+	full := func() bool {
+		if len(result.Contents)+len(result.CommonPrefixes) < maxKeys {
+			return false
+		}
+		result.IsTruncated = maxKeys > 0
+		return true
+	}
+
+	skip := func(dirKey string) bool {
+		return lastPrefix != "" && strings.HasPrefix(dirKey, lastPrefix)
+	}
+	err := b.walkData(name, prefix, marker, skip, func(key string, info os.FileInfo) error {
+		if key <= marker || !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+
+		if cp := commonPrefix(key, prefix, delimiter); cp != "" {
+			if cp <= marker || cp == lastPrefix {
+				return nil
+			}
+			if full() {
+				return errStopWalk
+			}
+			result.CommonPrefixes = append(result.CommonPrefixes, &s2.CommonPrefixes{
+				Prefix: cp,
+				Owner:  Owner,
+			})
+			lastPrefix = cp
+			return nil
+		}
+
+		meta, err := b.loadObject(name, key)
+		if err != nil {
+			return err
+		}
+		latest := meta.latest()
+		if latest == nil || latest.DeleteMarker {
+			return nil
+		}
+		if full() {
+			return errStopWalk
+		}
+		result.Contents = append(result.Contents, &s2.Contents{
+			Key:          key,
+			LastModified: latest.ModTime,
+			ETag:         latest.ETag,
+			Size:         uint64(latest.Size),
+			StorageClass: StorageClass,
+			Owner:        Owner,
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// versionKeys returns up to `limit` keys that have versions, in order,
+// starting after `after` (or at it, if `inclusive` is set.) Keys rolled up
+// by the delimiter are omitted. It also returns whether there may be more
+// keys.
+func (b *Backend) versionKeys(name, prefix, delimiter, after string, inclusive bool, limit int) ([]string, bool, error) {
+	more := false
+	collect := func(keys *[]string) func(string) error {
+		return func(key string) error {
+			if key < after || (key == after && !inclusive) || !strings.HasPrefix(key, prefix) {
+				return nil
+			}
+			if commonPrefix(key, prefix, delimiter) != "" {
+				return nil
+			}
+			if len(*keys) == limit {
+				more = true
+				return errStopWalk
+			}
+			*keys = append(*keys, key)
+			return nil
+		}
+	}
+
+	// keys with content are in the data directory (which might have been
+	// populated outside of s2), while keys that only have delete markers
+	// or noncurrent versions are only in the metadata directory. Both walks
+	// are in order, so the first `limit` keys of their union are complete.
+	dataKeys := []string{}
+	visitData := collect(&dataKeys)
+	skip := func(dirKey string) bool {
+		return strings.HasPrefix(dirKey, prefix) && commonPrefix(dirKey, prefix, delimiter) != ""
+	}
+	if err := b.walkData(name, prefix, after, skip, func(key string, info os.FileInfo) error {
+		return visitData(key)
+	}); err != nil {
+		return nil, false, err
+	}
+	metaKeys := []string{}
+	if err := b.walkMeta(name, prefix, after, collect(&metaKeys)); err != nil {
+		return nil, false, err
+	}
+
+	keys := append(dataKeys, metaKeys...)
+	sort.Strings(keys)
+	deduped := keys[:0]
+	for i, key := range keys {
+		if i == 0 || key != keys[i-1] {
+			deduped = append(deduped, key)
+		}
+	}
+	if len(deduped) > limit {
+		deduped = deduped[:limit]
+		more = true
+	}
+	return deduped, more, nil
+}
+
+// ListObjectVersions lists all versions and delete markers, ordered by key,
+// then newest first. Since the result can't express common prefixes, keys
+// that would be rolled up by the delimiter are omitted.
+func (b *Backend) ListObjectVersions(r *http.Request, name, prefix, keyMarker, versionMarker string, delimiter string, maxKeys int) (*s2.ListObjectVersionsResult, error) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	if _, err := b.bucket(r, name); err != nil {
+		return nil, err
+	}
+
+	result := s2.ListObjectVersionsResult{
+		Versions:      []*s2.Version{},
+		DeleteMarkers: []*s2.DeleteMarker{},
+	}
+
+	after := keyMarker
+	inclusive := versionMarker != ""
+	for {
+		keys, more, err := b.versionKeys(name, prefix, delimiter, after, inclusive, maxKeys+1)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, key := range keys {
+			meta, err := b.loadObject(name, key)
+			if err != nil {
+				return nil, err
+			}
+
+			start := len(meta.Versions) - 1
+			if key == keyMarker {
+				// resume after the version marker
+				start = -1
+				if i := meta.find(versionMarker); i >= 0 {
+					start = i - 1
+				}
+			}
+
+			for i := start; i >= 0; i-- {
+				if len(result.Versions)+len(result.DeleteMarkers) >= maxKeys {
+					result.IsTruncated = maxKeys > 0
+					return &result, nil
+				}
+
+				v := meta.Versions[i]
+				isLatest := i == len(meta.Versions)-1
+				if v.DeleteMarker {
+					result.DeleteMarkers = append(result.DeleteMarkers, &s2.DeleteMarker{
+						Key:          key,
+						Version:      v.ID,
+						IsLatest:     isLatest,
+						LastModified: v.ModTime,
+						Owner:        Owner,
+					})
+				} else {
+					result.Versions = append(result.Versions, &s2.Version{
+						Key:          key,
+						Version:      v.ID,
+						IsLatest:     isLatest,
+						LastModified: v.ModTime,
+						ETag:         v.ETag,
+						Size:         uint64(v.Size),
+						StorageClass: StorageClass,
+						Owner:        Owner,
+					})
+				}
+				result.NextKeyMarker = key
+				result.NextVersionIDMarker = v.ID
+			}
+		}
+
+		if !more || len(keys) == 0 {
+			return &result, nil
+		}
+		after = keys[len(keys)-1]
+		inclusive = false
+	}
+}
+
+// CreateBucket creates a bucket directory
+func (b *Backend) CreateBucket(r *http.Request, name string, options *s2.CreateBucketOptions) error {
+	if !validBucket(name) {
+		return s2.InvalidBucketNameError(r)
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if err := os.Mkdir(b.bucketDir(name), 0755); err != nil {
+		if os.IsExist(err) {
+			return s2.BucketAlreadyOwnedByYouError(r)
+		}
+		return err
+	}
+
+	config := bucketConfig{
+		Region:  DefaultRegion,
+		Created: now(),
+	}
+	if options != nil && options.LocationConstraint != "" {
+		config.Region = options.LocationConstraint
+	}
+	// clear out anything left over from a bucket of the same name that
+	// was removed outside of s2
+	if err := os.RemoveAll(b.internalBucketDir(name)); err != nil {
+		return err
+	}
+	return b.saveBucket(name, &config)
+}
+
+// DeleteBucket deletes a bucket, which must not have any objects, versions
+// or in-progress multipart uploads
+func (b *Backend) DeleteBucket(r *http.Request, name string) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if _, err := b.bucket(r, name); err != nil {
+		return err
+	}
+	for _, dir := range []string{b.bucketDir(name), b.metaDir(name), b.uploadsDir(name)} {
+		empty, err := isEmptyDir(dir)
+		if err != nil {
+			return err
+		}
+		if !empty {
+			return s2.BucketNotEmptyError(r)
+		}
+	}
+
+	if err := os.Remove(b.bucketDir(name)); err != nil {
+		return err
+	}
+	return os.RemoveAll(b.internalBucketDir(name))
+}
+
+// GetBucketVersioning gets the versioning state of a bucket
+func (b *Backend) GetBucketVersioning(r *http.Request, name string) (string, error) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	config, err := b.bucket(r, name)
+	if err != nil {
+		return "", err
+	}
+	return config.Versioning, nil
+}
+
+// SetBucketVersioning sets the versioning state of a bucket. As with S3,
+// versioning can only be suspended, not disabled, once it's been enabled.
+func (b *Backend) SetBucketVersioning(r *http.Request, name, status string) error {
+	return b.updateBucket(r, name, func(config *bucketConfig) error {
+		if status == s2.VersioningDisabled && config.Versioning != s2.VersioningDisabled {
+			return s2.IllegalVersioningConfigurationError(r)
+		}
+		config.Versioning = status
+		return nil
+	})
+}
+
+// GetBucketEncryption gets the default encryption of a bucket, or nil if
+// there is none
+func (b *Backend) GetBucketEncryption(r *http.Request, name string) (*s2.BucketEncryption, error) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	config, err := b.bucket(r, name)
+	if err != nil {
+		return nil, err
+	}
+	return config.Encryption, nil
+}
+
+// SetBucketEncryption sets the default encryption of a bucket
+func (b *Backend) SetBucketEncryption(r *http.Request, name string, encryption *s2.BucketEncryption) error {
+	return b.updateBucket(r, name, func(config *bucketConfig) error {
+		config.Encryption = encryption
+		return nil
+	})
+}
+
+// DeleteBucketEncryption removes the default encryption of a bucket
+func (b *Backend) DeleteBucketEncryption(r *http.Request, name string) error {
+	return b.updateBucket(r, name, func(config *bucketConfig) error {
+		config.Encryption = nil
+		return nil
+	})
+}
+
+// GetBucketNotification gets the notification configuration of a bucket
+func (b *Backend) GetBucketNotification(r *http.Request, name string) (*s2.NotificationConfiguration, error) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	config, err := b.bucket(r, name)
+	if err != nil {
+		return nil, err
+	}
+	if config.Notification == nil {
+		return &s2.NotificationConfiguration{}, nil
+	}
+	return config.Notification, nil
+}
+
+// SetBucketNotification sets the notification configuration of a bucket
+func (b *Backend) SetBucketNotification(r *http.Request, name string, notification *s2.NotificationConfiguration) error {
+	return b.updateBucket(r, name, func(config *bucketConfig) error {
+		config.Notification = notification
+		return nil
+	})
+}
+
+// updateBucket atomically updates the configuration of a bucket
+func (b *Backend) updateBucket(r *http.Request, name string, f func(config *bucketConfig) error) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	config, err := b.bucket(r, name)
+	if err != nil {
+		return err
+	}
+	if err := f(config); err != nil {
+		return err
+	}
+	return b.saveBucket(name, config)
+}
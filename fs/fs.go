@@ -0,0 +1,404 @@
+// Package fs implements the s2 controllers on top of a local filesystem.
+// Buckets are directories under a root directory, and objects are files
+// within them, so existing datasets can be served as-is. Everything else
+// lives in a hidden `.s2` directory under the root:
+//
+//	<root>/<bucket>/<key>                          latest object content
+//	<root>/.s2/tmp/                                staging for atomic writes
+//	<root>/.s2/buckets/<bucket>/bucket.json        bucket configuration
+//	<root>/.s2/buckets/<bucket>/meta/              per-key sidecar metadata
+//	<root>/.s2/buckets/<bucket>/versions/          noncurrent version content
+//	<root>/.s2/buckets/<bucket>/uploads/<id>/      multipart upload staging
+//
+// Writes are staged in a temporary file and renamed into place, so readers
+// never observe partially written objects. Files that are added or changed
+// outside of s2 are picked up, with their ETags computed (and cached) on
+// first access.
+//
+// Since keys map to paths, a key can't be both an object and a "directory"
+// of other objects (e.g. `a` and `a/b`), and keys with empty, `.` or `..`
+// path segments are rejected. Keys with a trailing slash are supported as
+// empty "folder" objects. Symlinks to files are served as objects, but
+// symlinks to directories aren't listed, so that links can't form cycles.
+// A root directory must only be served by one `Backend` at a time.
+package fs
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pachyderm/s2"
+)
+
+const (
+	// DefaultRegion is the region buckets are created in if no location
+	// constraint is specified
+	DefaultRegion = "us-east-1"
+	// StorageClass is the storage class reported for all objects
+	StorageClass = "STANDARD"
+	// internalDir is the name of the directory under the root that holds
+	// everything but object content
+	internalDir = ".s2"
+	// nullVersion is the version ID S3 gives to objects written while
+	// versioning is disabled or suspended
+	nullVersion = "null"
+	// metaChunkSize is the maximum length of each path segment of a
+	// metadata file, which is named after the hex-encoded key
+	metaChunkSize = 200
+	// maxSegmentLength is the maximum length of each path segment of a key
+	maxSegmentLength = 255
+)
+
+// Owner is the user reported as the owner of all buckets, objects and
+// uploads
+var Owner = s2.User{
+	ID:          "fs",
+	DisplayName: "fs",
+}
+
+// bucketConfig is the configuration of a bucket, stored in `bucket.json`
+type bucketConfig struct {
+	Region       string                        `json:"region"`
+	Created      time.Time                     `json:"created"`
+	Versioning   string                        `json:"versioning,omitempty"`
+	Encryption   *s2.BucketEncryption          `json:"encryption,omitempty"`
+	Notification *s2.NotificationConfiguration `json:"notification,omitempty"`
+}
+
+// versionMeta is the metadata of a single version of an object, or a
+// delete marker
+type versionMeta struct {
+	ID           string    `json:"id"`
+	ETag         string    `json:"etag,omitempty"`
+	ModTime      time.Time `json:"modTime"`
+	Size         int64     `json:"size"`
+	DeleteMarker bool      `json:"deleteMarker,omitempty"`
+	PartSizes    []int64   `json:"partSizes,omitempty"`
+	// File is the name of the file in the versions directory holding the
+	// content, if it's been moved out of the object's data path
+	File string `json:"file,omitempty"`
+	// DataModTime is the modification time of the data file, when the
+	// version was written to it. It's used to detect changes made outside
+	// of s2.
+	DataModTime time.Time `json:"dataModTime,omitempty"`
+}
+
+// objectMeta is the sidecar metadata of a key, holding its versions oldest
+// first
+type objectMeta struct {
+	Versions []*versionMeta `json:"versions"`
+}
+
+// latest returns the latest version, or nil if there are no versions
+func (m *objectMeta) latest() *versionMeta {
+	if len(m.Versions) == 0 {
+		return nil
+	}
+	return m.Versions[len(m.Versions)-1]
+}
+
+// find returns the index of the version with the given ID, or -1
+func (m *objectMeta) find(id string) int {
+	for i, v := range m.Versions {
+		if v.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// remove removes the version at the given index
+func (m *objectMeta) remove(i int) {
+	m.Versions = append(m.Versions[:i:i], m.Versions[i+1:]...)
+}
+
+// current returns whether the given version's content lives in the
+// object's data path
+func (m *objectMeta) current(v *versionMeta) bool {
+	return v == m.latest() && !v.DeleteMarker && v.File == ""
+}
+
+// Backend is a filesystem-backed S3 backend. It implements
+// `s2.ServiceController`, `s2.BucketController`,
+// `s2.HeadBucketController`, `s2.ObjectController`,
+// `s2.MultipartController`, `s2.EncryptionController` and
+// `s2.NotificationController`. It's safe for concurrent use.
+type Backend struct {
+	root string
+	// lock protects metadata and the layout of files. Request bodies are
+	// staged before it's acquired, so it's only held briefly.
+	lock sync.RWMutex
+}
+
+// New creates a backend serving the given root directory, which is created
+// if it doesn't exist. Any leftover staged writes are cleaned up.
+func New(root string) (*Backend, error) {
+	b := &Backend{root: root}
+	if err := os.RemoveAll(b.tmpDir()); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(b.tmpDir(), 0755); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Join(root, internalDir, "buckets"), 0755); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func (b *Backend) tmpDir() string {
+	return filepath.Join(b.root, internalDir, "tmp")
+}
+
+func (b *Backend) bucketDir(bucket string) string {
+	return filepath.Join(b.root, bucket)
+}
+
+func (b *Backend) internalBucketDir(bucket string) string {
+	return filepath.Join(b.root, internalDir, "buckets", bucket)
+}
+
+func (b *Backend) configPath(bucket string) string {
+	return filepath.Join(b.internalBucketDir(bucket), "bucket.json")
+}
+
+func (b *Backend) metaDir(bucket string) string {
+	return filepath.Join(b.internalBucketDir(bucket), "meta")
+}
+
+func (b *Backend) versionsDir(bucket string) string {
+	return filepath.Join(b.internalBucketDir(bucket), "versions")
+}
+
+func (b *Backend) uploadsDir(bucket string) string {
+	return filepath.Join(b.internalBucketDir(bucket), "uploads")
+}
+
+// dataPath returns the path of the file holding a key's latest content. For
+// folder keys (with a trailing slash), it's the directory.
+func (b *Backend) dataPath(bucket, key string) string {
+	return filepath.Join(b.bucketDir(bucket), filepath.FromSlash(strings.TrimSuffix(key, "/")))
+}
+
+// metaPath returns the path of a key's sidecar metadata. It's named after
+// the hex-encoded key, split into segments to respect filename length
+// limits, so that walking the metadata directory in lexicographical order
+// visits keys in lexicographical order.
+func (b *Backend) metaPath(bucket, key string) string {
+	encoded := hex.EncodeToString([]byte(key))
+	segments := []string{b.metaDir(bucket)}
+	for len(encoded) > metaChunkSize {
+		segments = append(segments, encoded[:metaChunkSize])
+		encoded = encoded[metaChunkSize:]
+	}
+	segments = append(segments, encoded+".json")
+	return filepath.Join(segments...)
+}
+
+// isFolderKey returns whether a key is a folder object, which is stored as
+// a directory
+func isFolderKey(key string) bool {
+	return strings.HasSuffix(key, "/")
+}
+
+// validKey returns whether a key can be mapped to a path
+func validKey(key string) bool {
+	if key == "" || strings.ContainsRune(key, 0) || strings.ContainsRune(key, '\\') {
+		return false
+	}
+	for _, segment := range strings.Split(strings.TrimSuffix(key, "/"), "/") {
+		if segment == "" || segment == "." || segment == ".." || len(segment) > maxSegmentLength {
+			return false
+		}
+	}
+	return true
+}
+
+// validBucket returns whether a bucket name can be served. Names starting
+// with a dot, which are only possible with legacy bucket names, are
+// reserved for internal use.
+func validBucket(name string) bool {
+	return name != "" && !strings.HasPrefix(name, ".") && !strings.ContainsAny(name, `/\`)
+}
+
+// invalidKeyError is returned for keys that can't be mapped to a path
+func invalidKeyError(r *http.Request) *s2.Error {
+	return s2.InvalidRequestError(r, "The key can't be stored on the filesystem.")
+}
+
+// keyConflictError is returned when a key conflicts with an existing key,
+// e.g. writing `a/b` when `a` is an object
+func keyConflictError(r *http.Request) *s2.Error {
+	return s2.InvalidRequestError(r, "The key conflicts with an existing object or prefix.")
+}
+
+// bucket loads the configuration of a bucket. Directories in the root that
+// weren't created through s2 are served with a default configuration.
+func (b *Backend) bucket(r *http.Request, name string) (*bucketConfig, error) {
+	if !validBucket(name) {
+		return nil, s2.NoSuchBucketError(r)
+	}
+	info, err := os.Stat(b.bucketDir(name))
+	if err != nil || !info.IsDir() {
+		if err == nil || os.IsNotExist(err) {
+			return nil, s2.NoSuchBucketError(r)
+		}
+		return nil, err
+	}
+
+	config := bucketConfig{
+		Region:  DefaultRegion,
+		Created: info.ModTime(),
+	}
+	if err := readJSON(b.configPath(name), &config); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return &config, nil
+}
+
+// saveBucket stores the configuration of a bucket
+func (b *Backend) saveBucket(name string, config *bucketConfig) error {
+	return b.writeJSON(b.configPath(name), config)
+}
+
+// readJSON reads a JSON file into `v`
+func readJSON(path string, v interface{}) error {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(contents, v)
+}
+
+// writeJSON atomically writes `v` as JSON to the given path, creating
+// parent directories as necessary
+func (b *Backend) writeJSON(path string, v interface{}) error {
+	contents, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(b.tmpDir(), "meta-")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(contents); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return nil
+}
+
+// stage streams content into a new temporary file, returning its path, the
+// hex-encoded MD5 of the content, and its size. The caller is responsible
+// for renaming or removing the file.
+func (b *Backend) stage(reader io.Reader) (string, string, int64, error) {
+	f, err := ioutil.TempFile(b.tmpDir(), "data-")
+	if err != nil {
+		return "", "", 0, err
+	}
+	hash := md5.New()
+	size, err := io.Copy(io.MultiWriter(f, hash), reader)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", "", 0, err
+	}
+	return f.Name(), hex.EncodeToString(hash.Sum(nil)), size, nil
+}
+
+// isNotExist returns whether an error indicates that a path doesn't exist,
+// including when one of its parents is a file
+func isNotExist(err error) bool {
+	if os.IsNotExist(err) {
+		return true
+	}
+	if pathErr, ok := err.(*os.PathError); ok {
+		return pathErr.Err == syscall.ENOTDIR
+	}
+	return false
+}
+
+// hashFile computes the hex-encoded MD5 of a file's content
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	hash := md5.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// removeEmptyDirs removes `dir` and its parents, up to but not including
+// `stop`, for as long as they're empty
+func removeEmptyDirs(dir, stop string) {
+	for dir != stop && strings.HasPrefix(dir, stop) {
+		if err := os.Remove(dir); err != nil {
+			return
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+// isEmptyDir returns whether a directory is empty or doesn't exist
+func isEmptyDir(dir string) (bool, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return true, nil
+		}
+		return false, err
+	}
+	defer f.Close()
+	names, err := f.Readdirnames(1)
+	if err == io.EOF {
+		return true, nil
+	}
+	return len(names) == 0, err
+}
+
+// newID generates a random ID
+func newID() string {
+	var buf [16]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		panic(fmt.Sprintf("could not generate random ID: %v", err))
+	}
+	return hex.EncodeToString(buf[:])
+}
+
+// now returns the current time, rounded to S3's millisecond precision
+func now() time.Time {
+	return time.Now().UTC().Round(time.Millisecond)
+}
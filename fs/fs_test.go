@@ -0,0 +1,87 @@
+package fs
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pachyderm/s2"
+	"github.com/pachyderm/s2/s2test"
+	"github.com/sirupsen/logrus"
+)
+
+func TestConformance(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	root, err := ioutil.TempDir("", "s2-fs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	i := 0
+	s2test.RunConformance(t, func() *s2.S2 {
+		i++
+		backend, err := New(filepath.Join(root, fmt.Sprint(i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		s := s2.NewS2(logrus.NewEntry(logger), 0, 5*time.Second)
+		s.Service = backend
+		s.Bucket = backend
+		s.Object = backend
+		s.Multipart = backend
+		s.Encryption = backend
+		s.Notification = backend
+		return s
+	})
+}
+
+func TestSymlinks(t *testing.T) {
+	root, err := ioutil.TempDir("", "s2-fs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	backend, err := New(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("GET", "/", nil)
+	if err := backend.CreateBucket(r, "bucket", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// a link to a file is served as an object, while a link back to the
+	// bucket directory would make listing recurse forever if it were
+	// followed
+	dir := filepath.Join(root, "bucket")
+	if err := ioutil.WriteFile(filepath.Join(dir, "file"), []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(dir, "file"), filepath.Join(dir, "link")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(dir, filepath.Join(dir, "loop")); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := backend.ListObjects(r, "bucket", "", "", "", 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := []string{}
+	for _, contents := range result.Contents {
+		keys = append(keys, contents.Key)
+	}
+	if fmt.Sprint(keys) != "[file link]" {
+		t.Fatalf("expected keys [file link], got %v", keys)
+	}
+}
@@ -0,0 +1,450 @@
+package fs
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pachyderm/s2"
+)
+
+// minPartSize is the minimum size of all but the last part of a multipart
+// upload
+const minPartSize = 5 * 1024 * 1024
+
+// uploadMeta is the metadata of a multipart upload, stored in
+// `upload.json` in its staging directory
+type uploadMeta struct {
+	Key       string    `json:"key"`
+	Initiated time.Time `json:"initiated"`
+}
+
+// partMeta is the metadata of an uploaded part, stored alongside it
+type partMeta struct {
+	ETag    string    `json:"etag"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+}
+
+func (b *Backend) uploadDir(bucket, uploadID string) string {
+	return filepath.Join(b.uploadsDir(bucket), uploadID)
+}
+
+func (b *Backend) partPath(bucket, uploadID string, partNumber int) string {
+	return filepath.Join(b.uploadDir(bucket, uploadID), strconv.Itoa(partNumber))
+}
+
+// upload loads the metadata of an in-progress multipart upload. The
+// backend's lock must be held.
+func (b *Backend) upload(r *http.Request, bucket, key, uploadID string) (*uploadMeta, error) {
+	if _, err := b.bucket(r, bucket); err != nil {
+		return nil, err
+	}
+	if !validUploadID(uploadID) {
+		return nil, s2.NoSuchUploadError(r)
+	}
+
+	meta := uploadMeta{}
+	if err := readJSON(filepath.Join(b.uploadDir(bucket, uploadID), "upload.json"), &meta); err != nil {
+		if os.IsNotExist(err) {
+			return nil, s2.NoSuchUploadError(r)
+		}
+		return nil, err
+	}
+	if meta.Key != key {
+		return nil, s2.NoSuchUploadError(r)
+	}
+	return &meta, nil
+}
+
+// validUploadID returns whether an upload ID has the format of those that
+// are generated, so that others aren't used to build paths
+func validUploadID(uploadID string) bool {
+	if len(uploadID) != 32 {
+		return false
+	}
+	_, err := hex.DecodeString(uploadID)
+	return err == nil
+}
+
+// parts loads the metadata of all parts of an upload, keyed by part number
+func (b *Backend) parts(bucket, uploadID string) (map[int]*partMeta, error) {
+	infos, err := ioutil.ReadDir(b.uploadDir(bucket, uploadID))
+	if err != nil {
+		return nil, err
+	}
+	parts := map[int]*partMeta{}
+	for _, info := range infos {
+		if !strings.HasSuffix(info.Name(), ".json") {
+			continue
+		}
+		partNumber, err := strconv.Atoi(strings.TrimSuffix(info.Name(), ".json"))
+		if err != nil {
+			continue
+		}
+		part := partMeta{}
+		if err := readJSON(filepath.Join(b.uploadDir(bucket, uploadID), info.Name()), &part); err != nil {
+			return nil, err
+		}
+		parts[partNumber] = &part
+	}
+	return parts, nil
+}
+
+// ListMultipart lists in-progress multipart uploads, ordered by key, then
+// by when they were initiated
+func (b *Backend) ListMultipart(r *http.Request, name, prefix, keyMarker, uploadIDMarker, delimiter string, maxUploads int) (*s2.ListMultipartResult, error) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	if _, err := b.bucket(r, name); err != nil {
+		return nil, err
+	}
+
+	infos, err := ioutil.ReadDir(b.uploadsDir(name))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	uploads := []*s2.Upload{}
+	for _, info := range infos {
+		meta := uploadMeta{}
+		if err := readJSON(filepath.Join(b.uploadDir(name, info.Name()), "upload.json"), &meta); err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		uploads = append(uploads, &s2.Upload{
+			Key:          meta.Key,
+			UploadID:     info.Name(),
+			Initiator:    Owner,
+			Owner:        Owner,
+			StorageClass: StorageClass,
+			Initiated:    meta.Initiated,
+		})
+	}
+	// upload IDs sort in the order the uploads were initiated
+	sort.Slice(uploads, func(i, j int) bool {
+		if uploads[i].Key != uploads[j].Key {
+			return uploads[i].Key < uploads[j].Key
+		}
+		return uploads[i].UploadID < uploads[j].UploadID
+	})
+
+	result := s2.ListMultipartResult{
+		Uploads:        []*s2.Upload{},
+		CommonPrefixes: []*s2.CommonPrefixes{},
+	}
+	lastPrefix := ""
+
+	for _, upload := range uploads {
+		if !strings.HasPrefix(upload.Key, prefix) || upload.Key < keyMarker {
+			continue
+		}
+		// without an upload ID marker, S3 resumes after the whole key
+		if upload.Key == keyMarker && (uploadIDMarker == "" || upload.UploadID <= uploadIDMarker) {
+			continue
+		}
+
+		if cp := commonPrefix(upload.Key, prefix, delimiter); cp != "" {
+			if cp <= keyMarker || cp == lastPrefix {
+				continue
+			}
+			if len(result.Uploads)+len(result.CommonPrefixes) >= maxUploads {
+				result.IsTruncated = maxUploads > 0
+				break
+			}
+			result.CommonPrefixes = append(result.CommonPrefixes, &s2.CommonPrefixes{
+				Prefix: cp,
+				Owner:  Owner,
+			})
+			result.NextKeyMarker = cp
+			result.NextUploadIDMarker = ""
+			lastPrefix = cp
+			continue
+		}
+
+		if len(result.Uploads)+len(result.CommonPrefixes) >= maxUploads {
+			result.IsTruncated = maxUploads > 0
+			break
+		}
+		result.Uploads = append(result.Uploads, upload)
+		result.NextKeyMarker = upload.Key
+		result.NextUploadIDMarker = upload.UploadID
+	}
+
+	return &result, nil
+}
+
+// InitMultipart starts a new multipart upload, creating its staging
+// directory
+func (b *Backend) InitMultipart(r *http.Request, name, key string) (string, error) {
+	if !validKey(key) {
+		return "", invalidKeyError(r)
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if _, err := b.bucket(r, name); err != nil {
+		return "", err
+	}
+
+	initiated := now()
+	uploadID := fmt.Sprintf("%016x%s", initiated.UnixNano(), newID()[:16])
+	if err := os.MkdirAll(b.uploadDir(name, uploadID), 0755); err != nil {
+		return "", err
+	}
+	meta := uploadMeta{
+		Key:       key,
+		Initiated: initiated,
+	}
+	if err := b.writeJSON(filepath.Join(b.uploadDir(name, uploadID), "upload.json"), &meta); err != nil {
+		return "", err
+	}
+	return uploadID, nil
+}
+
+// AbortMultipart discards a multipart upload and its staging directory
+func (b *Backend) AbortMultipart(r *http.Request, name, key, uploadID string) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if _, err := b.upload(r, name, key, uploadID); err != nil {
+		return err
+	}
+	return os.RemoveAll(b.uploadDir(name, uploadID))
+}
+
+// CompleteMultipart concatenates the given parts into a new version of the
+// object. All but the last part must be at least 5MiB, and the object gets
+// a multipart ETag. The parts are concatenated without holding the
+// backend's lock.
+func (b *Backend) CompleteMultipart(r *http.Request, name, key, uploadID string, parts []*s2.Part, preconditions *s2.Preconditions) (*s2.CompleteMultipartResult, error) {
+	v, stagedPath, err := b.concatenate(r, name, key, uploadID, parts)
+	if err != nil {
+		return nil, err
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	versionID, err := b.completeLocked(r, name, key, uploadID, preconditions, v, stagedPath)
+	if err != nil {
+		os.Remove(stagedPath)
+		return nil, err
+	}
+	return &s2.CompleteMultipartResult{
+		Location: "/" + name + "/" + key,
+		ETag:     v.ETag,
+		Version:  versionID,
+	}, nil
+}
+
+// completeLocked installs a concatenated multipart upload, and removes its
+// staging directory. The backend's lock must be held.
+func (b *Backend) completeLocked(r *http.Request, name, key, uploadID string, preconditions *s2.Preconditions, v *versionMeta, stagedPath string) (string, error) {
+	// the upload may have been aborted or completed in the meantime
+	if _, err := b.upload(r, name, key, uploadID); err != nil {
+		return "", err
+	}
+	config, err := b.bucket(r, name)
+	if err != nil {
+		return "", err
+	}
+	meta, err := b.loadObject(name, key)
+	if err != nil {
+		return "", err
+	}
+	if err := checkPreconditions(r, meta, preconditions); err != nil {
+		return "", err
+	}
+
+	v.ModTime = now()
+	versionID, err := b.write(r, name, config, key, meta, v, stagedPath)
+	if err != nil {
+		return "", err
+	}
+	if err := os.RemoveAll(b.uploadDir(name, uploadID)); err != nil {
+		return "", err
+	}
+	return versionID, nil
+}
+
+// concatenate validates the parts of a multipart upload, and stages their
+// concatenation
+func (b *Backend) concatenate(r *http.Request, name, key, uploadID string, parts []*s2.Part) (*versionMeta, string, error) {
+	b.lock.RLock()
+	files := make([]*os.File, 0, len(parts))
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	v, err := b.openParts(r, name, key, uploadID, parts, &files)
+	b.lock.RUnlock()
+	if err != nil {
+		return nil, "", err
+	}
+
+	readers := make([]io.Reader, len(files))
+	for i, f := range files {
+		readers[i] = f
+	}
+	stagedPath, _, size, err := b.stage(io.MultiReader(readers...))
+	if err != nil {
+		return nil, "", err
+	}
+	if isFolderKey(key) && size > 0 {
+		os.Remove(stagedPath)
+		return nil, "", s2.InvalidRequestError(r, "Objects with a trailing slash must be empty.")
+	}
+	v.Size = size
+	return v, stagedPath, nil
+}
+
+// openParts validates the parts of a multipart upload and opens them. Open
+// files are appended to `files`, even on error, so the caller can close
+// them. The backend's lock must be held, but the open files stay readable
+// after it's released, even if the parts are replaced or the upload is
+// aborted.
+func (b *Backend) openParts(r *http.Request, name, key, uploadID string, parts []*s2.Part, files *[]*os.File) (*versionMeta, error) {
+	if _, err := b.upload(r, name, key, uploadID); err != nil {
+		return nil, err
+	}
+	uploaded, err := b.parts(name, uploadID)
+	if err != nil {
+		return nil, err
+	}
+
+	etags := make([]string, 0, len(parts))
+	partSizes := make([]int64, 0, len(parts))
+	for i, part := range parts {
+		meta, ok := uploaded[part.PartNumber]
+		if !ok || meta.ETag != strings.Trim(part.ETag, `"`) {
+			return nil, s2.InvalidPartError(r)
+		}
+		if i < len(parts)-1 && meta.Size < minPartSize {
+			return nil, s2.EntityTooSmallError(r)
+		}
+		f, err := os.Open(b.partPath(name, uploadID, part.PartNumber))
+		if err != nil {
+			return nil, err
+		}
+		*files = append(*files, f)
+		etags = append(etags, meta.ETag)
+		partSizes = append(partSizes, meta.Size)
+	}
+
+	etag, err := s2.MultipartETag(etags)
+	if err != nil {
+		return nil, err
+	}
+	return &versionMeta{
+		ETag:      etag,
+		PartSizes: partSizes,
+	}, nil
+}
+
+// ListMultipartChunks lists the uploaded parts of a multipart upload, in
+// order
+func (b *Backend) ListMultipartChunks(r *http.Request, name, key, uploadID string, partNumberMarker, maxParts int) (*s2.ListMultipartChunksResult, error) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	if _, err := b.upload(r, name, key, uploadID); err != nil {
+		return nil, err
+	}
+	parts, err := b.parts(name, uploadID)
+	if err != nil {
+		return nil, err
+	}
+
+	partNumbers := make([]int, 0, len(parts))
+	for partNumber := range parts {
+		if partNumber > partNumberMarker {
+			partNumbers = append(partNumbers, partNumber)
+		}
+	}
+	sort.Ints(partNumbers)
+
+	owner := Owner
+	result := s2.ListMultipartChunksResult{
+		Initiator:    &owner,
+		Owner:        &owner,
+		StorageClass: StorageClass,
+		Parts:        []*s2.Part{},
+	}
+	for _, partNumber := range partNumbers {
+		if len(result.Parts) >= maxParts {
+			result.IsTruncated = maxParts > 0
+			break
+		}
+		part := parts[partNumber]
+		result.Parts = append(result.Parts, &s2.Part{
+			PartNumber:   partNumber,
+			ETag:         part.ETag,
+			Size:         part.Size,
+			LastModified: part.ModTime,
+		})
+	}
+
+	return &result, nil
+}
+
+// UploadMultipartChunk stages a part of a multipart upload, replacing any
+// existing part with the same number
+func (b *Backend) UploadMultipartChunk(r *http.Request, name, key, uploadID string, partNumber int, reader io.Reader) (string, error) {
+	stagedPath, etag, size, err := b.stage(reader)
+	if err != nil {
+		return "", err
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if _, err := b.upload(r, name, key, uploadID); err != nil {
+		os.Remove(stagedPath)
+		return "", err
+	}
+	partPath := b.partPath(name, uploadID, partNumber)
+	if err := os.Rename(stagedPath, partPath); err != nil {
+		os.Remove(stagedPath)
+		return "", err
+	}
+	meta := partMeta{
+		ETag:    etag,
+		Size:    size,
+		ModTime: now(),
+	}
+	if err := b.writeJSON(partPath+".json", &meta); err != nil {
+		return "", err
+	}
+	return etag, nil
+}
+
+// GetMultipartChunk opens an uploaded part of a multipart upload
+func (b *Backend) GetMultipartChunk(r *http.Request, name, key, uploadID string, partNumber int) (io.ReadSeeker, error) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	if _, err := b.upload(r, name, key, uploadID); err != nil {
+		return nil, err
+	}
+	f, err := os.Open(b.partPath(name, uploadID, partNumber))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, s2.InvalidPartError(r)
+		}
+		return nil, err
+	}
+	return f, nil
+}
@@ -0,0 +1,448 @@
+package fs
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/pachyderm/s2"
+)
+
+// loadObject loads the metadata of a key, reconciling it with the content
+// of the data path in case it was changed outside of s2. Reconciled
+// metadata is stored on a best-effort basis, so ETags only have to be
+// computed once.
+func (b *Backend) loadObject(bucket, key string) (*objectMeta, error) {
+	meta := &objectMeta{}
+	metaPath := b.metaPath(bucket, key)
+	if err := readJSON(metaPath, meta); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if isFolderKey(key) {
+		return meta, nil
+	}
+
+	dataPath := b.dataPath(bucket, key)
+	info, err := os.Stat(dataPath)
+	if err != nil && !isNotExist(err) {
+		return nil, err
+	}
+	latest := meta.latest()
+
+	if info == nil || !info.Mode().IsRegular() {
+		// the content was removed from under us, so the version that
+		// referred to it is gone
+		if latest != nil && meta.current(latest) {
+			meta.remove(len(meta.Versions) - 1)
+		}
+		return meta, nil
+	}
+
+	if latest != nil && meta.current(latest) && latest.Size == info.Size() && latest.DataModTime.Equal(info.ModTime()) {
+		return meta, nil
+	}
+
+	// the content was written outside of s2
+	etag, err := hashFile(dataPath)
+	if err != nil {
+		return nil, err
+	}
+	v := &versionMeta{
+		ETag:        etag,
+		ModTime:     info.ModTime().UTC(),
+		Size:        info.Size(),
+		DataModTime: info.ModTime(),
+	}
+	if latest != nil && meta.current(latest) {
+		v.ID = latest.ID
+		meta.Versions[len(meta.Versions)-1] = v
+	} else {
+		v.ID = nullVersion
+		if meta.find(nullVersion) >= 0 {
+			v.ID = newID()
+		}
+		meta.Versions = append(meta.Versions, v)
+	}
+	b.writeJSON(metaPath, meta)
+	return meta, nil
+}
+
+// saveObject stores the metadata of a key, removing it if there are no
+// versions left
+func (b *Backend) saveObject(bucket, key string, meta *objectMeta) error {
+	metaPath := b.metaPath(bucket, key)
+	if len(meta.Versions) > 0 {
+		return b.writeJSON(metaPath, meta)
+	}
+	if err := os.Remove(metaPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	removeEmptyDirs(filepath.Dir(metaPath), b.metaDir(bucket))
+	return nil
+}
+
+// open opens the content of a version
+func (b *Backend) open(bucket, key string, meta *objectMeta, v *versionMeta) (io.ReadSeeker, error) {
+	if v.File != "" {
+		return os.Open(filepath.Join(b.versionsDir(bucket), v.File))
+	}
+	if meta.current(v) && !isFolderKey(key) {
+		return os.Open(b.dataPath(bucket, key))
+	}
+	return bytes.NewReader(nil), nil
+}
+
+// demote moves the content of the current version out of the data path,
+// so that it can be replaced or deleted while the version is retained
+func (b *Backend) demote(bucket, key string, meta *objectMeta) error {
+	latest := meta.latest()
+	if latest == nil || !meta.current(latest) || isFolderKey(key) {
+		return nil
+	}
+	dataPath := b.dataPath(bucket, key)
+	file := newID()
+	if err := os.MkdirAll(b.versionsDir(bucket), 0755); err != nil {
+		return err
+	}
+	if err := os.Rename(dataPath, filepath.Join(b.versionsDir(bucket), file)); err != nil {
+		return err
+	}
+	latest.File = file
+	return nil
+}
+
+// discard removes the content of a version that's being deleted
+func (b *Backend) discard(bucket, key string, meta *objectMeta, v *versionMeta) error {
+	if v.File != "" {
+		return removeData(filepath.Join(b.versionsDir(bucket), v.File))
+	}
+	if meta.current(v) && !isFolderKey(key) {
+		return removeData(b.dataPath(bucket, key))
+	}
+	return nil
+}
+
+// promote moves the content of the latest version back into the data path,
+// after the version that was in it has been deleted
+func (b *Backend) promote(bucket, key string, meta *objectMeta) error {
+	latest := meta.latest()
+	if latest == nil || latest.DeleteMarker {
+		return nil
+	}
+	dataPath := b.dataPath(bucket, key)
+	if isFolderKey(key) {
+		return os.MkdirAll(dataPath, 0755)
+	}
+	if latest.File == "" {
+		// already in place
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(dataPath), 0755); err != nil {
+		return err
+	}
+	if err := os.Rename(filepath.Join(b.versionsDir(bucket), latest.File), dataPath); err != nil {
+		return err
+	}
+	info, err := os.Stat(dataPath)
+	if err != nil {
+		return err
+	}
+	latest.File = ""
+	latest.DataModTime = info.ModTime()
+	return nil
+}
+
+// removeData removes a content file, ignoring files that don't exist
+func removeData(path string) error {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// prepareDataPath checks that a key's data path doesn't conflict with
+// existing objects, and creates its parent directories
+func (b *Backend) prepareDataPath(r *http.Request, bucket, key string) error {
+	dataPath := b.dataPath(bucket, key)
+	if isFolderKey(key) {
+		if err := os.MkdirAll(dataPath, 0755); err != nil {
+			return keyConflictError(r)
+		}
+		return nil
+	}
+	if info, err := os.Stat(dataPath); err == nil && info.IsDir() {
+		return keyConflictError(r)
+	}
+	if err := os.MkdirAll(filepath.Dir(dataPath), 0755); err != nil {
+		return keyConflictError(r)
+	}
+	return nil
+}
+
+// write installs staged content as a new version of a key, respecting the
+// bucket's versioning state, and returns the version ID that should be
+// reported to the client. If `stagedPath` is empty, a delete marker is
+// written instead. The backend's lock must be held.
+func (b *Backend) write(r *http.Request, bucket string, config *bucketConfig, key string, meta *objectMeta, v *versionMeta, stagedPath string) (string, error) {
+	if stagedPath != "" {
+		if err := b.prepareDataPath(r, bucket, key); err != nil {
+			return "", err
+		}
+	}
+
+	switch config.Versioning {
+	case s2.VersioningEnabled:
+		v.ID = newID()
+	case s2.VersioningSuspended:
+		v.ID = nullVersion
+		if i := meta.find(nullVersion); i >= 0 {
+			if err := b.discard(bucket, key, meta, meta.Versions[i]); err != nil {
+				return "", err
+			}
+			meta.remove(i)
+		}
+	default:
+		v.ID = nullVersion
+		for _, old := range meta.Versions {
+			if err := b.discard(bucket, key, meta, old); err != nil {
+				return "", err
+			}
+		}
+		meta.Versions = nil
+	}
+	if err := b.demote(bucket, key, meta); err != nil {
+		return "", err
+	}
+
+	dataPath := b.dataPath(bucket, key)
+	if stagedPath != "" && !isFolderKey(key) {
+		if err := os.Rename(stagedPath, dataPath); err != nil {
+			return "", err
+		}
+		info, err := os.Stat(dataPath)
+		if err != nil {
+			return "", err
+		}
+		v.DataModTime = info.ModTime()
+	} else if stagedPath != "" {
+		os.Remove(stagedPath)
+	}
+
+	if config.Versioning == s2.VersioningDisabled && v.DeleteMarker {
+		// without versioning, deletes don't leave anything behind
+		meta.Versions = nil
+		b.pruneData(bucket, key)
+	} else {
+		meta.Versions = append(meta.Versions, v)
+		if v.DeleteMarker {
+			b.pruneData(bucket, key)
+		}
+	}
+
+	if err := b.saveObject(bucket, key, meta); err != nil {
+		return "", err
+	}
+	if config.Versioning == s2.VersioningDisabled {
+		return "", nil
+	}
+	return v.ID, nil
+}
+
+// pruneData removes a key's data path, if it's a now empty folder, and any
+// parent directories that are empty
+func (b *Backend) pruneData(bucket, key string) {
+	dataPath := b.dataPath(bucket, key)
+	if isFolderKey(key) {
+		removeEmptyDirs(dataPath, b.bucketDir(bucket))
+	} else {
+		removeEmptyDirs(filepath.Dir(dataPath), b.bucketDir(bucket))
+	}
+}
+
+// checkPreconditions checks write preconditions against the latest version
+// of a key
+func checkPreconditions(r *http.Request, meta *objectMeta, preconditions *s2.Preconditions) error {
+	latest := meta.latest()
+	if latest == nil || latest.DeleteMarker {
+		return preconditions.Check(r, false, "")
+	}
+	return preconditions.Check(r, true, latest.ETag)
+}
+
+// GetObject gets the latest version of an object, or a specific version.
+// The content is returned as an open file.
+func (b *Backend) GetObject(r *http.Request, name, key, versionID string) (*s2.GetObjectResult, error) {
+	if !validKey(key) {
+		return nil, s2.NoSuchKeyError(r)
+	}
+
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	config, err := b.bucket(r, name)
+	if err != nil {
+		return nil, err
+	}
+	meta, err := b.loadObject(name, key)
+	if err != nil {
+		return nil, err
+	}
+
+	var v *versionMeta
+	if versionID == "" {
+		v = meta.latest()
+		if v == nil {
+			return nil, s2.NoSuchKeyError(r)
+		}
+	} else {
+		i := meta.find(versionID)
+		if i < 0 {
+			return nil, s2.NoSuchVersionError(r)
+		}
+		v = meta.Versions[i]
+	}
+
+	result := s2.GetObjectResult{
+		ETag:         v.ETag,
+		DeleteMarker: v.DeleteMarker,
+		ModTime:      v.ModTime,
+		PartSizes:    v.PartSizes,
+	}
+	if config.Versioning != s2.VersioningDisabled {
+		result.Version = v.ID
+	}
+	if !v.DeleteMarker {
+		result.Content, err = b.open(name, key, meta, v)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &result, nil
+}
+
+// CopyObject copies the content of an object into a new object. The new
+// object gets a regular (non-multipart) ETag.
+func (b *Backend) CopyObject(r *http.Request, srcBucket, srcKey string, getResult *s2.GetObjectResult, destBucket, destKey string) (string, error) {
+	result, err := b.put(r, destBucket, destKey, getResult.Content, nil)
+	if err != nil {
+		return "", err
+	}
+	return result.Version, nil
+}
+
+// PutObject writes a new version of an object, checking `preconditions`
+// against the latest version
+func (b *Backend) PutObject(r *http.Request, name, key string, reader io.Reader, preconditions *s2.Preconditions) (*s2.PutObjectResult, error) {
+	return b.put(r, name, key, reader, preconditions)
+}
+
+// put stages content and installs it as a new version of a key
+func (b *Backend) put(r *http.Request, name, key string, reader io.Reader, preconditions *s2.Preconditions) (*s2.PutObjectResult, error) {
+	if !validKey(key) {
+		return nil, invalidKeyError(r)
+	}
+
+	stagedPath, etag, size, err := b.stage(reader)
+	if err != nil {
+		return nil, err
+	}
+	if isFolderKey(key) && size > 0 {
+		os.Remove(stagedPath)
+		return nil, s2.InvalidRequestError(r, "Objects with a trailing slash must be empty.")
+	}
+	v := &versionMeta{
+		ETag:    etag,
+		ModTime: now(),
+		Size:    size,
+	}
+
+	versionID, err := b.install(r, name, key, preconditions, v, stagedPath)
+	if err != nil {
+		os.Remove(stagedPath)
+		return nil, err
+	}
+	return &s2.PutObjectResult{
+		ETag:    v.ETag,
+		Version: versionID,
+	}, nil
+}
+
+// install writes staged content as a new version of a key, under the
+// backend's lock
+func (b *Backend) install(r *http.Request, name, key string, preconditions *s2.Preconditions, v *versionMeta, stagedPath string) (string, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	config, err := b.bucket(r, name)
+	if err != nil {
+		return "", err
+	}
+	meta, err := b.loadObject(name, key)
+	if err != nil {
+		return "", err
+	}
+	if err := checkPreconditions(r, meta, preconditions); err != nil {
+		return "", err
+	}
+	return b.write(r, name, config, key, meta, v, stagedPath)
+}
+
+// DeleteObject deletes an object. If no version is specified and
+// versioning is enabled or suspended, a delete marker is written instead,
+// as in S3. Deleting a specific version removes it permanently.
+func (b *Backend) DeleteObject(r *http.Request, name, key, versionID string) (*s2.DeleteObjectResult, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	config, err := b.bucket(r, name)
+	if err != nil {
+		return nil, err
+	}
+	if !validKey(key) {
+		// there can't be anything to delete
+		return &s2.DeleteObjectResult{Version: versionID}, nil
+	}
+	meta, err := b.loadObject(name, key)
+	if err != nil {
+		return nil, err
+	}
+
+	if versionID == "" {
+		versionID, err := b.write(r, name, config, key, meta, &versionMeta{
+			ModTime:      now(),
+			DeleteMarker: true,
+		}, "")
+		if err != nil {
+			return nil, err
+		}
+		return &s2.DeleteObjectResult{
+			Version:      versionID,
+			DeleteMarker: config.Versioning != s2.VersioningDisabled,
+		}, nil
+	}
+
+	// deleting a version that doesn't exist is a no-op
+	result := s2.DeleteObjectResult{Version: versionID}
+	i := meta.find(versionID)
+	if i < 0 {
+		return &result, nil
+	}
+	v := meta.Versions[i]
+	result.DeleteMarker = v.DeleteMarker
+	if err := b.discard(name, key, meta, v); err != nil {
+		return nil, err
+	}
+	meta.remove(i)
+	if err := b.promote(name, key, meta); err != nil {
+		return nil, err
+	}
+	if latest := meta.latest(); latest == nil || latest.DeleteMarker {
+		b.pruneData(name, key)
+	}
+	if err := b.saveObject(name, key, meta); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
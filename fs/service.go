@@ -0,0 +1,40 @@
+package fs
+
+import (
+	"io/ioutil"
+	"net/http"
+
+	"github.com/pachyderm/s2"
+)
+
+// ListBuckets lists the directories in the root, sorted by name
+func (b *Backend) ListBuckets(r *http.Request) (*s2.ListBucketsResult, error) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	infos, err := ioutil.ReadDir(b.root)
+	if err != nil {
+		return nil, err
+	}
+
+	owner := Owner
+	result := s2.ListBucketsResult{
+		Owner:   &owner,
+		Buckets: []*s2.Bucket{},
+	}
+	for _, info := range infos {
+		if !info.IsDir() || !validBucket(info.Name()) {
+			continue
+		}
+		config, err := b.bucket(r, info.Name())
+		if err != nil {
+			return nil, err
+		}
+		result.Buckets = append(result.Buckets, &s2.Bucket{
+			Name:         info.Name(),
+			CreationDate: config.Created,
+			BucketRegion: config.Region,
+		})
+	}
+	return &result, nil
+}
@@ -0,0 +1,182 @@
+package fs
+
+import (
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// errStopWalk is returned by walk visitors to end a walk early
+var errStopWalk = errors.New("stop walk")
+
+// dataEntry is an entry of a data directory
+type dataEntry struct {
+	key  string
+	info os.FileInfo
+}
+
+// walkData calls `visit` with the key of each file in a bucket's data
+// directory, in lexicographical key order, and with each directory that's a
+// folder object. Directories that can't contain keys with the given prefix,
+// or keys after `marker`, are pruned, as are directories that `skip`
+// returns true for. Symlinks to files are followed, but symlinks to
+// directories are skipped. `skip` is also consulted before each entry of a
+// directory, so that the remainder of a directory can be skipped once it's
+// been rolled up into a common prefix. If `visit` returns `errStopWalk`, the
+// walk ends without an error.
+func (b *Backend) walkData(bucket, prefix, marker string, skip func(dirKey string) bool, visit func(key string, info os.FileInfo) error) error {
+	err := b.walkDataDir(bucket, b.bucketDir(bucket), "", prefix, marker, skip, visit)
+	if err == errStopWalk {
+		return nil
+	}
+	return err
+}
+
+func (b *Backend) walkDataDir(bucket, dir, dirKey, prefix, marker string, skip func(string) bool, visit func(string, os.FileInfo) error) error {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	entries := make([]dataEntry, 0, len(infos))
+	for _, info := range infos {
+		if info.Mode()&os.ModeSymlink != 0 {
+			target, err := os.Stat(filepath.Join(dir, info.Name()))
+			if err != nil || target.IsDir() {
+				// dangling links are skipped, as are links to directories,
+				// which could otherwise form cycles
+				continue
+			}
+			info = target
+		}
+		key := dirKey + info.Name()
+		if info.IsDir() {
+			// directories are sorted with their trailing slash, so that
+			// e.g. `a/b` sorts after `a-b`, as it does in S3
+			key += "/"
+		} else if !info.Mode().IsRegular() {
+			continue
+		}
+		if !validKey(key) {
+			continue
+		}
+		entries = append(entries, dataEntry{key: key, info: info})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].key < entries[j].key
+	})
+
+	for _, entry := range entries {
+		if dirKey != "" && skip(dirKey) {
+			return nil
+		}
+		if !entry.info.IsDir() {
+			if err := visit(entry.key, entry.info); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if !strings.HasPrefix(entry.key, prefix) && !strings.HasPrefix(prefix, entry.key) {
+			continue
+		}
+		if entry.key < marker && !strings.HasPrefix(marker, entry.key) {
+			// everything in the directory sorts before the marker
+			continue
+		}
+		if skip(entry.key) {
+			continue
+		}
+		if _, err := os.Stat(b.metaPath(bucket, entry.key)); err == nil {
+			if err := visit(entry.key, entry.info); err != nil {
+				return err
+			}
+		}
+		if err := b.walkDataDir(bucket, filepath.Join(dir, entry.info.Name()), entry.key, prefix, marker, skip, visit); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// metaEntry is an entry of a metadata directory
+type metaEntry struct {
+	// encoded is the hex-encoded portion of the key that the entry adds
+	encoded string
+	isDir   bool
+}
+
+// walkMeta calls `visit` with each key that has metadata in a bucket, in
+// lexicographical key order. This includes keys whose content has been
+// deleted, but that still have versions or delete markers. Directories
+// that can't contain keys with the given prefix, or keys after `marker`,
+// are pruned. If `visit` returns `errStopWalk`, the walk ends without an
+// error.
+func (b *Backend) walkMeta(bucket, prefix, marker string, visit func(key string) error) error {
+	prefix = hex.EncodeToString([]byte(prefix))
+	marker = hex.EncodeToString([]byte(marker))
+	err := b.walkMetaDir(b.metaDir(bucket), "", prefix, marker, visit)
+	if err == errStopWalk {
+		return nil
+	}
+	return err
+}
+
+func (b *Backend) walkMetaDir(dir, encodedDir, prefix, marker string, visit func(string) error) error {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	entries := make([]metaEntry, 0, len(infos))
+	for _, info := range infos {
+		if info.IsDir() {
+			entries = append(entries, metaEntry{encoded: info.Name(), isDir: true})
+		} else if strings.HasSuffix(info.Name(), ".json") {
+			entries = append(entries, metaEntry{encoded: strings.TrimSuffix(info.Name(), ".json")})
+		}
+	}
+	// hex encoding preserves lexicographical order, and a key sorts before
+	// the longer keys in the directory of the same name
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].encoded != entries[j].encoded {
+			return entries[i].encoded < entries[j].encoded
+		}
+		return !entries[i].isDir
+	})
+
+	for _, entry := range entries {
+		encoded := encodedDir + entry.encoded
+		if !entry.isDir {
+			key, err := hex.DecodeString(encoded)
+			if err != nil {
+				continue
+			}
+			if err := visit(string(key)); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if !strings.HasPrefix(encoded, prefix) && !strings.HasPrefix(prefix, encoded) {
+			continue
+		}
+		if encoded < marker && !strings.HasPrefix(marker, encoded) {
+			continue
+		}
+		if err := b.walkMetaDir(filepath.Join(dir, entry.encoded), encoded, prefix, marker, visit); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,250 @@
+// Package signing implements the building blocks of AWS' auth V2 and V4
+// request signing algorithms. They're shared by s2, which verifies
+// signatures, and its client, which creates them, so that both sides of a
+// signature are computed the same way.
+package signing
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+const (
+	// TimeFormat specifies the time format used in AWS requests
+	TimeFormat = "20060102T150405Z"
+	// StreamingPayload is the `x-amz-content-sha256` value of requests
+	// whose body is signed chunk by chunk
+	StreamingPayload = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+	// UnsignedPayload is the `x-amz-content-sha256` value of requests whose
+	// body isn't signed
+	UnsignedPayload = "UNSIGNED-PAYLOAD"
+
+	// emptySHA256 is the hex-encoded SHA256 hash of an empty string
+	emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+// subresourceQueryParams is a list of query parameters that are considered
+// queries for "subresources" in S3. They're part of the resource that's
+// signed with auth V2.
+var subresourceQueryParams = []string{
+	"acl",
+	"lifecycle",
+	"location",
+	"logging",
+	"notification",
+	"partNumber",
+	"policy",
+	"requestPayment",
+	"response-cache-control",
+	"response-content-disposition",
+	"response-content-encoding",
+	"response-content-language",
+	"response-content-type",
+	"response-expires",
+	"torrent",
+	"uploadId",
+	"uploads",
+	"versionId",
+	"versioning",
+	"versions",
+}
+
+// V2StringToSign constructs the string to sign for a request using auth
+// V2. `date` is the request's timestamp, formatted as RFC1123.
+func V2StringToSign(r *http.Request, date string) string {
+	amzHeaderKeys := []string{}
+	for key := range r.Header {
+		key = strings.ToLower(key)
+		if strings.HasPrefix(key, "x-amz-") {
+			amzHeaderKeys = append(amzHeaderKeys, key)
+		}
+	}
+	sort.Strings(amzHeaderKeys)
+
+	stringToSignParts := []string{
+		r.Method,
+		r.Header.Get("content-md5"),
+		r.Header.Get("content-type"),
+		date,
+	}
+
+	for _, key := range amzHeaderKeys {
+		// NOTE: this doesn't properly handle multiple header values, or
+		// header values with repeated whitespace characters
+		value := fmt.Sprintf("%s:%s", key, strings.TrimSpace(r.Header.Get(key)))
+		stringToSignParts = append(stringToSignParts, value)
+	}
+
+	var canonicalizedResource strings.Builder
+	canonicalizedResource.WriteString(r.URL.Path)
+	query := r.URL.Query()
+	appendedQuery := false
+	for _, k := range subresourceQueryParams {
+		_, ok := query[k]
+		if ok {
+			if appendedQuery {
+				canonicalizedResource.WriteString("&")
+			} else {
+				canonicalizedResource.WriteString("?")
+				appendedQuery = true
+			}
+
+			canonicalizedResource.WriteString(k)
+
+			value := query.Get(k)
+			if value != "" {
+				// NOTE: this doesn't properly handle multiple query params
+				canonicalizedResource.WriteString("=")
+				canonicalizedResource.WriteString(value)
+			}
+		}
+	}
+	stringToSignParts = append(stringToSignParts, canonicalizedResource.String())
+
+	return strings.Join(stringToSignParts, "\n")
+}
+
+// V4CanonicalRequest constructs the canonical request for a request using
+// auth V4. `signedHeaderKeys` must be lowercase and sorted.
+func V4CanonicalRequest(r *http.Request, signedHeaderKeys []string) string {
+	var signedHeaders strings.Builder
+	for _, key := range signedHeaderKeys {
+		signedHeaders.WriteString(key)
+		signedHeaders.WriteString(":")
+		if key == "host" {
+			host := r.Host
+			if host == "" {
+				host = r.URL.Host
+			}
+			signedHeaders.WriteString(host)
+		} else {
+			signedHeaders.WriteString(strings.TrimSpace(r.Header.Get(key)))
+		}
+		signedHeaders.WriteString("\n")
+	}
+
+	return strings.Join([]string{
+		r.Method,
+		NormURI(r.URL.Path),
+		NormQuery(r.URL.Query()),
+		signedHeaders.String(),
+		strings.Join(signedHeaderKeys, ";"),
+		r.Header.Get("x-amz-content-sha256"),
+	}, "\n")
+}
+
+// V4StringToSign constructs the string to sign for a request using auth
+// V4. `timestamp` is formatted with `TimeFormat`.
+func V4StringToSign(timestamp, date, region, canonicalRequest string) string {
+	return fmt.Sprintf(
+		"AWS4-HMAC-SHA256\n%s\n%s/%s/s3/aws4_request\n%x",
+		timestamp,
+		date,
+		region,
+		sha256.Sum256([]byte(canonicalRequest)),
+	)
+}
+
+// V4SigningKey calculates the key that auth V4 signatures are created with
+func V4SigningKey(secretKey, date, region string) []byte {
+	dateKey := HMACSHA256([]byte("AWS4"+secretKey), date)
+	dateRegionKey := HMACSHA256(dateKey, region)
+	dateRegionServiceKey := HMACSHA256(dateRegionKey, "s3")
+	return HMACSHA256(dateRegionServiceKey, "aws4_request")
+}
+
+// ChunkStringToSign constructs the string to sign for a chunk of a
+// streaming auth V4 upload. Each chunk's signature chains off of the
+// previous one, starting with the signature of the request itself.
+func ChunkStringToSign(timestamp, date, region, previousSignature string, chunk []byte) string {
+	return fmt.Sprintf(
+		"AWS4-HMAC-SHA256-PAYLOAD\n%s\n%s/%s/s3/aws4_request\n%s\n%s\n%x",
+		timestamp,
+		date,
+		region,
+		previousSignature,
+		emptySHA256,
+		sha256.Sum256(chunk),
+	)
+}
+
+// NormURI normalizes a URI using AWS' technique
+func NormURI(uri string) string {
+	parts := strings.Split(uri, "/")
+	for i := range parts {
+		parts[i] = encodePathFrag(parts[i])
+	}
+	return strings.Join(parts, "/")
+}
+
+// encodePathFrag encodes a fragment of a path in a URL using AWS' technique
+func encodePathFrag(s string) string {
+	hexCount := 0
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if shouldEscape(c) {
+			hexCount++
+		}
+	}
+	t := make([]byte, len(s)+2*hexCount)
+	j := 0
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if shouldEscape(c) {
+			t[j] = '%'
+			t[j+1] = "0123456789ABCDEF"[c>>4]
+			t[j+2] = "0123456789ABCDEF"[c&15]
+			j += 3
+		} else {
+			t[j] = c
+			j++
+		}
+	}
+	return string(t)
+}
+
+// shouldEscape returns whether a character should be escaped under AWS' URL
+// encoding
+func shouldEscape(c byte) bool {
+	if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' {
+		return false
+	}
+	if '0' <= c && c <= '9' {
+		return false
+	}
+	if c == '-' || c == '_' || c == '.' || c == '~' {
+		return false
+	}
+	return true
+}
+
+// NormQuery normalizes query string values using AWS' technique
+func NormQuery(v url.Values) string {
+	queryString := v.Encode()
+
+	// Go encodes a space as '+' but Amazon requires '%20'. Luckily any '+' in the
+	// original query string has been percent escaped so all '+' chars that are left
+	// were originally spaces.
+
+	return strings.Replace(queryString, "+", "%20", -1)
+}
+
+// HMACSHA1 computes HMAC with SHA1
+func HMACSHA1(key []byte, content string) []byte {
+	mac := hmac.New(sha1.New, key)
+	mac.Write([]byte(content))
+	return mac.Sum(nil)
+}
+
+// HMACSHA256 computes HMAC with SHA256
+func HMACSHA256(key []byte, content string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(content))
+	return mac.Sum(nil)
+}
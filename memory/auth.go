@@ -0,0 +1,23 @@
+package memory
+
+import (
+	"net/http"
+)
+
+// SecretKey looks up the secret key of credentials added via
+// `AddCredentials`
+func (b *Backend) SecretKey(r *http.Request, accessKey string, region *string) (*string, error) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	secretKey, ok := b.credentials[accessKey]
+	if !ok {
+		return nil, nil
+	}
+	return &secretKey, nil
+}
+
+// CustomAuth allows unsigned requests if `AllowAnonymous` is set
+func (b *Backend) CustomAuth(r *http.Request) (bool, error) {
+	return b.AllowAnonymous, nil
+}
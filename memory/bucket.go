@@ -0,0 +1,313 @@
+package memory
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/pachyderm/s2"
+)
+
+// GetLocation gets the region a bucket was created in
+func (b *Backend) GetLocation(r *http.Request, name string) (string, error) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	bucket, err := b.bucket(r, name)
+	if err != nil {
+		return "", err
+	}
+	return bucket.region, nil
+}
+
+// HeadBucket checks that a bucket exists, and reports its region
+func (b *Backend) HeadBucket(r *http.Request, name string) (*s2.HeadBucketResult, error) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	bucket, err := b.bucket(r, name)
+	if err != nil {
+		return nil, err
+	}
+	return &s2.HeadBucketResult{Region: bucket.region}, nil
+}
+
+// commonPrefix returns the common prefix that a key is rolled up into, or an
+// empty string if it isn't rolled up.
+func commonPrefix(key, prefix, delimiter string) string {
+	if delimiter == "" {
+		return ""
+	}
+	i := strings.Index(key[len(prefix):], delimiter)
+	if i < 0 {
+		return ""
+	}
+	return key[:len(prefix)+i+len(delimiter)]
+}
+
+// ListObjects lists the latest versions of objects, skipping those whose
+// latest version is a delete marker
+func (b *Backend) ListObjects(r *http.Request, name, prefix, marker, delimiter string, maxKeys int) (*s2.ListObjectsResult, error) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	bucket, err := b.bucket(r, name)
+	if err != nil {
+		return nil, err
+	}
+
+	result := s2.ListObjectsResult{
+		Contents:       []*s2.Contents{},
+		CommonPrefixes: []*s2.CommonPrefixes{},
+	}
+	lastPrefix := ""
+
+	for _, key := range bucket.sortedKeys() {
+		if key <= marker || !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		latest := bucket.latest(key)
+		if latest.deleteMarker {
+			continue
+		}
+
+		if cp := commonPrefix(key, prefix, delimiter); cp != "" {
+			if cp <= marker || cp == lastPrefix {
+				continue
+			}
+			if len(result.Contents)+len(result.CommonPrefixes) >= maxKeys {
+				result.IsTruncated = maxKeys > 0
+				break
+			}
+			result.CommonPrefixes = append(result.CommonPrefixes, &s2.CommonPrefixes{
+				Prefix: cp,
+				Owner:  Owner,
+			})
+			lastPrefix = cp
+			continue
+		}
+
+		if len(result.Contents)+len(result.CommonPrefixes) >= maxKeys {
+			result.IsTruncated = maxKeys > 0
+			break
+		}
+		result.Contents = append(result.Contents, &s2.Contents{
+			Key:          key,
+			LastModified: latest.modTime,
+			ETag:         latest.etag,
+			Size:         uint64(len(latest.content)),
+			StorageClass: StorageClass,
+			Owner:        Owner,
+		})
+	}
+
+	return &result, nil
+}
+
+// ListObjectVersions lists all versions and delete markers, ordered by key,
+// then newest first. Since the result can't express common prefixes, keys
+// that would be rolled up by the delimiter are omitted.
+func (b *Backend) ListObjectVersions(r *http.Request, name, prefix, keyMarker, versionMarker string, delimiter string, maxKeys int) (*s2.ListObjectVersionsResult, error) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	bucket, err := b.bucket(r, name)
+	if err != nil {
+		return nil, err
+	}
+
+	result := s2.ListObjectVersionsResult{
+		Versions:      []*s2.Version{},
+		DeleteMarkers: []*s2.DeleteMarker{},
+	}
+
+	for _, key := range bucket.sortedKeys() {
+		if key < keyMarker || !strings.HasPrefix(key, prefix) || commonPrefix(key, prefix, delimiter) != "" {
+			continue
+		}
+
+		versions := bucket.objects[key]
+		start := len(versions) - 1
+		if key == keyMarker {
+			// S3 resumes after the version marker, or after the whole key
+			// if there isn't one
+			start = -1
+			if versionMarker != "" {
+				if i := bucket.find(key, versionMarker); i >= 0 {
+					start = i - 1
+				}
+			}
+		}
+
+		for i := start; i >= 0; i-- {
+			if len(result.Versions)+len(result.DeleteMarkers) >= maxKeys {
+				result.IsTruncated = maxKeys > 0
+				return &result, nil
+			}
+
+			v := versions[i]
+			if v.deleteMarker {
+				result.DeleteMarkers = append(result.DeleteMarkers, &s2.DeleteMarker{
+					Key:          key,
+					Version:      v.id,
+					IsLatest:     i == len(versions)-1,
+					LastModified: v.modTime,
+					Owner:        Owner,
+				})
+			} else {
+				result.Versions = append(result.Versions, &s2.Version{
+					Key:          key,
+					Version:      v.id,
+					IsLatest:     i == len(versions)-1,
+					LastModified: v.modTime,
+					ETag:         v.etag,
+					Size:         uint64(len(v.content)),
+					StorageClass: StorageClass,
+					Owner:        Owner,
+				})
+			}
+			result.NextKeyMarker = key
+			result.NextVersionIDMarker = v.id
+		}
+	}
+
+	return &result, nil
+}
+
+// CreateBucket creates a bucket in the requested region, or `DefaultRegion`
+func (b *Backend) CreateBucket(r *http.Request, name string, options *s2.CreateBucketOptions) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if _, ok := b.buckets[name]; ok {
+		return s2.BucketAlreadyOwnedByYouError(r)
+	}
+
+	region := DefaultRegion
+	if options != nil && options.LocationConstraint != "" {
+		region = options.LocationConstraint
+	}
+
+	b.buckets[name] = &bucket{
+		name:    name,
+		region:  region,
+		created: now(),
+		objects: map[string][]*version{},
+		uploads: map[string]*upload{},
+	}
+	return nil
+}
+
+// DeleteBucket deletes a bucket, which must not have any object versions or
+// in-progress multipart uploads
+func (b *Backend) DeleteBucket(r *http.Request, name string) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	bucket, err := b.bucket(r, name)
+	if err != nil {
+		return err
+	}
+	if len(bucket.objects) > 0 || len(bucket.uploads) > 0 {
+		return s2.BucketNotEmptyError(r)
+	}
+
+	delete(b.buckets, name)
+	return nil
+}
+
+// GetBucketVersioning gets the versioning state of a bucket
+func (b *Backend) GetBucketVersioning(r *http.Request, name string) (string, error) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	bucket, err := b.bucket(r, name)
+	if err != nil {
+		return "", err
+	}
+	return bucket.versioning, nil
+}
+
+// SetBucketVersioning sets the versioning state of a bucket. As with S3,
+// versioning can only be suspended, not disabled, once it's been enabled.
+func (b *Backend) SetBucketVersioning(r *http.Request, name, status string) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	bucket, err := b.bucket(r, name)
+	if err != nil {
+		return err
+	}
+	if status == s2.VersioningDisabled && bucket.versioning != s2.VersioningDisabled {
+		return s2.IllegalVersioningConfigurationError(r)
+	}
+
+	bucket.versioning = status
+	return nil
+}
+
+// GetBucketEncryption gets the default encryption of a bucket, or nil if
+// there is none
+func (b *Backend) GetBucketEncryption(r *http.Request, name string) (*s2.BucketEncryption, error) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	bucket, err := b.bucket(r, name)
+	if err != nil {
+		return nil, err
+	}
+	return bucket.encryption, nil
+}
+
+// SetBucketEncryption sets the default encryption of a bucket
+func (b *Backend) SetBucketEncryption(r *http.Request, name string, config *s2.BucketEncryption) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	bucket, err := b.bucket(r, name)
+	if err != nil {
+		return err
+	}
+	bucket.encryption = config
+	return nil
+}
+
+// DeleteBucketEncryption removes the default encryption of a bucket
+func (b *Backend) DeleteBucketEncryption(r *http.Request, name string) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	bucket, err := b.bucket(r, name)
+	if err != nil {
+		return err
+	}
+	bucket.encryption = nil
+	return nil
+}
+
+// GetBucketNotification gets the notification configuration of a bucket
+func (b *Backend) GetBucketNotification(r *http.Request, name string) (*s2.NotificationConfiguration, error) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	bucket, err := b.bucket(r, name)
+	if err != nil {
+		return nil, err
+	}
+	if bucket.notification == nil {
+		return &s2.NotificationConfiguration{}, nil
+	}
+	return bucket.notification, nil
+}
+
+// SetBucketNotification sets the notification configuration of a bucket
+func (b *Backend) SetBucketNotification(r *http.Request, name string, config *s2.NotificationConfiguration) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	bucket, err := b.bucket(r, name)
+	if err != nil {
+		return err
+	}
+	bucket.notification = config
+	return nil
+}
@@ -0,0 +1,231 @@
+// Package memory is a reference implementation of the s2 controllers that
+// keeps everything in memory. It aims to faithfully reproduce S3's
+// semantics - versioning, delete markers, pagination and multipart uploads
+// - so that it can back unit tests via `httptest`, e.g.:
+//
+//	backend := memory.New()
+//	server := httptest.NewServer(backend.S2(logger).Router())
+//
+// All data is lost when the backend is garbage collected.
+package memory
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pachyderm/s2"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultRegion is the region buckets are created in if no location
+	// constraint is specified
+	DefaultRegion = "us-east-1"
+	// StorageClass is the storage class reported for all objects
+	StorageClass = "STANDARD"
+	// nullVersion is the version ID S3 gives to objects written while
+	// versioning is suspended
+	nullVersion = "null"
+)
+
+// Owner is the user reported as the owner of all buckets, objects and
+// uploads
+var Owner = s2.User{
+	ID:          "memory",
+	DisplayName: "memory",
+}
+
+// version is a single version of an object, or a delete marker
+type version struct {
+	id           string
+	etag         string
+	modTime      time.Time
+	content      []byte
+	deleteMarker bool
+	partSizes    []int64
+}
+
+// part is an uploaded part of a multipart upload
+type part struct {
+	etag    string
+	modTime time.Time
+	content []byte
+}
+
+// upload is an in-progress multipart upload
+type upload struct {
+	id        string
+	key       string
+	initiated time.Time
+	parts     map[int]*part
+}
+
+// bucket is a bucket and all of its contents
+type bucket struct {
+	name         string
+	region       string
+	created      time.Time
+	versioning   string
+	encryption   *s2.BucketEncryption
+	notification *s2.NotificationConfiguration
+	// objects maps keys to their versions, oldest first
+	objects map[string][]*version
+	uploads map[string]*upload
+}
+
+// latest returns the latest version of the given key, or nil if the key has
+// no versions.
+func (b *bucket) latest(key string) *version {
+	versions := b.objects[key]
+	if len(versions) == 0 {
+		return nil
+	}
+	return versions[len(versions)-1]
+}
+
+// find returns the index of the given version of a key, or -1 if it doesn't
+// exist.
+func (b *bucket) find(key, id string) int {
+	for i, v := range b.objects[key] {
+		if v.id == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// remove deletes the version of a key at the given index.
+func (b *bucket) remove(key string, i int) {
+	versions := b.objects[key]
+	versions = append(versions[:i:i], versions[i+1:]...)
+	if len(versions) == 0 {
+		delete(b.objects, key)
+	} else {
+		b.objects[key] = versions
+	}
+}
+
+// write stores a new version of a key, respecting the bucket's versioning
+// state. It returns the version ID that should be reported to the client.
+func (b *bucket) write(key string, v *version) string {
+	switch b.versioning {
+	case s2.VersioningEnabled:
+		v.id = newID()
+		b.objects[key] = append(b.objects[key], v)
+		return v.id
+	case s2.VersioningSuspended:
+		if i := b.find(key, nullVersion); i >= 0 {
+			b.remove(key, i)
+		}
+		v.id = nullVersion
+		b.objects[key] = append(b.objects[key], v)
+		return v.id
+	default:
+		v.id = nullVersion
+		b.objects[key] = []*version{v}
+		return ""
+	}
+}
+
+// sortedKeys returns the keys of the bucket's objects, in lexicographical
+// order.
+func (b *bucket) sortedKeys() []string {
+	keys := make([]string, 0, len(b.objects))
+	for key := range b.objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Backend is an in-memory S3 backend. It implements `s2.ServiceController`,
+// `s2.BucketController`, `s2.HeadBucketController`, `s2.ObjectController`,
+// `s2.MultipartController`, `s2.EncryptionController`,
+// `s2.NotificationController` and `s2.AuthController`. It's safe for
+// concurrent use.
+type Backend struct {
+	// AllowAnonymous specifies whether requests that aren't signed with
+	// AWS' auth V2 or V4 are allowed
+	AllowAnonymous bool
+
+	// lock protects all of the state below. Request bodies are always read
+	// before it's acquired, so it's only held briefly.
+	lock        sync.RWMutex
+	buckets     map[string]*bucket
+	credentials map[string]string
+	// uploadSeq is used to generate upload IDs that sort in the order the
+	// uploads were initiated
+	uploadSeq uint64
+}
+
+// New creates a new, empty in-memory backend.
+func New() *Backend {
+	return &Backend{
+		buckets:     map[string]*bucket{},
+		credentials: map[string]string{},
+	}
+}
+
+// AddCredentials registers an access key/secret key pair that requests can
+// be signed with.
+func (b *Backend) AddCredentials(accessKey, secretKey string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.credentials[accessKey] = secretKey
+}
+
+// S2 creates an s2 instance that's backed by this backend. Requests must
+// be signed with credentials added via `AddCredentials`, unless
+// `AllowAnonymous` is set.
+func (b *Backend) S2(logger *logrus.Entry) *s2.S2 {
+	s := s2.NewS2(logger, 0, 5*time.Second)
+	s.Auth = b
+	s.Service = b
+	s.Bucket = b
+	s.Object = b
+	s.Multipart = b
+	s.Encryption = b
+	s.Notification = b
+	return s
+}
+
+// now returns the current time, rounded to S3's millisecond precision
+func now() time.Time {
+	return time.Now().UTC().Round(time.Millisecond)
+}
+
+// bucket gets a bucket by name. The backend's lock must be held.
+func (b *Backend) bucket(r *http.Request, name string) (*bucket, error) {
+	bucket, ok := b.buckets[name]
+	if !ok {
+		return nil, s2.NoSuchBucketError(r)
+	}
+	return bucket, nil
+}
+
+// newUploadID generates a new upload ID. The backend's lock must be held.
+func (b *Backend) newUploadID() string {
+	b.uploadSeq++
+	return fmt.Sprintf("%016x%s", b.uploadSeq, newID()[:16])
+}
+
+// newID generates a random ID
+func newID() string {
+	var buf [16]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		panic(fmt.Sprintf("could not generate random ID: %v", err))
+	}
+	return hex.EncodeToString(buf[:])
+}
+
+// etag computes the ETag of non-multipart content
+func etag(content []byte) string {
+	sum := md5.Sum(content)
+	return hex.EncodeToString(sum[:])
+}
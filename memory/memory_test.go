@@ -0,0 +1,175 @@
+package memory
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/pachyderm/s2"
+	"github.com/pachyderm/s2/client"
+	"github.com/pachyderm/s2/s2test"
+	"github.com/sirupsen/logrus"
+)
+
+func TestConformance(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	s2test.RunConformance(t, func() *s2.S2 {
+		return New().S2(logrus.NewEntry(logger))
+	})
+}
+
+func TestNotifications(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	keyFile, err := ioutil.TempFile("", "s2-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(keyFile.Name())
+	if _, err := keyFile.WriteString(strings.Repeat("00", 32)); err != nil {
+		t.Fatal(err)
+	}
+	keyFile.Close()
+	keys, err := s2.NewFileKeyProvider("key", keyFile.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	backend := New()
+	backend.AddCredentials("access", "secret")
+	sink := make(s2.ChannelSink, 10)
+	s := backend.S2(logrus.NewEntry(logger))
+	s.KeyProvider = keys
+	s.Events = s2.NewEventDispatcher(logrus.NewEntry(logger))
+	s.Events.RegisterSink("arn:s2:sink", sink)
+	server := httptest.NewServer(s.Router())
+	defer server.Close()
+
+	c := client.New(server.URL, client.Credentials{AccessKey: "access", SecretKey: "secret", Region: "us-east-1"})
+	do := func(method, path string, query url.Values, header http.Header, body string) *client.Response {
+		t.Helper()
+		res, err := c.Do(method, path, query, header, []byte(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("%s %s failed with status %d: %s", method, path, res.StatusCode, res.Body)
+		}
+		return res
+	}
+	expectEvent := func(name, key string, size int64) {
+		t.Helper()
+		s.Events.Wait()
+		select {
+		case event := <-sink:
+			object := event.Records[0].S3.Object
+			if event.Records[0].EventName != name || object.Key != key || object.Size != size {
+				t.Fatalf("expected %s of %s with size %d, got %s of %s with size %d", name, key, size, event.Records[0].EventName, object.Key, object.Size)
+			}
+		default:
+			t.Fatalf("expected %s of %s", name, key)
+		}
+	}
+
+	do("PUT", "/bucket", nil, nil, "")
+	do("PUT", "/bucket", url.Values{"notification": {""}}, nil, `<NotificationConfiguration>
+		<QueueConfiguration>
+			<Queue>arn:s2:sink</Queue>
+			<Event>s3:ObjectCreated:*</Event>
+			<Filter><S3Key><FilterRule><Name>suffix</Name><Value>.txt</Value></FilterRule></S3Key></Filter>
+		</QueueConfiguration>
+	</NotificationConfiguration>`)
+
+	do("PUT", "/bucket/a.txt", nil, nil, "hello")
+	expectEvent("ObjectCreated:Put", "a.txt", 5)
+	do("PUT", "/bucket/a.bin", nil, nil, "hello")
+
+	// sizes exclude encryption overhead
+	encrypted := http.Header{"x-amz-server-side-encryption": {s2.SSEAlgorithmAES256}}
+	do("PUT", "/bucket/b.txt", nil, http.Header{"x-amz-copy-source": {"/bucket/a.txt"}, "x-amz-server-side-encryption": {s2.SSEAlgorithmAES256}}, "")
+	expectEvent("ObjectCreated:Copy", "b.txt", 5)
+
+	var upload struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := do("POST", "/bucket/c.txt", url.Values{"uploads": {""}}, nil, "").Decode(&upload); err != nil {
+		t.Fatal(err)
+	}
+	etag := do("PUT", "/bucket/c.txt", url.Values{"uploadId": {upload.UploadID}, "partNumber": {"1"}}, encrypted, "hello world").Header.Get("ETag")
+	do("POST", "/bucket/c.txt", url.Values{"uploadId": {upload.UploadID}}, nil, fmt.Sprintf(`<CompleteMultipartUpload><Part><PartNumber>1</PartNumber><ETag>%s</ETag></Part></CompleteMultipartUpload>`, etag))
+	expectEvent("ObjectCreated:CompleteMultipartUpload", "c.txt", 11)
+
+	s.Events.Wait()
+	if len(sink) != 0 {
+		t.Fatalf("expected no more events, got %+v", <-sink)
+	}
+}
+
+func TestValidateEncryptedMultipart(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	backend := New()
+	backend.AddCredentials("access", "secret")
+	s := backend.S2(logrus.NewEntry(logger))
+	s.ValidateMultipart = true
+	server := httptest.NewServer(s.Router())
+	defer server.Close()
+
+	c := client.New(server.URL, client.Credentials{AccessKey: "access", SecretKey: "secret", Region: "us-east-1"})
+	do := func(method, path string, query url.Values, header http.Header, body []byte) *client.Response {
+		t.Helper()
+		res, err := c.Do(method, path, query, header, body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	customerKey := bytes.Repeat([]byte{1}, 32)
+	sum := md5.Sum(customerKey)
+	encrypted := http.Header{
+		"x-amz-server-side-encryption-customer-algorithm": {"AES256"},
+		"x-amz-server-side-encryption-customer-key":       {base64.StdEncoding.EncodeToString(customerKey)},
+		"x-amz-server-side-encryption-customer-key-MD5":   {base64.StdEncoding.EncodeToString(sum[:])},
+	}
+	do("PUT", "/bucket", nil, nil, nil)
+
+	// parts are checked by their plaintext size, though the overhead of
+	// encryption takes the stored size of the first part over the minimum
+	complete := func(firstSize int) *client.Response {
+		t.Helper()
+		var upload struct {
+			UploadID string `xml:"UploadId"`
+		}
+		if err := do("POST", "/bucket/key", url.Values{"uploads": {""}}, encrypted, nil).Decode(&upload); err != nil {
+			t.Fatal(err)
+		}
+		var body bytes.Buffer
+		body.WriteString("<CompleteMultipartUpload>")
+		for i, size := range []int{firstSize, 1} {
+			query := url.Values{"uploadId": {upload.UploadID}, "partNumber": {fmt.Sprint(i + 1)}}
+			etag := do("PUT", "/bucket/key", query, encrypted, bytes.Repeat([]byte("a"), size)).Header.Get("ETag")
+			fmt.Fprintf(&body, "<Part><PartNumber>%d</PartNumber><ETag>%s</ETag></Part>", i+1, etag)
+		}
+		body.WriteString("</CompleteMultipartUpload>")
+		return do("POST", "/bucket/key", url.Values{"uploadId": {upload.UploadID}}, nil, body.Bytes())
+	}
+	if err := complete(5<<20 - 1).Err(); err == nil || err.Code != "EntityTooSmall" {
+		t.Fatalf("expected EntityTooSmall, got %v", err)
+	}
+	if err := complete(5 << 20).Err(); err != nil {
+		t.Fatalf("expected the upload to complete, got %v", err)
+	}
+}
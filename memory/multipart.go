@@ -0,0 +1,280 @@
+package memory
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/pachyderm/s2"
+)
+
+// minPartSize is the minimum size of all but the last part of a multipart
+// upload
+const minPartSize = 5 * 1024 * 1024
+
+// upload gets an in-progress multipart upload. The backend's lock must be
+// held.
+func (b *Backend) upload(r *http.Request, name, key, uploadID string) (*bucket, *upload, error) {
+	bucket, err := b.bucket(r, name)
+	if err != nil {
+		return nil, nil, err
+	}
+	upload, ok := bucket.uploads[uploadID]
+	if !ok || upload.key != key {
+		return nil, nil, s2.NoSuchUploadError(r)
+	}
+	return bucket, upload, nil
+}
+
+// ListMultipart lists in-progress multipart uploads, ordered by key, then
+// by when they were initiated
+func (b *Backend) ListMultipart(r *http.Request, name, prefix, keyMarker, uploadIDMarker, delimiter string, maxUploads int) (*s2.ListMultipartResult, error) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	bucket, err := b.bucket(r, name)
+	if err != nil {
+		return nil, err
+	}
+
+	// upload IDs sort in the order the uploads were initiated
+	uploads := make([]*upload, 0, len(bucket.uploads))
+	for _, upload := range bucket.uploads {
+		uploads = append(uploads, upload)
+	}
+	sort.Slice(uploads, func(i, j int) bool {
+		if uploads[i].key != uploads[j].key {
+			return uploads[i].key < uploads[j].key
+		}
+		return uploads[i].id < uploads[j].id
+	})
+
+	result := s2.ListMultipartResult{
+		Uploads:        []*s2.Upload{},
+		CommonPrefixes: []*s2.CommonPrefixes{},
+	}
+	lastPrefix := ""
+
+	for _, upload := range uploads {
+		if !strings.HasPrefix(upload.key, prefix) || upload.key < keyMarker {
+			continue
+		}
+		// without an upload ID marker, S3 resumes after the whole key
+		if upload.key == keyMarker && (uploadIDMarker == "" || upload.id <= uploadIDMarker) {
+			continue
+		}
+
+		if cp := commonPrefix(upload.key, prefix, delimiter); cp != "" {
+			if cp <= keyMarker || cp == lastPrefix {
+				continue
+			}
+			if len(result.Uploads)+len(result.CommonPrefixes) >= maxUploads {
+				result.IsTruncated = maxUploads > 0
+				break
+			}
+			result.CommonPrefixes = append(result.CommonPrefixes, &s2.CommonPrefixes{
+				Prefix: cp,
+				Owner:  Owner,
+			})
+			result.NextKeyMarker = cp
+			result.NextUploadIDMarker = ""
+			lastPrefix = cp
+			continue
+		}
+
+		if len(result.Uploads)+len(result.CommonPrefixes) >= maxUploads {
+			result.IsTruncated = maxUploads > 0
+			break
+		}
+		result.Uploads = append(result.Uploads, &s2.Upload{
+			Key:          upload.key,
+			UploadID:     upload.id,
+			Initiator:    Owner,
+			Owner:        Owner,
+			StorageClass: StorageClass,
+			Initiated:    upload.initiated,
+		})
+		result.NextKeyMarker = upload.key
+		result.NextUploadIDMarker = upload.id
+	}
+
+	return &result, nil
+}
+
+// InitMultipart starts a new multipart upload
+func (b *Backend) InitMultipart(r *http.Request, name, key string) (string, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	bucket, err := b.bucket(r, name)
+	if err != nil {
+		return "", err
+	}
+
+	upload := &upload{
+		id:        b.newUploadID(),
+		key:       key,
+		initiated: now(),
+		parts:     map[int]*part{},
+	}
+	bucket.uploads[upload.id] = upload
+	return upload.id, nil
+}
+
+// AbortMultipart discards a multipart upload and all of its parts
+func (b *Backend) AbortMultipart(r *http.Request, name, key, uploadID string) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	bucket, _, err := b.upload(r, name, key, uploadID)
+	if err != nil {
+		return err
+	}
+	delete(bucket.uploads, uploadID)
+	return nil
+}
+
+// CompleteMultipart concatenates the given parts into a new version of the
+// object. All but the last part must be at least 5MiB, and the object gets
+// a multipart ETag.
+func (b *Backend) CompleteMultipart(r *http.Request, name, key, uploadID string, parts []*s2.Part, preconditions *s2.Preconditions) (*s2.CompleteMultipartResult, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	bucket, upload, err := b.upload(r, name, key, uploadID)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkPreconditions(r, bucket, key, preconditions); err != nil {
+		return nil, err
+	}
+
+	size := 0
+	etags := make([]string, 0, len(parts))
+	for i, p := range parts {
+		uploaded, ok := upload.parts[p.PartNumber]
+		if !ok || uploaded.etag != strings.Trim(p.ETag, `"`) {
+			return nil, s2.InvalidPartError(r)
+		}
+		if i < len(parts)-1 && len(uploaded.content) < minPartSize {
+			return nil, s2.EntityTooSmallError(r)
+		}
+		size += len(uploaded.content)
+		etags = append(etags, uploaded.etag)
+	}
+
+	etag, err := s2.MultipartETag(etags)
+	if err != nil {
+		return nil, err
+	}
+
+	content := make([]byte, 0, size)
+	partSizes := make([]int64, 0, len(parts))
+	for _, p := range parts {
+		uploaded := upload.parts[p.PartNumber]
+		content = append(content, uploaded.content...)
+		partSizes = append(partSizes, int64(len(uploaded.content)))
+	}
+
+	v := &version{
+		etag:      etag,
+		modTime:   now(),
+		content:   content,
+		partSizes: partSizes,
+	}
+	result := s2.CompleteMultipartResult{
+		Location: "/" + name + "/" + key,
+		ETag:     etag,
+		Version:  bucket.write(key, v),
+	}
+	delete(bucket.uploads, uploadID)
+	return &result, nil
+}
+
+// ListMultipartChunks lists the uploaded parts of a multipart upload, in
+// order
+func (b *Backend) ListMultipartChunks(r *http.Request, name, key, uploadID string, partNumberMarker, maxParts int) (*s2.ListMultipartChunksResult, error) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	_, upload, err := b.upload(r, name, key, uploadID)
+	if err != nil {
+		return nil, err
+	}
+
+	partNumbers := make([]int, 0, len(upload.parts))
+	for partNumber := range upload.parts {
+		if partNumber > partNumberMarker {
+			partNumbers = append(partNumbers, partNumber)
+		}
+	}
+	sort.Ints(partNumbers)
+
+	owner := Owner
+	result := s2.ListMultipartChunksResult{
+		Initiator:    &owner,
+		Owner:        &owner,
+		StorageClass: StorageClass,
+		Parts:        []*s2.Part{},
+	}
+	for _, partNumber := range partNumbers {
+		if len(result.Parts) >= maxParts {
+			result.IsTruncated = maxParts > 0
+			break
+		}
+		part := upload.parts[partNumber]
+		result.Parts = append(result.Parts, &s2.Part{
+			PartNumber:   partNumber,
+			ETag:         part.etag,
+			Size:         int64(len(part.content)),
+			LastModified: part.modTime,
+		})
+	}
+
+	return &result, nil
+}
+
+// UploadMultipartChunk stores a part of a multipart upload, replacing any
+// existing part with the same number
+func (b *Backend) UploadMultipartChunk(r *http.Request, name, key, uploadID string, partNumber int, reader io.Reader) (string, error) {
+	content, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return "", err
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	_, upload, err := b.upload(r, name, key, uploadID)
+	if err != nil {
+		return "", err
+	}
+
+	part := &part{
+		etag:    etag(content),
+		modTime: now(),
+		content: content,
+	}
+	upload.parts[partNumber] = part
+	return part.etag, nil
+}
+
+// GetMultipartChunk gets the content of an uploaded part of a multipart
+// upload
+func (b *Backend) GetMultipartChunk(r *http.Request, name, key, uploadID string, partNumber int) (io.ReadSeeker, error) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	_, upload, err := b.upload(r, name, key, uploadID)
+	if err != nil {
+		return nil, err
+	}
+	part, ok := upload.parts[partNumber]
+	if !ok {
+		return nil, s2.InvalidPartError(r)
+	}
+	return bytes.NewReader(part.content), nil
+}
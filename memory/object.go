@@ -0,0 +1,146 @@
+package memory
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/pachyderm/s2"
+)
+
+// GetObject gets the latest version of an object, or a specific version
+func (b *Backend) GetObject(r *http.Request, name, key, versionID string) (*s2.GetObjectResult, error) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	bucket, err := b.bucket(r, name)
+	if err != nil {
+		return nil, err
+	}
+
+	var v *version
+	if versionID == "" {
+		v = bucket.latest(key)
+		if v == nil {
+			return nil, s2.NoSuchKeyError(r)
+		}
+	} else {
+		i := bucket.find(key, versionID)
+		if i < 0 {
+			return nil, s2.NoSuchVersionError(r)
+		}
+		v = bucket.objects[key][i]
+	}
+
+	result := s2.GetObjectResult{
+		ETag:         v.etag,
+		DeleteMarker: v.deleteMarker,
+		ModTime:      v.modTime,
+		Content:      bytes.NewReader(v.content),
+		PartSizes:    v.partSizes,
+	}
+	if bucket.versioning != s2.VersioningDisabled {
+		result.Version = v.id
+	}
+	return &result, nil
+}
+
+// CopyObject copies the content of an object into a new object. The new
+// object gets a regular (non-multipart) ETag.
+func (b *Backend) CopyObject(r *http.Request, srcBucket, srcKey string, getResult *s2.GetObjectResult, destBucket, destKey string) (string, error) {
+	content, err := ioutil.ReadAll(getResult.Content)
+	if err != nil {
+		return "", err
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	bucket, err := b.bucket(r, destBucket)
+	if err != nil {
+		return "", err
+	}
+
+	return bucket.write(destKey, &version{
+		etag:    etag(content),
+		modTime: now(),
+		content: content,
+	}), nil
+}
+
+// PutObject writes a new version of an object, checking `preconditions`
+// against the latest version
+func (b *Backend) PutObject(r *http.Request, name, key string, reader io.Reader, preconditions *s2.Preconditions) (*s2.PutObjectResult, error) {
+	content, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	bucket, err := b.bucket(r, name)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkPreconditions(r, bucket, key, preconditions); err != nil {
+		return nil, err
+	}
+
+	v := &version{
+		etag:    etag(content),
+		modTime: now(),
+		content: content,
+	}
+	return &s2.PutObjectResult{
+		ETag:    v.etag,
+		Version: bucket.write(key, v),
+	}, nil
+}
+
+// DeleteObject deletes an object. If no version is specified and
+// versioning is enabled or suspended, a delete marker is written instead,
+// as in S3. Deleting a specific version removes it permanently.
+func (b *Backend) DeleteObject(r *http.Request, name, key, versionID string) (*s2.DeleteObjectResult, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	bucket, err := b.bucket(r, name)
+	if err != nil {
+		return nil, err
+	}
+
+	if versionID != "" {
+		// deleting a version that doesn't exist is a no-op
+		result := s2.DeleteObjectResult{Version: versionID}
+		if i := bucket.find(key, versionID); i >= 0 {
+			result.DeleteMarker = bucket.objects[key][i].deleteMarker
+			bucket.remove(key, i)
+		}
+		return &result, nil
+	}
+
+	if bucket.versioning == s2.VersioningDisabled {
+		delete(bucket.objects, key)
+		return &s2.DeleteObjectResult{}, nil
+	}
+
+	return &s2.DeleteObjectResult{
+		Version: bucket.write(key, &version{
+			modTime:      now(),
+			deleteMarker: true,
+		}),
+		DeleteMarker: true,
+	}, nil
+}
+
+// checkPreconditions checks write preconditions against the latest version
+// of a key. The backend's lock must be held.
+func checkPreconditions(r *http.Request, bucket *bucket, key string, preconditions *s2.Preconditions) error {
+	latest := bucket.latest(key)
+	if latest == nil || latest.deleteMarker {
+		return preconditions.Check(r, false, "")
+	}
+	return preconditions.Check(r, true, latest.etag)
+}
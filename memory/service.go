@@ -0,0 +1,31 @@
+package memory
+
+import (
+	"net/http"
+	"sort"
+
+	"github.com/pachyderm/s2"
+)
+
+// ListBuckets lists all buckets, sorted by name
+func (b *Backend) ListBuckets(r *http.Request) (*s2.ListBucketsResult, error) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	owner := Owner
+	result := s2.ListBucketsResult{
+		Owner:   &owner,
+		Buckets: make([]*s2.Bucket, 0, len(b.buckets)),
+	}
+	for _, bucket := range b.buckets {
+		result.Buckets = append(result.Buckets, &s2.Bucket{
+			Name:         bucket.name,
+			CreationDate: bucket.created,
+			BucketRegion: bucket.region,
+		})
+	}
+	sort.Slice(result.Buckets, func(i, j int) bool {
+		return result.Buckets[i].Name < result.Buckets[j].Name
+	})
+	return &result, nil
+}
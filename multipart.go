@@ -1,11 +1,12 @@
 package s2
 
 import (
+	"crypto/md5"
+	"encoding/hex"
 	"encoding/xml"
 	"fmt"
 	"io"
 	"net/http"
-	"sort"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -22,6 +23,9 @@ const (
 	// maxPartsAllowed specifies the maximum number of parts that can be
 	// uploaded in a multipart upload
 	maxPartsAllowed = 10000
+	// minPartSize is the minimum size of every part of a multipart upload,
+	// except the last
+	minPartSize = 5 * 1024 * 1024
 	// completeMultipartPing is how long to wait before sending whitespace in
 	// a complete multipart response (to ensure the connection doesn't close.)
 	completeMultipartPing = 10 * time.Second
@@ -53,6 +57,23 @@ type Part struct {
 	// ETag is a hex encoding of the hash of the object contents, with or
 	// without surrounding quotes.
 	ETag string `xml:"ETag"`
+	// Size is the size of the part. It's only used in part listings.
+	Size int64 `xml:"Size"`
+	// LastModified is when the part was uploaded. It's only used in part
+	// listings.
+	LastModified time.Time `xml:"LastModified"`
+	// ChecksumCRC32 is the base64-encoded CRC32 checksum of the part, if
+	// one was provided
+	ChecksumCRC32 string `xml:"ChecksumCRC32,omitempty"`
+	// ChecksumCRC32C is the base64-encoded CRC32C checksum of the part, if
+	// one was provided
+	ChecksumCRC32C string `xml:"ChecksumCRC32C,omitempty"`
+	// ChecksumSHA1 is the base64-encoded SHA-1 checksum of the part, if one
+	// was provided
+	ChecksumSHA1 string `xml:"ChecksumSHA1,omitempty"`
+	// ChecksumSHA256 is the base64-encoded SHA-256 checksum of the part, if
+	// one was provided
+	ChecksumSHA256 string `xml:"ChecksumSHA256,omitempty"`
 }
 
 // ListMultipartResult is a response from a ListMultipart call
@@ -61,6 +82,13 @@ type ListMultipartResult struct {
 	IsTruncated bool
 	// Uploads are the list of uploads returned
 	Uploads []*Upload
+	// CommonPrefixes are the list of common prefixes returned
+	CommonPrefixes []*CommonPrefixes
+	// NextKeyMarker and NextUploadIDMarker specify where the next page of
+	// a truncated listing starts. If they're empty, they're inferred from
+	// the highest key and upload ID returned.
+	NextKeyMarker      string
+	NextUploadIDMarker string
 }
 
 // CompleteMultipartResult is a response from a CompleteMultipart call
@@ -85,6 +113,8 @@ type ListMultipartChunksResult struct {
 	StorageClass string
 	// IsTruncated specifies whether this is the end of the list or not
 	IsTruncated bool
+	// ChecksumAlgorithm is the algorithm used for part checksums, if any
+	ChecksumAlgorithm string
 	// Parts are the list of parts returned
 	Parts []*Part
 }
@@ -93,13 +123,14 @@ type ListMultipartChunksResult struct {
 // functionality
 type MultipartController interface {
 	// ListMultipart lists in-progress multipart uploads in a bucket
-	ListMultipart(r *http.Request, bucket, keyMarker, uploadIDMarker string, maxUploads int) (*ListMultipartResult, error)
+	ListMultipart(r *http.Request, bucket, prefix, keyMarker, uploadIDMarker, delimiter string, maxUploads int) (*ListMultipartResult, error)
 	// InitMultipart initializes a new multipart upload
 	InitMultipart(r *http.Request, bucket, key string) (string, error)
 	// AbortMultipart aborts an in-progress multipart upload
 	AbortMultipart(r *http.Request, bucket, key, uploadID string) error
-	// CompleteMultipart finishes a multipart upload
-	CompleteMultipart(r *http.Request, bucket, key, uploadID string, parts []*Part) (*CompleteMultipartResult, error)
+	// CompleteMultipart finishes a multipart upload. Like `PutObject`,
+	// non-nil `preconditions` must be checked atomically with the write.
+	CompleteMultipart(r *http.Request, bucket, key, uploadID string, parts []*Part, preconditions *Preconditions) (*CompleteMultipartResult, error)
 	// ListMultipartChunks lists the constituent chunks of an in-progress
 	// multipart upload
 	ListMultipartChunks(r *http.Request, bucket, key, uploadID string, partNumberMarker, maxParts int) (*ListMultipartChunksResult, error)
@@ -107,11 +138,25 @@ type MultipartController interface {
 	UploadMultipartChunk(r *http.Request, bucket, key, uploadID string, partNumber int, reader io.Reader) (string, error)
 }
 
+// MultipartChunkController is an optional interface that a
+// `MultipartController` can implement to read back the parts of in-progress
+// uploads. Parts are read to report the plaintext sizes of encrypted parts,
+// and to check that the parts of an upload are encrypted alike before it's
+// completed. If it's not implemented, or `GetMultipartChunk` returns
+// `NotImplementedError`, part listings report stored sizes, including any
+// encryption overhead, and parts aren't checked.
+type MultipartChunkController interface {
+	// GetMultipartChunk gets the content of an uploaded chunk of an
+	// in-progress multipart upload. If the content is an `io.Closer`, it's
+	// closed once it's read.
+	GetMultipartChunk(r *http.Request, bucket, key, uploadID string, partNumber int) (io.ReadSeeker, error)
+}
+
 // unimplementedMultipartController defines a controller that returns
 // `NotImplementedError` for all functionality
 type unimplementedMultipartController struct{}
 
-func (c unimplementedMultipartController) ListMultipart(r *http.Request, bucket, keyMarker, uploadIDMarker string, maxUploads int) (*ListMultipartResult, error) {
+func (c unimplementedMultipartController) ListMultipart(r *http.Request, bucket, prefix, keyMarker, uploadIDMarker, delimiter string, maxUploads int) (*ListMultipartResult, error) {
 	return nil, NotImplementedError(r)
 }
 
@@ -123,7 +168,7 @@ func (c unimplementedMultipartController) AbortMultipart(r *http.Request, bucket
 	return NotImplementedError(r)
 }
 
-func (c unimplementedMultipartController) CompleteMultipart(r *http.Request, bucket, key, uploadID string, parts []*Part) (*CompleteMultipartResult, error) {
+func (c unimplementedMultipartController) CompleteMultipart(r *http.Request, bucket, key, uploadID string, parts []*Part, preconditions *Preconditions) (*CompleteMultipartResult, error) {
 	return nil, NotImplementedError(r)
 }
 
@@ -136,14 +181,20 @@ func (c unimplementedMultipartController) UploadMultipartChunk(r *http.Request,
 }
 
 type multipartHandler struct {
-	controller MultipartController
-	logger     *logrus.Entry
+	controller    MultipartController
+	objects       ObjectController
+	notifier      *notifier
+	encryptor     *encryptor
+	validateParts bool
+	logger        *logrus.Entry
 }
 
 func (h *multipartHandler) list(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	bucket := vars["bucket"]
 
+	prefix := r.FormValue("prefix")
+	delimiter := r.FormValue("delimiter")
 	keyMarker := r.FormValue("key-marker")
 	uploadIDMarker := r.FormValue("upload-id-marker")
 	if keyMarker == "" {
@@ -156,7 +207,7 @@ func (h *multipartHandler) list(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	result, err := h.controller.ListMultipart(r, bucket, keyMarker, uploadIDMarker, maxUploads)
+	result, err := h.controller.ListMultipart(r, bucket, prefix, keyMarker, uploadIDMarker, delimiter, maxUploads)
 	if err != nil {
 		WriteError(h.logger, w, r, err)
 		return
@@ -169,25 +220,34 @@ func (h *multipartHandler) list(w http.ResponseWriter, r *http.Request) {
 	}
 
 	marshallable := struct {
-		XMLName            xml.Name  `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListMultipartUploadsResult"`
-		Bucket             string    `xml:"Bucket"`
-		KeyMarker          string    `xml:"KeyMarker"`
-		UploadIDMarker     string    `xml:"UploadIdMarker"`
-		NextKeyMarker      string    `xml:"NextKeyMarker"`
-		NextUploadIDMarker string    `xml:"NextUploadIdMarker"`
-		MaxUploads         int       `xml:"MaxUploads"`
-		IsTruncated        bool      `xml:"IsTruncated"`
-		Uploads            []*Upload `xml:"Upload"`
+		XMLName            xml.Name          `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListMultipartUploadsResult"`
+		Bucket             string            `xml:"Bucket"`
+		KeyMarker          string            `xml:"KeyMarker"`
+		UploadIDMarker     string            `xml:"UploadIdMarker"`
+		NextKeyMarker      string            `xml:"NextKeyMarker"`
+		NextUploadIDMarker string            `xml:"NextUploadIdMarker"`
+		Prefix             string            `xml:"Prefix"`
+		Delimiter          string            `xml:"Delimiter,omitempty"`
+		MaxUploads         int               `xml:"MaxUploads"`
+		IsTruncated        bool              `xml:"IsTruncated"`
+		Uploads            []*Upload         `xml:"Upload"`
+		CommonPrefixes     []*CommonPrefixes `xml:"CommonPrefixes"`
 	}{
 		Bucket:         bucket,
 		KeyMarker:      keyMarker,
 		UploadIDMarker: uploadIDMarker,
+		Prefix:         prefix,
+		Delimiter:      delimiter,
 		MaxUploads:     maxUploads,
 		IsTruncated:    result.IsTruncated,
 		Uploads:        result.Uploads,
+		CommonPrefixes: result.CommonPrefixes,
 	}
 
-	if marshallable.IsTruncated {
+	if marshallable.IsTruncated && result.NextKeyMarker != "" {
+		marshallable.NextKeyMarker = result.NextKeyMarker
+		marshallable.NextUploadIDMarker = result.NextUploadIDMarker
+	} else if marshallable.IsTruncated {
 		highKey := ""
 		highUploadID := ""
 
@@ -195,10 +255,22 @@ func (h *multipartHandler) list(w http.ResponseWriter, r *http.Request) {
 			if upload.Key > highKey {
 				highKey = upload.Key
 			}
-			if upload.UploadID > highUploadID {
+		}
+		// only uploads of the last key matter; earlier keys won't be
+		// listed again
+		for _, upload := range marshallable.Uploads {
+			if upload.Key == highKey && upload.UploadID > highUploadID {
 				highUploadID = upload.UploadID
 			}
 		}
+		for _, commonPrefix := range marshallable.CommonPrefixes {
+			if commonPrefix.Prefix > highKey {
+				// a common prefix sorts after all of the uploads that
+				// were rolled up into it
+				highKey = commonPrefix.Prefix
+				highUploadID = ""
+			}
+		}
 
 		marshallable.NextKeyMarker = highKey
 		marshallable.NextUploadIDMarker = highUploadID
@@ -232,6 +304,17 @@ func (h *multipartHandler) listChunks(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// some clients (e.g. minio-python) can't handle sub-seconds in datetime
+	// output
+	for _, part := range result.Parts {
+		part.LastModified = part.LastModified.UTC().Round(time.Second)
+		part.ETag = addETagQuotes(part.ETag)
+	}
+	if err := h.plaintextPartSizes(r, bucket, key, uploadID, result.Parts); err != nil {
+		WriteError(h.logger, w, r, err)
+		return
+	}
+
 	marshallable := struct {
 		XMLName              xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListPartsResult"`
 		Bucket               string   `xml:"Bucket"`
@@ -240,22 +323,24 @@ func (h *multipartHandler) listChunks(w http.ResponseWriter, r *http.Request) {
 		Initiator            *User    `xml:"Initiator"`
 		Owner                *User    `xml:"Owner"`
 		StorageClass         string   `xml:"StorageClass"`
+		ChecksumAlgorithm    string   `xml:"ChecksumAlgorithm,omitempty"`
 		PartNumberMarker     int      `xml:"PartNumberMarker"`
 		NextPartNumberMarker int      `xml:"NextPartNumberMarker"`
 		MaxParts             int      `xml:"MaxParts"`
 		IsTruncated          bool     `xml:"IsTruncated"`
 		Parts                []*Part  `xml:"Part"`
 	}{
-		Bucket:           bucket,
-		Key:              key,
-		UploadID:         uploadID,
-		PartNumberMarker: partNumberMarker,
-		MaxParts:         maxParts,
-		Initiator:        result.Initiator,
-		Owner:            result.Owner,
-		StorageClass:     result.StorageClass,
-		IsTruncated:      result.IsTruncated,
-		Parts:            result.Parts,
+		Bucket:            bucket,
+		Key:               key,
+		UploadID:          uploadID,
+		PartNumberMarker:  partNumberMarker,
+		MaxParts:          maxParts,
+		Initiator:         result.Initiator,
+		Owner:             result.Owner,
+		StorageClass:      result.StorageClass,
+		ChecksumAlgorithm: result.ChecksumAlgorithm,
+		IsTruncated:       result.IsTruncated,
+		Parts:             result.Parts,
 	}
 
 	if marshallable.IsTruncated {
@@ -278,11 +363,18 @@ func (h *multipartHandler) init(w http.ResponseWriter, r *http.Request) {
 	bucket := vars["bucket"]
 	key := vars["key"]
 
+	encryption, err := h.encryptor.forUpload(r, bucket)
+	if err != nil {
+		WriteError(h.logger, w, r, err)
+		return
+	}
+
 	uploadID, err := h.controller.InitMultipart(r, bucket, key)
 	if err != nil {
 		WriteError(h.logger, w, r, err)
 		return
 	}
+	encryption.setHeaders(w)
 
 	marshallable := struct {
 		XMLName  xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ InitiateMultipartUploadResult"`
@@ -310,6 +402,12 @@ func (h *multipartHandler) complete(w http.ResponseWriter, r *http.Request) {
 
 	uploadID := r.FormValue("uploadId")
 
+	preconditions, err := preconditionsFromRequest(r)
+	if err != nil {
+		WriteError(h.logger, w, r, err)
+		return
+	}
+
 	payload := struct {
 		XMLName xml.Name `xml:"CompleteMultipartUpload"`
 		Parts   []*Part  `xml:"Part"`
@@ -319,26 +417,41 @@ func (h *multipartHandler) complete(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// verify that there's at least part, and all parts are in ascending order
-	isSorted := sort.SliceIsSorted(payload.Parts, func(i, j int) bool {
-		return payload.Parts[i].PartNumber < payload.Parts[j].PartNumber
-	})
-	if len(payload.Parts) == 0 || !isSorted {
+	// verify that there's at least part, and all parts are in ascending
+	// order without duplicates
+	if len(payload.Parts) == 0 {
 		WriteError(h.logger, w, r, InvalidPartOrderError(w, r))
 		return
 	}
+	for i := 1; i < len(payload.Parts); i++ {
+		if payload.Parts[i-1].PartNumber >= payload.Parts[i].PartNumber {
+			WriteError(h.logger, w, r, InvalidPartOrderError(w, r))
+			return
+		}
+	}
 
 	for _, part := range payload.Parts {
 		part.ETag = addETagQuotes(part.ETag)
 	}
 
+	if h.validateParts {
+		if err := h.validateCompletion(r, bucket, key, uploadID, payload.Parts); err != nil {
+			WriteError(h.logger, w, r, err)
+			return
+		}
+	}
+	if err := h.checkPartEncryption(r, bucket, key, uploadID, payload.Parts); err != nil {
+		WriteError(h.logger, w, r, err)
+		return
+	}
+
 	ch := make(chan struct {
 		result *CompleteMultipartResult
 		err    error
 	})
 
 	go func() {
-		result, err := h.controller.CompleteMultipart(r, bucket, key, uploadID, payload.Parts)
+		result, err := h.controller.CompleteMultipart(r, bucket, key, uploadID, payload.Parts, preconditions)
 		ch <- struct {
 			result *CompleteMultipartResult
 			err    error
@@ -384,6 +497,17 @@ func (h *multipartHandler) complete(w http.ResponseWriter, r *http.Request) {
 				} else {
 					writeXML(h.logger, w, r, http.StatusOK, marshallable)
 				}
+
+				h.notifier.notify(r, objectEvent{
+					name:   EventObjectCreatedCompleteMultipartUpload,
+					bucket: bucket,
+					key:    key,
+					sizeFunc: func() int64 {
+						return h.completedSize(r, bucket, key, value.result.Version)
+					},
+					etag:    value.result.ETag,
+					version: value.result.Version,
+				})
 			}
 			return
 		case <-time.After(completeMultipartPing):
@@ -397,6 +521,154 @@ func (h *multipartHandler) complete(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// completedSize gets the size of the object created by a multipart upload,
+// excluding any encryption overhead. Failures are logged, and reported as a
+// size of 0, since the upload has already succeeded.
+func (h *multipartHandler) completedSize(r *http.Request, bucket, key, version string) int64 {
+	result, err := h.objects.GetObject(r, bucket, key, version)
+	if err != nil {
+		h.logger.Warnf("could not get the size of completed upload %s/%s: %v", bucket, key, err)
+		return 0
+	}
+	defer closeContent(result.Content)
+
+	size, err := PlaintextSize(result.Content)
+	if err != nil {
+		h.logger.Warnf("could not get the size of completed upload %s/%s: %v", bucket, key, err)
+		return 0
+	}
+	return size
+}
+
+// getChunk reads back an uploaded part, returning nil if the controller
+// doesn't support it
+func (h *multipartHandler) getChunk(r *http.Request, bucket, key, uploadID string, partNumber int) (io.ReadSeeker, error) {
+	controller, ok := h.controller.(MultipartChunkController)
+	if !ok {
+		return nil, nil
+	}
+	content, err := controller.GetMultipartChunk(r, bucket, key, uploadID, partNumber)
+	if s3Err, ok := err.(*Error); ok && s3Err.Code == "NotImplemented" {
+		return nil, nil
+	}
+	return content, err
+}
+
+// plaintextPartSizes replaces the stored sizes of listed parts with the
+// sizes of their plaintext, for parts that are large enough to be
+// encrypted. Sizes are left as they are if the controller can't read parts.
+func (h *multipartHandler) plaintextPartSizes(r *http.Request, bucket, key, uploadID string, parts []*Part) error {
+	for _, part := range parts {
+		if part.Size < int64(minEncryptedSize) {
+			continue
+		}
+		content, err := h.getChunk(r, bucket, key, uploadID, part.PartNumber)
+		if err != nil {
+			return err
+		}
+		if content == nil {
+			return nil
+		}
+		size, err := PlaintextSize(content)
+		closeContent(content)
+		if err != nil {
+			return err
+		}
+		part.Size = size
+	}
+	return nil
+}
+
+// checkPartEncryption checks that the parts submitted to complete a
+// multipart upload were all encrypted alike, since an object made of parts
+// encrypted with different keys, or only partly encrypted, can't be read
+// back. Parts aren't checked if the controller can't read them.
+func (h *multipartHandler) checkPartEncryption(r *http.Request, bucket, key, uploadID string, parts []*Part) error {
+	var first *segmentHeader
+	for i, part := range parts {
+		content, err := h.getChunk(r, bucket, key, uploadID, part.PartNumber)
+		if err != nil {
+			return err
+		}
+		if content == nil {
+			return nil
+		}
+		header, err := peekSegmentHeader(content)
+		closeContent(content)
+		if err != nil {
+			return err
+		}
+		if i == 0 {
+			first = header
+		} else if !sameEncryption(first, header) {
+			return InvalidRequestError(r, "The parts of the upload were not all encrypted with the same encryption.")
+		}
+	}
+	return nil
+}
+
+// validateCompletion checks the parts submitted to complete a multipart
+// upload against the parts that were actually uploaded, as listed by the
+// controller. Every submitted part must have been uploaded with a matching
+// ETag, and every part except the last must be at least 5 MiB of
+// plaintext.
+func (h *multipartHandler) validateCompletion(r *http.Request, bucket, key, uploadID string, parts []*Part) error {
+	uploaded := map[int]*Part{}
+	partNumberMarker := 0
+	for {
+		result, err := h.controller.ListMultipartChunks(r, bucket, key, uploadID, partNumberMarker, defaultMaxParts)
+		if err != nil {
+			return err
+		}
+		for _, part := range result.Parts {
+			uploaded[part.PartNumber] = part
+			if part.PartNumber > partNumberMarker {
+				partNumberMarker = part.PartNumber
+			}
+		}
+		if !result.IsTruncated || len(result.Parts) == 0 {
+			break
+		}
+	}
+
+	sizes := make([]*Part, 0, len(parts))
+	for _, part := range parts {
+		if uploadedPart, ok := uploaded[part.PartNumber]; ok {
+			sizes = append(sizes, uploadedPart)
+		}
+	}
+	if err := h.plaintextPartSizes(r, bucket, key, uploadID, sizes); err != nil {
+		return err
+	}
+
+	for i, part := range parts {
+		uploadedPart, ok := uploaded[part.PartNumber]
+		if !ok || addETagQuotes(uploadedPart.ETag) != part.ETag {
+			return InvalidPartError(r)
+		}
+		if i < len(parts)-1 && uploadedPart.Size < minPartSize {
+			return EntityTooSmallError(r)
+		}
+	}
+	return nil
+}
+
+// MultipartETag computes the ETag S3 gives to objects created by multipart
+// uploads: the hex-encoded MD5 of the concatenated binary MD5s of the parts,
+// followed by a dash and the number of parts. `partETags` are the ETags of
+// the parts, in order, with or without surrounding quotes.
+func MultipartETag(partETags []string) (string, error) {
+	hash := md5.New()
+	for _, etag := range partETags {
+		sum, err := hex.DecodeString(stripETagQuotes(etag))
+		if err != nil || len(sum) != md5.Size {
+			return "", fmt.Errorf("invalid part etag: %q", etag)
+		}
+		hash.Write(sum)
+	}
+	return fmt.Sprintf("%x-%d", hash.Sum(nil), len(partETags)), nil
+}
+
 func (h *multipartHandler) put(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	bucket := vars["bucket"]
@@ -409,15 +681,31 @@ func (h *multipartHandler) put(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	etag, err := h.controller.UploadMultipartChunk(r, bucket, key, uploadID, partNumber, r.Body)
+	encryption, err := h.encryptor.forWrite(r, bucket)
+	if err != nil {
+		WriteError(h.logger, w, r, err)
+		return
+	}
+	reader, err := h.encryptor.encrypt(r, requestBody(r), encryption)
 	if err != nil {
 		WriteError(h.logger, w, r, err)
 		return
 	}
 
+	etag, err := h.controller.UploadMultipartChunk(r, bucket, key, uploadID, partNumber, reader)
+	if err != nil {
+		if err == errEncryptedLengthMismatch {
+			WriteError(h.logger, w, r, IncompleteBodyError(r))
+		} else {
+			WriteError(h.logger, w, r, err)
+		}
+		return
+	}
+
 	if etag != "" {
 		w.Header().Set("ETag", addETagQuotes(etag))
 	}
+	encryption.setHeaders(w)
 
 	w.WriteHeader(http.StatusOK)
 }
@@ -0,0 +1,566 @@
+// Package multipart emulates multipart uploads on top of an
+// `s2.ObjectController` that can only write whole objects:
+//
+//	m, err := multipart.New(backend, "/var/spool/s2")
+//	s.Multipart = m
+//
+// Parts are spooled to files on local disk as they're uploaded. Completing
+// an upload streams the concatenation of its parts into the wrapped
+// controller's `PutObject`, and reports the standard multipart ETag. Note
+// that the wrapped controller gives the object its own ETag, which is what
+// later reads of it report, and that reads by part number see the object as
+// a single part.
+//
+// In-progress uploads are only tracked in memory, so they're lost if the
+// process restarts, and uploads must be served by a single `Controller`.
+// Uploads that aren't completed or aborted within `MaxUploadAge` are
+// garbage collected. Since the wrapped controller can't be asked whether a
+// bucket exists, uploads to missing buckets only fail once they're
+// completed.
+package multipart
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pachyderm/s2"
+)
+
+const (
+	// DefaultMaxUploadAge is the default time after which uploads that
+	// haven't been completed are garbage collected
+	DefaultMaxUploadAge = 24 * time.Hour
+	// StorageClass is the storage class reported for all uploads
+	StorageClass = "STANDARD"
+	// minPartSize is the minimum size of all but the last part of a
+	// multipart upload
+	minPartSize = 5 * 1024 * 1024
+)
+
+// Owner is the user reported as the initiator and owner of all uploads
+var Owner = s2.User{
+	ID:          "multipart",
+	DisplayName: "multipart",
+}
+
+// upload is an in-progress multipart upload
+type upload struct {
+	id        string
+	bucket    string
+	key       string
+	initiated time.Time
+	parts     map[int]*part
+	// completing is the number of completions reading the upload's part
+	// files. While any are, files aren't removed, but are left for the last
+	// of them to remove.
+	completing int
+	// stale are the files of parts that were replaced while the upload was
+	// being completed
+	stale []string
+	// removed is set if the upload was removed while it was being
+	// completed
+	removed bool
+}
+
+// part is an uploaded part of a multipart upload, spooled to a file
+type part struct {
+	etag    string
+	size    int64
+	modTime time.Time
+	path    string
+}
+
+// Controller is an `s2.MultipartController` that emulates multipart
+// uploads on top of a wrapped object controller
+type Controller struct {
+	// MaxUploadAge is the time after which uploads that haven't been
+	// completed are aborted, or 0 to keep them indefinitely
+	MaxUploadAge time.Duration
+
+	object s2.ObjectController
+	dir    string
+
+	lock    sync.Mutex
+	uploads map[string]*upload
+	// uploadSeq is used to generate upload IDs that sort in the order the
+	// uploads were initiated
+	uploadSeq uint64
+	// collected is when abandoned uploads were last garbage collected
+	collected time.Time
+}
+
+// New creates a controller that emulates multipart uploads on top of
+// `object`, spooling parts to a new temporary directory under `dir`. The
+// directory is removed by `Close`.
+func New(object s2.ObjectController, dir string) (*Controller, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	spoolDir, err := ioutil.TempDir(dir, "s2-multipart")
+	if err != nil {
+		return nil, err
+	}
+	return &Controller{
+		MaxUploadAge: DefaultMaxUploadAge,
+		object:       object,
+		dir:          spoolDir,
+		uploads:      map[string]*upload{},
+		collected:    time.Now(),
+	}, nil
+}
+
+// Close aborts all in-progress uploads. The controller must not be used
+// afterwards.
+func (c *Controller) Close() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.uploads = map[string]*upload{}
+	return os.RemoveAll(c.dir)
+}
+
+// now returns the current time, rounded to S3's millisecond precision
+func now() time.Time {
+	return time.Now().UTC().Round(time.Millisecond)
+}
+
+// newUploadID generates a new upload ID. The controller's lock must be
+// held.
+func (c *Controller) newUploadID() string {
+	var buf [8]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		panic(fmt.Sprintf("could not generate random ID: %v", err))
+	}
+	c.uploadSeq++
+	return fmt.Sprintf("%016x%s", c.uploadSeq, hex.EncodeToString(buf[:]))
+}
+
+// upload gets an in-progress multipart upload. The controller's lock must
+// be held.
+func (c *Controller) upload(r *http.Request, bucket, key, uploadID string) (*upload, error) {
+	upload, ok := c.uploads[uploadID]
+	if !ok || upload.bucket != bucket || upload.key != key {
+		return nil, s2.NoSuchUploadError(r)
+	}
+	return upload, nil
+}
+
+// remove discards an upload and its spooled parts. If the upload is being
+// completed, the parts are only removed once it's done. The controller's
+// lock must be held.
+func (c *Controller) remove(upload *upload) {
+	delete(c.uploads, upload.id)
+	if upload.completing > 0 {
+		upload.removed = true
+		return
+	}
+	os.RemoveAll(filepath.Join(c.dir, upload.id))
+}
+
+// release ends a completion of an upload, removing the files that were
+// left while it read them. The controller's lock must be held.
+func (c *Controller) release(upload *upload) {
+	upload.completing--
+	if upload.completing > 0 {
+		return
+	}
+	if upload.removed {
+		os.RemoveAll(filepath.Join(c.dir, upload.id))
+		return
+	}
+	for _, path := range upload.stale {
+		os.Remove(path)
+	}
+	upload.stale = nil
+}
+
+// CollectGarbage aborts the uploads that were initiated more than
+// `MaxUploadAge` ago. It's called periodically by `InitMultipart`, so it
+// only needs to be called directly to reclaim space sooner.
+func (c *Controller) CollectGarbage() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.collectGarbage()
+}
+
+// collectGarbage aborts abandoned uploads. The controller's lock must be
+// held.
+func (c *Controller) collectGarbage() {
+	c.collected = time.Now()
+	if c.MaxUploadAge <= 0 {
+		return
+	}
+	for _, upload := range c.uploads {
+		if time.Since(upload.initiated) > c.MaxUploadAge {
+			c.remove(upload)
+		}
+	}
+}
+
+// commonPrefix gets the common prefix that a key is rolled up into by a
+// delimiter, or an empty string if it isn't
+func commonPrefix(key, prefix, delimiter string) string {
+	if delimiter == "" {
+		return ""
+	}
+	i := strings.Index(key[len(prefix):], delimiter)
+	if i < 0 {
+		return ""
+	}
+	return key[:len(prefix)+i+len(delimiter)]
+}
+
+// ListMultipart lists in-progress multipart uploads, ordered by key, then
+// by when they were initiated
+func (c *Controller) ListMultipart(r *http.Request, bucket, prefix, keyMarker, uploadIDMarker, delimiter string, maxUploads int) (*s2.ListMultipartResult, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	// upload IDs sort in the order the uploads were initiated
+	uploads := make([]*upload, 0, len(c.uploads))
+	for _, upload := range c.uploads {
+		if upload.bucket == bucket {
+			uploads = append(uploads, upload)
+		}
+	}
+	sort.Slice(uploads, func(i, j int) bool {
+		if uploads[i].key != uploads[j].key {
+			return uploads[i].key < uploads[j].key
+		}
+		return uploads[i].id < uploads[j].id
+	})
+
+	result := s2.ListMultipartResult{
+		Uploads:        []*s2.Upload{},
+		CommonPrefixes: []*s2.CommonPrefixes{},
+	}
+	lastPrefix := ""
+
+	for _, upload := range uploads {
+		if !strings.HasPrefix(upload.key, prefix) || upload.key < keyMarker {
+			continue
+		}
+		// without an upload ID marker, S3 resumes after the whole key
+		if upload.key == keyMarker && (uploadIDMarker == "" || upload.id <= uploadIDMarker) {
+			continue
+		}
+
+		if cp := commonPrefix(upload.key, prefix, delimiter); cp != "" {
+			if cp <= keyMarker || cp == lastPrefix {
+				continue
+			}
+			if len(result.Uploads)+len(result.CommonPrefixes) >= maxUploads {
+				result.IsTruncated = maxUploads > 0
+				break
+			}
+			result.CommonPrefixes = append(result.CommonPrefixes, &s2.CommonPrefixes{
+				Prefix: cp,
+				Owner:  Owner,
+			})
+			result.NextKeyMarker = cp
+			result.NextUploadIDMarker = ""
+			lastPrefix = cp
+			continue
+		}
+
+		if len(result.Uploads)+len(result.CommonPrefixes) >= maxUploads {
+			result.IsTruncated = maxUploads > 0
+			break
+		}
+		result.Uploads = append(result.Uploads, &s2.Upload{
+			Key:          upload.key,
+			UploadID:     upload.id,
+			Initiator:    Owner,
+			Owner:        Owner,
+			StorageClass: StorageClass,
+			Initiated:    upload.initiated,
+		})
+		result.NextKeyMarker = upload.key
+		result.NextUploadIDMarker = upload.id
+	}
+
+	return &result, nil
+}
+
+// InitMultipart starts a new multipart upload. Abandoned uploads are
+// garbage collected first, if they haven't been recently.
+func (c *Controller) InitMultipart(r *http.Request, bucket, key string) (string, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.MaxUploadAge > 0 && time.Since(c.collected) > c.MaxUploadAge/10 {
+		c.collectGarbage()
+	}
+
+	upload := &upload{
+		id:        c.newUploadID(),
+		bucket:    bucket,
+		key:       key,
+		initiated: now(),
+		parts:     map[int]*part{},
+	}
+	if err := os.Mkdir(filepath.Join(c.dir, upload.id), 0700); err != nil {
+		return "", err
+	}
+	c.uploads[upload.id] = upload
+	return upload.id, nil
+}
+
+// AbortMultipart discards a multipart upload and all of its parts
+func (c *Controller) AbortMultipart(r *http.Request, bucket, key, uploadID string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	upload, err := c.upload(r, bucket, key, uploadID)
+	if err != nil {
+		return err
+	}
+	c.remove(upload)
+	return nil
+}
+
+// CompleteMultipart streams the concatenation of the given parts into a new
+// object, which is written with the wrapped controller's `PutObject`. All
+// but the last part must be at least 5MiB. The upload is removed once the
+// object has been written.
+func (c *Controller) CompleteMultipart(r *http.Request, bucket, key, uploadID string, parts []*s2.Part, preconditions *s2.Preconditions) (*s2.CompleteMultipartResult, error) {
+	c.lock.Lock()
+	upload, err := c.upload(r, bucket, key, uploadID)
+	if err != nil {
+		c.lock.Unlock()
+		return nil, err
+	}
+
+	var size int64
+	etags := make([]string, 0, len(parts))
+	paths := make([]string, 0, len(parts))
+	for i, p := range parts {
+		uploaded, ok := upload.parts[p.PartNumber]
+		if !ok || uploaded.etag != strings.Trim(p.ETag, `"`) {
+			c.lock.Unlock()
+			return nil, s2.InvalidPartError(r)
+		}
+		if i < len(parts)-1 && uploaded.size < minPartSize {
+			c.lock.Unlock()
+			return nil, s2.EntityTooSmallError(r)
+		}
+		size += uploaded.size
+		etags = append(etags, uploaded.etag)
+		paths = append(paths, uploaded.path)
+	}
+	etag, err := s2.MultipartETag(etags)
+	if err != nil {
+		c.lock.Unlock()
+		return nil, err
+	}
+	// the lock isn't held while the object is written, so part files that
+	// are replaced, or aborted, meanwhile are kept until it's done
+	upload.completing++
+	c.lock.Unlock()
+
+	content := &concatReader{paths: paths}
+	result, err := c.object.PutObject(putRequest(r, size), bucket, key, content, preconditions)
+	content.Close()
+
+	c.lock.Lock()
+	c.release(upload)
+	if err == nil && c.uploads[uploadID] == upload {
+		c.remove(upload)
+	}
+	c.lock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	return &s2.CompleteMultipartResult{
+		Location: "/" + bucket + "/" + key,
+		ETag:     etag,
+		Version:  result.Version,
+	}, nil
+}
+
+// ListMultipartChunks lists the uploaded parts of a multipart upload, in
+// order
+func (c *Controller) ListMultipartChunks(r *http.Request, bucket, key, uploadID string, partNumberMarker, maxParts int) (*s2.ListMultipartChunksResult, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	upload, err := c.upload(r, bucket, key, uploadID)
+	if err != nil {
+		return nil, err
+	}
+
+	partNumbers := make([]int, 0, len(upload.parts))
+	for partNumber := range upload.parts {
+		if partNumber > partNumberMarker {
+			partNumbers = append(partNumbers, partNumber)
+		}
+	}
+	sort.Ints(partNumbers)
+
+	owner := Owner
+	result := s2.ListMultipartChunksResult{
+		Initiator:    &owner,
+		Owner:        &owner,
+		StorageClass: StorageClass,
+		Parts:        []*s2.Part{},
+	}
+	for _, partNumber := range partNumbers {
+		if len(result.Parts) >= maxParts {
+			result.IsTruncated = maxParts > 0
+			break
+		}
+		part := upload.parts[partNumber]
+		result.Parts = append(result.Parts, &s2.Part{
+			PartNumber:   partNumber,
+			ETag:         part.etag,
+			Size:         part.size,
+			LastModified: part.modTime,
+		})
+	}
+
+	return &result, nil
+}
+
+// GetMultipartChunk opens the spooled file of a part of a multipart
+// upload. The file is opened while the lock is held, so it can still be
+// read if the part is replaced or the upload is removed afterwards.
+func (c *Controller) GetMultipartChunk(r *http.Request, bucket, key, uploadID string, partNumber int) (io.ReadSeeker, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	upload, err := c.upload(r, bucket, key, uploadID)
+	if err != nil {
+		return nil, err
+	}
+	part := upload.parts[partNumber]
+	if part == nil {
+		return nil, s2.InvalidPartError(r)
+	}
+	f, err := os.Open(part.path)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// UploadMultipartChunk spools a part of a multipart upload to a file,
+// replacing any existing part with the same number
+func (c *Controller) UploadMultipartChunk(r *http.Request, bucket, key, uploadID string, partNumber int, reader io.Reader) (string, error) {
+	c.lock.Lock()
+	_, err := c.upload(r, bucket, key, uploadID)
+	c.lock.Unlock()
+	if err != nil {
+		return "", err
+	}
+
+	f, err := ioutil.TempFile(filepath.Join(c.dir, uploadID), "part")
+	if err != nil {
+		// the upload was removed while it was being checked
+		return "", s2.NoSuchUploadError(r)
+	}
+	hash := md5.New()
+	size, err := io.Copy(io.MultiWriter(f, hash), reader)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	upload, err := c.upload(r, bucket, key, uploadID)
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	if existing := upload.parts[partNumber]; existing != nil {
+		if upload.completing > 0 {
+			upload.stale = append(upload.stale, existing.path)
+		} else {
+			os.Remove(existing.path)
+		}
+	}
+	part := &part{
+		etag:    hex.EncodeToString(hash.Sum(nil)),
+		size:    size,
+		modTime: now(),
+		path:    f.Name(),
+	}
+	upload.parts[partNumber] = part
+	return part.etag, nil
+}
+
+// concatReader reads the concatenation of files, opening each one in turn
+type concatReader struct {
+	paths   []string
+	current *os.File
+}
+
+func (r *concatReader) Read(b []byte) (int, error) {
+	for {
+		if r.current == nil {
+			if len(r.paths) == 0 {
+				return 0, io.EOF
+			}
+			f, err := os.Open(r.paths[0])
+			if err != nil {
+				return 0, err
+			}
+			r.current = f
+			r.paths = r.paths[1:]
+		}
+
+		n, err := r.current.Read(b)
+		if err == io.EOF {
+			r.current.Close()
+			r.current = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+// Close closes the file that's currently being read, if any
+func (r *concatReader) Close() error {
+	if r.current == nil {
+		return nil
+	}
+	err := r.current.Close()
+	r.current = nil
+	return err
+}
+
+// putRequest derives a request for writing the completed object from the
+// request that completes an upload, so that wrapped controllers that look
+// at the request's headers see the length of the object rather than that
+// of the completion request
+func putRequest(r *http.Request, length int64) *http.Request {
+	put := r.WithContext(r.Context())
+	put.Header = http.Header{}
+	for name, values := range r.Header {
+		put.Header[name] = values
+	}
+	put.Header.Del("x-amz-decoded-content-length")
+	put.Header.Set("Content-Length", strconv.FormatInt(length, 10))
+	put.ContentLength = length
+	put.Body = http.NoBody
+	return put
+}
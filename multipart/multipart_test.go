@@ -0,0 +1,262 @@
+package multipart
+
+import (
+	"bytes"
+	"crypto/md5"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pachyderm/s2"
+	"github.com/pachyderm/s2/memory"
+	"github.com/pachyderm/s2/s2test"
+	"github.com/sirupsen/logrus"
+)
+
+func TestConformance(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	dir, err := ioutil.TempDir("", "s2-multipart-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s2test.RunConformance(t, func() *s2.S2 {
+		backend := memory.New()
+		m, err := New(backend, dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := backend.S2(logrus.NewEntry(logger))
+		s.Multipart = m
+		return s
+	})
+}
+
+func TestGarbageCollection(t *testing.T) {
+	dir, err := ioutil.TempDir("", "s2-multipart-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	backend := memory.New()
+	m, err := New(backend, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	r := httptest.NewRequest("POST", "/", nil)
+	uploadID, err := m.InitMultipart(r, "bucket", "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.UploadMultipartChunk(r, "bucket", "key", uploadID, 1, bytes.NewReader([]byte("part"))); err != nil {
+		t.Fatal(err)
+	}
+
+	// uploads younger than the maximum age are kept
+	m.CollectGarbage()
+	if _, err := m.ListMultipartChunks(r, "bucket", "key", uploadID, 0, 1000); err != nil {
+		t.Fatalf("expected a recent upload to be kept, got %v", err)
+	}
+
+	m.MaxUploadAge = time.Nanosecond
+	time.Sleep(time.Millisecond)
+	m.CollectGarbage()
+	if _, err := m.ListMultipartChunks(r, "bucket", "key", uploadID, 0, 1000); err == nil {
+		t.Fatal("expected an abandoned upload to be aborted")
+	}
+	files, err := ioutil.ReadDir(m.dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 0 {
+		t.Fatalf("expected the spooled parts to be removed, found %d files", len(files))
+	}
+}
+
+func TestETag(t *testing.T) {
+	dir, err := ioutil.TempDir("", "s2-multipart-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	backend := memory.New()
+	m, err := New(backend, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	r := httptest.NewRequest("POST", "/", nil)
+	if err := backend.CreateBucket(r, "bucket", nil); err != nil {
+		t.Fatal(err)
+	}
+	uploadID, err := m.InitMultipart(r, "bucket", "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	etags := map[int]string{}
+	upload := func(partNumber int, content []byte) {
+		t.Helper()
+		etag, err := m.UploadMultipartChunk(r, "bucket", "key", uploadID, partNumber, bytes.NewReader(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected := fmt.Sprintf("%x", md5.Sum(content)); etag != expected {
+			t.Fatalf("expected part %d to have ETag %s, got %s", partNumber, expected, etag)
+		}
+		etags[partNumber] = etag
+	}
+	complete := func(partNumbers ...int) (*s2.CompleteMultipartResult, error) {
+		parts := []*s2.Part{}
+		for _, partNumber := range partNumbers {
+			parts = append(parts, &s2.Part{PartNumber: partNumber, ETag: `"` + etags[partNumber] + `"`})
+		}
+		return m.CompleteMultipart(r, "bucket", "key", uploadID, parts, nil)
+	}
+	expectCode := func(err error, code string) {
+		t.Helper()
+		if s3Err, ok := err.(*s2.Error); !ok || s3Err.Code != code {
+			t.Fatalf("expected a %s error, got %v", code, err)
+		}
+	}
+
+	first := bytes.Repeat([]byte("a"), minPartSize)
+	second := []byte("second")
+	upload(1, first)
+	upload(2, []byte("replaced"))
+	stale := etags[2]
+	upload(2, second)
+	upload(3, []byte("small"))
+
+	// the ETags of replaced parts are rejected
+	_, err = m.CompleteMultipart(r, "bucket", "key", uploadID, []*s2.Part{
+		{PartNumber: 1, ETag: etags[1]},
+		{PartNumber: 2, ETag: stale},
+	}, nil)
+	expectCode(err, "InvalidPart")
+
+	// all but the last part must be at least 5MiB
+	_, err = complete(1, 2, 3)
+	expectCode(err, "EntityTooSmall")
+
+	// the ETag is the MD5 of the parts' MD5s, followed by the part count
+	result, err := complete(1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	firstSum, secondSum := md5.Sum(first), md5.Sum(second)
+	expected := fmt.Sprintf("%x-2", md5.Sum(append(firstSum[:], secondSum[:]...)))
+	if result.ETag != expected {
+		t.Fatalf("expected the multipart ETag %s, got %s", expected, result.ETag)
+	}
+
+	// the object is written whole, so it has the wrapped controller's ETag
+	object, err := backend.GetObject(r, "bucket", "key", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadAll(object.Content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(content, append(first, second...)) {
+		t.Fatal("expected the object to be the concatenation of its parts")
+	}
+	if etag := fmt.Sprintf("%x", md5.Sum(content)); strings.Trim(object.ETag, `"`) != etag {
+		t.Fatalf("expected the object to have ETag %s, got %s", etag, object.ETag)
+	}
+}
+
+// blockingController holds up writes until they're resumed
+type blockingController struct {
+	s2.ObjectController
+	started chan struct{}
+	resume  chan struct{}
+}
+
+func (c *blockingController) PutObject(r *http.Request, bucket, key string, reader io.Reader, preconditions *s2.Preconditions) (*s2.PutObjectResult, error) {
+	close(c.started)
+	<-c.resume
+	return c.ObjectController.PutObject(r, bucket, key, reader, preconditions)
+}
+
+func TestChangesDuringCompletion(t *testing.T) {
+	dir, err := ioutil.TempDir("", "s2-multipart-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	backend := memory.New()
+	object := &blockingController{ObjectController: backend, started: make(chan struct{}), resume: make(chan struct{})}
+	m, err := New(object, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	r := httptest.NewRequest("POST", "/", nil)
+	if err := backend.CreateBucket(r, "bucket", nil); err != nil {
+		t.Fatal(err)
+	}
+	uploadID, err := m.InitMultipart(r, "bucket", "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	etag, err := m.UploadMultipartChunk(r, "bucket", "key", uploadID, 1, strings.NewReader("part"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error)
+	go func() {
+		_, err := m.CompleteMultipart(r, "bucket", "key", uploadID, []*s2.Part{{PartNumber: 1, ETag: etag}}, nil)
+		done <- err
+	}()
+
+	// the part is replaced, and the upload aborted, before the completion
+	// reads the part
+	<-object.started
+	if _, err := m.UploadMultipartChunk(r, "bucket", "key", uploadID, 1, strings.NewReader("replaced")); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.AbortMultipart(r, "bucket", "key", uploadID); err != nil {
+		t.Fatal(err)
+	}
+	close(object.resume)
+	if err := <-done; err != nil {
+		t.Fatalf("expected the completion to succeed, got %v", err)
+	}
+
+	result, err := backend.GetObject(r, "bucket", "key", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadAll(result.Content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "part" {
+		t.Fatalf("expected the completed content %q, got %q", "part", content)
+	}
+	files, err := ioutil.ReadDir(m.dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 0 {
+		t.Fatalf("expected the spooled parts to be removed, found %d files", len(files))
+	}
+}
@@ -0,0 +1,460 @@
+package s2
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ControllerSet is a set of controllers that serves some buckets of a
+// `MultiplexController`. Nil controllers are treated as unimplemented.
+type ControllerSet struct {
+	Service      ServiceController
+	Bucket       BucketController
+	Object       ObjectController
+	Multipart    MultipartController
+	Encryption   EncryptionController
+	Notification NotificationController
+}
+
+func (c *ControllerSet) bucket() BucketController {
+	if c.Bucket == nil {
+		return unimplementedBucketController{}
+	}
+	return c.Bucket
+}
+
+func (c *ControllerSet) object() ObjectController {
+	if c.Object == nil {
+		return unimplementedObjectController{}
+	}
+	return c.Object
+}
+
+func (c *ControllerSet) multipart() MultipartController {
+	if c.Multipart == nil {
+		return unimplementedMultipartController{}
+	}
+	return c.Multipart
+}
+
+func (c *ControllerSet) encryption() EncryptionController {
+	if c.Encryption == nil {
+		return unimplementedEncryptionController{}
+	}
+	return c.Encryption
+}
+
+func (c *ControllerSet) notification() NotificationController {
+	if c.Notification == nil {
+		return unimplementedNotificationController{}
+	}
+	return c.Notification
+}
+
+// MultiplexController implements every bucket-scoped controller interface
+// by dispatching on the bucket name to one of several controller sets, so
+// that one s2 instance can serve buckets from different storage systems.
+// Set it as the `Service`, `Bucket`, `Object`, `Multipart`, `Encryption`
+// and `Notification` controllers of an `S2` instance.
+//
+// Buckets are routed by `Buckets` first, then by the longest matching
+// prefix in `Prefixes`, then by `Resolver`, and finally to `Default`.
+// Requests for buckets that aren't routed anywhere fail with
+// `NoSuchBucketError`.
+type MultiplexController struct {
+	// Buckets routes buckets by their exact name
+	Buckets map[string]*ControllerSet
+	// Prefixes routes buckets whose names start with a prefix
+	Prefixes map[string]*ControllerSet
+	// Resolver, if set, routes buckets that aren't matched by `Buckets` or
+	// `Prefixes`. It should return nil to fall back to `Default`.
+	Resolver func(r *http.Request, bucket string) (*ControllerSet, error)
+	// Default routes any remaining buckets, if set
+	Default *ControllerSet
+	// StreamCopies specifies whether objects copied between controller sets
+	// are streamed from the source to the destination. Otherwise, such
+	// copies are rejected with `InvalidRequestError`.
+	StreamCopies bool
+}
+
+// NewMultiplexController creates a new multiplex controller with no routes
+func NewMultiplexController() *MultiplexController {
+	return &MultiplexController{
+		Buckets:      map[string]*ControllerSet{},
+		Prefixes:     map[string]*ControllerSet{},
+		Resolver:     nil,
+		Default:      nil,
+		StreamCopies: false,
+	}
+}
+
+// resolve gets the controller set that a bucket is routed to, or nil if
+// it's not routed anywhere
+func (m *MultiplexController) resolve(r *http.Request, bucket string) (*ControllerSet, error) {
+	if set, ok := m.Buckets[bucket]; ok {
+		return set, nil
+	}
+
+	var set *ControllerSet
+	longest := -1
+	for prefix, prefixSet := range m.Prefixes {
+		if strings.HasPrefix(bucket, prefix) && len(prefix) > longest {
+			set = prefixSet
+			longest = len(prefix)
+		}
+	}
+	if set != nil {
+		return set, nil
+	}
+
+	if m.Resolver != nil {
+		set, err := m.Resolver(r, bucket)
+		if err != nil || set != nil {
+			return set, err
+		}
+	}
+	return m.Default, nil
+}
+
+// route gets the controller set that a bucket is routed to
+func (m *MultiplexController) route(r *http.Request, bucket string) (*ControllerSet, error) {
+	set, err := m.resolve(r, bucket)
+	if err != nil {
+		return nil, err
+	}
+	if set == nil {
+		return nil, NoSuchBucketError(r)
+	}
+	return set, nil
+}
+
+// sets gets every controller set that can be enumerated, i.e. those in
+// `Default`, `Buckets` and `Prefixes`, in a deterministic order
+func (m *MultiplexController) sets() []*ControllerSet {
+	var sets []*ControllerSet
+	seen := map[*ControllerSet]bool{}
+	add := func(set *ControllerSet) {
+		if set != nil && !seen[set] {
+			seen[set] = true
+			sets = append(sets, set)
+		}
+	}
+
+	add(m.Default)
+	for _, name := range sortedKeys(m.Buckets) {
+		add(m.Buckets[name])
+	}
+	for _, prefix := range sortedKeys(m.Prefixes) {
+		add(m.Prefixes[prefix])
+	}
+	return sets
+}
+
+func sortedKeys(sets map[string]*ControllerSet) []string {
+	keys := make([]string, 0, len(sets))
+	for key := range sets {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// ListBuckets merges the buckets listed by every controller set in
+// `Default`, `Buckets` and `Prefixes`. Buckets are only included if they're
+// routed to the set that listed them, so buckets shadowed by another route
+// are hidden. Sets that are only reachable through `Resolver` aren't
+// listed.
+func (m *MultiplexController) ListBuckets(r *http.Request) (*ListBucketsResult, error) {
+	result := &ListBucketsResult{Buckets: []*Bucket{}}
+	seen := map[string]bool{}
+
+	for _, set := range m.sets() {
+		if set.Service == nil {
+			continue
+		}
+		listed, err := set.Service.ListBuckets(r)
+		if err != nil {
+			return nil, err
+		}
+		if result.Owner == nil {
+			result.Owner = listed.Owner
+		}
+
+		for _, bucket := range listed.Buckets {
+			if seen[bucket.Name] {
+				continue
+			}
+			routed, err := m.resolve(r, bucket.Name)
+			if err != nil {
+				return nil, err
+			}
+			if routed == set {
+				seen[bucket.Name] = true
+				result.Buckets = append(result.Buckets, bucket)
+			}
+		}
+	}
+
+	sort.Slice(result.Buckets, func(i, j int) bool {
+		return result.Buckets[i].Name < result.Buckets[j].Name
+	})
+	return result, nil
+}
+
+func (m *MultiplexController) GetLocation(r *http.Request, bucket string) (string, error) {
+	set, err := m.route(r, bucket)
+	if err != nil {
+		return "", err
+	}
+	return set.bucket().GetLocation(r, bucket)
+}
+
+// HeadBucket uses the routed bucket controller's `HeadBucket`, if it
+// implements `HeadBucketController`. Otherwise, `NotImplementedError` is
+// returned, so that s2 falls back to `GetLocation`.
+func (m *MultiplexController) HeadBucket(r *http.Request, bucket string) (*HeadBucketResult, error) {
+	set, err := m.route(r, bucket)
+	if err != nil {
+		return nil, err
+	}
+	if controller, ok := set.bucket().(HeadBucketController); ok {
+		return controller.HeadBucket(r, bucket)
+	}
+	return nil, NotImplementedError(r)
+}
+
+func (m *MultiplexController) ListObjects(r *http.Request, bucket, prefix, marker, delimiter string, maxKeys int) (*ListObjectsResult, error) {
+	set, err := m.route(r, bucket)
+	if err != nil {
+		return nil, err
+	}
+	return set.bucket().ListObjects(r, bucket, prefix, marker, delimiter, maxKeys)
+}
+
+func (m *MultiplexController) ListObjectVersions(r *http.Request, bucket, prefix, keyMarker, versionMarker string, delimiter string, maxKeys int) (*ListObjectVersionsResult, error) {
+	set, err := m.route(r, bucket)
+	if err != nil {
+		return nil, err
+	}
+	return set.bucket().ListObjectVersions(r, bucket, prefix, keyMarker, versionMarker, delimiter, maxKeys)
+}
+
+// CreateBucket creates a bucket in the controller set its name is routed
+// to. Names that aren't routed anywhere are rejected with
+// `AccessDeniedError`.
+func (m *MultiplexController) CreateBucket(r *http.Request, bucket string, options *CreateBucketOptions) error {
+	set, err := m.resolve(r, bucket)
+	if err != nil {
+		return err
+	}
+	if set == nil {
+		return AccessDeniedError(r)
+	}
+	return set.bucket().CreateBucket(r, bucket, options)
+}
+
+func (m *MultiplexController) DeleteBucket(r *http.Request, bucket string) error {
+	set, err := m.route(r, bucket)
+	if err != nil {
+		return err
+	}
+	return set.bucket().DeleteBucket(r, bucket)
+}
+
+func (m *MultiplexController) GetBucketVersioning(r *http.Request, bucket string) (string, error) {
+	set, err := m.route(r, bucket)
+	if err != nil {
+		return "", err
+	}
+	return set.bucket().GetBucketVersioning(r, bucket)
+}
+
+func (m *MultiplexController) SetBucketVersioning(r *http.Request, bucket, status string) error {
+	set, err := m.route(r, bucket)
+	if err != nil {
+		return err
+	}
+	return set.bucket().SetBucketVersioning(r, bucket, status)
+}
+
+func (m *MultiplexController) GetObject(r *http.Request, bucket, key, version string) (*GetObjectResult, error) {
+	set, err := m.route(r, bucket)
+	if err != nil {
+		return nil, err
+	}
+	return set.object().GetObject(r, bucket, key, version)
+}
+
+// CopyObject copies an object within a controller set using its
+// `CopyObject`. Copies between controller sets are streamed into the
+// destination's `PutObject` if `StreamCopies` is set, and rejected
+// otherwise.
+func (m *MultiplexController) CopyObject(r *http.Request, srcBucket, srcKey string, getResult *GetObjectResult, destBucket, destKey string) (string, error) {
+	srcSet, err := m.route(r, srcBucket)
+	if err != nil {
+		return "", err
+	}
+	destSet, err := m.route(r, destBucket)
+	if err != nil {
+		return "", err
+	}
+	if srcSet == destSet {
+		return destSet.object().CopyObject(r, srcBucket, srcKey, getResult, destBucket, destKey)
+	}
+	if !m.StreamCopies {
+		return "", InvalidRequestError(r, "objects cannot be copied between these buckets")
+	}
+
+	size, err := getResult.Content.Seek(0, io.SeekEnd)
+	if err != nil {
+		return "", err
+	}
+	if _, err := getResult.Content.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	result, err := destSet.object().PutObject(copyPutRequest(r, getResult.Content, size), destBucket, destKey, getResult.Content, nil)
+	if err != nil {
+		return "", err
+	}
+	return result.Version, nil
+}
+
+// copyPutRequest derives a request from a copy request, which looks like a
+// plain PUT of the copied content to the controller it's streamed into
+func copyPutRequest(r *http.Request, content io.Reader, size int64) *http.Request {
+	put := r.WithContext(r.Context())
+	put.Header = http.Header{}
+	for name, values := range r.Header {
+		if strings.HasPrefix(strings.ToLower(name), "x-amz-copy-source") {
+			continue
+		}
+		put.Header[name] = values
+	}
+	put.Header.Del("x-amz-decoded-content-length")
+	put.Header.Set("Content-Length", strconv.FormatInt(size, 10))
+	put.ContentLength = size
+	put.Body = ioutil.NopCloser(content)
+	return put
+}
+
+func (m *MultiplexController) PutObject(r *http.Request, bucket, key string, reader io.Reader, preconditions *Preconditions) (*PutObjectResult, error) {
+	set, err := m.route(r, bucket)
+	if err != nil {
+		return nil, err
+	}
+	return set.object().PutObject(r, bucket, key, reader, preconditions)
+}
+
+func (m *MultiplexController) DeleteObject(r *http.Request, bucket, key, version string) (*DeleteObjectResult, error) {
+	set, err := m.route(r, bucket)
+	if err != nil {
+		return nil, err
+	}
+	return set.object().DeleteObject(r, bucket, key, version)
+}
+
+func (m *MultiplexController) ListMultipart(r *http.Request, bucket, prefix, keyMarker, uploadIDMarker, delimiter string, maxUploads int) (*ListMultipartResult, error) {
+	set, err := m.route(r, bucket)
+	if err != nil {
+		return nil, err
+	}
+	return set.multipart().ListMultipart(r, bucket, prefix, keyMarker, uploadIDMarker, delimiter, maxUploads)
+}
+
+func (m *MultiplexController) InitMultipart(r *http.Request, bucket, key string) (string, error) {
+	set, err := m.route(r, bucket)
+	if err != nil {
+		return "", err
+	}
+	return set.multipart().InitMultipart(r, bucket, key)
+}
+
+func (m *MultiplexController) AbortMultipart(r *http.Request, bucket, key, uploadID string) error {
+	set, err := m.route(r, bucket)
+	if err != nil {
+		return err
+	}
+	return set.multipart().AbortMultipart(r, bucket, key, uploadID)
+}
+
+func (m *MultiplexController) CompleteMultipart(r *http.Request, bucket, key, uploadID string, parts []*Part, preconditions *Preconditions) (*CompleteMultipartResult, error) {
+	set, err := m.route(r, bucket)
+	if err != nil {
+		return nil, err
+	}
+	return set.multipart().CompleteMultipart(r, bucket, key, uploadID, parts, preconditions)
+}
+
+func (m *MultiplexController) ListMultipartChunks(r *http.Request, bucket, key, uploadID string, partNumberMarker, maxParts int) (*ListMultipartChunksResult, error) {
+	set, err := m.route(r, bucket)
+	if err != nil {
+		return nil, err
+	}
+	return set.multipart().ListMultipartChunks(r, bucket, key, uploadID, partNumberMarker, maxParts)
+}
+
+// GetMultipartChunk uses the routed multipart controller's
+// `GetMultipartChunk`, if it implements `MultipartChunkController`.
+// Otherwise, `NotImplementedError` is returned.
+func (m *MultiplexController) GetMultipartChunk(r *http.Request, bucket, key, uploadID string, partNumber int) (io.ReadSeeker, error) {
+	set, err := m.route(r, bucket)
+	if err != nil {
+		return nil, err
+	}
+	if controller, ok := set.multipart().(MultipartChunkController); ok {
+		return controller.GetMultipartChunk(r, bucket, key, uploadID, partNumber)
+	}
+	return nil, NotImplementedError(r)
+}
+
+func (m *MultiplexController) UploadMultipartChunk(r *http.Request, bucket, key, uploadID string, partNumber int, reader io.Reader) (string, error) {
+	set, err := m.route(r, bucket)
+	if err != nil {
+		return "", err
+	}
+	return set.multipart().UploadMultipartChunk(r, bucket, key, uploadID, partNumber, reader)
+}
+
+func (m *MultiplexController) GetBucketEncryption(r *http.Request, bucket string) (*BucketEncryption, error) {
+	set, err := m.route(r, bucket)
+	if err != nil {
+		return nil, err
+	}
+	return set.encryption().GetBucketEncryption(r, bucket)
+}
+
+func (m *MultiplexController) SetBucketEncryption(r *http.Request, bucket string, config *BucketEncryption) error {
+	set, err := m.route(r, bucket)
+	if err != nil {
+		return err
+	}
+	return set.encryption().SetBucketEncryption(r, bucket, config)
+}
+
+func (m *MultiplexController) DeleteBucketEncryption(r *http.Request, bucket string) error {
+	set, err := m.route(r, bucket)
+	if err != nil {
+		return err
+	}
+	return set.encryption().DeleteBucketEncryption(r, bucket)
+}
+
+func (m *MultiplexController) GetBucketNotification(r *http.Request, bucket string) (*NotificationConfiguration, error) {
+	set, err := m.route(r, bucket)
+	if err != nil {
+		return nil, err
+	}
+	return set.notification().GetBucketNotification(r, bucket)
+}
+
+func (m *MultiplexController) SetBucketNotification(r *http.Request, bucket string, config *NotificationConfiguration) error {
+	set, err := m.route(r, bucket)
+	if err != nil {
+		return err
+	}
+	return set.notification().SetBucketNotification(r, bucket, config)
+}
@@ -0,0 +1,240 @@
+package s2_test
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pachyderm/s2"
+	"github.com/pachyderm/s2/memory"
+	"github.com/pachyderm/s2/s2test"
+	"github.com/sirupsen/logrus"
+)
+
+// controllerSet creates a controller set that's entirely served by a
+// memory backend
+func controllerSet(backend *memory.Backend) *s2.ControllerSet {
+	return &s2.ControllerSet{
+		Service:      backend,
+		Bucket:       backend,
+		Object:       backend,
+		Multipart:    backend,
+		Encryption:   backend,
+		Notification: backend,
+	}
+}
+
+// expectCode checks that an error is an S3 error with the given code
+func expectCode(t *testing.T, err error, code string) {
+	t.Helper()
+	if s3Err, ok := err.(*s2.Error); !ok || s3Err.Code != code {
+		t.Fatalf("expected a %s error, got %v", code, err)
+	}
+}
+
+func TestMultiplexConformance(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	s2test.RunConformance(t, func() *s2.S2 {
+		m := s2.NewMultiplexController()
+		m.Prefixes["b"] = controllerSet(memory.New())
+		m.Prefixes["m"] = controllerSet(memory.New())
+
+		s := s2.NewS2(logrus.NewEntry(logger), 0, 5*time.Second)
+		s.Service = m
+		s.Bucket = m
+		s.Object = m
+		s.Multipart = m
+		s.Encryption = m
+		s.Notification = m
+		return s
+	})
+}
+
+func TestMultiplexRouting(t *testing.T) {
+	backends := map[string]*memory.Backend{}
+	sets := map[string]*s2.ControllerSet{}
+	for _, name := range []string{"exact", "prefix", "shorter-prefix", "resolver", "default"} {
+		backends[name] = memory.New()
+		sets[name] = controllerSet(backends[name])
+	}
+
+	m := s2.NewMultiplexController()
+	m.Buckets["logs-exact"] = sets["exact"]
+	m.Prefixes["logs-"] = sets["prefix"]
+	m.Prefixes["lo"] = sets["shorter-prefix"]
+	m.Resolver = func(r *http.Request, bucket string) (*s2.ControllerSet, error) {
+		switch bucket {
+		case "resolved", "logs-resolved":
+			return sets["resolver"], nil
+		case "broken":
+			return nil, errors.New("resolver failed")
+		}
+		return nil, nil
+	}
+
+	r := httptest.NewRequest("PUT", "/", nil)
+	// routed gets the backend that a bucket was created in
+	routed := func(bucket string) string {
+		t.Helper()
+		for name, backend := range backends {
+			if _, err := backend.GetLocation(r, bucket); err == nil {
+				return name
+			}
+		}
+		return ""
+	}
+	tests := []struct {
+		bucket string
+		set    string
+	}{
+		// exact names take precedence over prefixes
+		{"logs-exact", "exact"},
+		// the longest matching prefix wins
+		{"logs-other", "prefix"},
+		{"local", "shorter-prefix"},
+		// prefixes take precedence over the resolver
+		{"logs-resolved", "prefix"},
+		{"resolved", "resolver"},
+	}
+	for _, test := range tests {
+		if err := m.CreateBucket(r, test.bucket, nil); err != nil {
+			t.Fatal(err)
+		}
+		if set := routed(test.bucket); set != test.set {
+			t.Fatalf("expected bucket %s to be routed to %s, got %s", test.bucket, test.set, set)
+		}
+		if _, err := m.GetLocation(r, test.bucket); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// buckets that aren't routed anywhere don't exist, and can't be created
+	expectCode(t, m.CreateBucket(r, "other", nil), "AccessDenied")
+	_, err := m.GetLocation(r, "other")
+	expectCode(t, err, "NoSuchBucket")
+	_, err = m.PutObject(r, "other", "key", strings.NewReader("content"), nil)
+	expectCode(t, err, "NoSuchBucket")
+	if _, err := m.GetLocation(r, "broken"); err == nil || err.Error() != "resolver failed" {
+		t.Fatalf("expected the resolver's error, got %v", err)
+	}
+
+	// the default set is used once the resolver falls through
+	m.Default = sets["default"]
+	if err := m.CreateBucket(r, "other", nil); err != nil {
+		t.Fatal(err)
+	}
+	if set := routed("other"); set != "default" {
+		t.Fatalf("expected bucket other to be routed to default, got %s", set)
+	}
+}
+
+func TestMultiplexListBuckets(t *testing.T) {
+	first, second, resolved := memory.New(), memory.New(), memory.New()
+	m := s2.NewMultiplexController()
+	m.Default = controllerSet(first)
+	m.Prefixes["second-"] = controllerSet(second)
+	m.Resolver = func(r *http.Request, bucket string) (*s2.ControllerSet, error) {
+		if bucket == "resolved" {
+			return controllerSet(resolved), nil
+		}
+		return nil, nil
+	}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	create := func(backend *memory.Backend, bucket string) {
+		t.Helper()
+		if err := backend.CreateBucket(r, bucket, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	create(first, "first-b")
+	create(first, "first-a")
+	// shadowed by the prefix route, so it can't be reached through the
+	// multiplexer
+	create(first, "second-shadowed")
+	create(second, "second-a")
+	// only routed to the default set, which doesn't have it
+	create(second, "elsewhere")
+	// sets that are only reachable through the resolver aren't listed
+	create(resolved, "resolved")
+
+	result, err := m.ListBuckets(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, bucket := range result.Buckets {
+		names = append(names, bucket.Name)
+	}
+	if fmt.Sprint(names) != "[first-a first-b second-a]" {
+		t.Fatalf("expected buckets [first-a first-b second-a], got %v", names)
+	}
+}
+
+func TestMultiplexCopy(t *testing.T) {
+	first, second := memory.New(), memory.New()
+	m := s2.NewMultiplexController()
+	m.Default = controllerSet(first)
+	m.Prefixes["second-"] = controllerSet(second)
+
+	r := httptest.NewRequest("PUT", "/", nil)
+	for _, bucket := range []string{"first-src", "first-dst", "second-dst"} {
+		if err := m.CreateBucket(r, bucket, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := m.PutObject(r, "first-src", "key", strings.NewReader("content"), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	copyObject := func(destBucket string) error {
+		t.Helper()
+		getResult, err := m.GetObject(r, "first-src", "key", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		copyRequest := httptest.NewRequest("PUT", "/"+destBucket+"/key", nil)
+		copyRequest.Header.Set("x-amz-copy-source", "/first-src/key")
+		_, err = m.CopyObject(copyRequest, "first-src", "key", getResult, destBucket, "key")
+		return err
+	}
+	expectContent := func(bucket string) {
+		t.Helper()
+		result, err := m.GetObject(r, bucket, "key", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := ioutil.ReadAll(result.Content)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(content) != "content" {
+			t.Fatalf("expected content %q in %s, got %q", "content", bucket, content)
+		}
+	}
+
+	// copies within a set are always allowed
+	if err := copyObject("first-dst"); err != nil {
+		t.Fatal(err)
+	}
+	expectContent("first-dst")
+
+	// copies between sets are rejected unless they're streamed
+	expectCode(t, copyObject("second-dst"), "InvalidRequest")
+	if _, err := second.GetObject(r, "second-dst", "key", ""); err == nil {
+		t.Fatal("expected a rejected copy not to write anything")
+	}
+
+	m.StreamCopies = true
+	if err := copyObject("second-dst"); err != nil {
+		t.Fatal(err)
+	}
+	expectContent("second-dst")
+}
@@ -0,0 +1,635 @@
+package s2
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// EventObjectCreatedAll matches all object creation events
+	EventObjectCreatedAll = "s3:ObjectCreated:*"
+	// EventObjectCreatedPut is fired when an object is created via PutObject
+	EventObjectCreatedPut = "s3:ObjectCreated:Put"
+	// EventObjectCreatedCopy is fired when an object is created via
+	// CopyObject
+	EventObjectCreatedCopy = "s3:ObjectCreated:Copy"
+	// EventObjectCreatedCompleteMultipartUpload is fired when an object is
+	// created via CompleteMultipartUpload
+	EventObjectCreatedCompleteMultipartUpload = "s3:ObjectCreated:CompleteMultipartUpload"
+	// EventObjectRemovedAll matches all object removal events
+	EventObjectRemovedAll = "s3:ObjectRemoved:*"
+	// EventObjectRemovedDelete is fired when an object (or an object
+	// version) is deleted
+	EventObjectRemovedDelete = "s3:ObjectRemoved:Delete"
+	// EventObjectRemovedDeleteMarkerCreated is fired when a delete marker is
+	// created in a versioning-enabled bucket
+	EventObjectRemovedDeleteMarkerCreated = "s3:ObjectRemoved:DeleteMarkerCreated"
+
+	// defaultEventMaxRetries is how many times delivery of an event to a sink
+	// is retried by default
+	defaultEventMaxRetries = 3
+	// defaultEventRetryDelay is the initial delay between event delivery
+	// retries by default. It doubles after every failed attempt.
+	defaultEventRetryDelay = time.Second
+)
+
+var (
+	// supportedEvents is the set of event names that can be used in a
+	// notification configuration
+	supportedEvents = map[string]bool{
+		EventObjectCreatedAll:                     true,
+		EventObjectCreatedPut:                     true,
+		EventObjectCreatedCopy:                    true,
+		EventObjectCreatedCompleteMultipartUpload: true,
+		EventObjectRemovedAll:                     true,
+		EventObjectRemovedDelete:                  true,
+		EventObjectRemovedDeleteMarkerCreated:     true,
+	}
+)
+
+// FilterRule is an XML marshallable representation of a key name filter in
+// a notification configuration
+type FilterRule struct {
+	// Name is either `prefix` or `suffix`
+	Name string `xml:"Name"`
+	// Value is the prefix or suffix to match keys against
+	Value string `xml:"Value"`
+}
+
+// NotificationFilter is an XML marshallable representation of the filters
+// attached to a notification configuration
+type NotificationFilter struct {
+	// FilterRules are the key name filters. All rules must match for an
+	// event to fire.
+	FilterRules []FilterRule `xml:"S3Key>FilterRule"`
+}
+
+// NotificationTarget is an XML marshallable representation of a single
+// notification destination. S3 distinguishes between topic, queue and
+// lambda function destinations; s2 treats them all the same, delivering
+// events to the `EventSink` registered under the target's ARN.
+type NotificationTarget struct {
+	// ID is an optional identifier for the configuration
+	ID string `xml:"Id,omitempty"`
+	// ARN identifies the destination that events are delivered to
+	ARN string `xml:"-"`
+	// Events are the event names that trigger a notification, e.g.
+	// `s3:ObjectCreated:*`
+	Events []string `xml:"Event"`
+	// Filter optionally restricts which keys trigger a notification
+	Filter *NotificationFilter `xml:"Filter,omitempty"`
+}
+
+// topicConfiguration, queueConfiguration and cloudFunctionConfiguration
+// only differ in the XML element name used for the destination ARN
+type topicConfiguration struct {
+	NotificationTarget
+	Topic string `xml:"Topic"`
+}
+
+type queueConfiguration struct {
+	NotificationTarget
+	Queue string `xml:"Queue"`
+}
+
+type cloudFunctionConfiguration struct {
+	NotificationTarget
+	CloudFunction string `xml:"CloudFunction"`
+}
+
+// NotificationConfiguration specifies which events on a bucket should be
+// delivered, and where
+type NotificationConfiguration struct {
+	// TopicConfigurations are destinations specified as SNS topics
+	TopicConfigurations []*NotificationTarget
+	// QueueConfigurations are destinations specified as SQS queues
+	QueueConfigurations []*NotificationTarget
+	// CloudFunctionConfigurations are destinations specified as lambda
+	// functions
+	CloudFunctionConfigurations []*NotificationTarget
+}
+
+// targets returns all of the destinations in a configuration
+func (c *NotificationConfiguration) targets() []*NotificationTarget {
+	targets := []*NotificationTarget{}
+	targets = append(targets, c.TopicConfigurations...)
+	targets = append(targets, c.QueueConfigurations...)
+	targets = append(targets, c.CloudFunctionConfigurations...)
+	return targets
+}
+
+// notificationConfigurationXML is the on-the-wire representation of a
+// `NotificationConfiguration`
+type notificationConfigurationXML struct {
+	XMLName                     xml.Name                     `xml:"http://s3.amazonaws.com/doc/2006-03-01/ NotificationConfiguration"`
+	TopicConfigurations         []topicConfiguration         `xml:"TopicConfiguration"`
+	QueueConfigurations         []queueConfiguration         `xml:"QueueConfiguration"`
+	CloudFunctionConfigurations []cloudFunctionConfiguration `xml:"CloudFunctionConfiguration"`
+}
+
+// NotificationController is an interface that specifies bucket event
+// notification configuration storage
+type NotificationController interface {
+	// GetBucketNotification gets the notification configuration of a
+	// bucket. If there is no configuration, an empty one should be
+	// returned.
+	GetBucketNotification(r *http.Request, bucket string) (*NotificationConfiguration, error)
+	// SetBucketNotification sets the notification configuration of a
+	// bucket
+	SetBucketNotification(r *http.Request, bucket string, config *NotificationConfiguration) error
+}
+
+// unimplementedNotificationController defines a controller that returns
+// `NotImplementedError` for all functionality
+type unimplementedNotificationController struct{}
+
+func (c unimplementedNotificationController) GetBucketNotification(r *http.Request, bucket string) (*NotificationConfiguration, error) {
+	return nil, NotImplementedError(r)
+}
+
+func (c unimplementedNotificationController) SetBucketNotification(r *http.Request, bucket string, config *NotificationConfiguration) error {
+	return NotImplementedError(r)
+}
+
+// EventUserIdentity identifies the user that caused an event
+type EventUserIdentity struct {
+	PrincipalID string `json:"principalId"`
+}
+
+// EventBucket describes the bucket an event occurred in
+type EventBucket struct {
+	Name          string            `json:"name"`
+	OwnerIdentity EventUserIdentity `json:"ownerIdentity"`
+	ARN           string            `json:"arn"`
+}
+
+// EventObject describes the object an event occurred on
+type EventObject struct {
+	// Key is the URL-encoded object key
+	Key       string `json:"key"`
+	Size      int64  `json:"size,omitempty"`
+	ETag      string `json:"eTag,omitempty"`
+	VersionID string `json:"versionId,omitempty"`
+	Sequencer string `json:"sequencer"`
+}
+
+// EventS3 is the S3-specific part of an event record
+type EventS3 struct {
+	SchemaVersion   string      `json:"s3SchemaVersion"`
+	ConfigurationID string      `json:"configurationId"`
+	Bucket          EventBucket `json:"bucket"`
+	Object          EventObject `json:"object"`
+}
+
+// EventRecord is a single AWS-format event notification record
+type EventRecord struct {
+	EventVersion      string            `json:"eventVersion"`
+	EventSource       string            `json:"eventSource"`
+	AWSRegion         string            `json:"awsRegion"`
+	EventTime         string            `json:"eventTime"`
+	EventName         string            `json:"eventName"`
+	UserIdentity      EventUserIdentity `json:"userIdentity"`
+	RequestParameters map[string]string `json:"requestParameters"`
+	ResponseElements  map[string]string `json:"responseElements"`
+	S3                EventS3           `json:"s3"`
+}
+
+// Event is the payload delivered to an `EventSink`. It is JSON
+// marshallable into the same format that S3 uses.
+type Event struct {
+	Records []EventRecord `json:"Records"`
+}
+
+// EventSink is an interface for destinations that bucket events are
+// delivered to. `Send` may be called concurrently. If it returns an error,
+// delivery is retried.
+type EventSink interface {
+	Send(event *Event) error
+}
+
+// WebhookSink is an `EventSink` that POSTs events as JSON to an HTTP
+// endpoint. Any non-2xx response is considered a failure.
+type WebhookSink struct {
+	// URL is the endpoint that events are POSTed to
+	URL string
+	// Client is the HTTP client used to deliver events. If nil,
+	// `http.DefaultClient` is used.
+	Client *http.Client
+}
+
+// NewWebhookSink creates a new webhook sink that delivers events to the
+// given URL
+func NewWebhookSink(url string) *WebhookSink {
+	return &WebhookSink{
+		URL:    url,
+		Client: http.DefaultClient,
+	}
+}
+
+// Send delivers an event to the webhook
+func (s *WebhookSink) Send(event *Event) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	resp, err := client.Post(s.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook %s returned status %d", s.URL, resp.StatusCode)
+	}
+	return nil
+}
+
+// ChannelSink is an `EventSink` that sends events to a go channel. Sends
+// never block: if the channel's buffer is full (or, for an unbuffered
+// channel, nothing is receiving), the send fails and is retried by the
+// dispatcher. Channels should be buffered to absorb bursts of events.
+type ChannelSink chan *Event
+
+// Send delivers an event to the channel
+func (s ChannelSink) Send(event *Event) error {
+	select {
+	case s <- event:
+		return nil
+	default:
+		return errors.New("event channel is full")
+	}
+}
+
+// EventDispatcher delivers bucket events to the sinks referenced by a
+// bucket's notification configuration. Delivery is asynchronous, and
+// failed deliveries are retried with exponential backoff.
+type EventDispatcher struct {
+	// MaxRetries is how many times a failed delivery is retried
+	MaxRetries int
+	// RetryDelay is the delay before the first retry. It doubles after
+	// every failed attempt.
+	RetryDelay time.Duration
+
+	logger    *logrus.Entry
+	sinksLock sync.RWMutex
+	sinks     map[string]EventSink
+	sequencer uint64
+	inflight  sync.WaitGroup
+}
+
+// NewEventDispatcher creates a new event dispatcher with no sinks
+func NewEventDispatcher(logger *logrus.Entry) *EventDispatcher {
+	return &EventDispatcher{
+		MaxRetries: defaultEventMaxRetries,
+		RetryDelay: defaultEventRetryDelay,
+		logger:     logger,
+		sinks:      map[string]EventSink{},
+	}
+}
+
+// RegisterSink makes a sink available to notification configurations
+// under the given ARN
+func (d *EventDispatcher) RegisterSink(arn string, sink EventSink) {
+	d.sinksLock.Lock()
+	defer d.sinksLock.Unlock()
+	d.sinks[arn] = sink
+}
+
+// Wait blocks until all in-flight deliveries have either succeeded or
+// exhausted their retries
+func (d *EventDispatcher) Wait() {
+	d.inflight.Wait()
+}
+
+// hasSinks returns whether any sinks are registered
+func (d *EventDispatcher) hasSinks() bool {
+	d.sinksLock.RLock()
+	defer d.sinksLock.RUnlock()
+	return len(d.sinks) > 0
+}
+
+func (d *EventDispatcher) sink(arn string) EventSink {
+	d.sinksLock.RLock()
+	defer d.sinksLock.RUnlock()
+	return d.sinks[arn]
+}
+
+// nextSequencer returns a value used to order events for the same key
+func (d *EventDispatcher) nextSequencer() string {
+	seq := atomic.AddUint64(&d.sequencer, 1)
+	return fmt.Sprintf("%016X", uint64(time.Now().UnixNano())+seq)
+}
+
+// deliver sends an event to a sink in the background, retrying on failure
+func (d *EventDispatcher) deliver(arn string, sink EventSink, event *Event) {
+	d.inflight.Add(1)
+	go func() {
+		defer d.inflight.Done()
+
+		delay := d.RetryDelay
+		for attempt := 0; ; attempt++ {
+			err := sink.Send(event)
+			if err == nil {
+				return
+			}
+			if attempt >= d.MaxRetries {
+				d.logger.Errorf("could not deliver event to %s after %d attempts: %v", arn, attempt+1, err)
+				return
+			}
+			d.logger.Warnf("could not deliver event to %s, retrying: %v", arn, err)
+			time.Sleep(delay)
+			delay *= 2
+		}
+	}()
+}
+
+// eventMatches checks whether an event name is selected by a list of event
+// name patterns
+func eventMatches(patterns []string, eventName string) bool {
+	for _, pattern := range patterns {
+		if pattern == eventName {
+			return true
+		}
+		if strings.HasSuffix(pattern, ":*") && strings.HasPrefix(eventName, strings.TrimSuffix(pattern, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+// filterMatches checks whether a key is selected by a notification filter
+func filterMatches(filter *NotificationFilter, key string) bool {
+	if filter == nil {
+		return true
+	}
+	for _, rule := range filter.FilterRules {
+		switch strings.ToLower(rule.Name) {
+		case "prefix":
+			if !strings.HasPrefix(key, rule.Value) {
+				return false
+			}
+		case "suffix":
+			if !strings.HasSuffix(key, rule.Value) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// objectEvent describes something that happened to an object, prior to
+// being turned into event records
+type objectEvent struct {
+	name    string
+	bucket  string
+	key     string
+	size    int64
+	etag    string
+	version string
+	// sizeFunc, if set, computes the size for events where that's
+	// expensive, so that it's only computed if the event is delivered
+	sizeFunc func() int64
+}
+
+// deleteEvent creates an object event for a completed deletion
+func deleteEvent(bucket, key, version string, result *DeleteObjectResult) objectEvent {
+	name := EventObjectRemovedDelete
+	if version == "" && result.DeleteMarker {
+		name = EventObjectRemovedDeleteMarkerCreated
+	}
+	return objectEvent{
+		name:    name,
+		bucket:  bucket,
+		key:     key,
+		version: result.Version,
+	}
+}
+
+// notifier fires bucket events after successful object operations. It
+// is shared by the handlers that mutate objects.
+type notifier struct {
+	controller NotificationController
+	dispatcher *EventDispatcher
+	logger     *logrus.Entry
+}
+
+// enabled returns whether events should be fired at all. Without any
+// registered sinks, events can't be delivered, so bucket configurations
+// aren't even looked up.
+func (n *notifier) enabled() bool {
+	return n != nil && n.dispatcher != nil && n.dispatcher.hasSinks()
+}
+
+// notify looks up the bucket's notification configuration, and delivers
+// an event record to every matching destination
+func (n *notifier) notify(r *http.Request, e objectEvent) {
+	if !n.enabled() {
+		return
+	}
+
+	config, err := n.controller.GetBucketNotification(r, e.bucket)
+	if err != nil {
+		n.logger.Errorf("could not get notification configuration for bucket %s: %v", e.bucket, err)
+		return
+	}
+	if config == nil {
+		return
+	}
+
+	targets := []*NotificationTarget{}
+	sinks := []EventSink{}
+	for _, target := range config.targets() {
+		if !eventMatches(target.Events, e.name) || !filterMatches(target.Filter, e.key) {
+			continue
+		}
+
+		sink := n.dispatcher.sink(target.ARN)
+		if sink == nil {
+			n.logger.Warnf("no event sink registered for %s", target.ARN)
+			continue
+		}
+		targets = append(targets, target)
+		sinks = append(sinks, sink)
+	}
+	if len(targets) == 0 {
+		return
+	}
+	if e.sizeFunc != nil {
+		e.size = e.sizeFunc()
+	}
+
+	vars := mux.Vars(r)
+	sourceIP, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		sourceIP = r.RemoteAddr
+	}
+	sequencer := n.dispatcher.nextSequencer()
+
+	for i, target := range targets {
+		record := EventRecord{
+			EventVersion: "2.1",
+			EventSource:  "aws:s3",
+			AWSRegion:    vars["authRegion"],
+			EventTime:    time.Now().UTC().Format("2006-01-02T15:04:05.000Z"),
+			EventName:    strings.TrimPrefix(e.name, "s3:"),
+			UserIdentity: EventUserIdentity{
+				PrincipalID: vars["authAccessKey"],
+			},
+			RequestParameters: map[string]string{
+				"sourceIPAddress": sourceIP,
+			},
+			ResponseElements: map[string]string{
+				"x-amz-request-id": vars["requestID"],
+				"x-amz-id-2":       vars["requestID"],
+			},
+			S3: EventS3{
+				SchemaVersion:   "1.0",
+				ConfigurationID: target.ID,
+				Bucket: EventBucket{
+					Name: e.bucket,
+					ARN:  fmt.Sprintf("arn:aws:s3:::%s", e.bucket),
+				},
+				Object: EventObject{
+					Key:       url.QueryEscape(e.key),
+					Size:      e.size,
+					ETag:      stripETagQuotes(e.etag),
+					VersionID: e.version,
+					Sequencer: sequencer,
+				},
+			},
+		}
+
+		n.dispatcher.deliver(target.ARN, sinks[i], &Event{Records: []EventRecord{record}})
+	}
+}
+
+type notificationHandler struct {
+	controller NotificationController
+	dispatcher *EventDispatcher
+	logger     *logrus.Entry
+}
+
+func (h *notificationHandler) get(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	bucket := vars["bucket"]
+
+	config, err := h.controller.GetBucketNotification(r, bucket)
+	if err != nil {
+		WriteError(h.logger, w, r, err)
+		return
+	}
+
+	marshallable := notificationConfigurationXML{
+		TopicConfigurations:         []topicConfiguration{},
+		QueueConfigurations:         []queueConfiguration{},
+		CloudFunctionConfigurations: []cloudFunctionConfiguration{},
+	}
+	if config != nil {
+		for _, target := range config.TopicConfigurations {
+			marshallable.TopicConfigurations = append(marshallable.TopicConfigurations, topicConfiguration{NotificationTarget: *target, Topic: target.ARN})
+		}
+		for _, target := range config.QueueConfigurations {
+			marshallable.QueueConfigurations = append(marshallable.QueueConfigurations, queueConfiguration{NotificationTarget: *target, Queue: target.ARN})
+		}
+		for _, target := range config.CloudFunctionConfigurations {
+			marshallable.CloudFunctionConfigurations = append(marshallable.CloudFunctionConfigurations, cloudFunctionConfiguration{NotificationTarget: *target, CloudFunction: target.ARN})
+		}
+	}
+
+	writeXML(h.logger, w, r, http.StatusOK, marshallable)
+}
+
+func (h *notificationHandler) put(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	bucket := vars["bucket"]
+
+	payload := struct {
+		XMLName                     xml.Name                     `xml:"NotificationConfiguration"`
+		TopicConfigurations         []topicConfiguration         `xml:"TopicConfiguration"`
+		QueueConfigurations         []queueConfiguration         `xml:"QueueConfiguration"`
+		CloudFunctionConfigurations []cloudFunctionConfiguration `xml:"CloudFunctionConfiguration"`
+	}{}
+	if err := readXMLBody(r, &payload); err != nil {
+		WriteError(h.logger, w, r, err)
+		return
+	}
+
+	config := &NotificationConfiguration{
+		TopicConfigurations:         []*NotificationTarget{},
+		QueueConfigurations:         []*NotificationTarget{},
+		CloudFunctionConfigurations: []*NotificationTarget{},
+	}
+	for _, c := range payload.TopicConfigurations {
+		target := c.NotificationTarget
+		target.ARN = c.Topic
+		config.TopicConfigurations = append(config.TopicConfigurations, &target)
+	}
+	for _, c := range payload.QueueConfigurations {
+		target := c.NotificationTarget
+		target.ARN = c.Queue
+		config.QueueConfigurations = append(config.QueueConfigurations, &target)
+	}
+	for _, c := range payload.CloudFunctionConfigurations {
+		target := c.NotificationTarget
+		target.ARN = c.CloudFunction
+		config.CloudFunctionConfigurations = append(config.CloudFunctionConfigurations, &target)
+	}
+
+	for _, target := range config.targets() {
+		if err := h.validateTarget(r, target); err != nil {
+			WriteError(h.logger, w, r, err)
+			return
+		}
+	}
+
+	if err := h.controller.SetBucketNotification(r, bucket, config); err != nil {
+		WriteError(h.logger, w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// validateTarget checks that a notification destination is well-formed,
+// and that it refers to a registered sink
+func (h *notificationHandler) validateTarget(r *http.Request, target *NotificationTarget) error {
+	if target.ARN == "" || len(target.Events) == 0 {
+		return MalformedXMLError(r)
+	}
+	for _, event := range target.Events {
+		if !supportedEvents[event] {
+			return InvalidArgumentError(r)
+		}
+	}
+	if target.Filter != nil {
+		for _, rule := range target.Filter.FilterRules {
+			name := strings.ToLower(rule.Name)
+			if name != "prefix" && name != "suffix" {
+				return InvalidArgumentError(r)
+			}
+		}
+	}
+	if h.dispatcher != nil && h.dispatcher.sink(target.ARN) == nil {
+		return InvalidArgumentError(r)
+	}
+	return nil
+}
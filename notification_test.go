@@ -0,0 +1,239 @@
+package s2
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestEventMatches(t *testing.T) {
+	tests := []struct {
+		patterns  []string
+		eventName string
+		matches   bool
+	}{
+		{[]string{EventObjectCreatedPut}, EventObjectCreatedPut, true},
+		{[]string{EventObjectCreatedPut}, EventObjectCreatedCopy, false},
+		{[]string{EventObjectCreatedAll}, EventObjectCreatedPut, true},
+		{[]string{EventObjectCreatedAll}, EventObjectCreatedCompleteMultipartUpload, true},
+		{[]string{EventObjectCreatedAll}, EventObjectRemovedDelete, false},
+		{[]string{EventObjectRemovedAll}, EventObjectRemovedDeleteMarkerCreated, true},
+		{[]string{EventObjectCreatedCopy, EventObjectRemovedAll}, EventObjectRemovedDelete, true},
+		// only whole event name components are wildcards
+		{[]string{"s3:Object*"}, EventObjectCreatedPut, false},
+		{[]string{"s3:ObjectCreated:*"}, "s3:ObjectCreatedPut", false},
+		{nil, EventObjectCreatedPut, false},
+	}
+
+	for _, test := range tests {
+		if matches := eventMatches(test.patterns, test.eventName); matches != test.matches {
+			t.Errorf("expected eventMatches(%v, %s) to be %v", test.patterns, test.eventName, test.matches)
+		}
+	}
+}
+
+func TestFilterMatches(t *testing.T) {
+	filter := func(rules ...FilterRule) *NotificationFilter {
+		return &NotificationFilter{FilterRules: rules}
+	}
+	tests := []struct {
+		filter  *NotificationFilter
+		key     string
+		matches bool
+	}{
+		{nil, "key", true},
+		{filter(), "key", true},
+		{filter(FilterRule{"prefix", "images/"}), "images/a.jpg", true},
+		{filter(FilterRule{"prefix", "images/"}), "videos/a.mp4", false},
+		{filter(FilterRule{"suffix", ".jpg"}), "images/a.jpg", true},
+		{filter(FilterRule{"suffix", ".jpg"}), "images/a.png", false},
+		// rule names are case-insensitive
+		{filter(FilterRule{"Prefix", "images/"}), "images/a.jpg", true},
+		{filter(FilterRule{"SUFFIX", ".jpg"}), "images/a.png", false},
+		// all rules must match
+		{filter(FilterRule{"prefix", "images/"}, FilterRule{"suffix", ".jpg"}), "images/a.jpg", true},
+		{filter(FilterRule{"prefix", "images/"}, FilterRule{"suffix", ".jpg"}), "images/a.png", false},
+		{filter(FilterRule{"prefix", "images/"}, FilterRule{"suffix", ".jpg"}), "a.jpg", false},
+	}
+
+	for _, test := range tests {
+		if matches := filterMatches(test.filter, test.key); matches != test.matches {
+			t.Errorf("expected filterMatches(%+v, %s) to be %v", test.filter, test.key, test.matches)
+		}
+	}
+}
+
+func TestChannelSink(t *testing.T) {
+	sink := make(ChannelSink, 1)
+	event := &Event{Records: []EventRecord{{EventName: "ObjectCreated:Put"}}}
+
+	if err := sink.Send(event); err != nil {
+		t.Fatal(err)
+	}
+	// sends fail rather than block when the channel is full
+	if err := sink.Send(event); err == nil {
+		t.Fatal("expected sending to a full channel to fail")
+	}
+	if received := <-sink; received != event {
+		t.Fatalf("expected to receive %v, got %v", event, received)
+	}
+	if err := sink.Send(event); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWebhookSink(t *testing.T) {
+	status := http.StatusOK
+	var received Event
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&received); err != nil {
+			t.Errorf("could not decode event: %v", err)
+		}
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	sink := NewWebhookSink(server.URL)
+	event := &Event{Records: []EventRecord{{EventName: "ObjectCreated:Put"}}}
+	if err := sink.Send(event); err != nil {
+		t.Fatal(err)
+	}
+	if len(received.Records) != 1 || received.Records[0].EventName != "ObjectCreated:Put" {
+		t.Fatalf("unexpected event delivered: %+v", received)
+	}
+
+	status = http.StatusInternalServerError
+	if err := sink.Send(event); err == nil {
+		t.Fatal("expected a non-2xx response to fail")
+	}
+}
+
+// flakySink fails a number of sends before succeeding, recording when each
+// send was attempted
+type flakySink struct {
+	lock     sync.Mutex
+	failures int
+	attempts []time.Time
+}
+
+func (s *flakySink) Send(event *Event) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.attempts = append(s.attempts, time.Now())
+	if len(s.attempts) <= s.failures {
+		return errors.New("unavailable")
+	}
+	return nil
+}
+
+func TestEventDispatcherRetries(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	d := NewEventDispatcher(logrus.NewEntry(logger))
+	d.MaxRetries = 3
+	d.RetryDelay = 10 * time.Millisecond
+
+	// succeeds on the last retry, with the delay doubling each time
+	sink := &flakySink{failures: 3}
+	d.deliver("arn", sink, &Event{})
+	d.Wait()
+	if len(sink.attempts) != 4 {
+		t.Fatalf("expected 4 attempts, got %d", len(sink.attempts))
+	}
+	delay := d.RetryDelay
+	for i := 1; i < len(sink.attempts); i++ {
+		if elapsed := sink.attempts[i].Sub(sink.attempts[i-1]); elapsed < delay {
+			t.Fatalf("expected retry %d to wait at least %v, waited %v", i, delay, elapsed)
+		}
+		delay *= 2
+	}
+
+	// gives up once the retries are exhausted
+	sink = &flakySink{failures: 10}
+	d.deliver("arn", sink, &Event{})
+	d.Wait()
+	if len(sink.attempts) != 4 {
+		t.Fatalf("expected 4 attempts, got %d", len(sink.attempts))
+	}
+
+	// isn't retried if it succeeds
+	sink = &flakySink{}
+	d.deliver("arn", sink, &Event{})
+	d.Wait()
+	if len(sink.attempts) != 1 {
+		t.Fatalf("expected 1 attempt, got %d", len(sink.attempts))
+	}
+}
+
+// staticNotificationController serves a fixed notification configuration,
+// counting how often it's looked up
+type staticNotificationController struct {
+	unimplementedNotificationController
+	config  *NotificationConfiguration
+	lookups int
+}
+
+func (c *staticNotificationController) GetBucketNotification(r *http.Request, bucket string) (*NotificationConfiguration, error) {
+	c.lookups++
+	return c.config, nil
+}
+
+func TestNotifierSkipsUndeliverableEvents(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	controller := &staticNotificationController{config: &NotificationConfiguration{}}
+	n := &notifier{
+		controller: controller,
+		dispatcher: NewEventDispatcher(logrus.NewEntry(logger)),
+		logger:     logrus.NewEntry(logger),
+	}
+	r := httptest.NewRequest("PUT", "/bucket/key", nil)
+	sizes := 0
+	notify := func(key string) {
+		n.notify(r, objectEvent{
+			name:   EventObjectCreatedPut,
+			bucket: "bucket",
+			key:    key,
+			sizeFunc: func() int64 {
+				sizes++
+				return 5
+			},
+		})
+	}
+
+	// without any sinks, configurations aren't looked up
+	notify("a.txt")
+	if controller.lookups != 0 {
+		t.Fatalf("expected no configuration lookups, got %d", controller.lookups)
+	}
+
+	// sizes aren't computed for events that don't match any destination
+	sink := make(ChannelSink, 1)
+	n.dispatcher.RegisterSink("arn", sink)
+	notify("a.txt")
+	controller.config.QueueConfigurations = []*NotificationTarget{{
+		ARN:    "arn",
+		Events: []string{EventObjectCreatedAll},
+		Filter: &NotificationFilter{FilterRules: []FilterRule{{"suffix", ".txt"}}},
+	}}
+	notify("a.bin")
+	if controller.lookups != 2 || sizes != 0 {
+		t.Fatalf("expected 2 lookups and no sizes computed, got %d and %d", controller.lookups, sizes)
+	}
+
+	notify("a.txt")
+	n.dispatcher.Wait()
+	if sizes != 1 {
+		t.Fatalf("expected the size to be computed once, got %d", sizes)
+	}
+	if event := <-sink; event.Records[0].S3.Object.Size != 5 {
+		t.Fatalf("expected an event with size 5, got %+v", event.Records[0].S3.Object)
+	}
+}
@@ -1,10 +1,13 @@
 package s2
 
 import (
+	"bytes"
 	"encoding/xml"
+	"fmt"
 	"io"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 	"time"
 
@@ -12,6 +15,17 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
+// responseHeaderOverrides maps the query parameters that can override the
+// headers of a GET response to the headers they override
+var responseHeaderOverrides = map[string]string{
+	"response-cache-control":       "Cache-Control",
+	"response-content-disposition": "Content-Disposition",
+	"response-content-encoding":    "Content-Encoding",
+	"response-content-language":    "Content-Language",
+	"response-content-type":        "Content-Type",
+	"response-expires":             "Expires",
+}
+
 // GetObjectResult is a response from a GetObject call
 type GetObjectResult struct {
 	// ETag is a hex encoding of the hash of the object contents, with or
@@ -25,8 +39,13 @@ type GetObjectResult struct {
 	DeleteMarker bool
 	// ModTime specifies when the object was modified.
 	ModTime time.Time
-	// Content is the contents of the object.
+	// Content is the contents of the object. If it implements `io.Closer`,
+	// it's closed once the request has been handled.
 	Content io.ReadSeeker
+	// PartSizes specifies the size of each part of the object, in order, if
+	// it was created by a multipart upload. It's used to serve `partNumber`
+	// reads. If nil, the object is treated as having a single part.
+	PartSizes []int64
 }
 
 // PutObjectResult is a response from a PutObject call
@@ -55,8 +74,12 @@ type ObjectController interface {
 	GetObject(r *http.Request, bucket, key, version string) (*GetObjectResult, error)
 	// CopyObject copies an object
 	CopyObject(r *http.Request, srcBucket, srcKey string, getResult *GetObjectResult, destBucket, destKey string) (string, error)
-	// PutObject sets an object
-	PutObject(r *http.Request, bucket, key string, reader io.Reader) (*PutObjectResult, error)
+	// PutObject sets an object. If `preconditions` is non-nil, it must be
+	// checked atomically with the write; if the preconditions don't hold, or
+	// a conflicting conditional write is in progress, implementations should
+	// return the error from `Preconditions.Check` or
+	// `ConditionalRequestConflictError` respectively.
+	PutObject(r *http.Request, bucket, key string, reader io.Reader, preconditions *Preconditions) (*PutObjectResult, error)
 	// DeleteObject deletes an object
 	DeleteObject(r *http.Request, bucket, key, version string) (*DeleteObjectResult, error)
 }
@@ -73,7 +96,7 @@ func (c unimplementedObjectController) CopyObject(r *http.Request, srcBucket, sr
 	return "", NotImplementedError(r)
 }
 
-func (c unimplementedObjectController) PutObject(r *http.Request, bucket, key string, reader io.Reader) (*PutObjectResult, error) {
+func (c unimplementedObjectController) PutObject(r *http.Request, bucket, key string, reader io.Reader, preconditions *Preconditions) (*PutObjectResult, error) {
 	return nil, NotImplementedError(r)
 }
 
@@ -83,6 +106,8 @@ func (c unimplementedObjectController) DeleteObject(r *http.Request, bucket, key
 
 type objectHandler struct {
 	controller ObjectController
+	notifier   *notifier
+	encryptor  *encryptor
 	logger     *logrus.Entry
 }
 
@@ -92,11 +117,34 @@ func (h *objectHandler) get(w http.ResponseWriter, r *http.Request) {
 	key := vars["key"]
 	versionId := r.FormValue("versionId")
 
+	partNumber, err := intFormValue(r, "partNumber", 1, maxPartsAllowed, 0)
+	if err != nil {
+		WriteError(h.logger, w, r, err)
+		return
+	}
+	if partNumber > 0 && r.Header.Get("Range") != "" {
+		WriteError(h.logger, w, r, InvalidRequestError(r, "Cannot specify both Range header and partNumber query parameter"))
+		return
+	}
+
+	overrides, err := headerOverrides(r)
+	if err != nil {
+		WriteError(h.logger, w, r, err)
+		return
+	}
+
+	customerKey, err := customerKeyFromRequest(r, sseCustomerHeaderPrefix)
+	if err != nil {
+		WriteError(h.logger, w, r, err)
+		return
+	}
+
 	result, err := h.controller.GetObject(r, bucket, key, versionId)
 	if err != nil {
 		WriteError(h.logger, w, r, err)
 		return
 	}
+	defer closeContent(result.Content)
 
 	if result.ETag != "" {
 		w.Header().Set("ETag", addETagQuotes(result.ETag))
@@ -105,13 +153,96 @@ func (h *objectHandler) get(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("x-amz-version-id", result.Version)
 	}
 
+	switch checkGetPreconditions(r, !result.DeleteMarker, addETagQuotes(result.ETag), result.ModTime) {
+	case http.StatusNotModified:
+		if !isZeroTime(result.ModTime) {
+			w.Header().Set("Last-Modified", result.ModTime.UTC().Format(http.TimeFormat))
+		}
+		w.WriteHeader(http.StatusNotModified)
+		return
+	case http.StatusPreconditionFailed:
+		WriteError(h.logger, w, r, PreconditionFailedError(r))
+		return
+	}
+
 	if result.DeleteMarker {
 		w.Header().Set("x-amz-delete-marker", "true")
 		WriteError(h.logger, w, r, NoSuchKeyError(r))
 		return
 	}
 
-	http.ServeContent(w, r, key, result.ModTime, result.Content)
+	content, encryption, err := h.encryptor.decrypt(r, result.Content, customerKey)
+	if err != nil {
+		WriteError(h.logger, w, r, err)
+		return
+	}
+
+	if partNumber > 0 {
+		partSizes := result.PartSizes
+		if decrypted, ok := content.(*decryptReadSeeker); ok && len(partSizes) > 0 {
+			// the controller's part sizes include encryption overhead
+			partSizes = decrypted.segmentSizes
+		}
+		content, err = selectPart(r, content, partSizes, partNumber)
+		if err != nil {
+			WriteError(h.logger, w, r, err)
+			return
+		}
+		if len(partSizes) > 0 {
+			w.Header().Set("x-amz-mp-parts-count", strconv.Itoa(len(partSizes)))
+		}
+	}
+
+	encryption.setHeaders(w)
+	for header, value := range overrides {
+		w.Header().Set(header, value)
+	}
+	http.ServeContent(w, r, key, result.ModTime, content)
+}
+
+// headerOverrides gets the response headers a GET request asks to override.
+// As with S3, overrides can't be used by unsigned requests when auth is
+// enabled.
+func headerOverrides(r *http.Request) (map[string]string, error) {
+	overrides := map[string]string{}
+	for param, header := range responseHeaderOverrides {
+		if value := r.FormValue(param); value != "" {
+			overrides[header] = value
+		}
+	}
+
+	if len(overrides) > 0 && mux.Vars(r)["authMethod"] == "custom" {
+		return nil, InvalidRequestError(r, "Request specific response headers cannot be used for anonymous GET requests.")
+	}
+	return overrides, nil
+}
+
+// selectPart narrows a GET request down to a single part of an object. The
+// part is served as a byte range of the object. Objects that weren't created
+// by a multipart upload are treated as having a single part.
+func selectPart(r *http.Request, content io.ReadSeeker, partSizes []int64, partNumber int) (io.ReadSeeker, error) {
+	if len(partSizes) == 0 {
+		if partNumber != 1 {
+			return nil, InvalidPartNumberError(r)
+		}
+		return content, nil
+	}
+	if partNumber > len(partSizes) {
+		return nil, InvalidPartNumberError(r)
+	}
+
+	var start int64
+	for _, size := range partSizes[:partNumber-1] {
+		start += size
+	}
+	size := partSizes[partNumber-1]
+	if size == 0 {
+		return bytes.NewReader(nil), nil
+	}
+
+	r.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, start+size-1))
+	r.Header.Del("If-Range")
+	return content, nil
 }
 
 func (h *objectHandler) copy(w http.ResponseWriter, r *http.Request) {
@@ -164,22 +295,34 @@ func (h *objectHandler) copy(w http.ResponseWriter, r *http.Request) {
 	ifUnmodifiedSince := r.Header.Get("x-amz-copy-source-if-unmodified-since")
 	ifModifiedSince := r.Header.Get("x-amz-copy-source-if-modified-since")
 
+	srcCustomerKey, err := customerKeyFromRequest(r, sseCopySourceCustomerHeaderPrefix)
+	if err != nil {
+		WriteError(h.logger, w, r, err)
+		return
+	}
+	destEncryption, err := h.encryptor.forWrite(r, destBucket)
+	if err != nil {
+		WriteError(h.logger, w, r, err)
+		return
+	}
+
 	getResult, err := h.controller.GetObject(r, srcBucket, srcKey, srcVersionID)
 	if err != nil {
 		WriteError(h.logger, w, r, err)
 		return
 	}
+	defer closeContent(getResult.Content)
 	if getResult.DeleteMarker {
 		WriteError(h.logger, w, r, NoSuchKeyError(r))
 		return
 	}
 
-	if !checkIfMatch(ifMatch, getResult.ETag) {
+	if !checkIfMatch(ifMatch, addETagQuotes(getResult.ETag)) {
 		WriteError(h.logger, w, r, PreconditionFailedError(r))
 		return
 	}
 
-	if !checkIfNoneMatch(ifNoneMatch, getResult.ETag) {
+	if !checkIfNoneMatch(ifNoneMatch, addETagQuotes(getResult.ETag)) {
 		WriteError(h.logger, w, r, PreconditionFailedError(r))
 		return
 	}
@@ -194,6 +337,21 @@ func (h *objectHandler) copy(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// decrypt the source and (re-)encrypt for the destination, so that
+	// controllers copying from `getResult.Content` store the right bytes.
+	// This is only done once the preconditions pass, since the whole
+	// source is read.
+	plaintext, _, err := h.encryptor.decrypt(r, getResult.Content, srcCustomerKey)
+	if err != nil {
+		WriteError(h.logger, w, r, err)
+		return
+	}
+	getResult.Content, err = h.encryptor.encryptSeekable(r, plaintext, destEncryption)
+	if err != nil {
+		WriteError(h.logger, w, r, err)
+		return
+	}
+
 	destVersionID, err := h.controller.CopyObject(r, srcBucket, srcKey, getResult, destBucket, destKey)
 	if err != nil {
 		WriteError(h.logger, w, r, err)
@@ -205,7 +363,19 @@ func (h *objectHandler) copy(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if destVersionID != "" {
-		w.Header().Set("x-amz-version-id", srcVersionID)
+		w.Header().Set("x-amz-version-id", destVersionID)
+	}
+	destEncryption.setHeaders(w)
+
+	if h.notifier.enabled() {
+		h.notifier.notify(r, objectEvent{
+			name:    EventObjectCreatedCopy,
+			bucket:  destBucket,
+			key:     destKey,
+			size:    contentSize(plaintext),
+			etag:    getResult.ETag,
+			version: destVersionID,
+		})
 	}
 
 	marshallable := struct {
@@ -238,24 +408,31 @@ func (h *objectHandler) put(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	bucket := vars["bucket"]
 	key := vars["key"]
-	chunked := r.Header.Get("X-Amz-Content-Sha256") == "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
-
-	var body io.ReadCloser
-	if chunked {
-		signingKey := []byte(vars["authSignatureKey"])
-		seedSignature := vars["authSignature"]
-		timestamp := vars["authSignatureTimestamp"]
-		date := vars["authSignatureDate"]
-		region := vars["authSignatureRegion"]
-		body = newChunkedReader(r.Body, signingKey, seedSignature, timestamp, date, region)
-	} else {
-		body = r.Body
+
+	preconditions, err := preconditionsFromRequest(r)
+	if err != nil {
+		WriteError(h.logger, w, r, err)
+		return
+	}
+	encryption, err := h.encryptor.forWrite(r, bucket)
+	if err != nil {
+		WriteError(h.logger, w, r, err)
+		return
 	}
 
-	result, err := h.controller.PutObject(r, bucket, key, body)
+	counter := &countingReader{reader: requestBody(r)}
+	reader, err := h.encryptor.encrypt(r, counter, encryption)
+	if err != nil {
+		WriteError(h.logger, w, r, err)
+		return
+	}
+
+	result, err := h.controller.PutObject(r, bucket, key, reader, preconditions)
 	if err != nil {
 		if err == InvalidChunk {
 			WriteError(h.logger, w, r, SignatureDoesNotMatchError(r))
+		} else if err == errEncryptedLengthMismatch {
+			WriteError(h.logger, w, r, IncompleteBodyError(r))
 		} else {
 			WriteError(h.logger, w, r, err)
 		}
@@ -268,7 +445,17 @@ func (h *objectHandler) put(w http.ResponseWriter, r *http.Request) {
 	if result.Version != "" {
 		w.Header().Set("x-amz-version-id", result.Version)
 	}
+	encryption.setHeaders(w)
 	w.WriteHeader(http.StatusOK)
+
+	h.notifier.notify(r, objectEvent{
+		name:    EventObjectCreatedPut,
+		bucket:  bucket,
+		key:     key,
+		size:    counter.n,
+		etag:    result.ETag,
+		version: result.Version,
+	})
 }
 
 func (h *objectHandler) del(w http.ResponseWriter, r *http.Request) {
@@ -290,6 +477,8 @@ func (h *objectHandler) del(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("x-amz-delete-marker", "true")
 	}
 	w.WriteHeader(http.StatusNoContent)
+
+	h.notifier.notify(r, deleteEvent(bucket, key, versionId, result))
 }
 
 func (h *objectHandler) post(w http.ResponseWriter, r *http.Request) {
@@ -356,6 +545,8 @@ func (h *objectHandler) post(w http.ResponseWriter, r *http.Request) {
 				deleteMarkerVersion = result.Version
 			}
 
+			h.notifier.notify(r, deleteEvent(bucket, object.Key, object.Version, result))
+
 			if !payload.Quiet {
 				marshallable.Deleted = append(marshallable.Deleted, struct {
 					Key                 string `xml:"Key"`
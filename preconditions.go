@@ -0,0 +1,65 @@
+package s2
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Preconditions are conditions on the current state of an object that must
+// hold for a write to it to succeed. They're passed to controllers, rather
+// than checked by s2, so that they can be evaluated atomically with the
+// write, under the controller's own locking.
+type Preconditions struct {
+	// IfMatch, if set, requires the object to exist and to have a matching
+	// ETag (compare-and-swap.)
+	IfMatch string
+	// IfNoneMatch, if true, requires the object to not exist (create-only.)
+	IfNoneMatch bool
+}
+
+// Check evaluates the preconditions against the current state of the
+// object. `exists` specifies whether the object currently exists (a delete
+// marker doesn't count), and `etag` is its ETag, with or without
+// surrounding quotes. If a precondition doesn't hold, an appropriate S3
+// error is returned. It's safe to call `Check` on nil preconditions.
+func (p *Preconditions) Check(r *http.Request, exists bool, etag string) error {
+	if p == nil {
+		return nil
+	}
+	if p.IfNoneMatch && exists {
+		return PreconditionFailedError(r)
+	}
+	if p.IfMatch != "" {
+		if !exists {
+			return NoSuchKeyError(r)
+		}
+		if !checkIfMatch(p.IfMatch, addETagQuotes(etag)) {
+			return PreconditionFailedError(r)
+		}
+	}
+	return nil
+}
+
+// preconditionsFromRequest parses the conditional write headers of a
+// request. If the request has none, nil is returned.
+func preconditionsFromRequest(r *http.Request) (*Preconditions, error) {
+	ifMatch := strings.TrimSpace(r.Header.Get("If-Match"))
+	ifNoneMatch := strings.TrimSpace(r.Header.Get("If-None-Match"))
+	if ifMatch == "" && ifNoneMatch == "" {
+		return nil, nil
+	}
+
+	// S3 only supports `If-None-Match: *` on writes. Clients may quote the
+	// wildcard, which is accepted as well.
+	if ifNoneMatch != "" && stripETagQuotes(ifNoneMatch) != "*" {
+		return nil, NotImplementedError(r)
+	}
+	if ifMatch != "" && stripETagQuotes(ifMatch) == "*" {
+		return nil, NotImplementedError(r)
+	}
+
+	return &Preconditions{
+		IfMatch:     ifMatch,
+		IfNoneMatch: ifNoneMatch != "",
+	}, nil
+}
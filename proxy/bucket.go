@@ -0,0 +1,296 @@
+package proxy
+
+import (
+	"encoding/xml"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/pachyderm/s2"
+)
+
+// GetLocation gets the region of an upstream bucket
+func (p *Proxy) GetLocation(r *http.Request, bucket string) (string, error) {
+	res, err := p.do(r, "GET", p.path(bucket, ""), url.Values{"location": {""}}, nil, nil)
+	if err != nil {
+		return "", err
+	}
+	var result struct {
+		Location string `xml:",chardata"`
+	}
+	if err := res.Decode(&result); err != nil {
+		return "", err
+	}
+	return result.Location, nil
+}
+
+// HeadBucket checks that an upstream bucket exists, and reports its region
+func (p *Proxy) HeadBucket(r *http.Request, bucket string) (*s2.HeadBucketResult, error) {
+	res, err := p.do(r, "HEAD", p.path(bucket, ""), nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &s2.HeadBucketResult{Region: res.Header.Get("x-amz-bucket-region")}, nil
+}
+
+// ListObjects lists the objects in an upstream bucket
+func (p *Proxy) ListObjects(r *http.Request, bucket, prefix, marker, delimiter string, maxKeys int) (*s2.ListObjectsResult, error) {
+	query := url.Values{
+		"prefix":    {prefix},
+		"marker":    {marker},
+		"delimiter": {delimiter},
+		"max-keys":  {strconv.Itoa(maxKeys)},
+	}
+	res, err := p.do(r, "GET", p.path(bucket, ""), query, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var result struct {
+		Contents       []*s2.Contents       `xml:"Contents"`
+		CommonPrefixes []*s2.CommonPrefixes `xml:"CommonPrefixes"`
+		IsTruncated    bool                 `xml:"IsTruncated"`
+	}
+	if err := res.Decode(&result); err != nil {
+		return nil, err
+	}
+	return &s2.ListObjectsResult{
+		Contents:       result.Contents,
+		CommonPrefixes: result.CommonPrefixes,
+		IsTruncated:    result.IsTruncated,
+	}, nil
+}
+
+// ListObjectVersions lists the versions of objects in an upstream bucket
+func (p *Proxy) ListObjectVersions(r *http.Request, bucket, prefix, keyMarker, versionMarker string, delimiter string, maxKeys int) (*s2.ListObjectVersionsResult, error) {
+	query := url.Values{
+		"versions":          {""},
+		"prefix":            {prefix},
+		"key-marker":        {keyMarker},
+		"version-id-marker": {versionMarker},
+		"delimiter":         {delimiter},
+		"max-keys":          {strconv.Itoa(maxKeys)},
+	}
+	res, err := p.do(r, "GET", p.path(bucket, ""), query, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var result struct {
+		Versions            []*s2.Version      `xml:"Version"`
+		DeleteMarkers       []*s2.DeleteMarker `xml:"DeleteMarker"`
+		IsTruncated         bool               `xml:"IsTruncated"`
+		NextKeyMarker       string             `xml:"NextKeyMarker"`
+		NextVersionIDMarker string             `xml:"NextVersionIdMarker"`
+	}
+	if err := res.Decode(&result); err != nil {
+		return nil, err
+	}
+	return &s2.ListObjectVersionsResult{
+		Versions:            result.Versions,
+		DeleteMarkers:       result.DeleteMarkers,
+		IsTruncated:         result.IsTruncated,
+		NextKeyMarker:       result.NextKeyMarker,
+		NextVersionIDMarker: result.NextVersionIDMarker,
+	}, nil
+}
+
+// CreateBucket creates an upstream bucket
+func (p *Proxy) CreateBucket(r *http.Request, bucket string, options *s2.CreateBucketOptions) error {
+	header := http.Header{}
+	var body []byte
+	if options != nil {
+		if options.ObjectLockEnabled {
+			header.Set("x-amz-bucket-object-lock-enabled", "true")
+		}
+		if options.LocationConstraint != "" {
+			var err error
+			body, err = xml.Marshal(struct {
+				XMLName            xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ CreateBucketConfiguration"`
+				LocationConstraint string   `xml:"LocationConstraint"`
+			}{
+				LocationConstraint: options.LocationConstraint,
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	_, err := p.do(r, "PUT", p.path(bucket, ""), nil, header, body)
+	return err
+}
+
+// DeleteBucket deletes an upstream bucket
+func (p *Proxy) DeleteBucket(r *http.Request, bucket string) error {
+	_, err := p.do(r, "DELETE", p.path(bucket, ""), nil, nil, nil)
+	return err
+}
+
+// versioningConfiguration is the XML form of a bucket's versioning state
+type versioningConfiguration struct {
+	XMLName xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ VersioningConfiguration"`
+	Status  string   `xml:"Status,omitempty"`
+}
+
+// GetBucketVersioning gets the versioning state of an upstream bucket
+func (p *Proxy) GetBucketVersioning(r *http.Request, bucket string) (string, error) {
+	res, err := p.do(r, "GET", p.path(bucket, ""), url.Values{"versioning": {""}}, nil, nil)
+	if err != nil {
+		return "", err
+	}
+	var result versioningConfiguration
+	if err := res.Decode(&result); err != nil {
+		return "", err
+	}
+	return result.Status, nil
+}
+
+// SetBucketVersioning sets the versioning state of an upstream bucket
+func (p *Proxy) SetBucketVersioning(r *http.Request, bucket, status string) error {
+	body, err := xml.Marshal(versioningConfiguration{Status: status})
+	if err != nil {
+		return err
+	}
+	_, err = p.do(r, "PUT", p.path(bucket, ""), url.Values{"versioning": {""}}, nil, body)
+	return err
+}
+
+// encryptionRule is the XML form of `s2.BucketEncryption`
+type encryptionRule struct {
+	ApplyServerSideEncryptionByDefault struct {
+		SSEAlgorithm   string `xml:"SSEAlgorithm"`
+		KMSMasterKeyID string `xml:"KMSMasterKeyID,omitempty"`
+	} `xml:"ApplyServerSideEncryptionByDefault"`
+	BucketKeyEnabled bool `xml:"BucketKeyEnabled"`
+}
+
+// encryptionConfiguration is the XML form of a bucket's default encryption
+type encryptionConfiguration struct {
+	XMLName xml.Name         `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ServerSideEncryptionConfiguration"`
+	Rules   []encryptionRule `xml:"Rule"`
+}
+
+// GetBucketEncryption gets the default encryption of an upstream bucket, or
+// nil if there is none
+func (p *Proxy) GetBucketEncryption(r *http.Request, bucket string) (*s2.BucketEncryption, error) {
+	res, err := p.do(r, "GET", p.path(bucket, ""), url.Values{"encryption": {""}}, nil, nil)
+	if err != nil {
+		if s3Err, ok := err.(*s2.Error); ok && s3Err.Code == "ServerSideEncryptionConfigurationNotFoundError" {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var result encryptionConfiguration
+	if err := res.Decode(&result); err != nil {
+		return nil, err
+	}
+	if len(result.Rules) == 0 {
+		return nil, nil
+	}
+	rule := result.Rules[0]
+	return &s2.BucketEncryption{
+		Algorithm:        rule.ApplyServerSideEncryptionByDefault.SSEAlgorithm,
+		KMSMasterKeyID:   rule.ApplyServerSideEncryptionByDefault.KMSMasterKeyID,
+		BucketKeyEnabled: rule.BucketKeyEnabled,
+	}, nil
+}
+
+// SetBucketEncryption sets the default encryption of an upstream bucket
+func (p *Proxy) SetBucketEncryption(r *http.Request, bucket string, encryption *s2.BucketEncryption) error {
+	rule := encryptionRule{BucketKeyEnabled: encryption.BucketKeyEnabled}
+	rule.ApplyServerSideEncryptionByDefault.SSEAlgorithm = encryption.Algorithm
+	rule.ApplyServerSideEncryptionByDefault.KMSMasterKeyID = encryption.KMSMasterKeyID
+
+	body, err := xml.Marshal(encryptionConfiguration{Rules: []encryptionRule{rule}})
+	if err != nil {
+		return err
+	}
+	_, err = p.do(r, "PUT", p.path(bucket, ""), url.Values{"encryption": {""}}, nil, body)
+	return err
+}
+
+// DeleteBucketEncryption removes the default encryption of an upstream
+// bucket
+func (p *Proxy) DeleteBucketEncryption(r *http.Request, bucket string) error {
+	_, err := p.do(r, "DELETE", p.path(bucket, ""), url.Values{"encryption": {""}}, nil, nil)
+	return err
+}
+
+// notificationConfiguration is the XML form of
+// `s2.NotificationConfiguration`. Destinations only differ in the element
+// name used for their ARN.
+type notificationConfiguration struct {
+	XMLName                     xml.Name                     `xml:"http://s3.amazonaws.com/doc/2006-03-01/ NotificationConfiguration"`
+	TopicConfigurations         []topicConfiguration         `xml:"TopicConfiguration"`
+	QueueConfigurations         []queueConfiguration         `xml:"QueueConfiguration"`
+	CloudFunctionConfigurations []cloudFunctionConfiguration `xml:"CloudFunctionConfiguration"`
+}
+
+type topicConfiguration struct {
+	s2.NotificationTarget
+	Topic string `xml:"Topic"`
+}
+
+type queueConfiguration struct {
+	s2.NotificationTarget
+	Queue string `xml:"Queue"`
+}
+
+type cloudFunctionConfiguration struct {
+	s2.NotificationTarget
+	CloudFunction string `xml:"CloudFunction"`
+}
+
+// GetBucketNotification gets the notification configuration of an upstream
+// bucket
+func (p *Proxy) GetBucketNotification(r *http.Request, bucket string) (*s2.NotificationConfiguration, error) {
+	res, err := p.do(r, "GET", p.path(bucket, ""), url.Values{"notification": {""}}, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	var result notificationConfiguration
+	if err := res.Decode(&result); err != nil {
+		return nil, err
+	}
+
+	config := s2.NotificationConfiguration{}
+	for _, c := range result.TopicConfigurations {
+		target := c.NotificationTarget
+		target.ARN = c.Topic
+		config.TopicConfigurations = append(config.TopicConfigurations, &target)
+	}
+	for _, c := range result.QueueConfigurations {
+		target := c.NotificationTarget
+		target.ARN = c.Queue
+		config.QueueConfigurations = append(config.QueueConfigurations, &target)
+	}
+	for _, c := range result.CloudFunctionConfigurations {
+		target := c.NotificationTarget
+		target.ARN = c.CloudFunction
+		config.CloudFunctionConfigurations = append(config.CloudFunctionConfigurations, &target)
+	}
+	return &config, nil
+}
+
+// SetBucketNotification sets the notification configuration of an upstream
+// bucket. Note that s2 also delivers the configured events itself, if its
+// `Events` dispatcher is set.
+func (p *Proxy) SetBucketNotification(r *http.Request, bucket string, config *s2.NotificationConfiguration) error {
+	payload := notificationConfiguration{}
+	for _, target := range config.TopicConfigurations {
+		payload.TopicConfigurations = append(payload.TopicConfigurations, topicConfiguration{NotificationTarget: *target, Topic: target.ARN})
+	}
+	for _, target := range config.QueueConfigurations {
+		payload.QueueConfigurations = append(payload.QueueConfigurations, queueConfiguration{NotificationTarget: *target, Queue: target.ARN})
+	}
+	for _, target := range config.CloudFunctionConfigurations {
+		payload.CloudFunctionConfigurations = append(payload.CloudFunctionConfigurations, cloudFunctionConfiguration{NotificationTarget: *target, CloudFunction: target.ARN})
+	}
+
+	body, err := xml.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	_, err = p.do(r, "PUT", p.path(bucket, ""), url.Values{"notification": {""}}, nil, body)
+	return err
+}
@@ -0,0 +1,169 @@
+package proxy
+
+import (
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/pachyderm/s2"
+)
+
+// completedPart is the XML form of a part in a request to complete a
+// multipart upload. Unlike `s2.Part`, it omits the fields that are only used
+// in part listings.
+type completedPart struct {
+	PartNumber     int    `xml:"PartNumber"`
+	ETag           string `xml:"ETag"`
+	ChecksumCRC32  string `xml:"ChecksumCRC32,omitempty"`
+	ChecksumCRC32C string `xml:"ChecksumCRC32C,omitempty"`
+	ChecksumSHA1   string `xml:"ChecksumSHA1,omitempty"`
+	ChecksumSHA256 string `xml:"ChecksumSHA256,omitempty"`
+}
+
+// ListMultipart lists the in-progress multipart uploads in an upstream
+// bucket
+func (p *Proxy) ListMultipart(r *http.Request, bucket, prefix, keyMarker, uploadIDMarker, delimiter string, maxUploads int) (*s2.ListMultipartResult, error) {
+	query := url.Values{
+		"uploads":          {""},
+		"prefix":           {prefix},
+		"key-marker":       {keyMarker},
+		"upload-id-marker": {uploadIDMarker},
+		"delimiter":        {delimiter},
+		"max-uploads":      {strconv.Itoa(maxUploads)},
+	}
+	res, err := p.do(r, "GET", p.path(bucket, ""), query, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var result struct {
+		Uploads            []*s2.Upload         `xml:"Upload"`
+		CommonPrefixes     []*s2.CommonPrefixes `xml:"CommonPrefixes"`
+		IsTruncated        bool                 `xml:"IsTruncated"`
+		NextKeyMarker      string               `xml:"NextKeyMarker"`
+		NextUploadIDMarker string               `xml:"NextUploadIdMarker"`
+	}
+	if err := res.Decode(&result); err != nil {
+		return nil, err
+	}
+	return &s2.ListMultipartResult{
+		Uploads:            result.Uploads,
+		CommonPrefixes:     result.CommonPrefixes,
+		IsTruncated:        result.IsTruncated,
+		NextKeyMarker:      result.NextKeyMarker,
+		NextUploadIDMarker: result.NextUploadIDMarker,
+	}, nil
+}
+
+// InitMultipart initializes an upstream multipart upload
+func (p *Proxy) InitMultipart(r *http.Request, bucket, key string) (string, error) {
+	res, err := p.do(r, "POST", p.path(bucket, key), url.Values{"uploads": {""}}, nil, nil)
+	if err != nil {
+		return "", err
+	}
+	var result struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := res.Decode(&result); err != nil {
+		return "", err
+	}
+	return result.UploadID, nil
+}
+
+// AbortMultipart aborts an upstream multipart upload
+func (p *Proxy) AbortMultipart(r *http.Request, bucket, key, uploadID string) error {
+	_, err := p.do(r, "DELETE", p.path(bucket, key), url.Values{"uploadId": {uploadID}}, nil, nil)
+	return err
+}
+
+// CompleteMultipart completes an upstream multipart upload. Like with
+// `PutObject`, preconditions are forwarded as conditional write headers.
+func (p *Proxy) CompleteMultipart(r *http.Request, bucket, key, uploadID string, parts []*s2.Part, preconditions *s2.Preconditions) (*s2.CompleteMultipartResult, error) {
+	payload := struct {
+		XMLName xml.Name        `xml:"http://s3.amazonaws.com/doc/2006-03-01/ CompleteMultipartUpload"`
+		Parts   []completedPart `xml:"Part"`
+	}{}
+	for _, part := range parts {
+		payload.Parts = append(payload.Parts, completedPart{
+			PartNumber:     part.PartNumber,
+			ETag:           part.ETag,
+			ChecksumCRC32:  part.ChecksumCRC32,
+			ChecksumCRC32C: part.ChecksumCRC32C,
+			ChecksumSHA1:   part.ChecksumSHA1,
+			ChecksumSHA256: part.ChecksumSHA256,
+		})
+	}
+	body, err := xml.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := p.do(r, "POST", p.path(bucket, key), url.Values{"uploadId": {uploadID}}, preconditionHeaders(preconditions), body)
+	if err != nil {
+		return nil, err
+	}
+	var result struct {
+		Location string `xml:"Location"`
+		ETag     string `xml:"ETag"`
+	}
+	if err := decodeResult(r, res, &result); err != nil {
+		return nil, err
+	}
+	return &s2.CompleteMultipartResult{
+		Location: result.Location,
+		ETag:     result.ETag,
+		Version:  res.Header.Get("x-amz-version-id"),
+	}, nil
+}
+
+// ListMultipartChunks lists the parts of an upstream multipart upload
+func (p *Proxy) ListMultipartChunks(r *http.Request, bucket, key, uploadID string, partNumberMarker, maxParts int) (*s2.ListMultipartChunksResult, error) {
+	query := url.Values{
+		"uploadId":           {uploadID},
+		"part-number-marker": {strconv.Itoa(partNumberMarker)},
+		"max-parts":          {strconv.Itoa(maxParts)},
+	}
+	res, err := p.do(r, "GET", p.path(bucket, key), query, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var result struct {
+		Initiator         *s2.User   `xml:"Initiator"`
+		Owner             *s2.User   `xml:"Owner"`
+		StorageClass      string     `xml:"StorageClass"`
+		ChecksumAlgorithm string     `xml:"ChecksumAlgorithm"`
+		IsTruncated       bool       `xml:"IsTruncated"`
+		Parts             []*s2.Part `xml:"Part"`
+	}
+	if err := res.Decode(&result); err != nil {
+		return nil, err
+	}
+	return &s2.ListMultipartChunksResult{
+		Initiator:         result.Initiator,
+		Owner:             result.Owner,
+		StorageClass:      result.StorageClass,
+		ChecksumAlgorithm: result.ChecksumAlgorithm,
+		IsTruncated:       result.IsTruncated,
+		Parts:             result.Parts,
+	}, nil
+}
+
+// UploadMultipartChunk streams a part into an upstream multipart upload
+func (p *Proxy) UploadMultipartChunk(r *http.Request, bucket, key, uploadID string, partNumber int, reader io.Reader) (string, error) {
+	if err := checkEncryption(r); err != nil {
+		return "", err
+	}
+	query := url.Values{
+		"uploadId":   {uploadID},
+		"partNumber": {strconv.Itoa(partNumber)},
+	}
+	res, err := p.stream(r, "PUT", p.path(bucket, key), query, nil, reader, contentLength(r))
+	if err != nil {
+		return "", err
+	}
+	res.Body.Close()
+	return res.Header.Get("ETag"), nil
+}
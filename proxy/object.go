@@ -0,0 +1,334 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/pachyderm/s2"
+)
+
+var (
+	errInvalidWhence  = errors.New("invalid whence")
+	errNegativeOffset = errors.New("negative offset")
+)
+
+// object is the content of an upstream object. It's streamed from a GET
+// request, which is only made once content is read. Seeking is lazy as
+// well: a ranged GET is made if content is then read from a different
+// offset. Reads are conditional on the object's ETag, so that the content
+// is consistent across requests.
+type object struct {
+	p     *Proxy
+	r     *http.Request
+	path  string
+	query url.Values
+	etag  string
+	size  int64
+
+	offset     int64
+	body       io.ReadCloser
+	bodyOffset int64
+}
+
+func (o *object) Read(b []byte) (int, error) {
+	if o.offset >= o.size {
+		return 0, io.EOF
+	}
+	if o.body == nil || o.bodyOffset != o.offset {
+		if err := o.open(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := o.body.Read(b)
+	o.offset += int64(n)
+	o.bodyOffset += int64(n)
+	if err == io.EOF && o.offset < o.size {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// open makes a GET request for the content from the current offset
+func (o *object) open() error {
+	o.Close()
+
+	header := http.Header{"Accept-Encoding": {"identity"}}
+	if o.offset > 0 {
+		header.Set("Range", fmt.Sprintf("bytes=%d-", o.offset))
+	}
+	if o.etag != "" {
+		header.Set("If-Match", o.etag)
+	}
+	res, err := o.p.stream(o.r, "GET", o.path, o.query, header, nil, 0)
+	if err != nil {
+		return err
+	}
+	if o.offset > 0 && res.StatusCode != http.StatusPartialContent {
+		res.Body.Close()
+		return errUnexpectedStatus(res.StatusCode)
+	}
+	o.body = res.Body
+	o.bodyOffset = o.offset
+	return nil
+}
+
+func (o *object) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += o.offset
+	case io.SeekEnd:
+		offset += o.size
+	default:
+		return 0, errInvalidWhence
+	}
+	if offset < 0 {
+		return 0, errNegativeOffset
+	}
+	o.offset = offset
+	return offset, nil
+}
+
+// Close closes the body of the current GET request, if any
+func (o *object) Close() error {
+	if o.body == nil {
+		return nil
+	}
+	err := o.body.Close()
+	o.body = nil
+	return err
+}
+
+// GetObject gets an upstream object. Requests that are unlikely to read the
+// content from the start (HEAD, range and copy requests) only make a HEAD
+// request upstream, deferring the GET until the content is read.
+func (p *Proxy) GetObject(r *http.Request, bucket, key, version string) (*s2.GetObjectResult, error) {
+	path := p.path(bucket, key)
+	query := url.Values{}
+	if version != "" {
+		query.Set("versionId", version)
+	}
+
+	method := "GET"
+	if r.Method == "HEAD" || r.Header.Get("Range") != "" || r.FormValue("partNumber") != "" || r.Header.Get("x-amz-copy-source") != "" {
+		method = "HEAD"
+	}
+	req, err := p.request(r, method, path, query, http.Header{"Accept-Encoding": {"identity"}})
+	if err != nil {
+		return nil, err
+	}
+	p.client.Credentials.SignV4(req, nil, time.Now())
+	res, err := p.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	modTime, _ := http.ParseTime(res.Header.Get("Last-Modified"))
+	if res.Header.Get("x-amz-delete-marker") == "true" {
+		res.Body.Close()
+		return &s2.GetObjectResult{
+			Version:      res.Header.Get("x-amz-version-id"),
+			DeleteMarker: true,
+			ModTime:      modTime,
+		}, nil
+	}
+	if method == "HEAD" && res.StatusCode == http.StatusNotFound {
+		// HEAD errors have no body, so check whether it's the bucket
+		// that's missing
+		res.Body.Close()
+		if _, err := p.do(r, "HEAD", p.path(bucket, ""), nil, nil, nil); err != nil {
+			if s3Err, ok := err.(*s2.Error); ok && s3Err.HTTPStatus == http.StatusNotFound {
+				return nil, s2.NoSuchBucketError(r)
+			}
+			return nil, err
+		}
+		return nil, s2.NoSuchKeyError(r)
+	}
+	if err := checkResponse(r, res); err != nil {
+		return nil, err
+	}
+
+	size, err := strconv.ParseInt(res.Header.Get("Content-Length"), 10, 64)
+	if err != nil {
+		res.Body.Close()
+		return nil, fmt.Errorf("invalid upstream content length: %v", err)
+	}
+	content := &object{
+		p:     p,
+		r:     r,
+		path:  path,
+		query: query,
+		etag:  res.Header.Get("ETag"),
+		size:  size,
+	}
+	if method == "GET" {
+		content.body = res.Body
+	} else {
+		res.Body.Close()
+	}
+
+	var partSizes []int64
+	if r.FormValue("partNumber") != "" {
+		partSizes, err = p.partSizes(r, content)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &s2.GetObjectResult{
+		ETag:      stripETagQuotes(res.Header.Get("ETag")),
+		Version:   res.Header.Get("x-amz-version-id"),
+		ModTime:   modTime,
+		Content:   content,
+		PartSizes: partSizes,
+	}, nil
+}
+
+// partSizes gets the size of each part of an upstream object, with a HEAD
+// request per part, or nil if the object wasn't uploaded in parts
+func (p *Proxy) partSizes(r *http.Request, o *object) ([]int64, error) {
+	var sizes []int64
+	count := 1
+	for partNumber := 1; partNumber <= count; partNumber++ {
+		query := url.Values{"partNumber": {strconv.Itoa(partNumber)}}
+		for name, values := range o.query {
+			query[name] = values
+		}
+		header := http.Header{}
+		if o.etag != "" {
+			header.Set("If-Match", o.etag)
+		}
+		res, err := p.do(r, "HEAD", o.path, query, header, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		if partNumber == 1 {
+			partsCount := res.Header.Get("x-amz-mp-parts-count")
+			if partsCount == "" {
+				return nil, nil
+			}
+			count, err = strconv.Atoi(partsCount)
+			if err != nil {
+				return nil, fmt.Errorf("invalid upstream parts count: %v", err)
+			}
+		}
+		size, err := strconv.ParseInt(res.Header.Get("Content-Length"), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid upstream content length: %v", err)
+		}
+		sizes = append(sizes, size)
+	}
+	return sizes, nil
+}
+
+// CopyObject copies an object. Objects that were read from the same
+// upstream are copied upstream, without their content passing through the
+// proxy; otherwise the content is streamed into a new upstream object.
+func (p *Proxy) CopyObject(r *http.Request, srcBucket, srcKey string, getResult *s2.GetObjectResult, destBucket, destKey string) (string, error) {
+	if err := checkEncryption(r); err != nil {
+		return "", err
+	}
+	src, ok := getResult.Content.(*object)
+	if !ok || src.p != p {
+		size, err := getResult.Content.Seek(0, io.SeekEnd)
+		if err != nil {
+			return "", err
+		}
+		if _, err := getResult.Content.Seek(0, io.SeekStart); err != nil {
+			return "", err
+		}
+		res, err := p.stream(r, "PUT", p.path(destBucket, destKey), nil, nil, getResult.Content, size)
+		if err != nil {
+			return "", err
+		}
+		res.Body.Close()
+		return res.Header.Get("x-amz-version-id"), nil
+	}
+
+	source := (&url.URL{Path: src.path}).EscapedPath()
+	if version := src.query.Get("versionId"); version != "" {
+		source += "?versionId=" + url.QueryEscape(version)
+	}
+	header := http.Header{"x-amz-copy-source": {source}}
+	if src.etag != "" {
+		header.Set("x-amz-copy-source-if-match", src.etag)
+	}
+	res, err := p.do(r, "PUT", p.path(destBucket, destKey), nil, header, nil)
+	if err != nil {
+		return "", err
+	}
+	var result struct {
+		ETag string `xml:"ETag"`
+	}
+	if err := decodeResult(r, res, &result); err != nil {
+		return "", err
+	}
+	return res.Header.Get("x-amz-version-id"), nil
+}
+
+// PutObject streams content into an upstream object. Preconditions are
+// forwarded as conditional write headers, so that they're checked
+// atomically upstream.
+func (p *Proxy) PutObject(r *http.Request, bucket, key string, reader io.Reader, preconditions *s2.Preconditions) (*s2.PutObjectResult, error) {
+	if err := checkEncryption(r); err != nil {
+		return nil, err
+	}
+	res, err := p.stream(r, "PUT", p.path(bucket, key), nil, preconditionHeaders(preconditions), reader, contentLength(r))
+	if err != nil {
+		return nil, err
+	}
+	res.Body.Close()
+	return &s2.PutObjectResult{
+		ETag:    res.Header.Get("ETag"),
+		Version: res.Header.Get("x-amz-version-id"),
+	}, nil
+}
+
+// checkEncryption rejects writes that ask for server-side encryption with
+// `NotImplementedError`. s2 would encrypt the content before it's proxied,
+// which an upstream s2 endpoint rejects, since it can't tell the content
+// apart from content that it encrypted itself.
+func checkEncryption(r *http.Request) error {
+	if r.Header.Get("x-amz-server-side-encryption") != "" || r.Header.Get("x-amz-server-side-encryption-customer-algorithm") != "" {
+		return s2.NotImplementedError(r)
+	}
+	return nil
+}
+
+// DeleteObject deletes an upstream object, or a version of it
+func (p *Proxy) DeleteObject(r *http.Request, bucket, key, version string) (*s2.DeleteObjectResult, error) {
+	query := url.Values{}
+	if version != "" {
+		query.Set("versionId", version)
+	}
+	res, err := p.do(r, "DELETE", p.path(bucket, key), query, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &s2.DeleteObjectResult{
+		Version:      res.Header.Get("x-amz-version-id"),
+		DeleteMarker: res.Header.Get("x-amz-delete-marker") == "true",
+	}, nil
+}
+
+// preconditionHeaders gets the conditional write headers for preconditions
+func preconditionHeaders(preconditions *s2.Preconditions) http.Header {
+	header := http.Header{}
+	if preconditions == nil {
+		return header
+	}
+	if preconditions.IfMatch != "" {
+		header.Set("If-Match", preconditions.IfMatch)
+	}
+	if preconditions.IfNoneMatch {
+		header.Set("If-None-Match", "*")
+	}
+	return header
+}
@@ -0,0 +1,262 @@
+// Package proxy implements the s2 controllers by forwarding requests to an
+// upstream S3-compatible endpoint, so that s2 can be run in front of other
+// object stores:
+//
+//	p := proxy.New("https://s3.amazonaws.com", client.Credentials{
+//		AccessKey: "upstream access key",
+//		SecretKey: "upstream secret key",
+//		Region:    "us-east-1",
+//	})
+//	p.BucketPrefix = "tenant-"
+//	router := p.S2(logger).Router()
+//
+// Upstream requests are signed with the proxy's own credentials, rather than
+// those of the client, so the proxy's `Auth` controller is configured
+// separately. Object content is streamed in both directions. Reads are
+// pinned to the ETag that was first seen, so that range reads of an object
+// that's concurrently overwritten fail rather than mixing content.
+//
+// Upstream errors are mapped into `*s2.Error`s for the request being
+// proxied. Upstream endpoints should do their own encryption, so writes that
+// ask for server-side encryption are rejected with `NotImplementedError`.
+package proxy
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/pachyderm/s2"
+	"github.com/pachyderm/s2/client"
+	"github.com/sirupsen/logrus"
+)
+
+// Proxy implements the s2 controllers by forwarding to an upstream endpoint
+type Proxy struct {
+	// BucketPrefix is prepended to the name of every bucket upstream, so
+	// that a proxy can serve a namespace of the upstream's buckets. Upstream
+	// buckets without the prefix aren't visible through the proxy.
+	BucketPrefix string
+	// HTTPClient is used to make upstream requests
+	HTTPClient *http.Client
+
+	client *client.Client
+}
+
+// New creates a proxy to an upstream endpoint, e.g.
+// `https://s3.amazonaws.com`, which signs requests with the given
+// credentials. Bucket names aren't rewritten, unless `BucketPrefix` is set,
+// and upstream requests are made with `http.DefaultClient`, unless
+// `HTTPClient` is set.
+func New(endpoint string, credentials client.Credentials) *Proxy {
+	return &Proxy{
+		BucketPrefix: "",
+		HTTPClient:   http.DefaultClient,
+		client:       client.New(endpoint, credentials),
+	}
+}
+
+// S2 creates an s2 instance that forwards to the upstream endpoint. No auth
+// controller is set; requests to the proxy are authenticated separately
+// from those it makes upstream.
+func (p *Proxy) S2(logger *logrus.Entry) *s2.S2 {
+	s := s2.NewS2(logger, 0, 5*time.Minute)
+	s.Service = p
+	s.Bucket = p
+	s.Object = p
+	s.Multipart = p
+	s.Encryption = p
+	s.Notification = p
+	return s
+}
+
+// upstreamBucket gets the name of a bucket upstream
+func (p *Proxy) upstreamBucket(bucket string) string {
+	return p.BucketPrefix + bucket
+}
+
+// path gets the upstream path of a bucket, or of an object if `key` is set
+func (p *Proxy) path(bucket, key string) string {
+	if key == "" {
+		return "/" + p.upstreamBucket(bucket)
+	}
+	return "/" + p.upstreamBucket(bucket) + "/" + key
+}
+
+// request creates an upstream request on behalf of `r`. It's cancelled if
+// `r` is.
+func (p *Proxy) request(r *http.Request, method, path string, query url.Values, header http.Header) (*http.Request, error) {
+	req, err := p.client.NewRequest(method, path, query, nil)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[http.CanonicalHeaderKey(name)] = values
+	}
+	return req.WithContext(r.Context()), nil
+}
+
+// do makes an upstream request with a small, fully signed body, and reads
+// the response. Error responses are returned as errors.
+func (p *Proxy) do(r *http.Request, method, path string, query url.Values, header http.Header, body []byte) (*client.Response, error) {
+	req, err := p.request(r, method, path, query, header)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		req.ContentLength = int64(len(body))
+	}
+	p.client.Credentials.SignV4(req, body, time.Now())
+
+	httpRes, err := p.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer httpRes.Body.Close()
+	res, err := readResponse(httpRes)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode >= 300 {
+		return nil, upstreamError(r, res)
+	}
+	return res, nil
+}
+
+// stream makes an upstream request whose body is streamed from `body`,
+// which has the given length (or -1 if it's unknown), and returns the
+// response without reading its body. Error responses are returned as
+// errors.
+func (p *Proxy) stream(r *http.Request, method, path string, query url.Values, header http.Header, body io.Reader, length int64) (*http.Response, error) {
+	req, err := p.request(r, method, path, query, header)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Body = ioutil.NopCloser(body)
+		req.ContentLength = length
+		if length == 0 {
+			req.Body = http.NoBody
+		}
+	}
+	p.client.Credentials.SignV4UnsignedPayload(req, time.Now())
+
+	res, err := p.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkResponse(r, res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// checkResponse reads and closes the body of an upstream error response, and
+// returns it as an error. Other responses are left unread.
+func checkResponse(r *http.Request, res *http.Response) error {
+	if res.StatusCode < 300 {
+		return nil
+	}
+	defer res.Body.Close()
+	errRes, err := readResponse(res)
+	if err != nil {
+		return err
+	}
+	return upstreamError(r, errRes)
+}
+
+// readResponse reads the body of an upstream response
+func readResponse(res *http.Response) (*client.Response, error) {
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	return &client.Response{
+		StatusCode: res.StatusCode,
+		Header:     res.Header,
+		Body:       body,
+	}, nil
+}
+
+// upstreamError maps an upstream error response to an error for the
+// request being proxied. Error responses without a body (e.g. to HEAD
+// requests) are mapped by their status.
+func upstreamError(r *http.Request, res *client.Response) *s2.Error {
+	upstream := res.Err()
+	if upstream == nil {
+		return s2.InternalError(r, errUnexpectedStatus(res.StatusCode))
+	}
+	if upstream.Code != "" {
+		e := s2.NewError(r, res.StatusCode, upstream.Code, upstream.Message)
+		e.Region = upstream.Region
+		return e
+	}
+
+	switch res.StatusCode {
+	case http.StatusForbidden:
+		return s2.AccessDeniedError(r)
+	case http.StatusNotFound:
+		if mux.Vars(r)["key"] != "" {
+			return s2.NoSuchKeyError(r)
+		}
+		return s2.NoSuchBucketError(r)
+	case http.StatusPreconditionFailed:
+		return s2.PreconditionFailedError(r)
+	case http.StatusNotImplemented:
+		return s2.NotImplementedError(r)
+	default:
+		return s2.NewError(r, res.StatusCode, strings.Replace(http.StatusText(res.StatusCode), " ", "", -1), http.StatusText(res.StatusCode))
+	}
+}
+
+// errUnexpectedStatus is an error for an upstream response with an
+// unexpected status
+type errUnexpectedStatus int
+
+func (e errUnexpectedStatus) Error() string {
+	return "unexpected upstream status: " + strconv.Itoa(int(e))
+}
+
+// decodeResult parses the XML body of a response that may be an error,
+// despite having a 200 status. S3 does this for requests that can take a
+// while, such as completing multipart uploads.
+func decodeResult(r *http.Request, res *client.Response, v interface{}) error {
+	var e struct {
+		XMLName xml.Name
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	if err := xml.Unmarshal(res.Body, &e); err != nil {
+		return err
+	}
+	if e.XMLName.Local == "Error" {
+		return s2.NewError(r, http.StatusInternalServerError, e.Code, e.Message)
+	}
+	return xml.Unmarshal(res.Body, v)
+}
+
+// contentLength gets the length of the content a proxied write request is
+// uploading, or -1 if it's unknown
+func contentLength(r *http.Request) int64 {
+	if decoded := r.Header.Get("x-amz-decoded-content-length"); decoded != "" {
+		length, err := strconv.ParseInt(decoded, 10, 64)
+		if err != nil {
+			return -1
+		}
+		return length
+	}
+	return r.ContentLength
+}
+
+// stripETagQuotes removes the quotes surrounding an ETag
+func stripETagQuotes(etag string) string {
+	return strings.Trim(etag, `"`)
+}
@@ -0,0 +1,94 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/pachyderm/s2"
+	"github.com/pachyderm/s2/client"
+	"github.com/pachyderm/s2/memory"
+	"github.com/pachyderm/s2/s2test"
+	"github.com/sirupsen/logrus"
+)
+
+var upstreamCredentials = client.Credentials{
+	AccessKey: "upstream",
+	SecretKey: "upstream-secret",
+	Region:    "us-east-1",
+}
+
+// newUpstream starts an in-memory s2 server for a proxy to forward to
+func newUpstream(logger *logrus.Entry) *httptest.Server {
+	backend := memory.New()
+	backend.AddCredentials(upstreamCredentials.AccessKey, upstreamCredentials.SecretKey)
+	return httptest.NewServer(backend.S2(logger).Router())
+}
+
+func TestConformance(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	entry := logrus.NewEntry(logger)
+
+	var upstreams []*httptest.Server
+	defer func() {
+		for _, upstream := range upstreams {
+			upstream.Close()
+		}
+	}()
+
+	s2test.RunConformance(t, func() *s2.S2 {
+		upstream := newUpstream(entry)
+		upstreams = append(upstreams, upstream)
+
+		p := New(upstream.URL, upstreamCredentials)
+		p.BucketPrefix = "tenant-"
+		p.HTTPClient = upstream.Client()
+		return p.S2(entry)
+	})
+}
+
+func TestBucketPrefix(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	entry := logrus.NewEntry(logger)
+
+	upstream := newUpstream(entry)
+	defer upstream.Close()
+	c := client.New(upstream.URL, upstreamCredentials)
+	c.HTTPClient = upstream.Client()
+
+	for _, bucket := range []string{"tenant-visible", "hidden"} {
+		res, err := c.Do("PUT", "/"+bucket, nil, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := res.Err(); err != nil {
+			t.Fatalf("creating upstream bucket %q: %v", bucket, err)
+		}
+	}
+
+	p := New(upstream.URL, upstreamCredentials)
+	p.BucketPrefix = "tenant-"
+	p.HTTPClient = upstream.Client()
+	r := httptest.NewRequest("GET", "/", nil)
+
+	result, err := p.ListBuckets(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Buckets) != 1 || result.Buckets[0].Name != "visible" {
+		t.Fatalf("expected only the prefixed bucket to be listed, got %+v", result.Buckets)
+	}
+
+	if err := p.DeleteBucket(r, "hidden"); err == nil {
+		t.Fatal("expected an unprefixed upstream bucket to be inaccessible")
+	} else if s3Err, ok := err.(*s2.Error); !ok || s3Err.HTTPStatus != http.StatusNotFound {
+		t.Fatalf("expected a not found error, got %v", err)
+	}
+
+	if _, err := p.HeadBucket(r, "visible"); err != nil {
+		t.Fatalf("expected the prefixed bucket to be accessible: %v", err)
+	}
+}
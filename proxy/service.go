@@ -0,0 +1,34 @@
+package proxy
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/pachyderm/s2"
+)
+
+// ListBuckets lists the upstream buckets with the proxy's bucket prefix,
+// with the prefix removed
+func (p *Proxy) ListBuckets(r *http.Request) (*s2.ListBucketsResult, error) {
+	res, err := p.do(r, "GET", "/", nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	var upstream s2.ListBucketsResult
+	if err := res.Decode(&upstream); err != nil {
+		return nil, err
+	}
+
+	result := s2.ListBucketsResult{
+		Owner:   upstream.Owner,
+		Buckets: []*s2.Bucket{},
+	}
+	for _, bucket := range upstream.Buckets {
+		if !strings.HasPrefix(bucket.Name, p.BucketPrefix) || bucket.Name == p.BucketPrefix {
+			continue
+		}
+		bucket.Name = strings.TrimPrefix(bucket.Name, p.BucketPrefix)
+		result.Buckets = append(result.Buckets, bucket)
+	}
+	return &result, nil
+}
@@ -0,0 +1,153 @@
+package quota
+
+import (
+	"io"
+	"net/http"
+
+	"github.com/pachyderm/s2"
+)
+
+// GetObject gets an object using the wrapped controller
+func (c *Controller) GetObject(r *http.Request, bucket, key, versionID string) (*s2.GetObjectResult, error) {
+	return c.object.GetObject(r, bucket, key, versionID)
+}
+
+// CopyObject copies an object using the wrapped controller, if the copy
+// fits within the destination's quotas
+func (c *Controller) CopyObject(r *http.Request, srcBucket, srcKey string, getResult *s2.GetObjectResult, destBucket, destKey string) (string, error) {
+	size, err := s2.PlaintextSize(getResult.Content)
+	if err != nil {
+		return "", err
+	}
+	return c.write(r, destBucket, destKey, size, func(res *reservation) (string, int64, error) {
+		version, err := c.object.CopyObject(r, srcBucket, srcKey, getResult, destBucket, destKey)
+		return version, size, err
+	})
+}
+
+// PutObject writes an object using the wrapped controller. The request's
+// content length is reserved up front, and the write fails as soon as more
+// content than fits within the quotas has been read.
+func (c *Controller) PutObject(r *http.Request, bucket, key string, reader io.Reader, preconditions *s2.Preconditions) (*s2.PutObjectResult, error) {
+	var result *s2.PutObjectResult
+	_, err := c.write(r, bucket, key, contentLength(r), func(res *reservation) (string, int64, error) {
+		metered := &meteredReader{reader: reader, res: res}
+		var err error
+		result, err = c.object.PutObject(r, bucket, key, metered, preconditions)
+		if err != nil {
+			return "", 0, err
+		}
+		return result.Version, metered.n, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// DeleteObject deletes an object using the wrapped controller, freeing the
+// deleted version's usage. Writing a delete marker doesn't free anything,
+// unless it replaces a "null" version.
+func (c *Controller) DeleteObject(r *http.Request, bucket, key, versionID string) (*s2.DeleteObjectResult, error) {
+	lock := c.lock(bucket, key)
+	lock.Lock()
+	defer lock.Unlock()
+
+	previous, err := c.current(r, bucket, key, versionID)
+	if err != nil {
+		return nil, err
+	}
+	result, err := c.object.DeleteObject(r, bucket, key, versionID)
+	if err != nil {
+		return nil, err
+	}
+	if previous == nil {
+		return result, nil
+	}
+	if versionID != "" || !result.DeleteMarker || result.Version == previous.version {
+		if err := c.free(r, bucket, key, previous); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// WrapMultipart wraps a multipart controller, so that parts and completed
+// uploads are checked against quotas, and completed uploads are counted
+func (c *Controller) WrapMultipart(controller s2.MultipartController) s2.MultipartController {
+	return &multipartController{MultipartController: controller, quota: c}
+}
+
+// multipartController enforces quotas on a wrapped multipart controller
+type multipartController struct {
+	s2.MultipartController
+	quota *Controller
+}
+
+// UploadMultipartChunk rejects parts that couldn't fit within the quotas,
+// even on their own. Parts aren't counted until the upload is completed.
+func (c *multipartController) UploadMultipartChunk(r *http.Request, bucket, key, uploadID string, partNumber int, reader io.Reader) (string, error) {
+	if err := c.quota.check(r, accounts(r, bucket, accessKey(r)), Usage{Bytes: contentLength(r), Objects: 1}); err != nil {
+		return "", err
+	}
+	return c.MultipartController.UploadMultipartChunk(r, bucket, key, uploadID, partNumber, reader)
+}
+
+// CompleteMultipart completes an upload, if the object it creates fits
+// within the quotas
+func (c *multipartController) CompleteMultipart(r *http.Request, bucket, key, uploadID string, parts []*s2.Part, preconditions *s2.Preconditions) (*s2.CompleteMultipartResult, error) {
+	size, err := c.size(r, bucket, key, uploadID, parts)
+	if err != nil {
+		return nil, err
+	}
+
+	var result *s2.CompleteMultipartResult
+	_, err = c.quota.write(r, bucket, key, size, func(res *reservation) (string, int64, error) {
+		var err error
+		result, err = c.MultipartController.CompleteMultipart(r, bucket, key, uploadID, parts, preconditions)
+		if err != nil {
+			return "", 0, err
+		}
+		return result.Version, size, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// GetMultipartChunk uses the wrapped controller's `GetMultipartChunk`, if
+// it implements `s2.MultipartChunkController`
+func (c *multipartController) GetMultipartChunk(r *http.Request, bucket, key, uploadID string, partNumber int) (io.ReadSeeker, error) {
+	if controller, ok := c.MultipartController.(s2.MultipartChunkController); ok {
+		return controller.GetMultipartChunk(r, bucket, key, uploadID, partNumber)
+	}
+	return nil, s2.NotImplementedError(r)
+}
+
+// size gets the size of the object that completing an upload with the
+// given parts would create, by listing the upload's parts
+func (c *multipartController) size(r *http.Request, bucket, key, uploadID string, parts []*s2.Part) (int64, error) {
+	wanted := map[int]bool{}
+	for _, part := range parts {
+		wanted[part.PartNumber] = true
+	}
+
+	var size int64
+	marker := 0
+	for {
+		result, err := c.MultipartController.ListMultipartChunks(r, bucket, key, uploadID, marker, 1000)
+		if err != nil {
+			return 0, err
+		}
+		for _, part := range result.Parts {
+			if wanted[part.PartNumber] {
+				size += part.Size
+			}
+		}
+		if !result.IsTruncated || len(result.Parts) == 0 {
+			return size, nil
+		}
+		marker = result.Parts[len(result.Parts)-1].PartNumber
+	}
+}
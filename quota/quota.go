@@ -0,0 +1,449 @@
+// Package quota enforces storage quotas on buckets and access keys, by
+// wrapping object and multipart controllers that don't do any accounting
+// of their own:
+//
+//	q := quota.New(backend, quota.NewMemoryStore())
+//	q.DefaultBucketLimit = quota.Limit{Bytes: 10 << 30}
+//	q.AccessKeyLimits["tenant"] = quota.Limit{Objects: 100000}
+//	s.Object = q
+//	s.Multipart = q.WrapMultipart(backend)
+//
+// Usage is the number of bytes and objects written to the wrapped
+// controllers, counting each stored version of an object, but not delete
+// markers. Bytes are counted as plaintext, without the overhead of
+// server-side encryption, though writes are metered by the bytes stored
+// while they're in progress, so encrypted writes need room for the overhead
+// until they're settled. Usage of an access key is the usage of the objects
+// written with it, and is freed when they're deleted or replaced, by
+// whichever access key. Writes that would take the bucket or the access key
+// over a limit are rejected with a `QuotaExceeded` error. Parts of
+// in-progress multipart uploads aren't counted, but are rejected if the
+// completed object couldn't fit.
+//
+// Usage is reserved before objects are written, so concurrent writes can't
+// exceed a limit together. Writes that replace an object in a bucket without
+// versioning are only charged the difference in size, while writes that
+// replace a "null" version, with versioning suspended, must fit before the
+// replaced version is freed. Objects written before the store was in use, or
+// without going through the wrapper, aren't counted.
+package quota
+
+import (
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/gorilla/mux"
+	"github.com/pachyderm/s2"
+)
+
+// lockStripes is the number of locks that writes to keys are spread across
+const lockStripes = 64
+
+// Usage is an amount of storage
+type Usage struct {
+	// Bytes is the number of bytes stored
+	Bytes int64
+	// Objects is the number of objects, or object versions, stored
+	Objects int64
+}
+
+// Limit is the maximum usage allowed for an account. Zero values are
+// unlimited.
+type Limit struct {
+	Bytes   int64
+	Objects int64
+}
+
+// Account is what usage is tracked for: either a bucket, or an access key
+type Account struct {
+	Bucket    string
+	AccessKey string
+}
+
+// BucketAccount gets the account of a bucket
+func BucketAccount(bucket string) Account {
+	return Account{Bucket: bucket}
+}
+
+// AccessKeyAccount gets the account of an access key
+func AccessKeyAccount(accessKey string) Account {
+	return Account{AccessKey: accessKey}
+}
+
+// Controller is an `s2.ObjectController` that enforces quotas on writes to
+// a wrapped object controller. Limits should be set before the controller
+// is served.
+type Controller struct {
+	// BucketLimits are the limits of specific buckets, by name
+	BucketLimits map[string]Limit
+	// DefaultBucketLimit is the limit of buckets not in `BucketLimits`
+	DefaultBucketLimit Limit
+	// AccessKeyLimits are the limits of specific access keys
+	AccessKeyLimits map[string]Limit
+	// DefaultAccessKeyLimit is the limit of access keys not in
+	// `AccessKeyLimits`
+	DefaultAccessKeyLimit Limit
+
+	object s2.ObjectController
+	store  Store
+
+	// locks serialize writes to each key, so that the objects they replace
+	// are only freed once
+	locks [lockStripes]sync.Mutex
+}
+
+// New creates a controller that enforces quotas on writes to `object`,
+// keeping usage in `store`. Nothing is limited until limits are set.
+func New(object s2.ObjectController, store Store) *Controller {
+	return &Controller{
+		BucketLimits:    map[string]Limit{},
+		AccessKeyLimits: map[string]Limit{},
+		object:          object,
+		store:           store,
+	}
+}
+
+// Usage gets the current usage of an account
+func (c *Controller) Usage(r *http.Request, account Account) (Usage, error) {
+	return c.store.Usage(r, account)
+}
+
+// lock gets the lock that serializes writes to a key
+func (c *Controller) lock(bucket, key string) *sync.Mutex {
+	hash := fnv.New32a()
+	hash.Write([]byte(bucket))
+	hash.Write([]byte{0})
+	hash.Write([]byte(key))
+	return &c.locks[hash.Sum32()%lockStripes]
+}
+
+// limit gets the limit of an account
+func (c *Controller) limit(account Account) Limit {
+	if account.AccessKey != "" {
+		if limit, ok := c.AccessKeyLimits[account.AccessKey]; ok {
+			return limit
+		}
+		return c.DefaultAccessKeyLimit
+	}
+	if limit, ok := c.BucketLimits[account.Bucket]; ok {
+		return limit
+	}
+	return c.DefaultBucketLimit
+}
+
+// exceeds returns whether usage that was increased by `delta` is over an
+// account's limit
+func (c *Controller) exceeds(account Account, usage, delta Usage) bool {
+	limit := c.limit(account)
+	if delta.Bytes > 0 && limit.Bytes > 0 && usage.Bytes > limit.Bytes {
+		return true
+	}
+	return delta.Objects > 0 && limit.Objects > 0 && usage.Objects > limit.Objects
+}
+
+// accessKey gets the access key a request was signed with, or an empty
+// string if it's anonymous
+func accessKey(r *http.Request) string {
+	return mux.Vars(r)["authAccessKey"]
+}
+
+// accounts gets the accounts that a request to write to a bucket is charged
+// to
+func accounts(r *http.Request, bucket, accessKey string) []Account {
+	if accessKey == "" {
+		return []Account{BucketAccount(bucket)}
+	}
+	return []Account{BucketAccount(bucket), AccessKeyAccount(accessKey)}
+}
+
+// uniform gets deltas that are the same for `n` accounts
+func uniform(delta Usage, n int) []Usage {
+	deltas := make([]Usage, n)
+	for i := range deltas {
+		deltas[i] = delta
+	}
+	return deltas
+}
+
+// charge adds `deltas[i]` to the usage of `accounts[i]`. If any of them
+// would go over its limit, nothing is charged, and a `QuotaExceeded` error
+// is returned.
+func (c *Controller) charge(r *http.Request, accounts []Account, deltas []Usage) error {
+	for i, account := range accounts {
+		usage, err := c.store.Add(r, account, deltas[i])
+		if err != nil {
+			return rollbackError(err, c.credit(r, accounts[:i], deltas[:i]))
+		}
+		if c.exceeds(account, usage, deltas[i]) {
+			return rollbackError(s2.QuotaExceededError(r), c.credit(r, accounts[:i+1], deltas[:i+1]))
+		}
+	}
+	return nil
+}
+
+// credit removes `deltas[i]` from the usage of `accounts[i]`
+func (c *Controller) credit(r *http.Request, accounts []Account, deltas []Usage) error {
+	var firstErr error
+	for i, account := range accounts {
+		if _, err := c.store.Add(r, account, Usage{Bytes: -deltas[i].Bytes, Objects: -deltas[i].Objects}); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// rollbackError combines the error that caused usage to be rolled back with
+// the error from rolling it back, if any. Usage is left inconsistent if the
+// rollback failed, which takes precedence over e.g. `QuotaExceeded`.
+func rollbackError(err, rollbackErr error) error {
+	if rollbackErr == nil {
+		return err
+	}
+	return fmt.Errorf("%v, and could not roll back usage: %v", err, rollbackErr)
+}
+
+// check returns a `QuotaExceeded` error if adding usage to any of the
+// accounts would take it over its limit, without charging anything
+func (c *Controller) check(r *http.Request, accounts []Account, delta Usage) error {
+	for _, account := range accounts {
+		usage, err := c.store.Usage(r, account)
+		if err != nil {
+			return err
+		}
+		usage.Bytes += delta.Bytes
+		usage.Objects += delta.Objects
+		if c.exceeds(account, usage, delta) {
+			return s2.QuotaExceededError(r)
+		}
+	}
+	return nil
+}
+
+// stored is an object version that's counted in usage
+type stored struct {
+	version string
+	size    int64
+}
+
+// current gets the latest version of an object, or a specific version,
+// returning nil if it doesn't exist or is a delete marker. It's read as if
+// for a HEAD request, so that controllers that fetch content lazily, or
+// only fetch it for GET requests, only get its size.
+func (c *Controller) current(r *http.Request, bucket, key, versionID string) (*stored, error) {
+	head := r.WithContext(r.Context())
+	head.Method = "HEAD"
+	result, err := c.object.GetObject(head, bucket, key, versionID)
+	if err != nil {
+		if s3Err, ok := err.(*s2.Error); ok && (s3Err.Code == "NoSuchKey" || s3Err.Code == "NoSuchVersion") {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if closer, ok := result.Content.(io.Closer); ok {
+		defer closer.Close()
+	}
+	if result.DeleteMarker {
+		return nil, nil
+	}
+
+	size, err := s2.PlaintextSize(result.Content)
+	if err != nil {
+		return nil, err
+	}
+	version := result.Version
+	if versionID != "" {
+		version = versionID
+	}
+	return &stored{version: version, size: size}, nil
+}
+
+// free removes a deleted or replaced object version from the usage of its
+// bucket and the access key that wrote it. The key's lock must be held.
+func (c *Controller) free(r *http.Request, bucket, key string, object *stored) error {
+	owner, err := c.store.Owner(r, bucket, key, object.version)
+	if err != nil {
+		return err
+	}
+	freed := accounts(r, bucket, owner)
+	if err := c.credit(r, freed, uniform(Usage{Bytes: object.size, Objects: 1}, len(freed))); err != nil {
+		return err
+	}
+	if owner == "" {
+		return nil
+	}
+	return c.store.SetOwner(r, bucket, key, object.version, "")
+}
+
+// reservation is usage that's charged for a write before it's made
+type reservation struct {
+	c        *Controller
+	r        *http.Request
+	accounts []Account
+	// replaced is the usage of the object version that the write replaces,
+	// which is deducted from the charge to each account it was counted in
+	replaced []Usage
+	usage    Usage
+}
+
+// reserve charges accounts for a new object of `size` bytes, less the
+// usage that it replaces
+func (c *Controller) reserve(r *http.Request, accounts []Account, replaced []Usage, size int64) (*reservation, error) {
+	res := &reservation{c: c, r: r, accounts: accounts, replaced: replaced, usage: Usage{Bytes: size, Objects: 1}}
+	if err := c.charge(r, accounts, res.charged()); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// charged gets the usage that's been charged to each account
+func (res *reservation) charged() []Usage {
+	deltas := make([]Usage, len(res.accounts))
+	for i, replaced := range res.replaced {
+		deltas[i] = Usage{Bytes: res.usage.Bytes - replaced.Bytes, Objects: res.usage.Objects - replaced.Objects}
+	}
+	return deltas
+}
+
+// grow charges more usage for the write
+func (res *reservation) grow(delta Usage) error {
+	if err := res.c.charge(res.r, res.accounts, uniform(delta, len(res.accounts))); err != nil {
+		return err
+	}
+	res.usage.Bytes += delta.Bytes
+	res.usage.Objects += delta.Objects
+	return nil
+}
+
+// write writes a new version of an object, reserving `size` bytes and an
+// object for it first. `write` does the actual write, returning the new
+// version's ID and the number of bytes stored. It may grow the reservation
+// if it stores more bytes than expected. The reservation is then settled to
+// the plaintext size of the new version. Any object version the write
+// replaces is freed.
+//
+// In buckets without versioning, the replaced object is deducted from the
+// reservation of the bucket, and of the access key if it wrote the object,
+// so that only the difference in size has to fit. Otherwise, the replaced
+// object is freed once the write is made.
+func (c *Controller) write(r *http.Request, bucket, key string, size int64, write func(res *reservation) (string, int64, error)) (string, error) {
+	lock := c.lock(bucket, key)
+	lock.Lock()
+	defer lock.Unlock()
+
+	previous, err := c.current(r, bucket, key, "")
+	if err != nil {
+		return "", err
+	}
+
+	writer := accessKey(r)
+	charged := accounts(r, bucket, writer)
+	replaced := make([]Usage, len(charged))
+	replacing := previous != nil && previous.version == ""
+	owner := ""
+	if replacing {
+		owner, err = c.store.Owner(r, bucket, key, previous.version)
+		if err != nil {
+			return "", err
+		}
+		replaced[0] = Usage{Bytes: previous.size, Objects: 1}
+		if writer != "" && owner == writer {
+			replaced[1] = replaced[0]
+		}
+	}
+
+	res, err := c.reserve(r, charged, replaced, size)
+	if err != nil {
+		return "", err
+	}
+	version, n, err := write(res)
+	if err != nil {
+		return "", rollbackError(err, c.credit(r, res.accounts, res.charged()))
+	}
+	// the written version is read back, since encrypted objects are
+	// stored larger than their plaintext. If it can't be, the bytes stored
+	// are counted instead.
+	if written, err := c.current(r, bucket, key, version); err == nil && written != nil {
+		n = written.size
+	}
+	if n != res.usage.Bytes {
+		// settle the reservation to the plaintext size of what was stored
+		if err := c.credit(r, res.accounts, uniform(Usage{Bytes: res.usage.Bytes - n}, len(res.accounts))); err != nil {
+			return "", err
+		}
+	}
+
+	switch {
+	case replacing && version == "":
+		// the replaced object is freed from the access key that wrote it,
+		// if that was a different one
+		if owner != "" && owner != writer {
+			if err := c.credit(r, []Account{AccessKeyAccount(owner)}, []Usage{replaced[0]}); err != nil {
+				return "", err
+			}
+		}
+	case replacing:
+		// versioning was enabled concurrently, so the previous object
+		// wasn't replaced after all, and is charged again
+		if err := c.credit(r, res.accounts, negate(replaced)); err != nil {
+			return "", err
+		}
+	case previous != nil && version == previous.version:
+		// with versioning suspended, the new version replaces a "null"
+		// version
+		if err := c.free(r, bucket, key, previous); err != nil {
+			return "", err
+		}
+	}
+	if writer == "" && owner == "" {
+		return version, nil
+	}
+	return version, c.store.SetOwner(r, bucket, key, version, writer)
+}
+
+// negate gets the negation of each of a list of deltas
+func negate(deltas []Usage) []Usage {
+	negated := make([]Usage, len(deltas))
+	for i, delta := range deltas {
+		negated[i] = Usage{Bytes: -delta.Bytes, Objects: -delta.Objects}
+	}
+	return negated
+}
+
+// meteredReader grows a reservation as content is read past it, so that
+// writes fail as soon as they go over a limit
+type meteredReader struct {
+	reader io.Reader
+	res    *reservation
+	n      int64
+}
+
+func (r *meteredReader) Read(b []byte) (int, error) {
+	n, err := r.reader.Read(b)
+	r.n += int64(n)
+	if r.n > r.res.usage.Bytes {
+		if growErr := r.res.grow(Usage{Bytes: r.n - r.res.usage.Bytes}); growErr != nil {
+			return n, growErr
+		}
+	}
+	return n, err
+}
+
+// contentLength gets the length of the content a write request is
+// uploading, or 0 if it's unknown
+func contentLength(r *http.Request) int64 {
+	if decoded := r.Header.Get("x-amz-decoded-content-length"); decoded != "" {
+		length, err := strconv.ParseInt(decoded, 10, 64)
+		if err != nil {
+			return 0
+		}
+		return length
+	}
+	if r.ContentLength < 0 {
+		return 0
+	}
+	return r.ContentLength
+}
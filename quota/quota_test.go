@@ -0,0 +1,301 @@
+package quota
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/pachyderm/s2"
+	"github.com/pachyderm/s2/client"
+	"github.com/pachyderm/s2/memory"
+	"github.com/pachyderm/s2/s2test"
+	"github.com/sirupsen/logrus"
+)
+
+func TestConformance(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	s2test.RunConformance(t, func() *s2.S2 {
+		backend := memory.New()
+		q := New(backend, NewMemoryStore())
+		q.DefaultBucketLimit = Limit{Bytes: 1 << 30, Objects: 1000}
+		s := backend.S2(logrus.NewEntry(logger))
+		s.Object = q
+		s.Multipart = q.WrapMultipart(backend)
+		return s
+	})
+}
+
+// request creates a request made with an access key
+func request(accessKey string) *http.Request {
+	r := httptest.NewRequest("PUT", "/", nil)
+	return mux.SetURLVars(r, map[string]string{"authAccessKey": accessKey})
+}
+
+// quotaTest makes writes through a controller, and checks its usage
+type quotaTest struct {
+	t *testing.T
+	q *Controller
+}
+
+// put writes an object with an access key, checking whether it exceeds a
+// quota, and returns the version written
+func (qt quotaTest) put(accessKey, bucket, key, content string, exceeded bool) string {
+	qt.t.Helper()
+	result, err := qt.q.PutObject(request(accessKey), bucket, key, strings.NewReader(content), nil)
+	if exceeded {
+		if s3Err, ok := err.(*s2.Error); !ok || s3Err.Code != "QuotaExceeded" {
+			qt.t.Fatalf("expected a QuotaExceeded error, got %v", err)
+		}
+		return ""
+	}
+	if err != nil {
+		qt.t.Fatal(err)
+	}
+	return result.Version
+}
+
+// expectUsage checks the usage of an account
+func (qt quotaTest) expectUsage(account Account, expected Usage) {
+	qt.t.Helper()
+	usage, err := qt.q.Usage(request(""), account)
+	if err != nil {
+		qt.t.Fatal(err)
+	}
+	if usage != expected {
+		qt.t.Fatalf("expected usage %+v of %+v, got %+v", expected, account, usage)
+	}
+}
+
+func TestQuota(t *testing.T) {
+	backend := memory.New()
+	q := New(backend, NewMemoryStore())
+	q.BucketLimits["bucket"] = Limit{Bytes: 10}
+	q.AccessKeyLimits["alice"] = Limit{Objects: 2}
+
+	if err := backend.CreateBucket(request(""), "bucket", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := backend.CreateBucket(request(""), "other", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	qt := quotaTest{t: t, q: q}
+
+	// the request has no content length, so the limit is only hit as the
+	// content is read
+	qt.put("bob", "bucket", "a", "hello", false)
+	qt.put("bob", "bucket", "b", "world!", true)
+	qt.expectUsage(BucketAccount("bucket"), Usage{Bytes: 5, Objects: 1})
+	qt.expectUsage(AccessKeyAccount("bob"), Usage{Bytes: 5, Objects: 1})
+
+	// replacing an object frees it, including from the usage of the access
+	// key that wrote it
+	qt.put("alice", "bucket", "a", "hi", false)
+	qt.expectUsage(BucketAccount("bucket"), Usage{Bytes: 2, Objects: 1})
+	qt.expectUsage(AccessKeyAccount("bob"), Usage{})
+	qt.expectUsage(AccessKeyAccount("alice"), Usage{Bytes: 2, Objects: 1})
+
+	qt.put("alice", "other", "a", "hello", false)
+	qt.put("alice", "other", "b", "world", true)
+	qt.expectUsage(BucketAccount("other"), Usage{Bytes: 5, Objects: 1})
+
+	if _, err := q.DeleteObject(request("bob"), "bucket", "a", ""); err != nil {
+		t.Fatal(err)
+	}
+	qt.expectUsage(BucketAccount("bucket"), Usage{})
+	qt.expectUsage(AccessKeyAccount("alice"), Usage{Bytes: 5, Objects: 1})
+	qt.put("alice", "bucket", "b", "world", false)
+}
+
+// headController records the methods of the requests that objects are
+// read with
+type headController struct {
+	s2.ObjectController
+	methods []string
+}
+
+func (c *headController) GetObject(r *http.Request, bucket, key, versionID string) (*s2.GetObjectResult, error) {
+	c.methods = append(c.methods, r.Method)
+	return c.ObjectController.GetObject(r, bucket, key, versionID)
+}
+
+func TestReplacement(t *testing.T) {
+	backend := memory.New()
+	object := &headController{ObjectController: backend}
+	q := New(object, NewMemoryStore())
+	q.BucketLimits["bucket"] = Limit{Bytes: 10}
+	q.BucketLimits["versioned"] = Limit{Bytes: 10}
+
+	for _, bucket := range []string{"bucket", "versioned"} {
+		if err := backend.CreateBucket(request(""), bucket, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := backend.SetBucketVersioning(request(""), "versioned", s2.VersioningEnabled); err != nil {
+		t.Fatal(err)
+	}
+
+	qt := quotaTest{t: t, q: q}
+
+	// replacing an object only has to fit the difference in size
+	qt.put("alice", "bucket", "key", "123456", false)
+	qt.put("alice", "bucket", "key", "abcdef", false)
+	qt.expectUsage(BucketAccount("bucket"), Usage{Bytes: 6, Objects: 1})
+	qt.expectUsage(AccessKeyAccount("alice"), Usage{Bytes: 6, Objects: 1})
+
+	// including when another access key replaces it
+	qt.put("bob", "bucket", "key", "12345678", false)
+	qt.expectUsage(BucketAccount("bucket"), Usage{Bytes: 8, Objects: 1})
+	qt.expectUsage(AccessKeyAccount("alice"), Usage{})
+	qt.expectUsage(AccessKeyAccount("bob"), Usage{Bytes: 8, Objects: 1})
+	qt.put("bob", "bucket", "key", "12345678901", true)
+	qt.expectUsage(BucketAccount("bucket"), Usage{Bytes: 8, Objects: 1})
+	qt.expectUsage(AccessKeyAccount("bob"), Usage{Bytes: 8, Objects: 1})
+
+	// with versioning, the previous version is kept, so both must fit
+	qt.put("alice", "versioned", "key", "123456", false)
+	qt.put("alice", "versioned", "key", "abcdef", true)
+	qt.expectUsage(BucketAccount("versioned"), Usage{Bytes: 6, Objects: 1})
+
+	// previous versions are only ever read for their size
+	for _, method := range object.methods {
+		if method != "HEAD" {
+			t.Fatalf("expected previous versions to be read with HEAD requests, got %s", method)
+		}
+	}
+}
+
+// creditFailingStore is a store that fails to remove usage from accounts
+type creditFailingStore struct {
+	*MemoryStore
+}
+
+func (s creditFailingStore) Add(r *http.Request, account Account, delta Usage) (Usage, error) {
+	if delta.Bytes < 0 || delta.Objects < 0 {
+		return Usage{}, errors.New("store unavailable")
+	}
+	return s.MemoryStore.Add(r, account, delta)
+}
+
+func TestRollbackErrors(t *testing.T) {
+	backend := memory.New()
+	q := New(backend, creditFailingStore{NewMemoryStore()})
+	q.BucketLimits["bucket"] = Limit{Bytes: 5}
+
+	r := httptest.NewRequest("PUT", "/", nil)
+	if err := backend.CreateBucket(r, "bucket", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// the QuotaExceeded error is reported along with the error rolling back
+	// the charge that exceeded the quota, since usage is now inconsistent
+	_, err := q.PutObject(r, "bucket", "key", strings.NewReader("too long"), nil)
+	if err == nil || !strings.Contains(err.Error(), "could not roll back usage: store unavailable") {
+		t.Fatalf("expected a rollback error, got %v", err)
+	}
+}
+
+func TestDeleteByAnotherKey(t *testing.T) {
+	backend := memory.New()
+	q := New(backend, NewMemoryStore())
+	q.AccessKeyLimits["alice"] = Limit{Objects: 1}
+
+	for _, bucket := range []string{"bucket", "versioned"} {
+		if err := backend.CreateBucket(request(""), bucket, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := backend.SetBucketVersioning(request(""), "versioned", s2.VersioningEnabled); err != nil {
+		t.Fatal(err)
+	}
+
+	qt := quotaTest{t: t, q: q}
+	del := func(accessKey, bucket, version string) {
+		t.Helper()
+		if _, err := q.DeleteObject(request(accessKey), bucket, "key", version); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// deleting frees the usage of the access key that wrote the object,
+	// not the one that deleted it
+	qt.put("alice", "bucket", "key", "hello", false)
+	del("bob", "bucket", "")
+	qt.expectUsage(BucketAccount("bucket"), Usage{})
+	qt.expectUsage(AccessKeyAccount("alice"), Usage{})
+	qt.expectUsage(AccessKeyAccount("bob"), Usage{})
+
+	// deleting an object that's already gone frees nothing
+	del("bob", "bucket", "")
+	qt.expectUsage(AccessKeyAccount("alice"), Usage{})
+	qt.expectUsage(AccessKeyAccount("bob"), Usage{})
+
+	// so the owner can write again within their limit
+	version := qt.put("alice", "versioned", "key", "hello", false)
+	qt.expectUsage(AccessKeyAccount("alice"), Usage{Bytes: 5, Objects: 1})
+
+	// delete markers don't free the version they hide
+	del("bob", "versioned", "")
+	qt.expectUsage(BucketAccount("versioned"), Usage{Bytes: 5, Objects: 1})
+	qt.expectUsage(AccessKeyAccount("alice"), Usage{Bytes: 5, Objects: 1})
+	qt.expectUsage(AccessKeyAccount("bob"), Usage{})
+
+	// but permanently deleting the version frees it from its owner
+	del("bob", "versioned", version)
+	qt.expectUsage(BucketAccount("versioned"), Usage{})
+	qt.expectUsage(AccessKeyAccount("alice"), Usage{})
+	qt.expectUsage(AccessKeyAccount("bob"), Usage{})
+	qt.put("alice", "versioned", "key", "world", false)
+}
+
+func TestEncryptedUsage(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	backend := memory.New()
+	backend.AddCredentials("access", "secret")
+	q := New(backend, NewMemoryStore())
+	q.BucketLimits["bucket"] = Limit{Bytes: 1000}
+	s := backend.S2(logrus.NewEntry(logger))
+	s.Object = q
+	s.Multipart = q.WrapMultipart(backend)
+	server := httptest.NewServer(s.Router())
+	defer server.Close()
+
+	c := client.New(server.URL, client.Credentials{AccessKey: "access", SecretKey: "secret", Region: "us-east-1"})
+	customerKey := bytes.Repeat([]byte{1}, 32)
+	sum := md5.Sum(customerKey)
+	encrypted := http.Header{
+		"x-amz-server-side-encryption-customer-algorithm": {"AES256"},
+		"x-amz-server-side-encryption-customer-key":       {base64.StdEncoding.EncodeToString(customerKey)},
+		"x-amz-server-side-encryption-customer-key-MD5":   {base64.StdEncoding.EncodeToString(sum[:])},
+	}
+	for _, req := range []struct {
+		path   string
+		header http.Header
+		body   string
+	}{
+		{"/bucket", nil, ""},
+		{"/bucket/key", encrypted, "hello"},
+	} {
+		res, err := c.Do("PUT", req.path, nil, req.header, []byte(req.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := res.Err(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the object is counted by its plaintext size
+	quotaTest{t: t, q: q}.expectUsage(BucketAccount("bucket"), Usage{Bytes: 5, Objects: 1})
+}
@@ -0,0 +1,95 @@
+package quota
+
+import (
+	"net/http"
+	"sync"
+)
+
+// Store stores the usage of accounts, and which access key wrote each
+// object version. Implementations must be safe for concurrent use.
+type Store interface {
+	// Usage gets the current usage of an account
+	Usage(r *http.Request, account Account) (Usage, error)
+	// Add adds `delta` to the usage of an account atomically, returning the
+	// new usage. Usage must not go below zero, since objects written before
+	// the store was in use are freed without ever having been counted.
+	Add(r *http.Request, account Account, delta Usage) (Usage, error)
+	// Owner gets the access key that wrote an object version, or an empty
+	// string if it isn't known. `version` is empty for objects in buckets
+	// without versioning.
+	Owner(r *http.Request, bucket, key, version string) (string, error)
+	// SetOwner records the access key that wrote an object version, or
+	// removes the record if `accessKey` is empty
+	SetOwner(r *http.Request, bucket, key, version, accessKey string) error
+}
+
+// object identifies an object version in a `MemoryStore`
+type object struct {
+	bucket  string
+	key     string
+	version string
+}
+
+// MemoryStore is a `Store` that keeps usage in memory, so it's lost when
+// the process exits
+type MemoryStore struct {
+	lock   sync.Mutex
+	usage  map[Account]Usage
+	owners map[object]string
+}
+
+// NewMemoryStore creates a new, empty in-memory store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		usage:  map[Account]Usage{},
+		owners: map[object]string{},
+	}
+}
+
+// Usage gets the current usage of an account
+func (s *MemoryStore) Usage(r *http.Request, account Account) (Usage, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.usage[account], nil
+}
+
+// Add adds `delta` to the usage of an account, returning the new usage
+func (s *MemoryStore) Add(r *http.Request, account Account, delta Usage) (Usage, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	usage := s.usage[account]
+	usage.Bytes += delta.Bytes
+	usage.Objects += delta.Objects
+	if usage.Bytes < 0 {
+		usage.Bytes = 0
+	}
+	if usage.Objects < 0 {
+		usage.Objects = 0
+	}
+	if usage == (Usage{}) {
+		delete(s.usage, account)
+	} else {
+		s.usage[account] = usage
+	}
+	return usage, nil
+}
+
+// Owner gets the access key that wrote an object version
+func (s *MemoryStore) Owner(r *http.Request, bucket, key, version string) (string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.owners[object{bucket, key, version}], nil
+}
+
+// SetOwner records the access key that wrote an object version
+func (s *MemoryStore) SetOwner(r *http.Request, bucket, key, version, accessKey string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if accessKey == "" {
+		delete(s.owners, object{bucket, key, version})
+	} else {
+		s.owners[object{bucket, key, version}] = accessKey
+	}
+	return nil
+}
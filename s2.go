@@ -16,6 +16,7 @@ import (
 
 	"github.com/gofrs/uuid"
 	"github.com/gorilla/mux"
+	"github.com/pachyderm/s2/internal/signing"
 	"github.com/sirupsen/logrus"
 )
 
@@ -28,26 +29,6 @@ var (
 	// authV4HeaderValidator is a regex for validating the authorization
 	// header when using AWs' auth V4
 	authV4HeaderValidator = regexp.MustCompile(`^AWS4-HMAC-SHA256 Credential=([^/]*)/([^/]*)/([^/]*)/s3/aws4_request, ?SignedHeaders=([^,]+), ?Signature=(.+)$`)
-
-	// subresourceQueryParams is a list of query parameters that are
-	// considered queries for "subresources" in S3. This is used in
-	// auth validation.
-	subresourceQueryParams = []string{
-		"acl",
-		"lifecycle",
-		"location",
-		"logging",
-		"notification",
-		"partNumber",
-		"policy",
-		"requestPayment",
-		"torrent",
-		"uploadId",
-		"uploads",
-		"versionId",
-		"versioning",
-		"versions",
-	}
 )
 
 // NotImplementedEndpoint creates an endpoint that returns
@@ -60,17 +41,15 @@ func NotImplementedEndpoint(logger *logrus.Entry) http.HandlerFunc {
 }
 
 // attachBucketRoutes adds bucket-related routes to a router
-func attachBucketRoutes(logger *logrus.Entry, router *mux.Router, handler *bucketHandler, multipartHandler *multipartHandler, objectHandler *objectHandler) {
+func attachBucketRoutes(logger *logrus.Entry, router *mux.Router, handler *bucketHandler, multipartHandler *multipartHandler, objectHandler *objectHandler, notificationHandler *notificationHandler, encryptionHandler *encryptionHandler) {
 	router.Methods("GET", "PUT").Queries("accelerate", "").HandlerFunc(NotImplementedEndpoint(logger))
 	router.Methods("GET", "PUT").Queries("acl", "").HandlerFunc(NotImplementedEndpoint(logger))
 	router.Methods("GET", "PUT", "DELETE").Queries("analytics", "").HandlerFunc(NotImplementedEndpoint(logger))
 	router.Methods("GET", "PUT", "DELETE").Queries("cors", "").HandlerFunc(NotImplementedEndpoint(logger))
-	router.Methods("GET", "PUT", "DELETE").Queries("encryption", "").HandlerFunc(NotImplementedEndpoint(logger))
 	router.Methods("GET", "PUT", "DELETE").Queries("inventory", "").HandlerFunc(NotImplementedEndpoint(logger))
 	router.Methods("GET", "PUT", "DELETE").Queries("lifecycle", "").HandlerFunc(NotImplementedEndpoint(logger))
 	router.Methods("GET", "PUT").Queries("logging", "").HandlerFunc(NotImplementedEndpoint(logger))
 	router.Methods("GET", "PUT", "DELETE").Queries("metrics", "").HandlerFunc(NotImplementedEndpoint(logger))
-	router.Methods("GET", "PUT").Queries("notification", "").HandlerFunc(NotImplementedEndpoint(logger))
 	router.Methods("GET", "PUT").Queries("object-lock", "").HandlerFunc(NotImplementedEndpoint(logger))
 	router.Methods("GET", "PUT", "DELETE").Queries("policy", "").HandlerFunc(NotImplementedEndpoint(logger))
 	router.Methods("GET").Queries("policyStatus", "").HandlerFunc(NotImplementedEndpoint(logger))
@@ -85,7 +64,13 @@ func attachBucketRoutes(logger *logrus.Entry, router *mux.Router, handler *bucke
 	router.Methods("GET").Queries("versions", "").HandlerFunc(handler.listVersions)
 	router.Methods("GET").Queries("uploads", "").HandlerFunc(multipartHandler.list)
 	router.Methods("GET").Queries("location", "").HandlerFunc(handler.location)
-	router.Methods("GET", "HEAD").HandlerFunc(handler.get)
+	router.Methods("GET").Queries("notification", "").HandlerFunc(notificationHandler.get)
+	router.Methods("PUT").Queries("notification", "").HandlerFunc(notificationHandler.put)
+	router.Methods("GET").Queries("encryption", "").HandlerFunc(encryptionHandler.get)
+	router.Methods("PUT").Queries("encryption", "").HandlerFunc(encryptionHandler.put)
+	router.Methods("DELETE").Queries("encryption", "").HandlerFunc(encryptionHandler.del)
+	router.Methods("HEAD").HandlerFunc(handler.head)
+	router.Methods("GET").HandlerFunc(handler.get)
 	router.Methods("PUT").HandlerFunc(handler.put)
 	router.Methods("POST").Queries("delete", "").HandlerFunc(objectHandler.post)
 	router.Methods("DELETE").HandlerFunc(handler.del)
@@ -102,8 +87,8 @@ func attachObjectRoutes(logger *logrus.Entry, router *mux.Router, handler *objec
 	router.Methods("GET", "PUT", "DELETE").Queries("tagging", "").HandlerFunc(NotImplementedEndpoint(logger))
 	router.Methods("GET").Queries("torrent", "").HandlerFunc(NotImplementedEndpoint(logger))
 	router.Methods("POST").Queries("restore", "").HandlerFunc(NotImplementedEndpoint(logger))
-	router.Methods("POST").Queries("select", "").HandlerFunc(NotImplementedEndpoint(logger))
 
+	router.Methods("POST").Queries("select", "").HandlerFunc(handler.selectContent)
 	router.Methods("GET").Queries("uploadId", "").HandlerFunc(multipartHandler.listChunks)
 	router.Methods("POST").Queries("uploads", "").HandlerFunc(multipartHandler.init)
 	router.Methods("POST").Queries("uploadId", "").HandlerFunc(multipartHandler.complete)
@@ -122,6 +107,13 @@ type S2 struct {
 	Bucket               BucketController
 	Object               ObjectController
 	Multipart            MultipartController
+	Notification         NotificationController
+	Events               *EventDispatcher
+	Encryption           EncryptionController
+	KeyProvider          KeyProvider
+	LegacyBucketNames    bool
+	Regions              []string
+	ValidateMultipart    bool
 	logger               *logrus.Entry
 	maxRequestBodyLength uint32
 	readBodyTimeout      time.Duration
@@ -131,7 +123,17 @@ type S2 struct {
 // attributes to implement various S3 functionality, then create a router.
 // `maxRequestBodyLength` specifies maximum request body size; if the value is
 // 0, there is no limit. `readBodyTimeout` specifies the maximum amount of
-// time s2 should spend trying to read the body of requests.
+// time s2 should spend trying to read the body of requests. Bucket event
+// notifications are only fired if `Events` is set. SSE-S3 and SSE-KMS
+// encryption, including bucket default encryption, is only available if
+// `KeyProvider` is set. New buckets must have DNS-compatible names, unless
+// `LegacyBucketNames` is set. If `Regions` is set, requests signed for
+// other regions are rejected, and the first region is used as the default
+// bucket location. If `ValidateMultipart` is set, the parts submitted to
+// complete a multipart upload are checked against `ListMultipartChunks`
+// (which must then report part sizes) before `CompleteMultipart` is called.
+// Encrypted parts are checked by their plaintext sizes if the multipart
+// controller implements `MultipartChunkController`.
 func NewS2(logger *logrus.Entry, maxRequestBodyLength uint32, readBodyTimeout time.Duration) *S2 {
 	return &S2{
 		Auth:                 nil,
@@ -139,6 +141,13 @@ func NewS2(logger *logrus.Entry, maxRequestBodyLength uint32, readBodyTimeout ti
 		Bucket:               unimplementedBucketController{},
 		Object:               unimplementedObjectController{},
 		Multipart:            unimplementedMultipartController{},
+		Notification:         unimplementedNotificationController{},
+		Events:               nil,
+		Encryption:           unimplementedEncryptionController{},
+		KeyProvider:          nil,
+		LegacyBucketNames:    false,
+		Regions:              nil,
+		ValidateMultipart:    false,
 		logger:               logger,
 		maxRequestBodyLength: maxRequestBodyLength,
 		readBodyTimeout:      readBodyTimeout,
@@ -177,6 +186,12 @@ func (h *S2) authV4(w http.ResponseWriter, r *http.Request, auth string) error {
 	sort.Strings(signedHeaderKeys)
 	expectedSignature := match[5]
 
+	// reject signatures scoped to other regions, reporting the expected
+	// region so that clients can retry with it
+	if len(h.Regions) > 0 && !containsString(h.Regions, region) {
+		return AuthorizationHeaderRegionError(r, region, h.Regions[0])
+	}
+
 	// get the expected secret key
 	secretKey, err := h.Auth.SecretKey(r, accessKey, &region)
 	if err != nil {
@@ -187,26 +202,7 @@ func (h *S2) authV4(w http.ResponseWriter, r *http.Request, auth string) error {
 	}
 
 	// step 1: construct the canonical request
-	var signedHeaders strings.Builder
-	for _, key := range signedHeaderKeys {
-		signedHeaders.WriteString(key)
-		signedHeaders.WriteString(":")
-		if key == "host" {
-			signedHeaders.WriteString(r.Host)
-		} else {
-			signedHeaders.WriteString(strings.TrimSpace(r.Header.Get(key)))
-		}
-		signedHeaders.WriteString("\n")
-	}
-
-	canonicalRequest := strings.Join([]string{
-		r.Method,
-		normURI(r.URL.Path),
-		normQuery(r.URL.Query()),
-		signedHeaders.String(),
-		strings.Join(signedHeaderKeys, ";"),
-		r.Header.Get("x-amz-content-sha256"),
-	}, "\n")
+	canonicalRequest := signing.V4CanonicalRequest(r, signedHeaderKeys)
 
 	timestamp, err := parseAWSTimestamp(r)
 	if err != nil {
@@ -215,22 +211,13 @@ func (h *S2) authV4(w http.ResponseWriter, r *http.Request, auth string) error {
 	formattedTimestamp := formatAWSTimestamp(timestamp)
 
 	// step 2: construct the string to sign
-	stringToSign := fmt.Sprintf(
-		"AWS4-HMAC-SHA256\n%s\n%s/%s/s3/aws4_request\n%x",
-		formattedTimestamp,
-		date,
-		region,
-		sha256.Sum256([]byte(canonicalRequest)),
-	)
+	stringToSign := signing.V4StringToSign(formattedTimestamp, date, region, canonicalRequest)
 
 	// step 3: calculate the signing key
-	dateKey := hmacSHA256([]byte("AWS4"+*secretKey), date)
-	dateRegionKey := hmacSHA256(dateKey, region)
-	dateRegionServiceKey := hmacSHA256(dateRegionKey, "s3")
-	signingKey := hmacSHA256(dateRegionServiceKey, "aws4_request")
+	signingKey := signing.V4SigningKey(*secretKey, date, region)
 
 	// step 4: construct & verify the signature
-	signature := hmacSHA256(signingKey, stringToSign)
+	signature := signing.HMACSHA256(signingKey, stringToSign)
 
 	if expectedSignature != fmt.Sprintf("%x", signature) {
 		return SignatureDoesNotMatchError(r)
@@ -277,56 +264,8 @@ func (h *S2) authV2(w http.ResponseWriter, r *http.Request, auth string) error {
 		return err
 	}
 
-	amzHeaderKeys := []string{}
-	for key := range r.Header {
-		if strings.HasPrefix(key, "x-amz-") {
-			amzHeaderKeys = append(amzHeaderKeys, key)
-		}
-	}
-	sort.Strings(amzHeaderKeys)
-
-	stringToSignParts := []string{
-		r.Method,
-		r.Header.Get("content-md5"),
-		r.Header.Get("content-type"),
-		timestamp.Format(time.RFC1123),
-	}
-
-	for _, key := range amzHeaderKeys {
-		// NOTE: this doesn't properly handle multiple header values, or
-		// header values with repeated whitespace characters
-		value := fmt.Sprintf("%s:%s", key, strings.TrimSpace(r.Header.Get(key)))
-		stringToSignParts = append(stringToSignParts, value)
-	}
-
-	var canonicalizedResource strings.Builder
-	canonicalizedResource.WriteString(r.URL.Path)
-	query := r.URL.Query()
-	appendedQuery := false
-	for _, k := range subresourceQueryParams {
-		_, ok := query[k]
-		if ok {
-			if appendedQuery {
-				canonicalizedResource.WriteString("&")
-			} else {
-				canonicalizedResource.WriteString("?")
-				appendedQuery = true
-			}
-
-			canonicalizedResource.WriteString(k)
-
-			value := query.Get(k)
-			if value != "" {
-				// NOTE: this doesn't properly handle multiple query params
-				canonicalizedResource.WriteString("=")
-				canonicalizedResource.WriteString(value)
-			}
-		}
-	}
-	stringToSignParts = append(stringToSignParts, canonicalizedResource.String())
-
-	stringToSign := strings.Join(stringToSignParts, "\n")
-	signature := base64.StdEncoding.EncodeToString(hmacSHA1([]byte(*secretKey), stringToSign))
+	stringToSign := signing.V2StringToSign(r, timestamp.Format(time.RFC1123))
+	signature := base64.StdEncoding.EncodeToString(signing.HMACSHA1([]byte(*secretKey), stringToSign))
 
 	if expectedSignature != signature {
 		return AccessDeniedError(r)
@@ -372,6 +311,8 @@ func (h *S2) authMiddleware(next http.Handler) http.Handler {
 }
 
 // etagMiddleware iterates over a requests headers and quotes unquoted Entity Tags headers.
+// The `*` wildcard of conditional headers is left as-is, since it isn't an
+// entity tag.
 // ref: https://developer.mozilla.org/en-US/docs/Web/HTTP/Headers/ETag
 func (h *S2) etagMiddleware(next http.Handler) http.Handler {
 	etagHeaders := [3]string{"ETag", "If-Match", "If-None-Match"}
@@ -379,7 +320,7 @@ func (h *S2) etagMiddleware(next http.Handler) http.Handler {
 		h.logger.Debugf("Headers: %s", r.Header)
 		for _, key := range etagHeaders {
 			value := r.Header.Get(key)
-			if value != "" {
+			if value != "" && strings.TrimSpace(value) != "*" {
 				r.Header.Set(key, addETagQuotes(value))
 			}
 		}
@@ -424,8 +365,10 @@ func (h *S2) bodyReadingMiddleware(next http.Handler) http.Handler {
 			r.Body = ioutil.NopCloser(bytes.NewBuffer(body))
 		}
 
-		expectedSHA256, ok := singleHeader(r, "x-amz-content-sha256")
-		if ok {
+		// streaming uploads are instead verified chunk by chunk as they're
+		// read, and unsigned payloads aren't verified
+		expectedSHA256, ok := singleHeader(r, "X-Amz-Content-Sha256")
+		if ok && expectedSHA256 != signing.StreamingPayload && expectedSHA256 != signing.UnsignedPayload {
 			if len(expectedSHA256) != 64 {
 				WriteError(h.logger, w, r, InvalidDigestError(r))
 				return
@@ -486,20 +429,48 @@ func (h *S2) readBody(r *http.Request, length uint32) (*bytes.Buffer, error) {
 
 // Router creates a new mux router.
 func (h *S2) Router() *mux.Router {
+	notifier := &notifier{
+		controller: h.Notification,
+		dispatcher: h.Events,
+		logger:     h.logger,
+	}
+	encryptor := &encryptor{
+		controller: h.Encryption,
+		keys:       h.KeyProvider,
+		logger:     h.logger,
+	}
 	serviceHandler := &serviceHandler{
 		controller: h.Service,
 		logger:     h.logger,
 	}
 	bucketHandler := &bucketHandler{
-		controller: h.Bucket,
-		logger:     h.logger,
+		controller:        h.Bucket,
+		objects:           h.Object,
+		legacyBucketNames: h.LegacyBucketNames,
+		regions:           h.Regions,
+		logger:            h.logger,
 	}
 	objectHandler := &objectHandler{
 		controller: h.Object,
+		notifier:   notifier,
+		encryptor:  encryptor,
 		logger:     h.logger,
 	}
 	multipartHandler := &multipartHandler{
-		controller: h.Multipart,
+		controller:    h.Multipart,
+		objects:       h.Object,
+		notifier:      notifier,
+		encryptor:     encryptor,
+		validateParts: h.ValidateMultipart,
+		logger:        h.logger,
+	}
+	notificationHandler := &notificationHandler{
+		controller: h.Notification,
+		dispatcher: h.Events,
+		logger:     h.logger,
+	}
+	encryptionHandler := &encryptionHandler{
+		controller: h.Encryption,
 		logger:     h.logger,
 	}
 
@@ -520,9 +491,9 @@ func (h *S2) Router() *mux.Router {
 	// slash" functionality, because that uses redirects which doesn't always
 	// play nice with s3 clients.
 	trailingSlashBucketRouter := router.Path(`/{bucket:[a-zA-Z0-9\-_\.]{1,255}}/`).Subrouter()
-	attachBucketRoutes(h.logger, trailingSlashBucketRouter, bucketHandler, multipartHandler, objectHandler)
+	attachBucketRoutes(h.logger, trailingSlashBucketRouter, bucketHandler, multipartHandler, objectHandler, notificationHandler, encryptionHandler)
 	bucketRouter := router.Path(`/{bucket:[a-zA-Z0-9\-_\.]{1,255}}`).Subrouter()
-	attachBucketRoutes(h.logger, bucketRouter, bucketHandler, multipartHandler, objectHandler)
+	attachBucketRoutes(h.logger, bucketRouter, bucketHandler, multipartHandler, objectHandler, notificationHandler, encryptionHandler)
 
 	// Object-related routes
 	objectRouter := router.Path(`/{bucket:[a-zA-Z0-9\-_\.]{1,255}}/{key:.+}`).Subrouter()
@@ -544,3 +515,13 @@ func (h *S2) Router() *mux.Router {
 
 	return router
 }
+
+// containsString checks whether a slice contains a string
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
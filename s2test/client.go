@@ -0,0 +1,163 @@
+package s2test
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/pachyderm/s2"
+	"github.com/pachyderm/s2/client"
+)
+
+const (
+	// AccessKey is the access key that the conformance suite signs requests
+	// with
+	AccessKey = "s2test"
+	// SecretKey is the secret key that the conformance suite signs requests
+	// with
+	SecretKey = "s2test-secret"
+	// Region is the region that the conformance suite signs requests for
+	Region = "us-east-1"
+)
+
+// credentials is an auth controller that only accepts the conformance
+// suite's credentials
+type credentials struct{}
+
+func (credentials) SecretKey(r *http.Request, accessKey string, region *string) (*string, error) {
+	if accessKey != AccessKey {
+		return nil, nil
+	}
+	secretKey := SecretKey
+	return &secretKey, nil
+}
+
+func (credentials) CustomAuth(r *http.Request) (bool, error) {
+	return false, nil
+}
+
+// masterKey is the master key of `keyProvider`
+var masterKey = bytes.Repeat([]byte("s2test"), 6)[:32]
+
+// keyProvider is a key provider with a single, fixed master key, which
+// wraps data keys with AES-GCM
+type keyProvider struct{}
+
+func (keyProvider) aead() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(masterKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (p keyProvider) GenerateDataKey(r *http.Request, keyID string) (*s2.DataKey, error) {
+	aead, err := p.aead()
+	if err != nil {
+		return nil, err
+	}
+	plaintext := make([]byte, 32)
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(plaintext); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	if keyID == "" {
+		keyID = AccessKey
+	}
+	return &s2.DataKey{
+		KeyID:      keyID,
+		Plaintext:  plaintext,
+		Ciphertext: aead.Seal(nonce, nonce, plaintext, []byte(keyID)),
+	}, nil
+}
+
+func (p keyProvider) DecryptDataKey(r *http.Request, keyID string, ciphertext []byte) ([]byte, error) {
+	aead, err := p.aead()
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, errors.New("wrapped data key is too short")
+	}
+	nonce := ciphertext[:aead.NonceSize()]
+	return aead.Open(nil, nonce, ciphertext[aead.NonceSize():], []byte(keyID))
+}
+
+// testClient makes requests against an s2 server, failing the test if
+// they can't be made
+type testClient struct {
+	t *testing.T
+	*client.Client
+}
+
+// newTestClient creates a client that signs requests with the suite's
+// credentials
+func newTestClient(t *testing.T, endpoint string, httpClient *http.Client) *testClient {
+	c := client.New(endpoint, client.Credentials{
+		AccessKey: AccessKey,
+		SecretKey: SecretKey,
+		Region:    Region,
+	})
+	c.HTTPClient = httpClient
+	return &testClient{t: t, Client: c}
+}
+
+// with returns a copy of the client that signs requests with the given
+// signature version
+func (c *testClient) with(signature client.SignatureVersion) *testClient {
+	copied := *c.Client
+	copied.Signature = signature
+	return &testClient{t: c.t, Client: &copied}
+}
+
+// do makes a request. Values in `header` are set on the request and
+// signed.
+func (c *testClient) do(method, path string, query url.Values, header http.Header, body []byte) *client.Response {
+	c.t.Helper()
+	res, err := c.Do(method, path, query, header, body)
+	if err != nil {
+		c.t.Fatalf("request %s %s failed: %v", method, path, err)
+	}
+	return res
+}
+
+// expect checks the status of a response, failing the test with the
+// response body if it's unexpected
+func (c *testClient) expect(res *client.Response, status int) *client.Response {
+	c.t.Helper()
+	if res.StatusCode != status {
+		c.t.Fatalf("expected status %d, got %d: %s", status, res.StatusCode, res.Body)
+	}
+	return res
+}
+
+// expectError checks that a response is an S3 error with the given status
+// and code. Responses to HEAD requests have no body, so only their status
+// is checked.
+func (c *testClient) expectError(res *client.Response, status int, code string) {
+	c.t.Helper()
+	err := res.Err()
+	if err == nil || res.StatusCode != status {
+		c.t.Fatalf("expected %s (%d), got status %d: %s", code, status, res.StatusCode, res.Body)
+	}
+	if len(res.Body) > 0 && err.Code != code {
+		c.t.Fatalf("expected error code %s, got %s: %s", code, err.Code, err.Message)
+	}
+}
+
+// decode parses the XML body of a successful response
+func (c *testClient) decode(res *client.Response, v interface{}) {
+	c.t.Helper()
+	c.expect(res, http.StatusOK)
+	if err := res.Decode(v); err != nil {
+		c.t.Fatalf("could not parse response %q: %v", res.Body, err)
+	}
+}
@@ -0,0 +1,1070 @@
+// Package s2test provides a conformance suite for s2 controller
+// implementations. The suite drives an s2 server through a real HTTP
+// client, so it checks the behavior that S3 clients see, rather than the
+// return values of individual controller methods. A backend can run it from
+// its own tests:
+//
+//	func TestConformance(t *testing.T) {
+//		s2test.RunConformance(t, func() *s2.S2 {
+//			return NewBackend().S2(logger)
+//		})
+//	}
+package s2test
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"hash/crc32"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pachyderm/s2"
+	"github.com/pachyderm/s2/client"
+)
+
+// minPartSize is the minimum size of all but the last part of a multipart
+// upload
+const minPartSize = 5 * 1024 * 1024
+
+// listBucketResult is the response to a list objects request
+type listBucketResult struct {
+	Contents []struct {
+		Key  string `xml:"Key"`
+		ETag string `xml:"ETag"`
+		Size int64  `xml:"Size"`
+	} `xml:"Contents"`
+	CommonPrefixes []struct {
+		Prefix string `xml:"Prefix"`
+	} `xml:"CommonPrefixes"`
+	IsTruncated bool   `xml:"IsTruncated"`
+	NextMarker  string `xml:"NextMarker"`
+}
+
+// listVersionsEntry is a version or delete marker in the response to a list
+// object versions request
+type listVersionsEntry struct {
+	XMLName   xml.Name
+	Key       string `xml:"Key"`
+	VersionID string `xml:"VersionId"`
+	IsLatest  bool   `xml:"IsLatest"`
+}
+
+// listVersionsResult is the response to a list object versions request.
+// Versions and delete markers are kept in a single list, to preserve their
+// order in the response.
+type listVersionsResult struct {
+	Entries             []listVersionsEntry `xml:",any"`
+	IsTruncated         bool                `xml:"IsTruncated"`
+	NextKeyMarker       string              `xml:"NextKeyMarker"`
+	NextVersionIDMarker string              `xml:"NextVersionIdMarker"`
+}
+
+// RunConformance runs the conformance suite as subtests of `t`. `newS2` is
+// called to create a fresh, empty server for each subtest. Its `Auth`
+// controller is replaced with one that only accepts the credentials in this
+// package, which the suite signs its requests with, and if it has no
+// `KeyProvider`, one with a fixed master key is set. Features that the
+// server reports as `NotImplemented` (versioning, multipart uploads,
+// server-side encryption and select) are skipped, rather than failed.
+func RunConformance(t *testing.T, newS2 func() *s2.S2) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, c *testClient)
+	}{
+		{"Auth", testAuth},
+		{"Signatures", testSignatures},
+		{"Buckets", testBuckets},
+		{"ListBuckets", testListBuckets},
+		{"Objects", testObjects},
+		{"ConditionalRequests", testConditionalRequests},
+		{"Listing", testListing},
+		{"Copy", testCopy},
+		{"Versioning", testVersioning},
+		{"Multipart", testMultipart},
+		{"Encryption", testEncryption},
+		{"Select", testSelect},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			s := newS2()
+			s.Auth = credentials{}
+			if s.KeyProvider == nil {
+				s.KeyProvider = keyProvider{}
+			}
+			server := httptest.NewServer(s.Router())
+			defer server.Close()
+
+			test.test(t, newTestClient(t, server.URL, server.Client()))
+		})
+	}
+}
+
+// createBucket creates a bucket, failing the test if it can't be
+func createBucket(c *testClient, bucket string) {
+	c.t.Helper()
+	c.expect(c.do("PUT", "/"+bucket, nil, nil, nil), http.StatusOK)
+}
+
+// putObject writes an object, failing the test if it can't be, and returns
+// the response
+func putObject(c *testClient, bucket, key, content string) *client.Response {
+	c.t.Helper()
+	return c.expect(c.do("PUT", "/"+bucket+"/"+key, nil, nil, []byte(content)), http.StatusOK)
+}
+
+// expectContent checks that an object has the given content
+func expectContent(c *testClient, bucket, key string, query url.Values, content string) {
+	c.t.Helper()
+	res := c.expect(c.do("GET", "/"+bucket+"/"+key, query, nil, nil), http.StatusOK)
+	if string(res.Body) != content {
+		c.t.Fatalf("expected %s/%s to contain %q, got %q", bucket, key, content, res.Body)
+	}
+}
+
+// skipIfNotImplemented skips the test if a response is a `NotImplemented`
+// error
+func skipIfNotImplemented(c *testClient, res *client.Response, feature string) {
+	c.t.Helper()
+	if res.StatusCode == http.StatusNotImplemented {
+		c.t.Skipf("%s not implemented", feature)
+	}
+}
+
+func testAuth(t *testing.T, c *testClient) {
+	c.expect(c.do("GET", "/", nil, nil, nil), http.StatusOK)
+	c.expect(c.with(client.SignatureV2).do("GET", "/", nil, nil, nil), http.StatusOK)
+
+	// unsigned requests aren't accepted
+	c.expectError(c.with(client.Unsigned).do("GET", "/", nil, nil, nil), http.StatusForbidden, "AccessDenied")
+
+	// neither are requests with unknown credentials
+	other := c.with(client.SignatureV4)
+	other.Credentials.AccessKey = "other"
+	c.expectError(other.do("GET", "/", nil, nil, nil), http.StatusForbidden, "InvalidAccessKeyId")
+	other.Credentials = c.Credentials
+	other.Credentials.SecretKey = "other"
+	c.expectError(other.do("GET", "/", nil, nil, nil), http.StatusForbidden, "SignatureDoesNotMatch")
+
+	// or requests that have been tampered with
+	req, err := c.NewRequest("GET", "/", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Credentials.SignV4(req, nil, time.Now())
+	req.URL.Path = "/bucket"
+	res, err := c.Send(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.expectError(res, http.StatusForbidden, "SignatureDoesNotMatch")
+}
+
+// testSignatures checks that writes can be made with every signature
+// version, including streaming uploads whose bodies are signed chunk by
+// chunk
+func testSignatures(t *testing.T, c *testClient) {
+	createBucket(c, "bucket")
+	content := bytes.Repeat([]byte("0123456789"), 1000)
+
+	for _, signature := range []client.SignatureVersion{client.SignatureV2, client.SignatureV4, client.SignatureStreamingV4} {
+		signed := c.with(signature)
+		signed.ChunkSize = 4096
+		key := fmt.Sprintf("key-%d", signature)
+		header := http.Header{
+			"Content-Type":   {"text/plain"},
+			"x-amz-meta-foo": {"bar"},
+		}
+		signed.expect(signed.do("PUT", "/bucket/"+key, nil, header, content), http.StatusOK)
+		expectContent(signed, "bucket", key, nil, string(content))
+	}
+
+	// streaming part uploads
+	streaming := c.with(client.SignatureStreamingV4)
+	streaming.ChunkSize = 4096
+	res := c.do("POST", "/bucket/multipart", url.Values{"uploads": {""}}, nil, nil)
+	skipIfNotImplemented(c, res, "multipart uploads")
+	var upload struct {
+		UploadID string `xml:"UploadId"`
+	}
+	c.decode(res, &upload)
+	query := url.Values{"uploadId": {upload.UploadID}, "partNumber": {"1"}}
+	etag := streaming.expect(streaming.do("PUT", "/bucket/multipart", query, nil, content), http.StatusOK).Header.Get("ETag")
+	sum := md5.Sum(content)
+	if etag != fmt.Sprintf("%q", hex.EncodeToString(sum[:])) {
+		t.Fatalf("expected streamed part to have the ETag of its decoded content, got %s", etag)
+	}
+}
+
+func testBuckets(t *testing.T, c *testClient) {
+	createBucket(c, "bucket")
+	c.expectError(c.do("PUT", "/bucket", nil, nil, nil), http.StatusConflict, "BucketAlreadyOwnedByYou")
+	c.expectError(c.do("PUT", "/Invalid_Bucket", nil, nil, nil), http.StatusBadRequest, "InvalidBucketName")
+
+	var buckets struct {
+		Names []string `xml:"Buckets>Bucket>Name"`
+	}
+	c.decode(c.do("GET", "/", nil, nil, nil), &buckets)
+	if len(buckets.Names) != 1 || buckets.Names[0] != "bucket" {
+		t.Fatalf("expected to list bucket, got %v", buckets.Names)
+	}
+
+	c.expect(c.do("HEAD", "/bucket", nil, nil, nil), http.StatusOK)
+	c.expectError(c.do("HEAD", "/missing", nil, nil, nil), http.StatusNotFound, "NoSuchBucket")
+	c.expect(c.do("GET", "/bucket", url.Values{"location": {""}}, nil, nil), http.StatusOK)
+	c.expectError(c.do("GET", "/missing", nil, nil, nil), http.StatusNotFound, "NoSuchBucket")
+
+	putObject(c, "bucket", "key", "content")
+	c.expectError(c.do("DELETE", "/bucket", nil, nil, nil), http.StatusConflict, "BucketNotEmpty")
+	c.expect(c.do("DELETE", "/bucket/key", nil, nil, nil), http.StatusNoContent)
+	c.expect(c.do("DELETE", "/bucket", nil, nil, nil), http.StatusNoContent)
+	c.expectError(c.do("DELETE", "/bucket", nil, nil, nil), http.StatusNotFound, "NoSuchBucket")
+	c.expectError(c.do("PUT", "/bucket/key", nil, nil, []byte("content")), http.StatusNotFound, "NoSuchBucket")
+}
+
+// testListBuckets checks that bucket listings can be filtered by prefix,
+// and paginated with continuation tokens
+func testListBuckets(t *testing.T, c *testClient) {
+	names := []string{"backup", "bucket-1", "bucket-2", "bucket-3"}
+	for _, name := range names {
+		createBucket(c, name)
+	}
+
+	// listAll lists every page of buckets
+	listAll := func(prefix string, maxBuckets int) []string {
+		t.Helper()
+		listed := []string{}
+		token := ""
+		for i := 0; ; i++ {
+			if i > len(names) {
+				t.Fatalf("bucket listing didn't terminate: %v", listed)
+			}
+			query := url.Values{"prefix": {prefix}, "max-buckets": {fmt.Sprint(maxBuckets)}}
+			if token != "" {
+				query.Set("continuation-token", token)
+			}
+			var result struct {
+				Names             []string `xml:"Buckets>Bucket>Name"`
+				ContinuationToken string   `xml:"ContinuationToken"`
+			}
+			c.decode(c.do("GET", "/", query, nil, nil), &result)
+			if len(result.Names) > maxBuckets {
+				t.Fatalf("expected at most %d buckets, got %v", maxBuckets, result.Names)
+			}
+			listed = append(listed, result.Names...)
+			if result.ContinuationToken == "" {
+				return listed
+			}
+			token = result.ContinuationToken
+		}
+	}
+
+	for _, maxBuckets := range []int{1, 2, 1000} {
+		if listed := listAll("", maxBuckets); strings.Join(listed, ",") != strings.Join(names, ",") {
+			t.Fatalf("expected buckets %v with max-buckets=%d, got %v", names, maxBuckets, listed)
+		}
+		if listed := listAll("bucket-", maxBuckets); strings.Join(listed, ",") != strings.Join(names[1:], ",") {
+			t.Fatalf("expected buckets %v with max-buckets=%d, got %v", names[1:], maxBuckets, listed)
+		}
+	}
+	if listed := listAll("missing", 1000); len(listed) != 0 {
+		t.Fatalf("expected no buckets, got %v", listed)
+	}
+
+	c.expectError(c.do("GET", "/", url.Values{"max-buckets": {"0"}}, nil, nil), http.StatusBadRequest, "InvalidArgument")
+}
+
+func testObjects(t *testing.T, c *testClient) {
+	createBucket(c, "bucket")
+
+	content := "hello, world"
+	sum := md5.Sum([]byte(content))
+	etag := fmt.Sprintf("%q", hex.EncodeToString(sum[:]))
+
+	res := putObject(c, "bucket", "dir/some key", content)
+	if res.Header.Get("ETag") != etag {
+		t.Fatalf("expected ETag %s, got %s", etag, res.Header.Get("ETag"))
+	}
+	expectContent(c, "bucket", "dir/some key", nil, content)
+
+	res = c.expect(c.do("HEAD", "/bucket/dir/some key", nil, nil, nil), http.StatusOK)
+	if res.Header.Get("ETag") != etag {
+		t.Fatalf("expected ETag %s, got %s", etag, res.Header.Get("ETag"))
+	}
+	if res.Header.Get("Content-Length") != fmt.Sprint(len(content)) {
+		t.Fatalf("expected Content-Length %d, got %s", len(content), res.Header.Get("Content-Length"))
+	}
+
+	res = c.expect(c.do("GET", "/bucket/dir/some key", nil, http.Header{"Range": {"bytes=7-11"}}, nil), http.StatusPartialContent)
+	if string(res.Body) != "world" {
+		t.Fatalf("expected range to contain %q, got %q", "world", res.Body)
+	}
+
+	// response headers can be overridden by signed requests
+	overrides := url.Values{
+		"response-content-type":        {"application/x-s2test"},
+		"response-content-disposition": {`attachment; filename="key"`},
+		"response-cache-control":       {"no-cache"},
+	}
+	res = c.expect(c.do("GET", "/bucket/dir/some key", overrides, nil, nil), http.StatusOK)
+	for param, header := range map[string]string{
+		"response-content-type":        "Content-Type",
+		"response-content-disposition": "Content-Disposition",
+		"response-cache-control":       "Cache-Control",
+	} {
+		if res.Header.Get(header) != overrides.Get(param) {
+			t.Fatalf("expected %s %q, got %q", header, overrides.Get(param), res.Header.Get(header))
+		}
+	}
+
+	// objects that weren't uploaded in parts have a single part
+	res = c.expect(c.do("GET", "/bucket/dir/some key", url.Values{"partNumber": {"1"}}, nil, nil), http.StatusOK)
+	if string(res.Body) != content {
+		t.Fatalf("expected part 1 to contain %q, got %q", content, res.Body)
+	}
+	c.expectError(c.do("GET", "/bucket/dir/some key", url.Values{"partNumber": {"2"}}, nil, nil), http.StatusRequestedRangeNotSatisfiable, "InvalidPartNumber")
+	c.expectError(c.do("GET", "/bucket/dir/some key", url.Values{"partNumber": {"1"}}, http.Header{"Range": {"bytes=0-1"}}, nil), http.StatusBadRequest, "InvalidRequest")
+
+	// overwrites replace the content
+	putObject(c, "bucket", "dir/some key", "replaced")
+	expectContent(c, "bucket", "dir/some key", nil, "replaced")
+
+	// bodies are checked against their digests
+	header := http.Header{"Content-Md5": {"1B2M2Y8AsgTpgAmY7PhCfg=="}}
+	c.expectError(c.do("PUT", "/bucket/key", nil, header, []byte("not empty")), http.StatusBadRequest, "BadDigest")
+
+	// unencrypted content can't be mistaken for encrypted content when it's
+	// read back
+	c.expectError(c.do("PUT", "/bucket/key", nil, nil, []byte("S2SSE\x00\x00\x01")), http.StatusBadRequest, "InvalidRequest")
+
+	c.expect(c.do("DELETE", "/bucket/dir/some key", nil, nil, nil), http.StatusNoContent)
+	c.expectError(c.do("GET", "/bucket/dir/some key", nil, nil, nil), http.StatusNotFound, "NoSuchKey")
+	c.expectError(c.do("HEAD", "/bucket/dir/some key", nil, nil, nil), http.StatusNotFound, "NoSuchKey")
+	// deleting a missing key succeeds
+	c.expect(c.do("DELETE", "/bucket/dir/some key", nil, nil, nil), http.StatusNoContent)
+}
+
+func testConditionalRequests(t *testing.T, c *testClient) {
+	createBucket(c, "bucket")
+	etag := putObject(c, "bucket", "key", "content").Header.Get("ETag")
+	other := `"00000000000000000000000000000000"`
+
+	// reads
+	c.expect(c.do("GET", "/bucket/key", nil, http.Header{"If-Match": {etag}}, nil), http.StatusOK)
+	c.expectError(c.do("GET", "/bucket/key", nil, http.Header{"If-Match": {other}}, nil), http.StatusPreconditionFailed, "PreconditionFailed")
+	c.expect(c.do("GET", "/bucket/key", nil, http.Header{"If-None-Match": {etag}}, nil), http.StatusNotModified)
+	c.expect(c.do("GET", "/bucket/key", nil, http.Header{"If-None-Match": {other}}, nil), http.StatusOK)
+	// wildcards match any object that exists
+	c.expect(c.do("GET", "/bucket/key", nil, http.Header{"If-Match": {"*"}}, nil), http.StatusOK)
+	c.expect(c.do("GET", "/bucket/key", nil, http.Header{"If-None-Match": {"*"}}, nil), http.StatusNotModified)
+	c.expect(c.do("HEAD", "/bucket/key", nil, http.Header{"If-None-Match": {"*"}}, nil), http.StatusNotModified)
+
+	// writes
+	ifNoneMatch := http.Header{"If-None-Match": {"*"}}
+	c.expectError(c.do("PUT", "/bucket/key", nil, ifNoneMatch, []byte("new")), http.StatusPreconditionFailed, "PreconditionFailed")
+	c.expect(c.do("PUT", "/bucket/new", nil, ifNoneMatch, []byte("new")), http.StatusOK)
+	c.expectError(c.do("PUT", "/bucket/key", nil, http.Header{"If-Match": {other}}, []byte("new")), http.StatusPreconditionFailed, "PreconditionFailed")
+	c.expect(c.do("PUT", "/bucket/key", nil, http.Header{"If-Match": {etag}}, []byte("new")), http.StatusOK)
+	expectContent(c, "bucket", "key", nil, "new")
+	// the ETag has changed
+	c.expectError(c.do("PUT", "/bucket/key", nil, http.Header{"If-Match": {etag}}, []byte("newer")), http.StatusPreconditionFailed, "PreconditionFailed")
+}
+
+func testListing(t *testing.T, c *testClient) {
+	createBucket(c, "bucket")
+	keys := []string{"a", "b/1", "b/2", "b/c/3", "c", "d-e", "d/f"}
+	for _, key := range keys {
+		putObject(c, "bucket", key, key)
+	}
+
+	// list returns a page of keys, and whether there are more pages
+	list := func(query url.Values) *listBucketResult {
+		t.Helper()
+		var result listBucketResult
+		c.decode(c.do("GET", "/bucket", query, nil, nil), &result)
+		return &result
+	}
+	// listAll lists every page, returning the keys and common prefixes
+	listAll := func(prefix, delimiter string, maxKeys int) []string {
+		t.Helper()
+		entries := []string{}
+		marker := ""
+		for i := 0; ; i++ {
+			if i > len(keys) {
+				t.Fatalf("listing didn't terminate: %v", entries)
+			}
+			result := list(url.Values{
+				"prefix":    {prefix},
+				"delimiter": {delimiter},
+				"marker":    {marker},
+				"max-keys":  {fmt.Sprint(maxKeys)},
+			})
+			if len(result.Contents)+len(result.CommonPrefixes) > maxKeys {
+				t.Fatalf("expected at most %d entries, got %d", maxKeys, len(result.Contents)+len(result.CommonPrefixes))
+			}
+			for _, contents := range result.Contents {
+				entries = append(entries, contents.Key)
+			}
+			for _, commonPrefix := range result.CommonPrefixes {
+				entries = append(entries, commonPrefix.Prefix)
+			}
+			if !result.IsTruncated {
+				return entries
+			}
+			if result.NextMarker == "" {
+				t.Fatal("truncated listing has no next marker")
+			}
+			marker = result.NextMarker
+		}
+	}
+	expectEntries := func(actual []string, expected ...string) {
+		t.Helper()
+		if strings.Join(actual, ",") != strings.Join(expected, ",") {
+			t.Fatalf("expected %v, got %v", expected, actual)
+		}
+	}
+
+	result := list(nil)
+	if result.IsTruncated || len(result.Contents) != len(keys) {
+		t.Fatalf("expected to list all keys, got %v", result.Contents)
+	}
+	for i, contents := range result.Contents {
+		if contents.Key != keys[i] {
+			t.Fatalf("expected key %s, got %s", keys[i], contents.Key)
+		}
+		if contents.Size != int64(len(keys[i])) {
+			t.Fatalf("expected %s to have size %d, got %d", keys[i], len(keys[i]), contents.Size)
+		}
+	}
+
+	for _, maxKeys := range []int{1, 2, 1000} {
+		expectEntries(listAll("", "", maxKeys), keys...)
+		expectEntries(listAll("b/", "", maxKeys), "b/1", "b/2", "b/c/3")
+		// contents are listed before common prefixes within each page, so
+		// only the set of entries is checked
+		entries := listAll("", "/", maxKeys)
+		sort.Strings(entries)
+		expectEntries(entries, "a", "b/", "c", "d-e", "d/")
+		entries = listAll("b/", "/", maxKeys)
+		sort.Strings(entries)
+		expectEntries(entries, "b/1", "b/2", "b/c/")
+	}
+	expectEntries(listAll("missing", "", 1000))
+
+	result = list(url.Values{"marker": {"c"}})
+	if len(result.Contents) != 2 || result.Contents[0].Key != "d-e" {
+		t.Fatalf("expected listing to start after the marker, got %v", result.Contents)
+	}
+	result = list(url.Values{"max-keys": {"0"}})
+	if len(result.Contents) != 0 {
+		t.Fatalf("expected no keys with max-keys=0, got %v", result.Contents)
+	}
+
+	c.expectError(c.do("GET", "/bucket", url.Values{"max-keys": {"-1"}}, nil, nil), http.StatusBadRequest, "InvalidArgument")
+}
+
+func testCopy(t *testing.T, c *testClient) {
+	createBucket(c, "bucket")
+	etag := putObject(c, "bucket", "src", "content").Header.Get("ETag")
+	modTime := time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat)
+	future := time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)
+
+	copyHeader := func(name, value string) http.Header {
+		header := http.Header{"x-amz-copy-source": {"/bucket/src"}}
+		if name != "" {
+			header.Set(name, value)
+		}
+		return header
+	}
+
+	var result struct {
+		ETag string `xml:"ETag"`
+	}
+	c.decode(c.do("PUT", "/bucket/dst", nil, copyHeader("", ""), nil), &result)
+	if strings.Trim(result.ETag, `"`) != strings.Trim(etag, `"`) {
+		t.Fatalf("expected copy to have ETag %s, got %s", etag, result.ETag)
+	}
+	expectContent(c, "bucket", "dst", nil, "content")
+
+	c.expect(c.do("PUT", "/bucket/dst", nil, copyHeader("x-amz-copy-source-if-match", etag), nil), http.StatusOK)
+	c.expect(c.do("PUT", "/bucket/dst", nil, copyHeader("x-amz-copy-source-if-none-match", `"other"`), nil), http.StatusOK)
+	c.expect(c.do("PUT", "/bucket/dst", nil, copyHeader("x-amz-copy-source-if-modified-since", modTime), nil), http.StatusOK)
+	c.expect(c.do("PUT", "/bucket/dst", nil, copyHeader("x-amz-copy-source-if-unmodified-since", future), nil), http.StatusOK)
+
+	for _, header := range []http.Header{
+		copyHeader("x-amz-copy-source-if-match", `"other"`),
+		copyHeader("x-amz-copy-source-if-none-match", etag),
+		copyHeader("x-amz-copy-source-if-modified-since", future),
+		copyHeader("x-amz-copy-source-if-unmodified-since", modTime),
+	} {
+		c.expectError(c.do("PUT", "/bucket/dst", nil, header, nil), http.StatusPreconditionFailed, "PreconditionFailed")
+	}
+
+	missing := http.Header{"x-amz-copy-source": {"/bucket/missing"}}
+	c.expectError(c.do("PUT", "/bucket/dst", nil, missing, nil), http.StatusNotFound, "NoSuchKey")
+	missing = http.Header{"x-amz-copy-source": {"/missing/src"}}
+	c.expectError(c.do("PUT", "/bucket/dst", nil, missing, nil), http.StatusNotFound, "NoSuchBucket")
+}
+
+func testVersioning(t *testing.T, c *testClient) {
+	createBucket(c, "bucket")
+
+	setVersioning := func(status string) *client.Response {
+		t.Helper()
+		body := fmt.Sprintf("<VersioningConfiguration><Status>%s</Status></VersioningConfiguration>", status)
+		return c.do("PUT", "/bucket", url.Values{"versioning": {""}}, nil, []byte(body))
+	}
+	res := setVersioning(s2.VersioningEnabled)
+	skipIfNotImplemented(c, res, "versioning")
+	c.expect(res, http.StatusOK)
+
+	var config struct {
+		Status string `xml:"Status"`
+	}
+	c.decode(c.do("GET", "/bucket", url.Values{"versioning": {""}}, nil, nil), &config)
+	if config.Status != s2.VersioningEnabled {
+		t.Fatalf("expected versioning to be %s, got %q", s2.VersioningEnabled, config.Status)
+	}
+
+	v1 := putObject(c, "bucket", "key", "v1").Header.Get("x-amz-version-id")
+	v2 := putObject(c, "bucket", "key", "v2").Header.Get("x-amz-version-id")
+	if v1 == "" || v2 == "" || v1 == v2 {
+		t.Fatalf("expected distinct version IDs, got %q and %q", v1, v2)
+	}
+	expectContent(c, "bucket", "key", nil, "v2")
+	expectContent(c, "bucket", "key", url.Values{"versionId": {v1}}, "v1")
+
+	copied := c.expect(c.do("PUT", "/bucket/copy", nil, http.Header{"x-amz-copy-source": {"/bucket/key?versionId=" + v1}}, nil), http.StatusOK)
+	if copied.Header.Get("x-amz-copy-source-version-id") != v1 {
+		t.Fatalf("expected copy source version %s, got %q", v1, copied.Header.Get("x-amz-copy-source-version-id"))
+	}
+	if v := copied.Header.Get("x-amz-version-id"); v == "" || v == v1 {
+		t.Fatalf("expected the copy to have a new version ID, got %q", v)
+	}
+	expectContent(c, "bucket", "copy", nil, "v1")
+
+	res = c.expect(c.do("DELETE", "/bucket/key", nil, nil, nil), http.StatusNoContent)
+	marker := res.Header.Get("x-amz-version-id")
+	if res.Header.Get("x-amz-delete-marker") != "true" || marker == "" {
+		t.Fatalf("expected delete to create a delete marker, got headers %v", res.Header)
+	}
+	c.expectError(c.do("GET", "/bucket/key", nil, nil, nil), http.StatusNotFound, "NoSuchKey")
+	expectContent(c, "bucket", "key", url.Values{"versionId": {v2}}, "v2")
+
+	// list versions a page at a time, which should be newest first
+	expected := []listVersionsEntry{
+		{XMLName: xml.Name{Local: "DeleteMarker"}, Key: "key", VersionID: marker, IsLatest: true},
+		{XMLName: xml.Name{Local: "Version"}, Key: "key", VersionID: v2},
+		{XMLName: xml.Name{Local: "Version"}, Key: "key", VersionID: v1},
+	}
+	for _, maxKeys := range []int{1, 2, 1000} {
+		entries := []listVersionsEntry{}
+		keyMarker, versionIDMarker := "", ""
+		for i := 0; ; i++ {
+			if i > len(expected) {
+				t.Fatalf("version listing didn't terminate: %v", entries)
+			}
+			var result listVersionsResult
+			c.decode(c.do("GET", "/bucket", url.Values{
+				"versions":          {""},
+				"prefix":            {"key"},
+				"max-keys":          {fmt.Sprint(maxKeys)},
+				"key-marker":        {keyMarker},
+				"version-id-marker": {versionIDMarker},
+			}, nil, nil), &result)
+			for _, entry := range result.Entries {
+				if entry.XMLName.Local == "Version" || entry.XMLName.Local == "DeleteMarker" {
+					entry.XMLName.Space = ""
+					entries = append(entries, entry)
+				}
+			}
+			if !result.IsTruncated {
+				break
+			}
+			keyMarker, versionIDMarker = result.NextKeyMarker, result.NextVersionIDMarker
+		}
+		if maxKeys > 1 {
+			// versions and delete markers are listed separately within
+			// each page, so only the set of entries can be checked
+			sort.Slice(entries, func(i, j int) bool {
+				return entries[i].VersionID < entries[j].VersionID
+			})
+			sorted := append([]listVersionsEntry{}, expected...)
+			sort.Slice(sorted, func(i, j int) bool {
+				return sorted[i].VersionID < sorted[j].VersionID
+			})
+			if fmt.Sprint(entries) != fmt.Sprint(sorted) {
+				t.Fatalf("expected versions %v with max-keys=%d, got %v", expected, maxKeys, entries)
+			}
+			continue
+		}
+		if fmt.Sprint(entries) != fmt.Sprint(expected) {
+			t.Fatalf("expected versions %v with max-keys=%d, got %v", expected, maxKeys, entries)
+		}
+	}
+
+	// removing the delete marker restores the previous version
+	c.expect(c.do("DELETE", "/bucket/key", url.Values{"versionId": {marker}}, nil, nil), http.StatusNoContent)
+	expectContent(c, "bucket", "key", nil, "v2")
+	// as does removing the latest version
+	c.expect(c.do("DELETE", "/bucket/key", url.Values{"versionId": {v2}}, nil, nil), http.StatusNoContent)
+	expectContent(c, "bucket", "key", nil, "v1")
+
+	// versioning can be suspended, but not disabled
+	c.expect(setVersioning(s2.VersioningSuspended), http.StatusOK)
+	c.decode(c.do("GET", "/bucket", url.Values{"versioning": {""}}, nil, nil), &config)
+	if config.Status != s2.VersioningSuspended {
+		t.Fatalf("expected versioning to be %s, got %q", s2.VersioningSuspended, config.Status)
+	}
+	putObject(c, "bucket", "key", "null")
+	expectContent(c, "bucket", "key", nil, "null")
+	expectContent(c, "bucket", "key", url.Values{"versionId": {v1}}, "v1")
+}
+
+func testMultipart(t *testing.T, c *testClient) {
+	createBucket(c, "bucket")
+
+	initiate := func(key string) string {
+		t.Helper()
+		res := c.do("POST", "/bucket/"+key, url.Values{"uploads": {""}}, nil, nil)
+		skipIfNotImplemented(c, res, "multipart uploads")
+		var result struct {
+			UploadID string `xml:"UploadId"`
+		}
+		c.decode(res, &result)
+		if result.UploadID == "" {
+			t.Fatal("expected an upload ID")
+		}
+		return result.UploadID
+	}
+	uploadPart := func(key, uploadID string, partNumber int, content []byte) string {
+		t.Helper()
+		query := url.Values{"uploadId": {uploadID}, "partNumber": {fmt.Sprint(partNumber)}}
+		etag := c.expect(c.do("PUT", "/bucket/"+key, query, nil, content), http.StatusOK).Header.Get("ETag")
+		if etag == "" {
+			t.Fatalf("expected part %d to have an ETag", partNumber)
+		}
+		return etag
+	}
+	complete := func(key, uploadID string, partNumbers []int, etags []string) *client.Response {
+		t.Helper()
+		var body bytes.Buffer
+		body.WriteString("<CompleteMultipartUpload>")
+		for i := range partNumbers {
+			fmt.Fprintf(&body, "<Part><PartNumber>%d</PartNumber><ETag>%s</ETag></Part>", partNumbers[i], etags[i])
+		}
+		body.WriteString("</CompleteMultipartUpload>")
+		return c.do("POST", "/bucket/"+key, url.Values{"uploadId": {uploadID}}, nil, body.Bytes())
+	}
+	// expectCompleteError checks for an error completing an upload, which
+	// might be reported in the body of a 200 response, if the server
+	// started streaming its response
+	expectCompleteError := func(res *client.Response, status int, code string) {
+		t.Helper()
+		if res.StatusCode == http.StatusOK {
+			res.StatusCode = status
+		}
+		c.expectError(res, status, code)
+	}
+
+	uploadID := initiate("key")
+	first := bytes.Repeat([]byte("a"), minPartSize)
+	etag1 := uploadPart("key", uploadID, 1, first)
+	etag2 := uploadPart("key", uploadID, 2, []byte("tail"))
+	// re-uploading a part replaces it
+	etag2 = uploadPart("key", uploadID, 2, []byte("last"))
+
+	var uploads struct {
+		Uploads []struct {
+			Key      string `xml:"Key"`
+			UploadID string `xml:"UploadId"`
+		} `xml:"Upload"`
+	}
+	c.decode(c.do("GET", "/bucket", url.Values{"uploads": {""}}, nil, nil), &uploads)
+	if len(uploads.Uploads) != 1 || uploads.Uploads[0].Key != "key" || uploads.Uploads[0].UploadID != uploadID {
+		t.Fatalf("expected to list upload %s, got %v", uploadID, uploads.Uploads)
+	}
+
+	var parts struct {
+		Parts []struct {
+			PartNumber int    `xml:"PartNumber"`
+			ETag       string `xml:"ETag"`
+		} `xml:"Part"`
+	}
+	c.decode(c.do("GET", "/bucket/key", url.Values{"uploadId": {uploadID}}, nil, nil), &parts)
+	if len(parts.Parts) != 2 || parts.Parts[0].PartNumber != 1 || parts.Parts[1].PartNumber != 2 {
+		t.Fatalf("expected to list parts 1 and 2, got %v", parts.Parts)
+	}
+	if strings.Trim(parts.Parts[1].ETag, `"`) != strings.Trim(etag2, `"`) {
+		t.Fatalf("expected part 2 to have ETag %s, got %s", etag2, parts.Parts[1].ETag)
+	}
+
+	expectCompleteError(complete("key", uploadID, []int{2, 1}, []string{etag2, etag1}), http.StatusBadRequest, "InvalidPartOrder")
+	expectCompleteError(complete("key", uploadID, []int{1, 2}, []string{etag1, `"00000000000000000000000000000000"`}), http.StatusBadRequest, "InvalidPart")
+	expectCompleteError(complete("key", uploadID, []int{1, 3}, []string{etag1, etag2}), http.StatusBadRequest, "InvalidPart")
+
+	res := complete("key", uploadID, []int{1, 2}, []string{etag1, etag2})
+	var result struct {
+		ETag string `xml:"ETag"`
+	}
+	c.decode(res, &result)
+	if !strings.HasSuffix(strings.Trim(result.ETag, `"`), "-2") {
+		t.Fatalf("expected a multipart ETag for 2 parts, got %s", result.ETag)
+	}
+	expectContent(c, "bucket", "key", nil, string(first)+"last")
+	c.expectError(c.do("GET", "/bucket/key", url.Values{"uploadId": {uploadID}}, nil, nil), http.StatusNotFound, "NoSuchUpload")
+
+	// parts of the completed object can be read by number, unless the
+	// server doesn't keep track of them, in which case the object is read
+	// as a single part
+	res = c.do("HEAD", "/bucket/key", url.Values{"partNumber": {"1"}}, nil, nil)
+	if res.Header.Get("x-amz-mp-parts-count") == "" {
+		c.expect(res, http.StatusOK)
+		c.expectError(c.do("GET", "/bucket/key", url.Values{"partNumber": {"2"}}, nil, nil), http.StatusRequestedRangeNotSatisfiable, "InvalidPartNumber")
+	} else {
+		c.expect(res, http.StatusPartialContent)
+		if res.Header.Get("Content-Length") != fmt.Sprint(minPartSize) {
+			t.Fatalf("expected part 1 to have length %d, got %s", minPartSize, res.Header.Get("Content-Length"))
+		}
+		res = c.expect(c.do("GET", "/bucket/key", url.Values{"partNumber": {"2"}}, nil, nil), http.StatusPartialContent)
+		if string(res.Body) != "last" {
+			t.Fatalf("expected part 2 to contain %q, got %q", "last", res.Body)
+		}
+		if res.Header.Get("x-amz-mp-parts-count") != "2" {
+			t.Fatalf("expected a parts count of 2, got %q", res.Header.Get("x-amz-mp-parts-count"))
+		}
+		c.expectError(c.do("GET", "/bucket/key", url.Values{"partNumber": {"3"}}, nil, nil), http.StatusRequestedRangeNotSatisfiable, "InvalidPartNumber")
+	}
+
+	// all parts but the last must be at least 5MiB
+	uploadID = initiate("small")
+	etag1 = uploadPart("small", uploadID, 1, []byte("small"))
+	etag2 = uploadPart("small", uploadID, 2, []byte("last"))
+	expectCompleteError(complete("small", uploadID, []int{1, 2}, []string{etag1, etag2}), http.StatusBadRequest, "EntityTooSmall")
+
+	// aborted uploads are gone
+	c.expect(c.do("DELETE", "/bucket/small", url.Values{"uploadId": {uploadID}}, nil, nil), http.StatusNoContent)
+	c.expectError(c.do("DELETE", "/bucket/small", url.Values{"uploadId": {uploadID}}, nil, nil), http.StatusNotFound, "NoSuchUpload")
+	c.expectError(c.do("PUT", "/bucket/small", url.Values{"uploadId": {uploadID}, "partNumber": {"3"}}, nil, []byte("part")), http.StatusNotFound, "NoSuchUpload")
+	expectCompleteError(complete("small", uploadID, []int{1, 2}, []string{etag1, etag2}), http.StatusNotFound, "NoSuchUpload")
+	c.expectError(c.do("GET", "/bucket/small", nil, nil, nil), http.StatusNotFound, "NoSuchKey")
+
+	// uploads can be listed by prefix, and grouped by a delimiter
+	uploadIDs := map[string]string{}
+	for _, key := range []string{"dir/a", "dir/b", "dir/sub/c", "other"} {
+		uploadIDs[key] = initiate(key)
+	}
+	var grouped struct {
+		Uploads []struct {
+			Key string `xml:"Key"`
+		} `xml:"Upload"`
+		CommonPrefixes []struct {
+			Prefix string `xml:"Prefix"`
+		} `xml:"CommonPrefixes"`
+	}
+	c.decode(c.do("GET", "/bucket", url.Values{"uploads": {""}, "prefix": {"dir/"}, "delimiter": {"/"}}, nil, nil), &grouped)
+	if len(grouped.Uploads) != 2 || grouped.Uploads[0].Key != "dir/a" || grouped.Uploads[1].Key != "dir/b" {
+		t.Fatalf("expected to list uploads of dir/a and dir/b, got %v", grouped.Uploads)
+	}
+	if len(grouped.CommonPrefixes) != 1 || grouped.CommonPrefixes[0].Prefix != "dir/sub/" {
+		t.Fatalf("expected common prefix dir/sub/, got %v", grouped.CommonPrefixes)
+	}
+	for key, uploadID := range uploadIDs {
+		c.expect(c.do("DELETE", "/bucket/"+key, url.Values{"uploadId": {uploadID}}, nil, nil), http.StatusNoContent)
+	}
+
+	uploads.Uploads = nil
+	c.decode(c.do("GET", "/bucket", url.Values{"uploads": {""}}, nil, nil), &uploads)
+	if len(uploads.Uploads) != 0 {
+		t.Fatalf("expected no uploads, got %v", uploads.Uploads)
+	}
+}
+
+// testEncryption checks that objects can be written and read back with
+// customer-provided keys (SSE-C) and server-managed keys (SSE-S3), and that
+// the bucket's default encryption is applied
+func testEncryption(t *testing.T, c *testClient) {
+	createBucket(c, "bucket")
+	// the content spans more than one encrypted package in s2's format
+	content := strings.Repeat("0123456789", 10000)
+
+	// customerKey gets the headers that provide a customer key, to encrypt
+	// an object if `prefix` is "x-amz-", or to decrypt the source of a copy
+	// if it's "x-amz-copy-source-"
+	customerKey := func(prefix string, key []byte) http.Header {
+		sum := md5.Sum(key)
+		header := http.Header{}
+		header.Set(prefix+"server-side-encryption-customer-algorithm", "AES256")
+		header.Set(prefix+"server-side-encryption-customer-key", base64.StdEncoding.EncodeToString(key))
+		header.Set(prefix+"server-side-encryption-customer-key-MD5", base64.StdEncoding.EncodeToString(sum[:]))
+		return header
+	}
+	key := customerKey("x-amz-", bytes.Repeat([]byte{1}, 32))
+	otherKey := customerKey("x-amz-", bytes.Repeat([]byte{2}, 32))
+
+	res := c.do("PUT", "/bucket/customer", nil, key, []byte(content))
+	skipIfNotImplemented(c, res, "SSE-C")
+	c.expect(res, http.StatusOK)
+	if res.Header.Get("x-amz-server-side-encryption-customer-key-MD5") != key.Get("x-amz-server-side-encryption-customer-key-MD5") {
+		t.Fatalf("expected the customer key's MD5 to be echoed, got headers %v", res.Header)
+	}
+	res = c.expect(c.do("GET", "/bucket/customer", nil, key, nil), http.StatusOK)
+	if string(res.Body) != content {
+		t.Fatalf("expected customer encrypted content of length %d, got length %d", len(content), len(res.Body))
+	}
+	res = c.expect(c.do("HEAD", "/bucket/customer", nil, key, nil), http.StatusOK)
+	if res.Header.Get("Content-Length") != fmt.Sprint(len(content)) {
+		t.Fatalf("expected Content-Length %d, got %s", len(content), res.Header.Get("Content-Length"))
+	}
+	rangeHeader := http.Header{"Range": {"bytes=65530-65549"}}
+	for name, values := range key {
+		rangeHeader[name] = values
+	}
+	res = c.expect(c.do("GET", "/bucket/customer", nil, rangeHeader, nil), http.StatusPartialContent)
+	if string(res.Body) != content[65530:65550] {
+		t.Fatalf("expected range to contain %q, got %q", content[65530:65550], res.Body)
+	}
+
+	// the object can only be read with the key it was written with
+	c.expectError(c.do("GET", "/bucket/customer", nil, nil, nil), http.StatusBadRequest, "InvalidRequest")
+	c.expectError(c.do("GET", "/bucket/customer", nil, otherKey, nil), http.StatusForbidden, "AccessDenied")
+	// and keys can't be used for objects that weren't written with one
+	putObject(c, "bucket", "plain", "content")
+	c.expectError(c.do("GET", "/bucket/plain", nil, key, nil), http.StatusBadRequest, "InvalidRequest")
+
+	// listings report the size of the plaintext
+	var listing struct {
+		Contents []struct {
+			Key  string `xml:"Key"`
+			Size int    `xml:"Size"`
+		} `xml:"Contents"`
+	}
+	c.decode(c.do("GET", "/bucket", url.Values{"prefix": {"customer"}}, nil, nil), &listing)
+	if len(listing.Contents) != 1 || listing.Contents[0].Key != "customer" || listing.Contents[0].Size != len(content) {
+		t.Fatalf("expected to list customer with size %d, got %v", len(content), listing.Contents)
+	}
+	res = c.do("GET", "/bucket", url.Values{"versions": {""}, "prefix": {"customer"}}, nil, nil)
+	if res.StatusCode != http.StatusNotImplemented {
+		var versions struct {
+			Versions []struct {
+				Key  string `xml:"Key"`
+				Size int    `xml:"Size"`
+			} `xml:"Version"`
+		}
+		c.decode(res, &versions)
+		if len(versions.Versions) != 1 || versions.Versions[0].Size != len(content) {
+			t.Fatalf("expected to list a version of customer with size %d, got %v", len(content), versions.Versions)
+		}
+	}
+	// completeUpload initiates a multipart upload of `objectKey`, uploads a
+	// part with each of `partHeaders`, and completes it
+	completeUpload := func(objectKey string, initHeader http.Header, partHeaders ...http.Header) *client.Response {
+		t.Helper()
+		var upload struct {
+			UploadID string `xml:"UploadId"`
+		}
+		c.decode(c.do("POST", "/bucket/"+objectKey, url.Values{"uploads": {""}}, initHeader, nil), &upload)
+		var body bytes.Buffer
+		body.WriteString("<CompleteMultipartUpload>")
+		for i, header := range partHeaders {
+			query := url.Values{"uploadId": {upload.UploadID}, "partNumber": {fmt.Sprint(i + 1)}}
+			etag := c.expect(c.do("PUT", "/bucket/"+objectKey, query, header, []byte(content)), http.StatusOK).Header.Get("ETag")
+			fmt.Fprintf(&body, "<Part><PartNumber>%d</PartNumber><ETag>%s</ETag></Part>", i+1, etag)
+		}
+		body.WriteString("</CompleteMultipartUpload>")
+		return c.do("POST", "/bucket/"+objectKey, url.Values{"uploadId": {upload.UploadID}}, nil, body.Bytes())
+	}
+	res = c.do("POST", "/bucket/parts", url.Values{"uploads": {""}}, key, nil)
+	multipart := res.StatusCode != http.StatusNotImplemented
+	if multipart {
+		var upload struct {
+			UploadID string `xml:"UploadId"`
+		}
+		c.decode(res, &upload)
+		query := url.Values{"uploadId": {upload.UploadID}, "partNumber": {"1"}}
+		c.expect(c.do("PUT", "/bucket/parts", query, key, []byte(content)), http.StatusOK)
+		var parts struct {
+			Parts []struct {
+				Size int `xml:"Size"`
+			} `xml:"Part"`
+		}
+		c.decode(c.do("GET", "/bucket/parts", url.Values{"uploadId": {upload.UploadID}}, nil, nil), &parts)
+		if len(parts.Parts) != 1 || parts.Parts[0].Size != len(content) {
+			t.Fatalf("expected to list a part with size %d, got %v", len(content), parts.Parts)
+		}
+		c.expect(c.do("DELETE", "/bucket/parts", url.Values{"uploadId": {upload.UploadID}}, nil, nil), http.StatusNoContent)
+
+		// an object can't be made of parts encrypted differently, since it
+		// couldn't be read back
+		c.expectError(completeUpload("parts", key, key, otherKey), http.StatusBadRequest, "InvalidRequest")
+		c.expectError(completeUpload("parts", key, key, nil), http.StatusBadRequest, "InvalidRequest")
+	}
+
+	// copies decrypt with the source's key
+	copyHeader := customerKey("x-amz-copy-source-", bytes.Repeat([]byte{1}, 32))
+	copyHeader.Set("x-amz-copy-source", "/bucket/customer")
+	c.expect(c.do("PUT", "/bucket/copy", nil, copyHeader, nil), http.StatusOK)
+	expectContent(c, "bucket", "copy", nil, content)
+	// but only once the source's preconditions pass
+	failing := http.Header{"x-amz-copy-source": {"/bucket/customer"}, "x-amz-copy-source-if-match": {`"other"`}}
+	c.expectError(c.do("PUT", "/bucket/copy", nil, failing, nil), http.StatusPreconditionFailed, "PreconditionFailed")
+
+	// server-managed keys are transparent to readers
+	managed := http.Header{"x-amz-server-side-encryption": {s2.SSEAlgorithmAES256}}
+	res = c.do("PUT", "/bucket/managed", nil, managed, []byte(content))
+	skipIfNotImplemented(c, res, "SSE-S3")
+	c.expect(res, http.StatusOK)
+	if res.Header.Get("x-amz-server-side-encryption") != s2.SSEAlgorithmAES256 {
+		t.Fatalf("expected SSE-S3 to be reported, got headers %v", res.Header)
+	}
+	res = c.expect(c.do("GET", "/bucket/managed", nil, nil, nil), http.StatusOK)
+	if string(res.Body) != content {
+		t.Fatalf("expected SSE-S3 content of length %d, got length %d", len(content), len(res.Body))
+	}
+	if res.Header.Get("x-amz-server-side-encryption") != s2.SSEAlgorithmAES256 {
+		t.Fatalf("expected SSE-S3 to be reported, got headers %v", res.Header)
+	}
+	res = c.expect(c.do("GET", "/bucket/managed", nil, http.Header{"Range": {"bytes=65530-65549"}}, nil), http.StatusPartialContent)
+	if string(res.Body) != content[65530:65550] {
+		t.Fatalf("expected range to contain %q, got %q", content[65530:65550], res.Body)
+	}
+	// but the parts of multipart uploads aren't sent with the encryption
+	// requested for the upload, so it's only supported by default
+	// encryption
+	if multipart {
+		c.expectError(c.do("POST", "/bucket/managed", url.Values{"uploads": {""}}, managed, nil), http.StatusNotImplemented, "NotImplemented")
+	}
+
+	// as is the bucket's default encryption
+	config := "<ServerSideEncryptionConfiguration><Rule><ApplyServerSideEncryptionByDefault>" +
+		"<SSEAlgorithm>AES256</SSEAlgorithm>" +
+		"</ApplyServerSideEncryptionByDefault></Rule></ServerSideEncryptionConfiguration>"
+	res = c.do("PUT", "/bucket", url.Values{"encryption": {""}}, nil, []byte(config))
+	skipIfNotImplemented(c, res, "default bucket encryption")
+	c.expect(res, http.StatusOK)
+	res = putObject(c, "bucket", "default", "content")
+	if res.Header.Get("x-amz-server-side-encryption") != s2.SSEAlgorithmAES256 {
+		t.Fatalf("expected default encryption to be applied, got headers %v", res.Header)
+	}
+	expectContent(c, "bucket", "default", nil, "content")
+	if multipart {
+		c.expect(completeUpload("default", managed, nil), http.StatusOK)
+		res = c.expect(c.do("GET", "/bucket/default", nil, nil, nil), http.StatusOK)
+		if string(res.Body) != content || res.Header.Get("x-amz-server-side-encryption") != s2.SSEAlgorithmAES256 {
+			t.Fatalf("expected SSE-S3 content of length %d, got length %d and headers %v", len(content), len(res.Body), res.Header)
+		}
+	}
+}
+
+// testSelect checks that objects can be queried with SQL expressions,
+// with results streamed back as event stream messages
+func testSelect(t *testing.T, c *testClient) {
+	createBucket(c, "bucket")
+	putObject(c, "bucket", "people.csv", "name,age\nAlice,30\n\"Smith, Bob\",25\nCarol,41\n")
+	putObject(c, "bucket", "people.json", "{\"name\":\"Alice\",\"age\":30}\n{\"name\":\"Bob\",\"age\":null}\n")
+
+	request := func(expression, input, output string) []byte {
+		return []byte("<SelectObjectContentRequest>" +
+			"<Expression>" + expression + "</Expression><ExpressionType>SQL</ExpressionType>" +
+			"<InputSerialization>" + input + "</InputSerialization>" +
+			"<OutputSerialization>" + output + "</OutputSerialization>" +
+			"</SelectObjectContentRequest>")
+	}
+	selectQuery := url.Values{"select": {""}, "select-type": {"2"}}
+	tests := []struct {
+		key        string
+		expression string
+		input      string
+		output     string
+		expected   string
+	}{
+		{
+			key:        "people.csv",
+			expression: "SELECT s.name FROM S3Object s WHERE s.age &lt; '35'",
+			input:      "<CSV><FileHeaderInfo>USE</FileHeaderInfo></CSV>",
+			output:     "<CSV/>",
+			expected:   "Alice\n\"Smith, Bob\"\n",
+		},
+		{
+			key:        "people.csv",
+			expression: "SELECT _1 FROM S3Object LIMIT 2",
+			input:      "<CSV><FileHeaderInfo>IGNORE</FileHeaderInfo></CSV>",
+			output:     "<JSON/>",
+			expected:   "{\"_1\":\"Alice\"}\n{\"_1\":\"Smith, Bob\"}\n",
+		},
+		{
+			key:        "people.json",
+			expression: "SELECT COUNT(*) FROM S3Object s WHERE s.age IS NULL",
+			input:      "<JSON><Type>LINES</Type></JSON>",
+			output:     "<JSON/>",
+			expected:   "{\"_1\":1}\n",
+		},
+	}
+	for _, test := range tests {
+		res := c.do("POST", "/bucket/"+test.key, selectQuery, nil, request(test.expression, test.input, test.output))
+		skipIfNotImplemented(c, res, "select")
+		if records := selectRecords(c, c.expect(res, http.StatusOK)); records != test.expected {
+			t.Fatalf("expected %s to select %q, got %q", test.expression, test.expected, records)
+		}
+	}
+
+	c.expectError(c.do("POST", "/bucket/missing", selectQuery, nil, request("SELECT * FROM S3Object", "<CSV/>", "<CSV/>")), http.StatusNotFound, "NoSuchKey")
+	c.expectError(c.do("POST", "/bucket/people.csv", selectQuery, nil, request("SELECT FROM", "<CSV/>", "<CSV/>")), http.StatusBadRequest, "InvalidRequest")
+}
+
+// selectRecords reads the records streamed in response to a select
+// request, failing the test if the stream reports an error or doesn't end
+func selectRecords(c *testClient, res *client.Response) string {
+	c.t.Helper()
+	var records bytes.Buffer
+	body := res.Body
+	for len(body) > 0 {
+		if len(body) < 16 {
+			c.t.Fatalf("truncated event stream message: %x", body)
+		}
+		totalLength := int(binary.BigEndian.Uint32(body[0:4]))
+		headersLength := int(binary.BigEndian.Uint32(body[4:8]))
+		if totalLength > len(body) || 12+headersLength+4 > totalLength {
+			c.t.Fatalf("invalid event stream message lengths %d and %d", totalLength, headersLength)
+		}
+		if crc32.ChecksumIEEE(body[:8]) != binary.BigEndian.Uint32(body[8:12]) {
+			c.t.Fatal("invalid event stream prelude CRC")
+		}
+		if crc32.ChecksumIEEE(body[:totalLength-4]) != binary.BigEndian.Uint32(body[totalLength-4:totalLength]) {
+			c.t.Fatal("invalid event stream message CRC")
+		}
+
+		// headers are all strings, i.e. of type 7
+		headers := map[string]string{}
+		encoded := body[12 : 12+headersLength]
+		for len(encoded) > 0 {
+			nameLength := int(encoded[0])
+			valueLength := int(binary.BigEndian.Uint16(encoded[2+nameLength:]))
+			headers[string(encoded[1:1+nameLength])] = string(encoded[4+nameLength : 4+nameLength+valueLength])
+			encoded = encoded[4+nameLength+valueLength:]
+		}
+		if headers[":message-type"] == "error" {
+			c.t.Fatalf("select failed: %s: %s", headers[":error-code"], headers[":error-message"])
+		}
+		switch headers[":event-type"] {
+		case "Records":
+			records.Write(body[12+headersLength : totalLength-4])
+		case "End":
+			return records.String()
+		}
+		body = body[totalLength:]
+	}
+	c.t.Fatal("event stream ended without an End message")
+	return ""
+}
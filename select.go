@@ -0,0 +1,735 @@
+package s2
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// selectRecordsFlushSize is how much output is buffered before a Records
+	// message is sent in a select response
+	selectRecordsFlushSize = 64 * 1024
+	// selectMaxRecordSize is the maximum size of an input record in a
+	// select request. This matches S3's limit.
+	selectMaxRecordSize = 1024 * 1024
+	// selectProgressInterval is how many input records are processed between
+	// Progress messages, if progress reporting is requested
+	selectProgressInterval = 10000
+)
+
+// selectCSVInput is the XML representation of CSV input serialization
+// options
+type selectCSVInput struct {
+	FileHeaderInfo       string `xml:"FileHeaderInfo"`
+	Comments             string `xml:"Comments"`
+	QuoteEscapeCharacter string `xml:"QuoteEscapeCharacter"`
+	RecordDelimiter      string `xml:"RecordDelimiter"`
+	FieldDelimiter       string `xml:"FieldDelimiter"`
+	QuoteCharacter       string `xml:"QuoteCharacter"`
+}
+
+// selectJSONInput is the XML representation of JSON input serialization
+// options
+type selectJSONInput struct {
+	Type string `xml:"Type"`
+}
+
+// selectCSVOutput is the XML representation of CSV output serialization
+// options
+type selectCSVOutput struct {
+	QuoteFields     string `xml:"QuoteFields"`
+	RecordDelimiter string `xml:"RecordDelimiter"`
+	FieldDelimiter  string `xml:"FieldDelimiter"`
+	QuoteCharacter  string `xml:"QuoteCharacter"`
+}
+
+// selectJSONOutput is the XML representation of JSON output serialization
+// options
+type selectJSONOutput struct {
+	RecordDelimiter string `xml:"RecordDelimiter"`
+}
+
+// selectRequest is the XML representation of a SelectObjectContent request
+type selectRequest struct {
+	XMLName         xml.Name `xml:"SelectObjectContentRequest"`
+	Expression      string   `xml:"Expression"`
+	ExpressionType  string   `xml:"ExpressionType"`
+	RequestProgress struct {
+		Enabled bool `xml:"Enabled"`
+	} `xml:"RequestProgress"`
+	InputSerialization struct {
+		CompressionType string           `xml:"CompressionType"`
+		CSV             *selectCSVInput  `xml:"CSV"`
+		JSON            *selectJSONInput `xml:"JSON"`
+		Parquet         *struct{}        `xml:"Parquet"`
+	} `xml:"InputSerialization"`
+	OutputSerialization struct {
+		CSV  *selectCSVOutput  `xml:"CSV"`
+		JSON *selectJSONOutput `xml:"JSON"`
+	} `xml:"OutputSerialization"`
+}
+
+// selectStats is the XML payload of Stats and Progress messages
+type selectStats struct {
+	XMLName        xml.Name
+	BytesScanned   int64 `xml:"BytesScanned"`
+	BytesProcessed int64 `xml:"BytesProcessed"`
+	BytesReturned  int64 `xml:"BytesReturned"`
+}
+
+// jsonObject is a JSON object that preserves the order of its fields
+type jsonObject struct {
+	fields []sqlField
+}
+
+func (o *jsonObject) field(name string, caseSensitive bool) (interface{}, bool) {
+	for _, f := range o.fields {
+		if f.name == name || !caseSensitive && strings.EqualFold(f.name, name) {
+			return f.value, true
+		}
+	}
+	return nil, false
+}
+
+// MarshalJSON marshals the object, preserving field order
+func (o *jsonObject) MarshalJSON() ([]byte, error) {
+	return marshalSQLFields(o.fields)
+}
+
+// marshalSQLFields marshals a list of fields as a JSON object, preserving
+// field order
+func marshalSQLFields(fields []sqlField) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, f := range fields {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		name, err := json.Marshal(f.name)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(name)
+		buf.WriteByte(':')
+		value, err := marshalSQLValue(f.value)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// marshalSQLValue marshals a value produced by a select expression as JSON
+func marshalSQLValue(v interface{}) ([]byte, error) {
+	if f, ok := v.(float64); ok {
+		return []byte(sqlToString(f)), nil
+	}
+	return json.Marshal(v)
+}
+
+// decodeJSONValue decodes the next JSON value from a decoder, preserving
+// the order of object fields
+func decodeJSONValue(decoder *json.Decoder) (interface{}, error) {
+	t, err := decoder.Token()
+	if err != nil {
+		return nil, err
+	}
+	return decodeJSONToken(decoder, t)
+}
+
+func decodeJSONToken(decoder *json.Decoder, t json.Token) (interface{}, error) {
+	switch t := t.(type) {
+	case json.Delim:
+		switch t {
+		case '{':
+			obj := &jsonObject{fields: []sqlField{}}
+			for decoder.More() {
+				keyToken, err := decoder.Token()
+				if err != nil {
+					return nil, err
+				}
+				key, ok := keyToken.(string)
+				if !ok {
+					return nil, fmt.Errorf("unexpected JSON object key %v", keyToken)
+				}
+				value, err := decodeJSONValue(decoder)
+				if err != nil {
+					return nil, err
+				}
+				obj.fields = append(obj.fields, sqlField{name: key, value: value})
+			}
+			if _, err := decoder.Token(); err != nil {
+				return nil, err
+			}
+			return obj, nil
+		case '[':
+			arr := []interface{}{}
+			for decoder.More() {
+				value, err := decodeJSONValue(decoder)
+				if err != nil {
+					return nil, err
+				}
+				arr = append(arr, value)
+			}
+			if _, err := decoder.Token(); err != nil {
+				return nil, err
+			}
+			return arr, nil
+		}
+		return nil, fmt.Errorf("unexpected JSON delimiter %v", t)
+	case json.Number:
+		f, err := t.Float64()
+		if err != nil {
+			return nil, err
+		}
+		return f, nil
+	default:
+		return t, nil
+	}
+}
+
+// jsonRecord is a record from JSON input
+type jsonRecord struct {
+	object *jsonObject
+}
+
+func (r *jsonRecord) field(name string, caseSensitive bool) (interface{}, bool) {
+	return r.object.field(name, caseSensitive)
+}
+
+func (r *jsonRecord) index(i int) (interface{}, bool) {
+	if i < 0 || i >= len(r.object.fields) {
+		return nil, false
+	}
+	return r.object.fields[i].value, true
+}
+
+func (r *jsonRecord) fields() []sqlField {
+	return r.object.fields
+}
+
+// csvRecord is a record from CSV input
+type csvRecord struct {
+	header []string
+	values []string
+}
+
+func (r *csvRecord) field(name string, caseSensitive bool) (interface{}, bool) {
+	for i, h := range r.header {
+		if h == name || !caseSensitive && strings.EqualFold(h, name) {
+			return r.index(i)
+		}
+	}
+	return nil, false
+}
+
+func (r *csvRecord) index(i int) (interface{}, bool) {
+	if i < 0 || i >= len(r.values) {
+		return nil, false
+	}
+	return r.values[i], true
+}
+
+func (r *csvRecord) fields() []sqlField {
+	fields := make([]sqlField, len(r.values))
+	for i, value := range r.values {
+		name := fmt.Sprintf("_%d", i+1)
+		if i < len(r.header) {
+			name = r.header[i]
+		}
+		fields[i] = sqlField{name: name, value: value}
+	}
+	return fields
+}
+
+// selectReader reads input records for a select request
+type selectReader interface {
+	// next returns the next record, or `io.EOF` if there are no more
+	next() (sqlRecord, error)
+}
+
+// csvSelectReader reads records from CSV input. Records are split on the
+// record delimiter before being parsed, so quoted record delimiters are not
+// supported (matching S3's default of `AllowQuotedRecordDelimiter=false`.)
+type csvSelectReader struct {
+	scanner        *bufio.Scanner
+	fieldDelimiter rune
+	comment        string
+	header         []string
+	fileHeaderInfo string
+	readHeader     bool
+}
+
+func newCSVSelectReader(r io.Reader, options *selectCSVInput) (*csvSelectReader, error) {
+	recordDelimiter := options.RecordDelimiter
+	if recordDelimiter == "" {
+		recordDelimiter = "\n"
+	}
+	fieldDelimiter := options.FieldDelimiter
+	if fieldDelimiter == "" {
+		fieldDelimiter = ","
+	}
+	if len([]rune(fieldDelimiter)) != 1 {
+		return nil, fmt.Errorf("field delimiter must be a single character")
+	}
+	if options.QuoteCharacter != "" && options.QuoteCharacter != `"` {
+		return nil, fmt.Errorf("only '\"' is supported as a quote character")
+	}
+	fileHeaderInfo := strings.ToUpper(options.FileHeaderInfo)
+	if fileHeaderInfo == "" {
+		fileHeaderInfo = "NONE"
+	}
+	if fileHeaderInfo != "NONE" && fileHeaderInfo != "USE" && fileHeaderInfo != "IGNORE" {
+		return nil, fmt.Errorf("invalid FileHeaderInfo %q", options.FileHeaderInfo)
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), selectMaxRecordSize)
+	delimiter := []byte(recordDelimiter)
+	scanner.Split(func(data []byte, atEOF bool) (int, []byte, error) {
+		if atEOF && len(data) == 0 {
+			return 0, nil, nil
+		}
+		if i := bytes.Index(data, delimiter); i >= 0 {
+			return i + len(delimiter), data[:i], nil
+		}
+		if atEOF {
+			return len(data), data, nil
+		}
+		return 0, nil, nil
+	})
+
+	return &csvSelectReader{
+		scanner:        scanner,
+		fieldDelimiter: []rune(fieldDelimiter)[0],
+		comment:        options.Comments,
+		fileHeaderInfo: fileHeaderInfo,
+	}, nil
+}
+
+// line returns the fields of the next non-comment line
+func (c *csvSelectReader) line() ([]string, error) {
+	for c.scanner.Scan() {
+		line := strings.TrimSuffix(c.scanner.Text(), "\r")
+		if line == "" || c.comment != "" && strings.HasPrefix(line, c.comment) {
+			continue
+		}
+		reader := csv.NewReader(strings.NewReader(line))
+		reader.Comma = c.fieldDelimiter
+		reader.FieldsPerRecord = -1
+		reader.LazyQuotes = true
+		values, err := reader.Read()
+		if err != nil {
+			return nil, err
+		}
+		return values, nil
+	}
+	if err := c.scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, io.EOF
+}
+
+func (c *csvSelectReader) next() (sqlRecord, error) {
+	if !c.readHeader && c.fileHeaderInfo != "NONE" {
+		c.readHeader = true
+		header, err := c.line()
+		if err != nil {
+			return nil, err
+		}
+		if c.fileHeaderInfo == "USE" {
+			c.header = header
+		}
+	}
+
+	values, err := c.line()
+	if err != nil {
+		return nil, err
+	}
+	return &csvRecord{header: c.header, values: values}, nil
+}
+
+// jsonSelectReader reads records from JSON input. Both JSON lines and JSON
+// documents are supported: each top-level value is a record.
+type jsonSelectReader struct {
+	decoder *json.Decoder
+}
+
+func newJSONSelectReader(r io.Reader, options *selectJSONInput) (*jsonSelectReader, error) {
+	jsonType := strings.ToUpper(options.Type)
+	if jsonType != "" && jsonType != "LINES" && jsonType != "DOCUMENT" {
+		return nil, fmt.Errorf("invalid JSON type %q", options.Type)
+	}
+	decoder := json.NewDecoder(r)
+	decoder.UseNumber()
+	return &jsonSelectReader{decoder: decoder}, nil
+}
+
+func (j *jsonSelectReader) next() (sqlRecord, error) {
+	t, err := j.decoder.Token()
+	if err != nil {
+		return nil, err
+	}
+	// running out of input within a value means it's truncated, rather
+	// than that there are no more records
+	value, err := decodeJSONToken(j.decoder, t)
+	if err == io.EOF {
+		return nil, io.ErrUnexpectedEOF
+	} else if err != nil {
+		return nil, err
+	}
+	obj, ok := value.(*jsonObject)
+	if !ok {
+		obj = &jsonObject{fields: []sqlField{{name: "_1", value: value}}}
+	}
+	return &jsonRecord{object: obj}, nil
+}
+
+// selectWriter serializes output records for a select request
+type selectWriter interface {
+	write(buf *bytes.Buffer, fields []sqlField) error
+}
+
+// csvSelectWriter serializes output records as CSV
+type csvSelectWriter struct {
+	fieldDelimiter  string
+	recordDelimiter string
+	quote           string
+	quoteAlways     bool
+}
+
+func newCSVSelectWriter(options *selectCSVOutput) *csvSelectWriter {
+	w := &csvSelectWriter{
+		fieldDelimiter:  options.FieldDelimiter,
+		recordDelimiter: options.RecordDelimiter,
+		quote:           options.QuoteCharacter,
+		quoteAlways:     strings.ToUpper(options.QuoteFields) == "ALWAYS",
+	}
+	if w.fieldDelimiter == "" {
+		w.fieldDelimiter = ","
+	}
+	if w.recordDelimiter == "" {
+		w.recordDelimiter = "\n"
+	}
+	if w.quote == "" {
+		w.quote = `"`
+	}
+	return w
+}
+
+func (c *csvSelectWriter) write(buf *bytes.Buffer, fields []sqlField) error {
+	for i, f := range fields {
+		if i > 0 {
+			buf.WriteString(c.fieldDelimiter)
+		}
+		value := sqlToString(f.value)
+		needsQuotes := c.quoteAlways || strings.Contains(value, c.fieldDelimiter) || strings.Contains(value, c.recordDelimiter) || strings.Contains(value, c.quote)
+		if needsQuotes {
+			buf.WriteString(c.quote)
+			buf.WriteString(strings.Replace(value, c.quote, c.quote+c.quote, -1))
+			buf.WriteString(c.quote)
+		} else {
+			buf.WriteString(value)
+		}
+	}
+	buf.WriteString(c.recordDelimiter)
+	return nil
+}
+
+// jsonSelectWriter serializes output records as JSON
+type jsonSelectWriter struct {
+	recordDelimiter string
+}
+
+func newJSONSelectWriter(options *selectJSONOutput) *jsonSelectWriter {
+	w := &jsonSelectWriter{recordDelimiter: options.RecordDelimiter}
+	if w.recordDelimiter == "" {
+		w.recordDelimiter = "\n"
+	}
+	return w
+}
+
+func (j *jsonSelectWriter) write(buf *bytes.Buffer, fields []sqlField) error {
+	b, err := marshalSQLFields(fields)
+	if err != nil {
+		return err
+	}
+	buf.Write(b)
+	buf.WriteString(j.recordDelimiter)
+	return nil
+}
+
+// selectContent handles SelectObjectContent requests. The object is read
+// via `GetObject`, filtered through the SQL expression, and the results
+// are streamed back in AWS' binary event stream framing.
+func (h *objectHandler) selectContent(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	bucket := vars["bucket"]
+	key := vars["key"]
+
+	payload := selectRequest{}
+	if err := readXMLBody(r, &payload); err != nil {
+		WriteError(h.logger, w, r, err)
+		return
+	}
+
+	if !strings.EqualFold(payload.ExpressionType, "SQL") {
+		WriteError(h.logger, w, r, InvalidExpressionTypeError(r))
+		return
+	}
+	query, err := parseSQL(payload.Expression)
+	if err != nil {
+		WriteError(h.logger, w, r, InvalidRequestError(r, err.Error()))
+		return
+	}
+
+	input := payload.InputSerialization
+	if input.Parquet != nil {
+		WriteError(h.logger, w, r, NotImplementedError(r))
+		return
+	}
+	if (input.CSV == nil) == (input.JSON == nil) {
+		WriteError(h.logger, w, r, InvalidRequestError(r, "exactly one of CSV or JSON input serialization must be specified"))
+		return
+	}
+	output := payload.OutputSerialization
+	var writer selectWriter
+	if output.CSV != nil && output.JSON == nil {
+		writer = newCSVSelectWriter(output.CSV)
+	} else if output.JSON != nil && output.CSV == nil {
+		writer = newJSONSelectWriter(output.JSON)
+	} else {
+		WriteError(h.logger, w, r, InvalidRequestError(r, "exactly one of CSV or JSON output serialization must be specified"))
+		return
+	}
+
+	customerKey, err := customerKeyFromRequest(r, sseCustomerHeaderPrefix)
+	if err != nil {
+		WriteError(h.logger, w, r, err)
+		return
+	}
+
+	result, err := h.controller.GetObject(r, bucket, key, "")
+	if err != nil {
+		WriteError(h.logger, w, r, err)
+		return
+	}
+	defer closeContent(result.Content)
+	if result.DeleteMarker {
+		WriteError(h.logger, w, r, NoSuchKeyError(r))
+		return
+	}
+	content, _, err := h.encryptor.decrypt(r, result.Content, customerKey)
+	if err != nil {
+		WriteError(h.logger, w, r, err)
+		return
+	}
+
+	scanned := &countingReader{reader: content}
+	var decompressed io.Reader
+	switch strings.ToUpper(input.CompressionType) {
+	case "", "NONE":
+		decompressed = scanned
+	case "GZIP":
+		decompressed, err = gzip.NewReader(scanned)
+		if err != nil {
+			WriteError(h.logger, w, r, InvalidCompressionFormatError(r))
+			return
+		}
+	case "BZIP2":
+		decompressed = bzip2.NewReader(scanned)
+	default:
+		WriteError(h.logger, w, r, InvalidCompressionFormatError(r))
+		return
+	}
+	processed := &countingReader{reader: decompressed}
+
+	var reader selectReader
+	if input.CSV != nil {
+		reader, err = newCSVSelectReader(processed, input.CSV)
+	} else {
+		reader, err = newJSONSelectReader(processed, input.JSON)
+	}
+	if err != nil {
+		WriteError(h.logger, w, r, InvalidRequestError(r, err.Error()))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("x-amz-request-id", vars["requestID"])
+	w.WriteHeader(http.StatusOK)
+
+	stream := &selectStream{
+		w:         w,
+		scanned:   scanned,
+		processed: processed,
+		progress:  payload.RequestProgress.Enabled,
+	}
+
+	parsingErrorCode := "CSVParsingError"
+	if input.JSON != nil {
+		parsingErrorCode = "JSONParsingError"
+	}
+
+	var records int64
+	var returned int64
+	for query.limit < 0 || query.isAggregate() || returned < query.limit {
+		record, err := reader.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			stream.fail(h, parsingErrorCode, err.Error())
+			return
+		}
+		records++
+
+		matches, err := query.matches(record)
+		if err != nil {
+			stream.fail(h, "EvaluatorInvalidArguments", err.Error())
+			return
+		}
+		if matches {
+			if query.isAggregate() {
+				err = query.accumulate(record)
+			} else {
+				err = stream.emit(query, writer, record)
+				returned++
+			}
+			if err != nil {
+				stream.fail(h, "EvaluatorInvalidArguments", err.Error())
+				return
+			}
+		}
+
+		if stream.progress && records%selectProgressInterval == 0 {
+			if err := stream.writeStats("Progress"); err != nil {
+				h.logger.Errorf("could not write select progress: %v", err)
+				return
+			}
+		}
+	}
+
+	if query.isAggregate() && query.limit != 0 {
+		if err := stream.emit(query, writer, nil); err != nil {
+			stream.fail(h, "EvaluatorInvalidArguments", err.Error())
+			return
+		}
+	}
+
+	if err := stream.finish(); err != nil {
+		h.logger.Errorf("could not write select response: %v", err)
+	}
+}
+
+// selectStream writes the event stream messages of a select response
+type selectStream struct {
+	w         http.ResponseWriter
+	buf       bytes.Buffer
+	scanned   *countingReader
+	processed *countingReader
+	returned  int64
+	progress  bool
+}
+
+// emit projects a record and buffers it, sending a Records message once
+// enough output has been buffered
+func (s *selectStream) emit(query *sqlQuery, writer selectWriter, record sqlRecord) error {
+	fields, err := query.project(record)
+	if err != nil {
+		return err
+	}
+	if err := writer.write(&s.buf, fields); err != nil {
+		return err
+	}
+	if s.buf.Len() >= selectRecordsFlushSize {
+		return s.flushRecords()
+	}
+	return nil
+}
+
+// flushRecords sends any buffered output as a Records message
+func (s *selectStream) flushRecords() error {
+	if s.buf.Len() == 0 {
+		return nil
+	}
+	s.returned += int64(s.buf.Len())
+	if err := writeEventStreamEvent(s.w, "Records", "application/octet-stream", s.buf.Bytes()); err != nil {
+		return err
+	}
+	s.buf.Reset()
+	s.flush()
+	return nil
+}
+
+// writeStats sends a Stats or Progress message
+func (s *selectStream) writeStats(eventType string) error {
+	stats := selectStats{
+		XMLName:        xml.Name{Local: eventType},
+		BytesScanned:   s.scanned.n,
+		BytesProcessed: s.processed.n,
+		BytesReturned:  s.returned,
+	}
+	body, err := xml.Marshal(stats)
+	if err != nil {
+		return err
+	}
+	if err := writeEventStreamEvent(s.w, eventType, "text/xml", body); err != nil {
+		return err
+	}
+	s.flush()
+	return nil
+}
+
+// finish sends any remaining records, followed by the Stats and End
+// messages
+func (s *selectStream) finish() error {
+	if err := s.flushRecords(); err != nil {
+		return err
+	}
+	if s.progress {
+		if err := s.writeStats("Progress"); err != nil {
+			return err
+		}
+	}
+	if err := s.writeStats("Stats"); err != nil {
+		return err
+	}
+	if err := writeEventStreamEvent(s.w, "End", "", nil); err != nil {
+		return err
+	}
+	s.flush()
+	return nil
+}
+
+// fail sends an error message, which terminates the stream. Records that
+// have already been buffered are sent first.
+func (s *selectStream) fail(h *objectHandler, code, message string) {
+	if err := s.flushRecords(); err != nil {
+		h.logger.Errorf("could not write select response: %v", err)
+		return
+	}
+	if err := writeEventStreamError(s.w, code, message); err != nil {
+		h.logger.Errorf("could not write select error: %v", err)
+	}
+	s.flush()
+}
+
+func (s *selectStream) flush() {
+	if flusher, ok := s.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
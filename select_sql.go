@@ -0,0 +1,1239 @@
+package s2
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// This implements the subset of S3 Select's SQL dialect that s2 supports:
+//
+//   SELECT <* | expr [AS alias], ...> FROM S3Object [[AS] alias]
+//   [WHERE expr] [LIMIT n]
+//
+// Expressions support column references (by name, `_N` position, or
+// alias-qualified path), string/number/boolean/NULL literals, arithmetic,
+// comparisons, LIKE, IS [NOT] NULL, AND/OR/NOT, CAST, a handful of string
+// functions, and the COUNT/SUM/AVG/MIN/MAX aggregates.
+
+// sqlTokenKind identifies the kind of a lexical token
+type sqlTokenKind int
+
+const (
+	sqlTokenEOF sqlTokenKind = iota
+	sqlTokenIdent
+	sqlTokenQuotedIdent
+	sqlTokenString
+	sqlTokenNumber
+	sqlTokenSymbol
+)
+
+// sqlToken is a lexical token of a select expression
+type sqlToken struct {
+	kind  sqlTokenKind
+	value string
+}
+
+// sqlKeywords are identifiers with special meaning, which can't be used as
+// bare column names
+var sqlKeywords = map[string]bool{
+	"SELECT": true, "FROM": true, "WHERE": true, "LIMIT": true, "AS": true,
+	"AND": true, "OR": true, "NOT": true, "LIKE": true, "ESCAPE": true,
+	"IS": true, "NULL": true, "TRUE": true, "FALSE": true, "CAST": true,
+	"MISSING": true,
+}
+
+// sqlError is an error in a select expression
+type sqlError struct {
+	message string
+}
+
+func (e *sqlError) Error() string {
+	return e.message
+}
+
+func newSQLError(format string, args ...interface{}) *sqlError {
+	return &sqlError{message: fmt.Sprintf(format, args...)}
+}
+
+// tokenizeSQL splits a select expression into tokens
+func tokenizeSQL(s string) ([]sqlToken, error) {
+	tokens := []sqlToken{}
+	i := 0
+	for i < len(s) {
+		c := s[i]
+		switch {
+		case unicode.IsSpace(rune(c)):
+			i++
+		case c == '\'':
+			var value strings.Builder
+			i++
+			for {
+				if i >= len(s) {
+					return nil, newSQLError("unterminated string literal")
+				}
+				if s[i] == '\'' {
+					if i+1 < len(s) && s[i+1] == '\'' {
+						value.WriteByte('\'')
+						i += 2
+						continue
+					}
+					i++
+					break
+				}
+				value.WriteByte(s[i])
+				i++
+			}
+			tokens = append(tokens, sqlToken{kind: sqlTokenString, value: value.String()})
+		case c == '"':
+			end := strings.IndexByte(s[i+1:], '"')
+			if end < 0 {
+				return nil, newSQLError("unterminated quoted identifier")
+			}
+			tokens = append(tokens, sqlToken{kind: sqlTokenQuotedIdent, value: s[i+1 : i+1+end]})
+			i += end + 2
+		case c >= '0' && c <= '9' || c == '.' && i+1 < len(s) && s[i+1] >= '0' && s[i+1] <= '9':
+			start := i
+			for i < len(s) && (s[i] >= '0' && s[i] <= '9' || s[i] == '.' || s[i] == 'e' || s[i] == 'E') {
+				i++
+			}
+			tokens = append(tokens, sqlToken{kind: sqlTokenNumber, value: s[start:i]})
+		case c == '_' || unicode.IsLetter(rune(c)):
+			start := i
+			for i < len(s) && (s[i] == '_' || unicode.IsLetter(rune(s[i])) || unicode.IsDigit(rune(s[i]))) {
+				i++
+			}
+			tokens = append(tokens, sqlToken{kind: sqlTokenIdent, value: s[start:i]})
+		default:
+			if i+1 < len(s) {
+				two := s[i : i+2]
+				if two == "<=" || two == ">=" || two == "<>" || two == "!=" || two == "||" {
+					tokens = append(tokens, sqlToken{kind: sqlTokenSymbol, value: two})
+					i += 2
+					continue
+				}
+			}
+			if strings.IndexByte("=<>()*,.+-/%[]", c) < 0 {
+				return nil, newSQLError("unexpected character %q", c)
+			}
+			tokens = append(tokens, sqlToken{kind: sqlTokenSymbol, value: string(c)})
+			i++
+		}
+	}
+	return append(tokens, sqlToken{kind: sqlTokenEOF}), nil
+}
+
+// sqlRecord is a single input record that expressions are evaluated against
+type sqlRecord interface {
+	// field looks up a top-level field by name
+	field(name string, caseSensitive bool) (interface{}, bool)
+	// index looks up a field by its zero-based position
+	index(i int) (interface{}, bool)
+	// fields returns all of the fields of the record, in order
+	fields() []sqlField
+}
+
+// sqlField is a named value in a record or in a projection
+type sqlField struct {
+	name  string
+	value interface{}
+}
+
+// sqlExpr is a node in a parsed select expression
+type sqlExpr interface {
+	eval(record sqlRecord) (interface{}, error)
+}
+
+// sqlPathComponent is a step in a column reference path
+type sqlPathComponent struct {
+	name          string
+	caseSensitive bool
+	index         int
+	isIndex       bool
+}
+
+type sqlLiteral struct {
+	value interface{}
+}
+
+func (e *sqlLiteral) eval(record sqlRecord) (interface{}, error) {
+	return e.value, nil
+}
+
+type sqlColumn struct {
+	path []sqlPathComponent
+}
+
+func (e *sqlColumn) eval(record sqlRecord) (interface{}, error) {
+	if len(e.path) == 0 {
+		return &jsonObject{fields: record.fields()}, nil
+	}
+
+	first := e.path[0]
+	var value interface{}
+	var ok bool
+	if position, isPosition := positionalColumn(first.name); isPosition && !first.caseSensitive {
+		value, ok = record.index(position)
+	} else {
+		value, ok = record.field(first.name, first.caseSensitive)
+	}
+	if !ok {
+		return nil, nil
+	}
+
+	for _, component := range e.path[1:] {
+		switch v := value.(type) {
+		case *jsonObject:
+			value, ok = v.field(component.name, component.caseSensitive)
+			if !ok {
+				return nil, nil
+			}
+		case []interface{}:
+			if !component.isIndex || component.index < 0 || component.index >= len(v) {
+				return nil, nil
+			}
+			value = v[component.index]
+		default:
+			return nil, nil
+		}
+	}
+	return value, nil
+}
+
+// name returns the name a column reference is output under
+func (e *sqlColumn) name() string {
+	for i := len(e.path) - 1; i >= 0; i-- {
+		if !e.path[i].isIndex {
+			return e.path[i].name
+		}
+	}
+	return ""
+}
+
+// positionalColumn checks whether a column name is a positional reference
+// like `_1`, returning its zero-based index
+func positionalColumn(name string) (int, bool) {
+	if !strings.HasPrefix(name, "_") {
+		return 0, false
+	}
+	i, err := strconv.Atoi(name[1:])
+	if err != nil || i < 1 {
+		return 0, false
+	}
+	return i - 1, true
+}
+
+type sqlUnary struct {
+	op      string
+	operand sqlExpr
+}
+
+func (e *sqlUnary) eval(record sqlRecord) (interface{}, error) {
+	v, err := e.operand.eval(record)
+	if err != nil {
+		return nil, err
+	}
+	switch e.op {
+	case "NOT":
+		if v == nil {
+			return nil, nil
+		}
+		b, ok := v.(bool)
+		if !ok {
+			return nil, newSQLError("NOT requires a boolean operand")
+		}
+		return !b, nil
+	case "-":
+		if v == nil {
+			return nil, nil
+		}
+		f, ok := sqlToNumber(v)
+		if !ok {
+			return nil, newSQLError("cannot negate a non-numeric value")
+		}
+		return -f, nil
+	}
+	return nil, newSQLError("unknown operator %s", e.op)
+}
+
+type sqlBinary struct {
+	op    string
+	left  sqlExpr
+	right sqlExpr
+}
+
+func (e *sqlBinary) eval(record sqlRecord) (interface{}, error) {
+	l, err := e.left.eval(record)
+	if err != nil {
+		return nil, err
+	}
+
+	// AND and OR use three-valued logic, and short-circuit
+	if e.op == "AND" || e.op == "OR" {
+		lb, lok := l.(bool)
+		if l != nil && !lok {
+			return nil, newSQLError("%s requires boolean operands", e.op)
+		}
+		if e.op == "AND" && lok && !lb {
+			return false, nil
+		}
+		if e.op == "OR" && lok && lb {
+			return true, nil
+		}
+		r, err := e.right.eval(record)
+		if err != nil {
+			return nil, err
+		}
+		rb, rok := r.(bool)
+		if r != nil && !rok {
+			return nil, newSQLError("%s requires boolean operands", e.op)
+		}
+		if e.op == "AND" && rok && !rb {
+			return false, nil
+		}
+		if e.op == "OR" && rok && rb {
+			return true, nil
+		}
+		if l == nil || r == nil {
+			return nil, nil
+		}
+		return rb, nil
+	}
+
+	r, err := e.right.eval(record)
+	if err != nil {
+		return nil, err
+	}
+	if l == nil || r == nil {
+		return nil, nil
+	}
+
+	switch e.op {
+	case "||":
+		return sqlToString(l) + sqlToString(r), nil
+	case "+", "-", "*", "/", "%":
+		lf, lok := sqlToNumber(l)
+		rf, rok := sqlToNumber(r)
+		if !lok || !rok {
+			return nil, newSQLError("arithmetic requires numeric operands")
+		}
+		switch e.op {
+		case "+":
+			return lf + rf, nil
+		case "-":
+			return lf - rf, nil
+		case "*":
+			return lf * rf, nil
+		case "/":
+			if rf == 0 {
+				return nil, newSQLError("division by zero")
+			}
+			return lf / rf, nil
+		default:
+			if rf == 0 {
+				return nil, newSQLError("division by zero")
+			}
+			return math.Mod(lf, rf), nil
+		}
+	default:
+		cmp, err := sqlCompare(l, r)
+		if err != nil {
+			return nil, err
+		}
+		switch e.op {
+		case "=":
+			return cmp == 0, nil
+		case "!=", "<>":
+			return cmp != 0, nil
+		case "<":
+			return cmp < 0, nil
+		case "<=":
+			return cmp <= 0, nil
+		case ">":
+			return cmp > 0, nil
+		case ">=":
+			return cmp >= 0, nil
+		}
+	}
+	return nil, newSQLError("unknown operator %s", e.op)
+}
+
+type sqlLike struct {
+	operand sqlExpr
+	pattern *regexp.Regexp
+	negate  bool
+}
+
+func (e *sqlLike) eval(record sqlRecord) (interface{}, error) {
+	v, err := e.operand.eval(record)
+	if err != nil || v == nil {
+		return nil, err
+	}
+	return e.pattern.MatchString(sqlToString(v)) != e.negate, nil
+}
+
+type sqlIsNull struct {
+	operand sqlExpr
+	negate  bool
+}
+
+func (e *sqlIsNull) eval(record sqlRecord) (interface{}, error) {
+	v, err := e.operand.eval(record)
+	if err != nil {
+		return nil, err
+	}
+	return (v == nil) != e.negate, nil
+}
+
+type sqlCast struct {
+	operand  sqlExpr
+	typeName string
+}
+
+func (e *sqlCast) eval(record sqlRecord) (interface{}, error) {
+	v, err := e.operand.eval(record)
+	if err != nil || v == nil {
+		return nil, err
+	}
+	switch e.typeName {
+	case "INT", "INTEGER":
+		f, ok := sqlToNumber(v)
+		if !ok {
+			return nil, newSQLError("cannot cast %q to %s", sqlToString(v), e.typeName)
+		}
+		return math.Trunc(f), nil
+	case "FLOAT", "DECIMAL", "NUMERIC":
+		f, ok := sqlToNumber(v)
+		if !ok {
+			return nil, newSQLError("cannot cast %q to %s", sqlToString(v), e.typeName)
+		}
+		return f, nil
+	case "STRING", "VARCHAR":
+		return sqlToString(v), nil
+	case "BOOL", "BOOLEAN":
+		switch strings.ToLower(sqlToString(v)) {
+		case "true":
+			return true, nil
+		case "false":
+			return false, nil
+		}
+		return nil, newSQLError("cannot cast %q to %s", sqlToString(v), e.typeName)
+	}
+	return nil, newSQLError("unsupported cast type %s", e.typeName)
+}
+
+type sqlFunction struct {
+	name string
+	args []sqlExpr
+}
+
+func (e *sqlFunction) eval(record sqlRecord) (interface{}, error) {
+	args := make([]interface{}, len(e.args))
+	for i, arg := range e.args {
+		v, err := arg.eval(record)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = v
+	}
+
+	switch e.name {
+	case "COALESCE":
+		for _, arg := range args {
+			if arg != nil {
+				return arg, nil
+			}
+		}
+		return nil, nil
+	}
+
+	if len(args) != 1 {
+		return nil, newSQLError("%s takes exactly one argument", e.name)
+	}
+	if args[0] == nil {
+		return nil, nil
+	}
+	s := sqlToString(args[0])
+	switch e.name {
+	case "LOWER":
+		return strings.ToLower(s), nil
+	case "UPPER":
+		return strings.ToUpper(s), nil
+	case "TRIM":
+		return strings.TrimSpace(s), nil
+	case "CHAR_LENGTH", "CHARACTER_LENGTH":
+		return float64(len([]rune(s))), nil
+	}
+	return nil, newSQLError("unsupported function %s", e.name)
+}
+
+// sqlAggregate is an aggregate function. Aggregates are first fed every
+// matching record via `accumulate`, and then `eval` returns the result.
+type sqlAggregate struct {
+	name    string
+	operand sqlExpr // nil for COUNT(*)
+
+	count int64
+	sum   float64
+	best  interface{}
+}
+
+func (e *sqlAggregate) accumulate(record sqlRecord) error {
+	if e.operand == nil {
+		e.count++
+		return nil
+	}
+	v, err := e.operand.eval(record)
+	if err != nil || v == nil {
+		return err
+	}
+
+	switch e.name {
+	case "COUNT":
+		e.count++
+	case "SUM", "AVG":
+		f, ok := sqlToNumber(v)
+		if !ok {
+			return newSQLError("%s requires numeric values", e.name)
+		}
+		e.count++
+		e.sum += f
+	case "MIN", "MAX":
+		if e.best == nil {
+			e.best = v
+		} else {
+			cmp, err := sqlCompare(v, e.best)
+			if err != nil {
+				return err
+			}
+			if e.name == "MIN" && cmp < 0 || e.name == "MAX" && cmp > 0 {
+				e.best = v
+			}
+		}
+		e.count++
+	}
+	return nil
+}
+
+func (e *sqlAggregate) eval(record sqlRecord) (interface{}, error) {
+	switch e.name {
+	case "COUNT":
+		return float64(e.count), nil
+	case "SUM":
+		if e.count == 0 {
+			return nil, nil
+		}
+		return e.sum, nil
+	case "AVG":
+		if e.count == 0 {
+			return nil, nil
+		}
+		return e.sum / float64(e.count), nil
+	default:
+		return e.best, nil
+	}
+}
+
+// sqlProjection is an item in the SELECT list
+type sqlProjection struct {
+	expr  sqlExpr
+	alias string
+}
+
+// sqlQuery is a parsed select expression
+type sqlQuery struct {
+	// projections is empty for `SELECT *`
+	projections []sqlProjection
+	where       sqlExpr
+	limit       int64
+	alias       string
+	aggregates  []*sqlAggregate
+}
+
+// isAggregate returns whether the query produces a single aggregated row
+func (q *sqlQuery) isAggregate() bool {
+	return len(q.aggregates) > 0
+}
+
+// matches evaluates the WHERE clause against a record
+func (q *sqlQuery) matches(record sqlRecord) (bool, error) {
+	if q.where == nil {
+		return true, nil
+	}
+	v, err := q.where.eval(record)
+	if err != nil {
+		return false, err
+	}
+	b, ok := v.(bool)
+	return ok && b, nil
+}
+
+// accumulate feeds a matching record to all of the query's aggregates
+func (q *sqlQuery) accumulate(record sqlRecord) error {
+	for _, aggregate := range q.aggregates {
+		if err := aggregate.accumulate(record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// project evaluates the SELECT list against a record. `record` is nil when
+// producing the result of an aggregate query.
+func (q *sqlQuery) project(record sqlRecord) ([]sqlField, error) {
+	if len(q.projections) == 0 {
+		return record.fields(), nil
+	}
+
+	fields := make([]sqlField, len(q.projections))
+	for i, projection := range q.projections {
+		v, err := projection.expr.eval(record)
+		if err != nil {
+			return nil, err
+		}
+		name := projection.alias
+		if name == "" {
+			if column, ok := projection.expr.(*sqlColumn); ok {
+				name = column.name()
+			}
+		}
+		if name == "" {
+			name = fmt.Sprintf("_%d", i+1)
+		}
+		fields[i] = sqlField{name: name, value: v}
+	}
+	return fields, nil
+}
+
+// sqlParser is a recursive descent parser for select expressions
+type sqlParser struct {
+	tokens     []sqlToken
+	pos        int
+	aggregates []*sqlAggregate
+	// inAggregate tracks whether an aggregate's operand is being parsed, as
+	// aggregates can't be nested
+	inAggregate bool
+}
+
+// parseSQL parses a select expression
+func parseSQL(s string) (*sqlQuery, error) {
+	tokens, err := tokenizeSQL(s)
+	if err != nil {
+		return nil, err
+	}
+	p := &sqlParser{tokens: tokens}
+	return p.parseQuery()
+}
+
+func (p *sqlParser) peek() sqlToken {
+	return p.tokens[p.pos]
+}
+
+func (p *sqlParser) next() sqlToken {
+	t := p.tokens[p.pos]
+	if t.kind != sqlTokenEOF {
+		p.pos++
+	}
+	return t
+}
+
+// isKeyword checks whether the next token is the given keyword
+func (p *sqlParser) isKeyword(keyword string) bool {
+	t := p.peek()
+	return t.kind == sqlTokenIdent && strings.EqualFold(t.value, keyword)
+}
+
+// acceptKeyword consumes the next token if it's the given keyword
+func (p *sqlParser) acceptKeyword(keyword string) bool {
+	if p.isKeyword(keyword) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *sqlParser) expectKeyword(keyword string) error {
+	if !p.acceptKeyword(keyword) {
+		return newSQLError("expected %s, got %q", keyword, p.peek().value)
+	}
+	return nil
+}
+
+// isSymbol checks whether the next token is the given symbol
+func (p *sqlParser) isSymbol(symbol string) bool {
+	t := p.peek()
+	return t.kind == sqlTokenSymbol && t.value == symbol
+}
+
+// acceptSymbol consumes the next token if it's the given symbol
+func (p *sqlParser) acceptSymbol(symbol string) bool {
+	if p.isSymbol(symbol) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *sqlParser) expectSymbol(symbol string) error {
+	if !p.acceptSymbol(symbol) {
+		return newSQLError("expected %q, got %q", symbol, p.peek().value)
+	}
+	return nil
+}
+
+// acceptAlias consumes an optional `[AS] alias`
+func (p *sqlParser) acceptAlias() (string, error) {
+	explicit := p.acceptKeyword("AS")
+	t := p.peek()
+	if t.kind == sqlTokenQuotedIdent || t.kind == sqlTokenIdent && !sqlKeywords[strings.ToUpper(t.value)] {
+		p.pos++
+		return t.value, nil
+	}
+	if explicit {
+		return "", newSQLError("expected an alias after AS")
+	}
+	return "", nil
+}
+
+func (p *sqlParser) parseQuery() (*sqlQuery, error) {
+	q := &sqlQuery{limit: -1}
+
+	if err := p.expectKeyword("SELECT"); err != nil {
+		return nil, err
+	}
+
+	if !p.acceptSymbol("*") {
+		for {
+			expr, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			alias, err := p.acceptAlias()
+			if err != nil {
+				return nil, err
+			}
+			q.projections = append(q.projections, sqlProjection{expr: expr, alias: alias})
+			if !p.acceptSymbol(",") {
+				break
+			}
+		}
+	}
+	q.aggregates = p.aggregates
+
+	if err := p.expectKeyword("FROM"); err != nil {
+		return nil, err
+	}
+	if !p.acceptKeyword("S3Object") {
+		return nil, newSQLError("expected S3Object, got %q", p.peek().value)
+	}
+	if p.acceptSymbol("[") {
+		if err := p.expectSymbol("*"); err != nil {
+			return nil, err
+		}
+		if err := p.expectSymbol("]"); err != nil {
+			return nil, err
+		}
+	}
+	alias, err := p.acceptAlias()
+	if err != nil {
+		return nil, err
+	}
+	q.alias = alias
+
+	if p.acceptKeyword("WHERE") {
+		p.aggregates = nil
+		where, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		if len(p.aggregates) > 0 {
+			return nil, newSQLError("aggregates are not allowed in WHERE clauses")
+		}
+		q.where = where
+	}
+
+	if p.acceptKeyword("LIMIT") {
+		t := p.next()
+		limit, err := strconv.ParseInt(t.value, 10, 64)
+		if t.kind != sqlTokenNumber || err != nil || limit < 0 {
+			return nil, newSQLError("invalid LIMIT %q", t.value)
+		}
+		q.limit = limit
+	}
+
+	if t := p.peek(); t.kind != sqlTokenEOF {
+		return nil, newSQLError("unexpected token %q", t.value)
+	}
+
+	if q.isAggregate() {
+		for _, projection := range q.projections {
+			if containsColumn(projection.expr) {
+				return nil, newSQLError("cannot mix aggregate and non-aggregate projections")
+			}
+		}
+	}
+
+	q.stripAlias()
+	return q, nil
+}
+
+// stripAlias removes the FROM alias (or `S3Object`) qualifier from the
+// column references in the query, e.g. `s.name` becomes `name`
+func (q *sqlQuery) stripAlias() {
+	var strip func(expr sqlExpr)
+	strip = func(expr sqlExpr) {
+		switch e := expr.(type) {
+		case *sqlColumn:
+			if len(e.path) > 0 && !e.path[0].caseSensitive && (q.alias != "" && strings.EqualFold(e.path[0].name, q.alias) || strings.EqualFold(e.path[0].name, "S3Object")) {
+				e.path = e.path[1:]
+			}
+		case *sqlUnary:
+			strip(e.operand)
+		case *sqlBinary:
+			strip(e.left)
+			strip(e.right)
+		case *sqlLike:
+			strip(e.operand)
+		case *sqlIsNull:
+			strip(e.operand)
+		case *sqlCast:
+			strip(e.operand)
+		case *sqlFunction:
+			for _, arg := range e.args {
+				strip(arg)
+			}
+		case *sqlAggregate:
+			if e.operand != nil {
+				strip(e.operand)
+			}
+		}
+	}
+
+	for _, projection := range q.projections {
+		strip(projection.expr)
+	}
+	if q.where != nil {
+		strip(q.where)
+	}
+}
+
+// containsColumn checks whether an expression references a column outside
+// of an aggregate
+func containsColumn(expr sqlExpr) bool {
+	switch e := expr.(type) {
+	case *sqlColumn:
+		return true
+	case *sqlUnary:
+		return containsColumn(e.operand)
+	case *sqlBinary:
+		return containsColumn(e.left) || containsColumn(e.right)
+	case *sqlLike:
+		return containsColumn(e.operand)
+	case *sqlIsNull:
+		return containsColumn(e.operand)
+	case *sqlCast:
+		return containsColumn(e.operand)
+	case *sqlFunction:
+		for _, arg := range e.args {
+			if containsColumn(arg) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (p *sqlParser) parseExpr() (sqlExpr, error) {
+	return p.parseOr()
+}
+
+func (p *sqlParser) parseOr() (sqlExpr, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.acceptKeyword("OR") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &sqlBinary{op: "OR", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *sqlParser) parseAnd() (sqlExpr, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.acceptKeyword("AND") {
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = &sqlBinary{op: "AND", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *sqlParser) parseNot() (sqlExpr, error) {
+	if p.acceptKeyword("NOT") {
+		operand, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &sqlUnary{op: "NOT", operand: operand}, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *sqlParser) parseComparison() (sqlExpr, error) {
+	left, err := p.parseAdditive()
+	if err != nil {
+		return nil, err
+	}
+
+	t := p.peek()
+	if t.kind == sqlTokenSymbol {
+		switch t.value {
+		case "=", "!=", "<>", "<", "<=", ">", ">=":
+			p.pos++
+			right, err := p.parseAdditive()
+			if err != nil {
+				return nil, err
+			}
+			return &sqlBinary{op: t.value, left: left, right: right}, nil
+		}
+	}
+
+	if p.acceptKeyword("IS") {
+		negate := p.acceptKeyword("NOT")
+		if !p.acceptKeyword("NULL") && !p.acceptKeyword("MISSING") {
+			return nil, newSQLError("expected NULL, got %q", p.peek().value)
+		}
+		return &sqlIsNull{operand: left, negate: negate}, nil
+	}
+
+	negate := false
+	if p.isKeyword("NOT") && p.pos+1 < len(p.tokens) && strings.EqualFold(p.tokens[p.pos+1].value, "LIKE") {
+		p.pos++
+		negate = true
+	}
+	if p.acceptKeyword("LIKE") {
+		t := p.next()
+		if t.kind != sqlTokenString {
+			return nil, newSQLError("LIKE requires a string pattern")
+		}
+		escape := ""
+		if p.acceptKeyword("ESCAPE") {
+			e := p.next()
+			if e.kind != sqlTokenString || len(e.value) != 1 {
+				return nil, newSQLError("ESCAPE requires a single character")
+			}
+			escape = e.value
+		}
+		pattern, err := likePattern(t.value, escape)
+		if err != nil {
+			return nil, err
+		}
+		return &sqlLike{operand: left, pattern: pattern, negate: negate}, nil
+	}
+
+	return left, nil
+}
+
+// likePattern converts a SQL LIKE pattern into a regular expression
+func likePattern(pattern, escape string) (*regexp.Regexp, error) {
+	var re strings.Builder
+	re.WriteString("^(?s:")
+	escaped := false
+	for _, c := range pattern {
+		switch {
+		case escaped:
+			re.WriteString(regexp.QuoteMeta(string(c)))
+			escaped = false
+		case escape != "" && string(c) == escape:
+			escaped = true
+		case c == '%':
+			re.WriteString(".*")
+		case c == '_':
+			re.WriteString(".")
+		default:
+			re.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	if escaped {
+		return nil, newSQLError("LIKE pattern ends with an escape character")
+	}
+	re.WriteString(")$")
+	return regexp.Compile(re.String())
+}
+
+func (p *sqlParser) parseAdditive() (sqlExpr, error) {
+	left, err := p.parseMultiplicative()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t := p.peek()
+		if t.kind != sqlTokenSymbol || (t.value != "+" && t.value != "-" && t.value != "||") {
+			return left, nil
+		}
+		p.pos++
+		right, err := p.parseMultiplicative()
+		if err != nil {
+			return nil, err
+		}
+		left = &sqlBinary{op: t.value, left: left, right: right}
+	}
+}
+
+func (p *sqlParser) parseMultiplicative() (sqlExpr, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t := p.peek()
+		if t.kind != sqlTokenSymbol || (t.value != "*" && t.value != "/" && t.value != "%") {
+			return left, nil
+		}
+		p.pos++
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = &sqlBinary{op: t.value, left: left, right: right}
+	}
+}
+
+func (p *sqlParser) parseUnary() (sqlExpr, error) {
+	if p.acceptSymbol("-") {
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &sqlUnary{op: "-", operand: operand}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *sqlParser) parsePrimary() (sqlExpr, error) {
+	t := p.next()
+	switch t.kind {
+	case sqlTokenNumber:
+		f, err := strconv.ParseFloat(t.value, 64)
+		if err != nil {
+			return nil, newSQLError("invalid number %q", t.value)
+		}
+		return &sqlLiteral{value: f}, nil
+	case sqlTokenString:
+		return &sqlLiteral{value: t.value}, nil
+	case sqlTokenSymbol:
+		if t.value == "(" {
+			expr, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expectSymbol(")"); err != nil {
+				return nil, err
+			}
+			return expr, nil
+		}
+	case sqlTokenQuotedIdent:
+		return p.parsePath(sqlPathComponent{name: t.value, caseSensitive: true})
+	case sqlTokenIdent:
+		upper := strings.ToUpper(t.value)
+		switch upper {
+		case "NULL", "MISSING":
+			return &sqlLiteral{value: nil}, nil
+		case "TRUE":
+			return &sqlLiteral{value: true}, nil
+		case "FALSE":
+			return &sqlLiteral{value: false}, nil
+		case "CAST":
+			return p.parseCast()
+		}
+		if sqlKeywords[upper] {
+			break
+		}
+		if p.isSymbol("(") {
+			return p.parseCall(upper)
+		}
+		return p.parsePath(sqlPathComponent{name: t.value})
+	}
+	if t.kind == sqlTokenEOF {
+		return nil, newSQLError("unexpected end of expression")
+	}
+	return nil, newSQLError("unexpected token %q", t.value)
+}
+
+func (p *sqlParser) parsePath(first sqlPathComponent) (sqlExpr, error) {
+	path := []sqlPathComponent{first}
+	for {
+		if p.acceptSymbol(".") {
+			t := p.next()
+			switch t.kind {
+			case sqlTokenIdent:
+				path = append(path, sqlPathComponent{name: t.value})
+			case sqlTokenQuotedIdent:
+				path = append(path, sqlPathComponent{name: t.value, caseSensitive: true})
+			default:
+				return nil, newSQLError("expected a field name after '.'")
+			}
+		} else if p.acceptSymbol("[") {
+			t := p.next()
+			i, err := strconv.Atoi(t.value)
+			if t.kind != sqlTokenNumber || err != nil {
+				return nil, newSQLError("invalid array index %q", t.value)
+			}
+			if err := p.expectSymbol("]"); err != nil {
+				return nil, err
+			}
+			path = append(path, sqlPathComponent{index: i, isIndex: true})
+		} else {
+			return &sqlColumn{path: path}, nil
+		}
+	}
+}
+
+func (p *sqlParser) parseCast() (sqlExpr, error) {
+	if err := p.expectSymbol("("); err != nil {
+		return nil, err
+	}
+	operand, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expectKeyword("AS"); err != nil {
+		return nil, err
+	}
+	t := p.next()
+	if t.kind != sqlTokenIdent {
+		return nil, newSQLError("expected a type name, got %q", t.value)
+	}
+	if err := p.expectSymbol(")"); err != nil {
+		return nil, err
+	}
+	return &sqlCast{operand: operand, typeName: strings.ToUpper(t.value)}, nil
+}
+
+func (p *sqlParser) parseCall(name string) (sqlExpr, error) {
+	if err := p.expectSymbol("("); err != nil {
+		return nil, err
+	}
+
+	switch name {
+	case "COUNT", "SUM", "AVG", "MIN", "MAX":
+		if p.inAggregate {
+			return nil, newSQLError("aggregates cannot be nested")
+		}
+		aggregate := &sqlAggregate{name: name}
+		if name == "COUNT" && p.acceptSymbol("*") {
+			// COUNT(*) counts every record
+		} else {
+			p.inAggregate = true
+			operand, err := p.parseExpr()
+			p.inAggregate = false
+			if err != nil {
+				return nil, err
+			}
+			aggregate.operand = operand
+		}
+		if err := p.expectSymbol(")"); err != nil {
+			return nil, err
+		}
+		p.aggregates = append(p.aggregates, aggregate)
+		return aggregate, nil
+	case "LOWER", "UPPER", "TRIM", "CHAR_LENGTH", "CHARACTER_LENGTH", "COALESCE":
+		args := []sqlExpr{}
+		if !p.isSymbol(")") {
+			for {
+				arg, err := p.parseExpr()
+				if err != nil {
+					return nil, err
+				}
+				args = append(args, arg)
+				if !p.acceptSymbol(",") {
+					break
+				}
+			}
+		}
+		if err := p.expectSymbol(")"); err != nil {
+			return nil, err
+		}
+		return &sqlFunction{name: name, args: args}, nil
+	}
+	return nil, newSQLError("unsupported function %s", name)
+}
+
+// sqlToNumber converts a value to a number. Strings (as found in CSV input)
+// are converted if they're numeric.
+func sqlToNumber(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case float64:
+		return v, true
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// sqlToString converts a value to its string representation
+func sqlToString(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case bool:
+		return strconv.FormatBool(v)
+	case float64:
+		if v == math.Trunc(v) && math.Abs(v) < 1e15 {
+			return strconv.FormatInt(int64(v), 10)
+		}
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		b, err := marshalSQLValue(v)
+		if err != nil {
+			return ""
+		}
+		return string(b)
+	}
+}
+
+// sqlCompare compares two non-null values. If both values are numeric
+// (including numeric strings, as found in CSV input), they're compared as
+// numbers; otherwise they're compared as strings.
+func sqlCompare(l, r interface{}) (int, error) {
+	if lb, ok := l.(bool); ok {
+		rb, ok := r.(bool)
+		if !ok {
+			return 0, newSQLError("cannot compare a boolean to a non-boolean")
+		}
+		if lb == rb {
+			return 0, nil
+		} else if !lb {
+			return -1, nil
+		}
+		return 1, nil
+	}
+
+	lf, lok := sqlToNumber(l)
+	rf, rok := sqlToNumber(r)
+	if lok && rok {
+		if lf < rf {
+			return -1, nil
+		} else if lf > rf {
+			return 1, nil
+		}
+		return 0, nil
+	}
+
+	return strings.Compare(sqlToString(l), sqlToString(r)), nil
+}
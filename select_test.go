@@ -0,0 +1,513 @@
+package s2
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/xml"
+	"hash/crc32"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+func TestParseSQL(t *testing.T) {
+	tests := []struct {
+		expression string
+		// names are the output names of the projections, or nil for
+		// `SELECT *`
+		names     []string
+		where     bool
+		limit     int64
+		aggregate bool
+		err       string
+	}{
+		{expression: "SELECT * FROM S3Object", limit: -1},
+		{expression: "select * from s3object[*] s limit 10", limit: 10},
+		{expression: "SELECT s.name, s._2 AS age FROM S3Object s WHERE s.age > 30", names: []string{"name", "age"}, where: true, limit: -1},
+		{expression: "SELECT S3Object.name FROM S3Object", names: []string{"name"}, limit: -1},
+		{expression: `SELECT s."Name", s.address.city, s.tags[0] FROM S3Object AS s`, names: []string{"Name", "city", "tags"}, limit: -1},
+		{expression: "SELECT 1 + 2, UPPER(name) upper FROM S3Object", names: []string{"_1", "upper"}, limit: -1},
+		{expression: "SELECT COUNT(*), AVG(CAST(age AS INT)) FROM S3Object WHERE age IS NOT NULL LIMIT 0", names: []string{"_1", "_2"}, where: true, limit: 0, aggregate: true},
+
+		{expression: "", err: "expected SELECT"},
+		{expression: "SELECT", err: "unexpected end of expression"},
+		{expression: "SELECT * FROM table", err: "expected S3Object"},
+		{expression: "SELECT * FROM S3Object LIMIT -1", err: "invalid LIMIT"},
+		{expression: "SELECT * FROM S3Object LIMIT 1.5", err: "invalid LIMIT"},
+		{expression: "SELECT * FROM S3Object WHERE", err: "unexpected end of expression"},
+		{expression: "SELECT * FROM S3Object extra tokens", err: "unexpected token"},
+		{expression: "SELECT name AS FROM S3Object", err: "expected an alias after AS"},
+		{expression: "SELECT 'unterminated FROM S3Object", err: "unterminated string literal"},
+		{expression: `SELECT "unterminated FROM S3Object`, err: "unterminated quoted identifier"},
+		{expression: "SELECT * FROM S3Object WHERE a ~ b", err: "unexpected character"},
+		{expression: "SELECT FOO(a) FROM S3Object", err: "unsupported function FOO"},
+		{expression: "SELECT CAST(a) FROM S3Object", err: "expected AS"},
+		{expression: "SELECT a[x] FROM S3Object", err: "invalid array index"},
+		{expression: "SELECT * FROM S3Object WHERE COUNT(*) > 1", err: "aggregates are not allowed in WHERE clauses"},
+		{expression: "SELECT name, COUNT(*) FROM S3Object", err: "cannot mix aggregate and non-aggregate projections"},
+		{expression: "SELECT COUNT(SUM(a)) FROM S3Object", err: "aggregates cannot be nested"},
+	}
+
+	for _, test := range tests {
+		query, err := parseSQL(test.expression)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("expected parsing %q to fail with %q, got %v", test.expression, test.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("could not parse %q: %v", test.expression, err)
+			continue
+		}
+
+		var names []string
+		if len(query.projections) > 0 {
+			fields, err := query.project(&csvRecord{})
+			if err != nil {
+				t.Errorf("could not project %q: %v", test.expression, err)
+				continue
+			}
+			for _, field := range fields {
+				names = append(names, field.name)
+			}
+		}
+		if strings.Join(names, ",") != strings.Join(test.names, ",") || (names == nil) != (test.names == nil) {
+			t.Errorf("expected %q to project %v, got %v", test.expression, test.names, names)
+		}
+		if (query.where != nil) != test.where {
+			t.Errorf("expected %q to have a WHERE clause: %v", test.expression, test.where)
+		}
+		if query.limit != test.limit {
+			t.Errorf("expected %q to have limit %d, got %d", test.expression, test.limit, query.limit)
+		}
+		if query.isAggregate() != test.aggregate {
+			t.Errorf("expected %q to be an aggregate query: %v", test.expression, test.aggregate)
+		}
+	}
+}
+
+func TestSQLEval(t *testing.T) {
+	record := &csvRecord{
+		header: []string{"name", "age", "empty"},
+		values: []string{"Alice_Smith", "30", ""},
+	}
+	tests := []struct {
+		expr     string
+		expected interface{}
+		err      string
+	}{
+		{expr: "name", expected: "Alice_Smith"},
+		{expr: "NAME", expected: "Alice_Smith"},
+		{expr: `"NAME"`, expected: nil},
+		{expr: "_2", expected: "30"},
+		{expr: "_4", expected: nil},
+		{expr: "1 + 2 * 3", expected: 7.0},
+		{expr: "(1 + 2) * 3", expected: 9.0},
+		{expr: "-age + 1", expected: -29.0},
+		{expr: "7 % 4", expected: 3.0},
+		{expr: "age / 0", err: "division by zero"},
+		{expr: "name + 1", err: "arithmetic requires numeric operands"},
+		{expr: "'it''s ' || name", expected: "it's Alice_Smith"},
+
+		// CSV values are compared as numbers when both sides are numeric
+		{expr: "age > 4", expected: true},
+		{expr: "age > '4'", expected: true},
+		{expr: "name < 'B'", expected: true},
+		{expr: "age = 30.0", expected: true},
+		{expr: "age <> 30", expected: false},
+		{expr: "TRUE = 1", err: "cannot compare a boolean"},
+
+		// NULLs propagate, and AND and OR use three-valued logic
+		{expr: "missing", expected: nil},
+		{expr: "missing IS NULL", expected: true},
+		{expr: "empty IS NULL", expected: false},
+		{expr: "missing IS NOT NULL", expected: false},
+		{expr: "missing = 1", expected: nil},
+		{expr: "missing + 1", expected: nil},
+		{expr: "NOT NULL", expected: nil},
+		{expr: "NULL AND FALSE", expected: false},
+		{expr: "NULL AND TRUE", expected: nil},
+		{expr: "NULL OR TRUE", expected: true},
+		{expr: "NULL OR FALSE", expected: nil},
+		{expr: "NOT age > 4 OR name = 'Alice_Smith'", expected: true},
+		{expr: "age AND TRUE", err: "AND requires boolean operands"},
+		{expr: "COALESCE(missing, NULL, name)", expected: "Alice_Smith"},
+		{expr: "UPPER(missing)", expected: nil},
+
+		{expr: "name LIKE 'A%'", expected: true},
+		{expr: "name LIKE 'a%'", expected: false},
+		{expr: "name LIKE '_lice%'", expected: true},
+		{expr: "name NOT LIKE '%Smith'", expected: false},
+		{expr: `name LIKE 'Alice\_%' ESCAPE '\'`, expected: true},
+		{expr: `'AliceXSmith' LIKE 'Alice\_%' ESCAPE '\'`, expected: false},
+		{expr: "missing LIKE '%'", expected: nil},
+
+		{expr: "CAST(age AS INT) + 1", expected: 31.0},
+		{expr: "CAST('2.5' AS INT)", expected: 2.0},
+		{expr: "CAST('2.5' AS FLOAT)", expected: 2.5},
+		{expr: "CAST(age AS STRING)", expected: "30"},
+		{expr: "CAST('TRUE' AS BOOL)", expected: true},
+		{expr: "CAST(name AS INT)", err: "cannot cast"},
+		{expr: "CAST(age AS DATE)", err: "unsupported cast type"},
+
+		{expr: "LOWER(name)", expected: "alice_smith"},
+		{expr: "TRIM('  x ')", expected: "x"},
+		{expr: "CHAR_LENGTH('héllo')", expected: 5.0},
+		{expr: "UPPER(name, age)", err: "takes exactly one argument"},
+	}
+
+	for _, test := range tests {
+		query, err := parseSQL("SELECT " + test.expr + " FROM S3Object")
+		if err != nil {
+			t.Errorf("could not parse %q: %v", test.expr, err)
+			continue
+		}
+		fields, err := query.project(record)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("expected %q to fail with %q, got %v", test.expr, test.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("could not evaluate %q: %v", test.expr, err)
+			continue
+		}
+		if fields[0].value != test.expected {
+			t.Errorf("expected %q to be %#v, got %#v", test.expr, test.expected, fields[0].value)
+		}
+	}
+}
+
+func TestSelectCSV(t *testing.T) {
+	people := "name,age,city\n" +
+		"Alice,30,London\n" +
+		"\"Smith, Bob\",42,\"New \"\"York\"\"\"\n" +
+		"Carol,,Paris\n" +
+		"Dan,25\n"
+
+	tests := []struct {
+		name       string
+		expression string
+		input      string
+		content    string
+		output     string
+		expected   string
+	}{
+		{
+			name:       "header use",
+			expression: "SELECT name, city FROM S3Object WHERE age > 28",
+			input:      "<FileHeaderInfo>USE</FileHeaderInfo>",
+			content:    people,
+			expected:   "Alice,London\n\"Smith, Bob\",\"New \"\"York\"\"\"\n",
+		},
+		{
+			name:       "header ignore",
+			expression: "SELECT _1 FROM S3Object s WHERE s._2 <> '' AND s._2 < 30",
+			input:      "<FileHeaderInfo>IGNORE</FileHeaderInfo>",
+			content:    people,
+			expected:   "Dan\n",
+		},
+		{
+			name:       "header none",
+			expression: "SELECT _2 FROM S3Object LIMIT 2",
+			input:      "<FileHeaderInfo>NONE</FileHeaderInfo>",
+			content:    people,
+			expected:   "age\n30\n",
+		},
+		{
+			name:       "nulls",
+			expression: "SELECT name, COALESCE(city, 'unknown') AS city FROM S3Object WHERE age = '' OR city IS NULL",
+			input:      "<FileHeaderInfo>USE</FileHeaderInfo>",
+			content:    people,
+			expected:   "Carol,Paris\nDan,unknown\n",
+		},
+		{
+			name:       "select star",
+			expression: "SELECT * FROM S3Object WHERE name LIKE 'S%'",
+			input:      "<FileHeaderInfo>USE</FileHeaderInfo>",
+			content:    people,
+			output:     "<QuoteFields>ALWAYS</QuoteFields>",
+			expected:   "\"Smith, Bob\",\"42\",\"New \"\"York\"\"\"\n",
+		},
+		{
+			name:       "json output",
+			expression: "SELECT name, age FROM S3Object WHERE city IS NOT NULL LIMIT 2",
+			input:      "<FileHeaderInfo>USE</FileHeaderInfo>",
+			content:    people,
+			output:     "json",
+			expected:   "{\"name\":\"Alice\",\"age\":\"30\"}\n{\"name\":\"Smith, Bob\",\"age\":\"42\"}\n",
+		},
+		{
+			name:       "aggregates",
+			expression: "SELECT COUNT(*), SUM(age), MAX(name) FROM S3Object",
+			input:      "<FileHeaderInfo>USE</FileHeaderInfo>",
+			content:    "name,age\nAlice,30\nBob\nCarol,12\n",
+			expected:   "3,42,Carol\n",
+		},
+		{
+			name:       "delimiters and comments",
+			expression: "SELECT b, a FROM S3Object",
+			input:      "<FileHeaderInfo>USE</FileHeaderInfo><Comments>#</Comments><FieldDelimiter>;</FieldDelimiter><RecordDelimiter>|</RecordDelimiter>",
+			content:    "a;b|#comment|1;2|3;4",
+			output:     "<FieldDelimiter>&#9;</FieldDelimiter><RecordDelimiter>&#13;&#10;</RecordDelimiter>",
+			expected:   "2\t1\r\n4\t3\r\n",
+		},
+		{
+			name:       "crlf",
+			expression: "SELECT age FROM S3Object",
+			input:      "<FileHeaderInfo>USE</FileHeaderInfo>",
+			content:    "name,age\r\nAlice,30\r\n",
+			expected:   "30\n",
+		},
+	}
+
+	for _, test := range tests {
+		output := "<CSV>" + test.output + "</CSV>"
+		if test.output == "json" {
+			output = "<JSON/>"
+		}
+		request := "<SelectObjectContentRequest>" +
+			"<Expression>" + xmlEscape(test.expression) + "</Expression><ExpressionType>SQL</ExpressionType>" +
+			"<InputSerialization><CSV>" + test.input + "</CSV></InputSerialization>" +
+			"<OutputSerialization>" + output + "</OutputSerialization>" +
+			"</SelectObjectContentRequest>"
+		records, end := runSelect(t, request, test.content)
+		if !end {
+			t.Errorf("%s: expected the stream to end", test.name)
+		}
+		if records != test.expected {
+			t.Errorf("%s: expected %q, got %q", test.name, test.expected, records)
+		}
+	}
+}
+
+func TestSelectJSON(t *testing.T) {
+	lines := `{"name":"Alice","age":30,"address":{"city":"London"},"tags":["a","b"]}
+{"name":"Bob","age":null,"address":{"city":"Paris"},"tags":[]}
+{"name":"Carol","age":25}
+`
+
+	tests := []struct {
+		name       string
+		expression string
+		jsonType   string
+		content    string
+		expected   string
+	}{
+		{
+			name:       "lines",
+			expression: "SELECT s.name, s.address.city, s.tags[1] FROM S3Object s WHERE s.age >= 25",
+			jsonType:   "LINES",
+			content:    lines,
+			expected:   "{\"name\":\"Alice\",\"city\":\"London\",\"tags\":\"b\"}\n{\"name\":\"Carol\",\"city\":null,\"tags\":null}\n",
+		},
+		{
+			name:       "nulls",
+			expression: "SELECT name FROM S3Object WHERE age IS NULL OR address.city IS NULL",
+			jsonType:   "LINES",
+			content:    lines,
+			expected:   "{\"name\":\"Bob\"}\n{\"name\":\"Carol\"}\n",
+		},
+		{
+			name:       "select star preserves field order",
+			expression: "SELECT * FROM S3Object s WHERE s.name = 'Bob'",
+			jsonType:   "LINES",
+			content:    lines,
+			expected:   "{\"name\":\"Bob\",\"age\":null,\"address\":{\"city\":\"Paris\"},\"tags\":[]}\n",
+		},
+		{
+			name:       "document",
+			expression: "SELECT s.count, s.items[0].id FROM S3Object s",
+			jsonType:   "DOCUMENT",
+			content:    "{\n  \"count\": 1.5,\n  \"items\": [{\"id\": \"x\"}]\n}",
+			expected:   "{\"count\":1.5,\"id\":\"x\"}\n",
+		},
+		{
+			name:       "aggregates",
+			expression: "SELECT COUNT(age), AVG(age), MIN(name) FROM S3Object",
+			jsonType:   "LINES",
+			content:    lines,
+			expected:   "{\"_1\":2,\"_2\":27.5,\"_3\":\"Alice\"}\n",
+		},
+	}
+
+	for _, test := range tests {
+		request := "<SelectObjectContentRequest>" +
+			"<Expression>" + xmlEscape(test.expression) + "</Expression><ExpressionType>SQL</ExpressionType>" +
+			"<InputSerialization><JSON><Type>" + test.jsonType + "</Type></JSON></InputSerialization>" +
+			"<OutputSerialization><JSON/></OutputSerialization>" +
+			"</SelectObjectContentRequest>"
+		records, end := runSelect(t, request, test.content)
+		if !end {
+			t.Errorf("%s: expected the stream to end", test.name)
+		}
+		if records != test.expected {
+			t.Errorf("%s: expected %q, got %q", test.name, test.expected, records)
+		}
+	}
+}
+
+func TestSelectParsingError(t *testing.T) {
+	request := "<SelectObjectContentRequest>" +
+		"<Expression>SELECT * FROM S3Object</Expression><ExpressionType>SQL</ExpressionType>" +
+		"<InputSerialization><JSON><Type>LINES</Type></JSON></InputSerialization>" +
+		"<OutputSerialization><JSON/></OutputSerialization>" +
+		"</SelectObjectContentRequest>"
+	messages := selectMessages(t, request, "{\"a\":1}\n{\"a\":")
+
+	// records that were read before the error are still sent
+	if len(messages) != 2 {
+		t.Fatalf("expected 2 messages, got %d", len(messages))
+	}
+	if messages[0].headers[":event-type"] != "Records" || string(messages[0].payload) != "{\"a\":1}\n" {
+		t.Fatalf("unexpected first message: %+v", messages[0])
+	}
+	if messages[1].headers[":message-type"] != "error" || messages[1].headers[":error-code"] != "JSONParsingError" {
+		t.Fatalf("expected a JSONParsingError, got %+v", messages[1].headers)
+	}
+}
+
+func TestEventStreamGolden(t *testing.T) {
+	golden := func(s string) []byte {
+		b, err := hex.DecodeString(strings.Join(strings.Fields(s), ""))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+
+	var buf bytes.Buffer
+	if err := writeEventStreamEvent(&buf, "Records", "application/octet-stream", []byte("a,1\nb,2\n")); err != nil {
+		t.Fatal(err)
+	}
+	records := golden(`
+		0000006d 00000055 1f81c9ee
+		0b 3a6576656e742d74797065 07 0007 5265636f726473
+		0d 3a636f6e74656e742d74797065 07 0018 6170706c69636174696f6e2f6f637465742d73747265616d
+		0d 3a6d6573736167652d74797065 07 0005 6576656e74
+		612c310a622c320a
+		0f068a48`)
+	if !bytes.Equal(buf.Bytes(), records) {
+		t.Fatalf("unexpected Records message:\n%x\nexpected:\n%x", buf.Bytes(), records)
+	}
+
+	buf.Reset()
+	if err := writeEventStreamEvent(&buf, "End", "", nil); err != nil {
+		t.Fatal(err)
+	}
+	end := golden(`
+		00000038 00000028 c1c684d4
+		0b 3a6576656e742d74797065 07 0003 456e64
+		0d 3a6d6573736167652d74797065 07 0005 6576656e74
+		fe2cee99`)
+	if !bytes.Equal(buf.Bytes(), end) {
+		t.Fatalf("unexpected End message:\n%x\nexpected:\n%x", buf.Bytes(), end)
+	}
+}
+
+// selectTestController serves a single object for select tests
+type selectTestController struct {
+	unimplementedObjectController
+	content string
+}
+
+func (c selectTestController) GetObject(r *http.Request, bucket, key, version string) (*GetObjectResult, error) {
+	return &GetObjectResult{Content: strings.NewReader(c.content)}, nil
+}
+
+// eventStreamMessage is a decoded event stream message
+type eventStreamMessage struct {
+	headers map[string]string
+	payload []byte
+}
+
+// selectMessages runs a select request against an object with the given
+// content, and decodes the messages of the response, checking their CRCs
+func selectMessages(t *testing.T, request, content string) []eventStreamMessage {
+	t.Helper()
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	h := &objectHandler{
+		controller: selectTestController{content: content},
+		encryptor:  &encryptor{controller: unimplementedEncryptionController{}},
+		logger:     logrus.NewEntry(logger),
+	}
+
+	r := httptest.NewRequest("POST", "/bucket/key?select&select-type=2", strings.NewReader(request))
+	r = mux.SetURLVars(r, map[string]string{"bucket": "bucket", "key": "key"})
+	w := httptest.NewRecorder()
+	h.selectContent(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("select failed with status %d: %s", w.Code, w.Body)
+	}
+
+	messages := []eventStreamMessage{}
+	body := w.Body.Bytes()
+	for len(body) > 0 {
+		if len(body) < 16 {
+			t.Fatalf("truncated message: %x", body)
+		}
+		totalLength := int(binary.BigEndian.Uint32(body[0:4]))
+		headersLength := int(binary.BigEndian.Uint32(body[4:8]))
+		if totalLength > len(body) || 12+headersLength+4 > totalLength {
+			t.Fatalf("invalid message lengths %d and %d", totalLength, headersLength)
+		}
+		if crc32.ChecksumIEEE(body[:8]) != binary.BigEndian.Uint32(body[8:12]) {
+			t.Fatalf("invalid prelude CRC")
+		}
+		if crc32.ChecksumIEEE(body[:totalLength-4]) != binary.BigEndian.Uint32(body[totalLength-4:totalLength]) {
+			t.Fatalf("invalid message CRC")
+		}
+
+		message := eventStreamMessage{headers: map[string]string{}, payload: body[12+headersLength : totalLength-4]}
+		headers := body[12 : 12+headersLength]
+		for len(headers) > 0 {
+			nameLength := int(headers[0])
+			name := string(headers[1 : 1+nameLength])
+			if headers[1+nameLength] != eventStreamHeaderTypeString {
+				t.Fatalf("unexpected type of header %s", name)
+			}
+			valueLength := int(binary.BigEndian.Uint16(headers[2+nameLength:]))
+			message.headers[name] = string(headers[4+nameLength : 4+nameLength+valueLength])
+			headers = headers[4+nameLength+valueLength:]
+		}
+		messages = append(messages, message)
+		body = body[totalLength:]
+	}
+	return messages
+}
+
+// runSelect runs a select request, returning the concatenated payloads of
+// its Records messages, and whether the stream ended successfully
+func runSelect(t *testing.T, request, content string) (string, bool) {
+	t.Helper()
+	var records bytes.Buffer
+	end := false
+	for _, message := range selectMessages(t, request, content) {
+		switch message.headers[":event-type"] {
+		case "Records":
+			records.Write(message.payload)
+		case "End":
+			end = true
+		}
+		if message.headers[":message-type"] == "error" {
+			t.Fatalf("select failed: %s: %s", message.headers[":error-code"], message.headers[":error-message"])
+		}
+	}
+	return records.String(), end
+}
+
+// xmlEscape escapes text for inclusion in an XML document
+func xmlEscape(s string) string {
+	var buf bytes.Buffer
+	xml.EscapeText(&buf, []byte(s))
+	return buf.String()
+}
@@ -1,8 +1,11 @@
 package s2
 
 import (
+	"encoding/base64"
 	"encoding/xml"
 	"net/http"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/sirupsen/logrus"
@@ -14,6 +17,9 @@ type Bucket struct {
 	Name string `xml:"Name"`
 	// CreationDate is when the bucket was created
 	CreationDate time.Time `xml:"CreationDate"`
+	// BucketRegion is the region the bucket lives in, or an empty string if
+	// unknown
+	BucketRegion string `xml:"BucketRegion,omitempty"`
 }
 
 // ListBucketsResult is a response from a ListBucket call
@@ -23,6 +29,25 @@ type ListBucketsResult struct {
 	Owner *User `xml:"Owner"`
 	// Buckets are a list of buckets under the given owner
 	Buckets []*Bucket `xml:"Buckets>Bucket"`
+	// ContinuationToken is an opaque token for fetching the next page of
+	// buckets, or an empty string if this is the last page
+	ContinuationToken string `xml:"ContinuationToken,omitempty"`
+	// Prefix is the prefix the buckets were filtered by
+	Prefix string `xml:"Prefix,omitempty"`
+}
+
+// ListBucketsOptions are the parameters of a paginated ListBuckets call
+type ListBucketsOptions struct {
+	// Prefix limits the listing to buckets whose names start with it
+	Prefix string
+	// ContinuationToken is a token returned by a previous call, from which
+	// to continue listing
+	ContinuationToken string
+	// MaxBuckets is the maximum number of buckets to return, or 0 for no
+	// limit
+	MaxBuckets int
+	// BucketRegion limits the listing to buckets in the given region
+	BucketRegion string
 }
 
 // ServiceController is an interface defining service-level functionality
@@ -31,6 +56,16 @@ type ServiceController interface {
 	ListBuckets(r *http.Request) (*ListBucketsResult, error)
 }
 
+// PaginatedServiceController is an optional interface that a
+// `ServiceController` can implement to list buckets a page at a time. If
+// it's not implemented, s2 paginates the full results of `ListBuckets`
+// itself.
+type PaginatedServiceController interface {
+	// ListBucketsPaginated lists a page of buckets. Buckets should be
+	// listed in lexicographical order.
+	ListBucketsPaginated(r *http.Request, options *ListBucketsOptions) (*ListBucketsResult, error)
+}
+
 // unimplementedServiceController defines a controller that returns
 // `NotImplementedError` for all functionality
 type unimplementedServiceController struct{}
@@ -45,7 +80,27 @@ type serviceHandler struct {
 }
 
 func (h *serviceHandler) get(w http.ResponseWriter, r *http.Request) {
-	result, err := h.controller.ListBuckets(r)
+	maxBuckets, err := intFormValue(r, "max-buckets", 1, 10000, 0)
+	if err != nil {
+		WriteError(h.logger, w, r, err)
+		return
+	}
+	options := &ListBucketsOptions{
+		Prefix:            r.FormValue("prefix"),
+		ContinuationToken: r.FormValue("continuation-token"),
+		MaxBuckets:        maxBuckets,
+		BucketRegion:      r.FormValue("bucket-region"),
+	}
+
+	var result *ListBucketsResult
+	if controller, ok := h.controller.(PaginatedServiceController); ok {
+		result, err = controller.ListBucketsPaginated(r, options)
+	} else {
+		result, err = h.controller.ListBuckets(r)
+		if err == nil {
+			err = paginateBuckets(r, result, options)
+		}
+	}
 	if err != nil {
 		WriteError(h.logger, w, r, err)
 		return
@@ -59,3 +114,45 @@ func (h *serviceHandler) get(w http.ResponseWriter, r *http.Request) {
 
 	writeXML(h.logger, w, r, http.StatusOK, result)
 }
+
+// paginateBuckets applies ListBuckets options to the full list of buckets
+// returned by a controller. Continuation tokens encode the name of the last
+// bucket returned.
+func paginateBuckets(r *http.Request, result *ListBucketsResult, options *ListBucketsOptions) error {
+	if options.Prefix == "" && options.ContinuationToken == "" && options.MaxBuckets == 0 && options.BucketRegion == "" {
+		return nil
+	}
+
+	after := ""
+	if options.ContinuationToken != "" {
+		decoded, err := base64.RawURLEncoding.DecodeString(options.ContinuationToken)
+		if err != nil {
+			return InvalidArgumentError(r)
+		}
+		after = string(decoded)
+	}
+
+	sort.Slice(result.Buckets, func(i, j int) bool {
+		return result.Buckets[i].Name < result.Buckets[j].Name
+	})
+
+	buckets := []*Bucket{}
+	result.ContinuationToken = ""
+	for _, bucket := range result.Buckets {
+		if bucket.Name <= after || !strings.HasPrefix(bucket.Name, options.Prefix) {
+			continue
+		}
+		if options.BucketRegion != "" && bucket.BucketRegion != options.BucketRegion {
+			continue
+		}
+		if options.MaxBuckets > 0 && len(buckets) == options.MaxBuckets {
+			result.ContinuationToken = base64.RawURLEncoding.EncodeToString([]byte(buckets[len(buckets)-1].Name))
+			break
+		}
+		buckets = append(buckets, bucket)
+	}
+
+	result.Buckets = buckets
+	result.Prefix = options.Prefix
+	return nil
+}
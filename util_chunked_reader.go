@@ -2,12 +2,15 @@ package s2
 
 import (
 	"bufio"
-	"crypto/sha256"
 	"errors"
 	"fmt"
 	"io"
+	"net/http"
 	"regexp"
 	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/pachyderm/s2/internal/signing"
 )
 
 var (
@@ -33,6 +36,23 @@ type chunkedReader struct {
 	region        string
 }
 
+// requestBody returns the content of a write request's body, which is
+// decoded and verified chunk by chunk if the request is a streaming auth V4
+// upload
+func requestBody(r *http.Request) io.Reader {
+	if r.Header.Get("x-amz-content-sha256") != signing.StreamingPayload {
+		return r.Body
+	}
+
+	vars := mux.Vars(r)
+	signingKey := []byte(vars["authSignatureKey"])
+	seedSignature := vars["authSignature"]
+	timestamp := vars["authSignatureTimestamp"]
+	date := vars["authSignatureDate"]
+	region := vars["authSignatureRegion"]
+	return newChunkedReader(r.Body, signingKey, seedSignature, timestamp, date, region)
+}
+
 func newChunkedReader(body io.ReadCloser, signingKey []byte, seedSignature, timestamp, date, region string) *chunkedReader {
 	return &chunkedReader{
 		body:      body,
@@ -103,17 +123,10 @@ func (c *chunkedReader) readChunk() error {
 	}
 
 	// step 4: construct the string to sign
-	stringToSign := fmt.Sprintf(
-		"AWS4-HMAC-SHA256-PAYLOAD\n%s\n%s/%s/s3/aws4_request\n%s\ne3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855\n%x",
-		c.timestamp,
-		c.date,
-		c.region,
-		c.lastSignature,
-		sha256.Sum256(chunk),
-	)
+	stringToSign := signing.ChunkStringToSign(c.timestamp, c.date, c.region, c.lastSignature, chunk)
 
 	// step 5: calculate & verify the signature
-	signature := hmacSHA256(c.signingKey, stringToSign)
+	signature := signing.HMACSHA256(c.signingKey, stringToSign)
 	if chunkSignature != fmt.Sprintf("%x", signature) {
 		return InvalidChunk
 	}
@@ -0,0 +1,685 @@
+package s2
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sort"
+)
+
+// Encrypted objects are stored as one or more segments (one per PutObject,
+// or one per part of a multipart upload.) Each segment is laid out as:
+//
+//	magic (7 bytes) | version (1 byte) | key info | nonce prefix (7 bytes)
+//	plaintext length (8 bytes)
+//	package 0 | package 1 | ... | package N
+//
+// where the key info depends on the version:
+//
+//	customer-provided keys: key fingerprint (32 bytes)
+//	envelope encryption:    algorithm length (1 byte) | algorithm
+//	                        key ID length (2 bytes) | key ID
+//	                        wrapped data key length (2 bytes) | wrapped key
+//
+// and each package is laid out as:
+//
+//	plaintext length (4 bytes) | final flag (1 byte) | AES-256-GCM ciphertext
+//
+// Packages hold at most `encryptedPackageSize` bytes of plaintext, and only
+// the last package of a segment may be shorter. Every package is sealed
+// with a nonce made from the segment's nonce prefix, the package index and
+// the final flag, so packages can't be reordered, dropped or truncated
+// without detection. Because packages are independently sealed, encrypted
+// content can be decrypted starting from any offset, which makes range
+// reads possible.
+//
+// The plaintext length lets readers locate packages and the next segment
+// without reading every package header. It's all ones if the length wasn't
+// known when the segment was written, in which case readers fall back to
+// walking the segment's package headers.
+
+const (
+	// encryptedPackageSize is the maximum amount of plaintext in a package
+	encryptedPackageSize = 64 * 1024
+	// encryptedSegmentMagic identifies the start of an encrypted segment.
+	// It's followed by a version byte.
+	encryptedSegmentMagic = "S2SSE\x00\x00"
+	// encryptedSegmentVersionCustomer identifies segments encrypted with a
+	// customer-provided key
+	encryptedSegmentVersionCustomer byte = 1
+	// encryptedSegmentVersionEnvelope identifies segments encrypted with a
+	// data key that's wrapped by a `KeyProvider`
+	encryptedSegmentVersionEnvelope byte = 2
+	// encryptedFingerprintSize is the size of the key fingerprint in a
+	// segment header
+	encryptedFingerprintSize = 32
+	// encryptedNoncePrefixSize is the size of the random nonce prefix in a
+	// segment header
+	encryptedNoncePrefixSize = 7
+	// encryptedLengthSize is the size of the plaintext length in a segment
+	// header
+	encryptedLengthSize = 8
+	// encryptedPackageHeaderSize is the size of a package header
+	encryptedPackageHeaderSize = 5
+	// encryptedPackageOverhead is how many bytes a package adds on top of
+	// its plaintext
+	encryptedPackageOverhead = encryptedPackageHeaderSize + 16
+	// minEncryptedSize is the size of the smallest possible encrypted
+	// segment: a header without any key info, and an empty final package.
+	// Anything smaller is stored unencrypted.
+	minEncryptedSize = len(encryptedSegmentMagic) + 1 + encryptedNoncePrefixSize + encryptedLengthSize + encryptedPackageOverhead
+)
+
+var (
+	// errEncryptionKeyMismatch is returned when content is decrypted with a
+	// key other than the one it was encrypted with
+	errEncryptionKeyMismatch = errors.New("encryption key does not match")
+	// errEncryptedContentCorrupt is returned when encrypted content is
+	// malformed or fails authentication
+	errEncryptedContentCorrupt = errors.New("encrypted content is corrupt")
+	// errEncryptedLengthMismatch is returned when the plaintext being
+	// encrypted isn't the length recorded in its segment header
+	errEncryptedLengthMismatch = errors.New("content does not match its declared length")
+)
+
+// segmentHeader is the header of an encrypted segment
+type segmentHeader struct {
+	version byte
+	// fingerprint identifies a customer-provided key
+	fingerprint []byte
+	// algorithm, keyID and wrappedKey describe an envelope-encrypted data
+	// key
+	algorithm  string
+	keyID      string
+	wrappedKey []byte
+	// noncePrefix is the random part of every package nonce in the segment
+	noncePrefix []byte
+	// plaintextSize is the length of the segment's plaintext, or -1 if it
+	// wasn't known when the segment was written
+	plaintextSize int64
+}
+
+// newCustomerSegmentHeader creates a segment header for content encrypted
+// with a customer-provided key
+func newCustomerSegmentHeader(key []byte) (*segmentHeader, error) {
+	noncePrefix, err := randomNoncePrefix()
+	if err != nil {
+		return nil, err
+	}
+	return &segmentHeader{
+		version:       encryptedSegmentVersionCustomer,
+		fingerprint:   keyFingerprint(key),
+		noncePrefix:   noncePrefix,
+		plaintextSize: -1,
+	}, nil
+}
+
+// newEnvelopeSegmentHeader creates a segment header for content encrypted
+// with a wrapped data key
+func newEnvelopeSegmentHeader(algorithm, keyID string, wrappedKey []byte) (*segmentHeader, error) {
+	noncePrefix, err := randomNoncePrefix()
+	if err != nil {
+		return nil, err
+	}
+	return &segmentHeader{
+		version:       encryptedSegmentVersionEnvelope,
+		algorithm:     algorithm,
+		keyID:         keyID,
+		wrappedKey:    wrappedKey,
+		noncePrefix:   noncePrefix,
+		plaintextSize: -1,
+	}, nil
+}
+
+func randomNoncePrefix() ([]byte, error) {
+	noncePrefix := make([]byte, encryptedNoncePrefixSize)
+	if _, err := rand.Read(noncePrefix); err != nil {
+		return nil, err
+	}
+	return noncePrefix, nil
+}
+
+// marshal serializes a segment header
+func (h *segmentHeader) marshal() []byte {
+	var buf bytes.Buffer
+	buf.WriteString(encryptedSegmentMagic)
+	buf.WriteByte(h.version)
+	if h.version == encryptedSegmentVersionCustomer {
+		buf.Write(h.fingerprint)
+	} else {
+		buf.WriteByte(byte(len(h.algorithm)))
+		buf.WriteString(h.algorithm)
+		binary.Write(&buf, binary.BigEndian, uint16(len(h.keyID)))
+		buf.WriteString(h.keyID)
+		binary.Write(&buf, binary.BigEndian, uint16(len(h.wrappedKey)))
+		buf.Write(h.wrappedKey)
+	}
+	buf.Write(h.noncePrefix)
+	binary.Write(&buf, binary.BigEndian, uint64(h.plaintextSize))
+	return buf.Bytes()
+}
+
+// readSegmentHeader reads a segment header, returning it along with its
+// serialized size
+func readSegmentHeader(r io.Reader) (*segmentHeader, int64, error) {
+	magic := make([]byte, len(encryptedSegmentMagic)+1)
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return nil, 0, errEncryptedContentCorrupt
+	}
+	if string(magic[:len(encryptedSegmentMagic)]) != encryptedSegmentMagic {
+		return nil, 0, errEncryptedContentCorrupt
+	}
+	size := int64(len(magic))
+
+	// readField reads a length-prefixed field, where the length is encoded
+	// in `lengthSize` bytes
+	readField := func(lengthSize int) ([]byte, error) {
+		lengthBytes := make([]byte, 2)
+		if _, err := io.ReadFull(r, lengthBytes[2-lengthSize:]); err != nil {
+			return nil, errEncryptedContentCorrupt
+		}
+		field := make([]byte, binary.BigEndian.Uint16(lengthBytes))
+		if _, err := io.ReadFull(r, field); err != nil {
+			return nil, errEncryptedContentCorrupt
+		}
+		size += int64(lengthSize + len(field))
+		return field, nil
+	}
+
+	h := &segmentHeader{version: magic[len(magic)-1]}
+	switch h.version {
+	case encryptedSegmentVersionCustomer:
+		h.fingerprint = make([]byte, encryptedFingerprintSize)
+		if _, err := io.ReadFull(r, h.fingerprint); err != nil {
+			return nil, 0, errEncryptedContentCorrupt
+		}
+		size += encryptedFingerprintSize
+	case encryptedSegmentVersionEnvelope:
+		algorithm, err := readField(1)
+		if err != nil {
+			return nil, 0, err
+		}
+		keyID, err := readField(2)
+		if err != nil {
+			return nil, 0, err
+		}
+		wrappedKey, err := readField(2)
+		if err != nil {
+			return nil, 0, err
+		}
+		h.algorithm = string(algorithm)
+		h.keyID = string(keyID)
+		h.wrappedKey = wrappedKey
+	default:
+		return nil, 0, errEncryptedContentCorrupt
+	}
+
+	h.noncePrefix = make([]byte, encryptedNoncePrefixSize)
+	if _, err := io.ReadFull(r, h.noncePrefix); err != nil {
+		return nil, 0, errEncryptedContentCorrupt
+	}
+	size += encryptedNoncePrefixSize
+
+	length := make([]byte, encryptedLengthSize)
+	if _, err := io.ReadFull(r, length); err != nil {
+		return nil, 0, errEncryptedContentCorrupt
+	}
+	h.plaintextSize = int64(binary.BigEndian.Uint64(length))
+	if h.plaintextSize < -1 {
+		return nil, 0, errEncryptedContentCorrupt
+	}
+	size += encryptedLengthSize
+	return h, size, nil
+}
+
+// peekSegmentHeader reads the header of the first segment of encrypted
+// content. If the content isn't encrypted, nil is returned. The content is
+// rewound afterwards.
+func peekSegmentHeader(rs io.ReadSeeker) (*segmentHeader, error) {
+	magic := make([]byte, len(encryptedSegmentMagic))
+	n, err := io.ReadFull(rs, magic)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	if _, err := rs.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	if n != len(magic) || string(magic) != encryptedSegmentMagic {
+		return nil, nil
+	}
+
+	h, _, err := readSegmentHeader(rs)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := rs.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// sameEncryption checks whether two segments were encrypted alike, so that
+// they can be read back as one object. Either may be nil, for plaintext.
+func sameEncryption(a, b *segmentHeader) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.version == b.version && bytes.Equal(a.fingerprint, b.fingerprint) && a.algorithm == b.algorithm && a.keyID == b.keyID
+}
+
+// PlaintextSize gets the size of content read from a controller, excluding
+// the overhead of any server-side encryption, and rewinds it. Since s2
+// encrypts content before passing it to controllers, wrappers that account
+// for the sizes of objects should measure them with this. Encrypted content
+// doesn't need to be decrypted, or even have its keys available, to be
+// measured.
+func PlaintextSize(rs io.ReadSeeker) (int64, error) {
+	header, err := peekSegmentHeader(rs)
+	if err != nil {
+		return 0, err
+	}
+	if header == nil {
+		size, err := rs.Seek(0, io.SeekEnd)
+		if err != nil {
+			return 0, err
+		}
+		_, err = rs.Seek(0, io.SeekStart)
+		return size, err
+	}
+	decrypted, err := newDecryptReadSeeker(rs, func(segment *segmentHeader) error {
+		return nil
+	}, nil)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := rs.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return decrypted.size, nil
+}
+
+// keyFingerprint derives a value that identifies an encryption key without
+// revealing it
+func keyFingerprint(key []byte) []byte {
+	return hmacSHA256(key, "s2 encryption key fingerprint")
+}
+
+// packageNonce constructs the nonce for a package
+func packageNonce(prefix []byte, index uint32, final bool) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[encryptedNoncePrefixSize:], index)
+	if final {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// packageCount returns the number of packages that plaintext of the given
+// size is split into. Even empty plaintext has a (final) package.
+func packageCount(plaintextSize int64) int64 {
+	packages := (plaintextSize + encryptedPackageSize - 1) / encryptedPackageSize
+	if packages == 0 {
+		packages = 1
+	}
+	return packages
+}
+
+// encryptedSize returns the size of the single segment that plaintext of
+// the given size encrypts to
+func encryptedSize(header *segmentHeader, plaintextSize int64) int64 {
+	return int64(len(header.marshal())) + packageCount(plaintextSize)*encryptedPackageOverhead + plaintextSize
+}
+
+// encryptReader encrypts plaintext into a single segment as it is read
+type encryptReader struct {
+	src       *bufio.Reader
+	aead      cipher.AEAD
+	header    *segmentHeader
+	index     uint32
+	plaintext []byte
+	pending   bytes.Buffer
+	n         int64
+	started   bool
+	done      bool
+}
+
+// newEncryptReader creates a reader that encrypts `src` with a 256-bit key,
+// prefixing the output with the given segment header. If the header has a
+// plaintext length, reading fails with `errEncryptedLengthMismatch` unless
+// `src` is exactly that long.
+func newEncryptReader(src io.Reader, key []byte, header *segmentHeader) (*encryptReader, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &encryptReader{
+		src:       bufio.NewReaderSize(src, encryptedPackageSize),
+		aead:      aead,
+		header:    header,
+		plaintext: make([]byte, encryptedPackageSize),
+	}, nil
+}
+
+func (e *encryptReader) Read(p []byte) (int, error) {
+	for e.pending.Len() == 0 {
+		if e.done {
+			return 0, io.EOF
+		}
+		if err := e.sealPackage(); err != nil {
+			return 0, err
+		}
+	}
+	return e.pending.Read(p)
+}
+
+// sealPackage reads the next package worth of plaintext, and appends its
+// encrypted form to the pending output
+func (e *encryptReader) sealPackage() error {
+	if !e.started {
+		e.started = true
+		e.pending.Write(e.header.marshal())
+	}
+
+	n, err := io.ReadFull(e.src, e.plaintext)
+	final := false
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		final = true
+	} else if err != nil {
+		return err
+	} else if _, err := e.src.Peek(1); err == io.EOF {
+		final = true
+	} else if err != nil {
+		return err
+	}
+	e.n += int64(n)
+	if e.header.plaintextSize >= 0 && (e.n > e.header.plaintextSize || (final && e.n != e.header.plaintextSize)) {
+		return errEncryptedLengthMismatch
+	}
+
+	var header [encryptedPackageHeaderSize]byte
+	binary.BigEndian.PutUint32(header[:4], uint32(n))
+	if final {
+		header[4] = 1
+	}
+	e.pending.Write(header[:])
+	e.pending.Write(e.aead.Seal(nil, packageNonce(e.header.noncePrefix, e.index, final), e.plaintext[:n], header[:]))
+
+	e.index++
+	e.done = final
+	return nil
+}
+
+// encryptReadSeeker encrypts seekable plaintext. It only supports seeking
+// to the start (to re-read the content) and to the end (to determine the
+// encrypted size), which is what's needed to hand encrypted content to
+// controllers in place of a `GetObjectResult`'s content.
+type encryptReadSeeker struct {
+	*encryptReader
+	src io.ReadSeeker
+	key []byte
+}
+
+func newEncryptReadSeeker(src io.ReadSeeker, key []byte, header *segmentHeader) (*encryptReadSeeker, error) {
+	reader, err := newEncryptReader(src, key, header)
+	if err != nil {
+		return nil, err
+	}
+	return &encryptReadSeeker{
+		encryptReader: reader,
+		src:           src,
+		key:           key,
+	}, nil
+}
+
+func (e *encryptReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	if offset != 0 || (whence != io.SeekStart && whence != io.SeekEnd) {
+		return 0, errors.New("encrypted content only supports seeking to the start or end")
+	}
+
+	if whence == io.SeekEnd {
+		size, err := e.src.Seek(0, io.SeekEnd)
+		if err != nil {
+			return 0, err
+		}
+		e.encryptReader.done = true
+		e.encryptReader.pending.Reset()
+		return encryptedSize(e.header, size), nil
+	}
+
+	if _, err := e.src.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	// re-encrypting with the same nonce prefix is safe, as the plaintext is
+	// the same
+	reader, err := newEncryptReader(e.src, e.key, e.header)
+	if err != nil {
+		return 0, err
+	}
+	e.encryptReader = reader
+	return 0, nil
+}
+
+// encryptedSegment locates a segment within encrypted content
+type encryptedSegment struct {
+	header *segmentHeader
+	// offset is where the segment's first package starts
+	offset int64
+	// plainOffset is where the segment's plaintext starts in the decrypted
+	// content
+	plainOffset int64
+	size        int64
+	// aead is created when the segment is first read
+	aead cipher.AEAD
+}
+
+// decryptReadSeeker decrypts content made of one or more encrypted
+// segments, supporting arbitrary seeks
+type decryptReadSeeker struct {
+	src        io.ReadSeeker
+	segmentKey func(header *segmentHeader) ([]byte, error)
+	segments   []encryptedSegment
+	size       int64
+	offset     int64
+
+	// segmentSizes is the plaintext size of each segment. Since each part
+	// of a multipart upload is encrypted as its own segment, these are the
+	// plaintext part sizes.
+	segmentSizes []int64
+
+	// the most recently decrypted package is cached, since reads are
+	// typically sequential and smaller than a package
+	cachedSegment int
+	cachedIndex   int64
+	cached        []byte
+}
+
+// newDecryptReadSeeker indexes the segments of encrypted content, which
+// only requires reading their headers. `checkSegment` is called with the
+// header of every segment up front, and may reject it. `segmentKey` returns
+// the key to decrypt a segment with, and is only called once the segment is
+// read.
+func newDecryptReadSeeker(src io.ReadSeeker, checkSegment func(header *segmentHeader) error, segmentKey func(header *segmentHeader) ([]byte, error)) (*decryptReadSeeker, error) {
+	total, err := src.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+
+	segments := []encryptedSegment{}
+	segmentSizes := []int64{}
+	var offset int64
+	var plainOffset int64
+
+	for offset < total {
+		if _, err := src.Seek(offset, io.SeekStart); err != nil {
+			return nil, err
+		}
+		header, headerSize, err := readSegmentHeader(src)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkSegment(header); err != nil {
+			return nil, err
+		}
+		offset += headerSize
+
+		size := header.plaintextSize
+		if size < 0 {
+			size, err = scanSegment(src, offset, total)
+			if err != nil {
+				return nil, err
+			}
+		}
+		segments = append(segments, encryptedSegment{
+			header:      header,
+			offset:      offset,
+			plainOffset: plainOffset,
+			size:        size,
+		})
+		segmentSizes = append(segmentSizes, size)
+		offset += packageCount(size)*encryptedPackageOverhead + size
+		plainOffset += size
+		if offset > total {
+			return nil, errEncryptedContentCorrupt
+		}
+	}
+
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	return &decryptReadSeeker{
+		src:           src,
+		segmentKey:    segmentKey,
+		segments:      segments,
+		size:          plainOffset,
+		segmentSizes:  segmentSizes,
+		cachedSegment: -1,
+	}, nil
+}
+
+// scanSegment gets the plaintext size of a segment that doesn't record it,
+// by walking its package headers from `offset` until the final package
+func scanSegment(src io.ReadSeeker, offset, total int64) (int64, error) {
+	var size int64
+	packageHeader := make([]byte, encryptedPackageHeaderSize)
+	for {
+		if _, err := src.Seek(offset, io.SeekStart); err != nil {
+			return 0, err
+		}
+		if _, err := io.ReadFull(src, packageHeader); err != nil {
+			return 0, errEncryptedContentCorrupt
+		}
+		length := int64(binary.BigEndian.Uint32(packageHeader[:4]))
+		final := packageHeader[4] == 1
+		if length > encryptedPackageSize || (!final && length != encryptedPackageSize) {
+			return 0, errEncryptedContentCorrupt
+		}
+		offset += encryptedPackageOverhead + length
+		size += length
+		if offset > total {
+			return 0, errEncryptedContentCorrupt
+		}
+		if final {
+			return size, nil
+		}
+	}
+}
+
+// openPackage reads and decrypts a package of a segment. Since all but the
+// final package are full, its location follows from its index.
+func (d *decryptReadSeeker) openPackage(segment *encryptedSegment, index int64) ([]byte, error) {
+	if segment.aead == nil {
+		key, err := d.segmentKey(segment.header)
+		if err != nil {
+			return nil, err
+		}
+		segment.aead, err = newAEAD(key)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	final := index == packageCount(segment.size)-1
+	length := segment.size - index*encryptedPackageSize
+	if length > encryptedPackageSize {
+		length = encryptedPackageSize
+	}
+	sealed := make([]byte, encryptedPackageOverhead+length)
+	if _, err := d.src.Seek(segment.offset+index*(encryptedPackageOverhead+encryptedPackageSize), io.SeekStart); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(d.src, sealed); err != nil {
+		return nil, errEncryptedContentCorrupt
+	}
+
+	header := sealed[:encryptedPackageHeaderSize]
+	if int64(binary.BigEndian.Uint32(header[:4])) != length || (header[4] == 1) != final {
+		return nil, errEncryptedContentCorrupt
+	}
+	ciphertext := sealed[encryptedPackageHeaderSize:]
+	plaintext, err := segment.aead.Open(ciphertext[:0], packageNonce(segment.header.noncePrefix, uint32(index), final), ciphertext, header)
+	if err != nil {
+		return nil, errEncryptedContentCorrupt
+	}
+	return plaintext, nil
+}
+
+func (d *decryptReadSeeker) Read(p []byte) (int, error) {
+	if d.offset >= d.size {
+		return 0, io.EOF
+	}
+
+	// find the segment holding the current offset, skipping over empty
+	// segments
+	i := sort.Search(len(d.segments), func(i int) bool {
+		return d.segments[i].plainOffset+d.segments[i].size > d.offset
+	})
+	segment := &d.segments[i]
+	index := (d.offset - segment.plainOffset) / encryptedPackageSize
+
+	if d.cachedSegment != i || d.cachedIndex != index {
+		plaintext, err := d.openPackage(segment, index)
+		if err != nil {
+			return 0, err
+		}
+		d.cachedSegment = i
+		d.cachedIndex = index
+		d.cached = plaintext
+	}
+
+	n := copy(p, d.cached[d.offset-segment.plainOffset-index*encryptedPackageSize:])
+	d.offset += int64(n)
+	return n, nil
+}
+
+func (d *decryptReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += d.offset
+	case io.SeekEnd:
+		offset += d.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	d.offset = offset
+	return offset, nil
+}
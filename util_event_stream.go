@@ -0,0 +1,74 @@
+package s2
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+)
+
+// eventStreamHeader is a string-valued header in an AWS event stream
+// message
+type eventStreamHeader struct {
+	name  string
+	value string
+}
+
+// eventStreamHeaderTypeString is the header value type used for strings in
+// the AWS event stream encoding
+const eventStreamHeaderTypeString = 7
+
+// writeEventStreamMessage encodes a message in AWS' binary event stream
+// framing, and writes it. Each message is laid out as:
+//
+//	total length (4 bytes) | headers length (4 bytes) | prelude CRC (4 bytes)
+//	headers | payload | message CRC (4 bytes)
+//
+// where both CRCs are CRC32 (IEEE) checksums; the prelude CRC covers the
+// first 8 bytes, and the message CRC covers everything before it.
+func writeEventStreamMessage(w io.Writer, headers []eventStreamHeader, payload []byte) error {
+	var headerBuf bytes.Buffer
+	for _, header := range headers {
+		headerBuf.WriteByte(byte(len(header.name)))
+		headerBuf.WriteString(header.name)
+		headerBuf.WriteByte(eventStreamHeaderTypeString)
+		binary.Write(&headerBuf, binary.BigEndian, uint16(len(header.value)))
+		headerBuf.WriteString(header.value)
+	}
+
+	totalLength := 4 + 4 + 4 + headerBuf.Len() + len(payload) + 4
+
+	var msg bytes.Buffer
+	msg.Grow(totalLength)
+	binary.Write(&msg, binary.BigEndian, uint32(totalLength))
+	binary.Write(&msg, binary.BigEndian, uint32(headerBuf.Len()))
+	binary.Write(&msg, binary.BigEndian, crc32.ChecksumIEEE(msg.Bytes()))
+	msg.Write(headerBuf.Bytes())
+	msg.Write(payload)
+	binary.Write(&msg, binary.BigEndian, crc32.ChecksumIEEE(msg.Bytes()))
+
+	_, err := w.Write(msg.Bytes())
+	return err
+}
+
+// writeEventStreamEvent writes an event stream message of the `event` type
+func writeEventStreamEvent(w io.Writer, eventType, contentType string, payload []byte) error {
+	headers := []eventStreamHeader{
+		{name: ":event-type", value: eventType},
+	}
+	if contentType != "" {
+		headers = append(headers, eventStreamHeader{name: ":content-type", value: contentType})
+	}
+	headers = append(headers, eventStreamHeader{name: ":message-type", value: "event"})
+	return writeEventStreamMessage(w, headers, payload)
+}
+
+// writeEventStreamError writes an event stream message of the `error` type
+func writeEventStreamError(w io.Writer, code, message string) error {
+	headers := []eventStreamHeader{
+		{name: ":error-code", value: code},
+		{name: ":error-message", value: message},
+		{name: ":message-type", value: "error"},
+	}
+	return writeEventStreamMessage(w, headers, nil)
+}
@@ -2,11 +2,9 @@ package s2
 
 import (
 	"crypto/hmac"
-	"crypto/sha1"
 	"crypto/sha256"
 	"fmt"
 	"net/http"
-	"net/url"
 	"strconv"
 	"strings"
 	"time"
@@ -61,74 +59,6 @@ func addETagQuotes(s string) string {
 	return s
 }
 
-// normURI normalizes a URI using AWS' technique
-func normURI(uri string) string {
-	parts := strings.Split(uri, "/")
-	for i := range parts {
-		parts[i] = encodePathFrag(parts[i])
-	}
-	return strings.Join(parts, "/")
-}
-
-// encodePathFrag encodes a fragment of a path in a URL using AWS' technique
-func encodePathFrag(s string) string {
-	hexCount := 0
-	for i := 0; i < len(s); i++ {
-		c := s[i]
-		if shouldEscape(c) {
-			hexCount++
-		}
-	}
-	t := make([]byte, len(s)+2*hexCount)
-	j := 0
-	for i := 0; i < len(s); i++ {
-		c := s[i]
-		if shouldEscape(c) {
-			t[j] = '%'
-			t[j+1] = "0123456789ABCDEF"[c>>4]
-			t[j+2] = "0123456789ABCDEF"[c&15]
-			j += 3
-		} else {
-			t[j] = c
-			j++
-		}
-	}
-	return string(t)
-}
-
-// shouldEscape returns whether a character should be escaped under AWS' URL
-// encoding
-func shouldEscape(c byte) bool {
-	if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' {
-		return false
-	}
-	if '0' <= c && c <= '9' {
-		return false
-	}
-	if c == '-' || c == '_' || c == '.' || c == '~' {
-		return false
-	}
-	return true
-}
-
-// normQuery normalizes query string values using AWS' technique
-func normQuery(v url.Values) string {
-	queryString := v.Encode()
-
-	// Go encodes a space as '+' but Amazon requires '%20'. Luckily any '+' in the
-	// original query string has been percent escaped so all '+' chars that are left
-	// were originally spaces.
-
-	return strings.Replace(queryString, "+", "%20", -1)
-}
-
-// hmacSHA1 computes HMAC with SHA1
-func hmacSHA1(key []byte, content string) []byte {
-	mac := hmac.New(sha1.New, key)
-	mac.Write([]byte(content))
-	return mac.Sum(nil)
-}
-
 // hmacSHA256 computes HMAC with SHA256
 func hmacSHA256(key []byte, content string) []byte {
 	mac := hmac.New(sha256.New, key)
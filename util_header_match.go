@@ -106,6 +106,50 @@ func checkIfModifiedSince(ims string, modtime time.Time) bool {
 	return true
 }
 
+// checkGetPreconditions evaluates the conditional headers of a GET or HEAD
+// request with S3 semantics, returning the status the request should fail
+// with (`http.StatusNotModified` or `http.StatusPreconditionFailed`), or 0
+// if the request should proceed. `exists` is false for delete markers. The
+// conditional headers are removed from the request afterwards, so that
+// `http.ServeContent` doesn't evaluate them again.
+func checkGetPreconditions(r *http.Request, exists bool, etag string, modtime time.Time) int {
+	im := r.Header.Get("If-Match")
+	inm := r.Header.Get("If-None-Match")
+	ius := r.Header.Get("If-Unmodified-Since")
+	ims := r.Header.Get("If-Modified-Since")
+	for _, header := range []string{"If-Match", "If-None-Match", "If-Unmodified-Since", "If-Modified-Since"} {
+		r.Header.Del(header)
+	}
+
+	if !exists {
+		// nothing matches an object that doesn't exist
+		if im != "" {
+			return http.StatusPreconditionFailed
+		}
+		return 0
+	}
+
+	// If-Unmodified-Since is ignored when If-Match is present, and
+	// If-Modified-Since is ignored when If-None-Match is present
+	if im != "" {
+		if !checkIfMatch(im, etag) {
+			return http.StatusPreconditionFailed
+		}
+	} else if !checkIfUnmodifiedSince(ius, modtime) {
+		return http.StatusPreconditionFailed
+	}
+
+	if inm != "" {
+		if !checkIfNoneMatch(inm, etag) {
+			return http.StatusNotModified
+		}
+	} else if !checkIfModifiedSince(ims, modtime) {
+		return http.StatusNotModified
+	}
+
+	return 0
+}
+
 // scanETag determines if a syntactically valid ETag is present at s. If so,
 // the ETag and remaining text after consuming ETag is returned. Otherwise,
 // it returns "", "".
@@ -0,0 +1,39 @@
+package s2
+
+import (
+	"io"
+)
+
+// countingReader wraps a reader, keeping track of how many bytes have been
+// read through it
+type countingReader struct {
+	reader io.Reader
+	n      int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.reader.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// contentSize returns the total size of seekable content, or 0 if it can't
+// be determined
+func contentSize(rs io.ReadSeeker) int64 {
+	if rs == nil {
+		return 0
+	}
+	size, err := rs.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0
+	}
+	return size
+}
+
+// closeContent closes object content returned by a controller, if it's
+// closeable (e.g. a file)
+func closeContent(rs io.ReadSeeker) {
+	if closer, ok := rs.(io.Closer); ok {
+		closer.Close()
+	}
+}
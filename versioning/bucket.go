@@ -0,0 +1,274 @@
+package versioning
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/pachyderm/s2"
+)
+
+// internalEnd is a marker that sorts after every hidden key
+const internalEnd = internalPrefix + "\U0010FFFF"
+
+// GetLocation gets the location of a bucket from the wrapped controller
+func (c *Controller) GetLocation(r *http.Request, bucket string) (string, error) {
+	return c.bucket.GetLocation(r, bucket)
+}
+
+// HeadBucket uses the wrapped controller's `HeadBucket`, if it implements
+// `s2.HeadBucketController`
+func (c *Controller) HeadBucket(r *http.Request, bucket string) (*s2.HeadBucketResult, error) {
+	if controller, ok := c.bucket.(s2.HeadBucketController); ok {
+		return controller.HeadBucket(r, bucket)
+	}
+	return nil, s2.NotImplementedError(r)
+}
+
+// ListObjects lists the latest versions of objects using the wrapped
+// controller, with hidden keys removed
+func (c *Controller) ListObjects(r *http.Request, bucket, prefix, marker, delimiter string, maxKeys int) (*s2.ListObjectsResult, error) {
+	result, err := c.bucket.ListObjects(r, bucket, prefix, marker, delimiter, maxKeys)
+	if err != nil {
+		return nil, err
+	}
+	filtered := filterInternal(result)
+	if len(filtered.Contents)+len(filtered.CommonPrefixes) == 0 && result.IsTruncated && marker < internalEnd {
+		// the page only had hidden keys, so skip past them
+		result, err = c.bucket.ListObjects(r, bucket, prefix, internalEnd, delimiter, maxKeys)
+		if err != nil {
+			return nil, err
+		}
+		filtered = filterInternal(result)
+	}
+	return filtered, nil
+}
+
+// filterInternal removes hidden keys from a listing
+func filterInternal(result *s2.ListObjectsResult) *s2.ListObjectsResult {
+	filtered := &s2.ListObjectsResult{
+		Contents:       []*s2.Contents{},
+		CommonPrefixes: []*s2.CommonPrefixes{},
+		IsTruncated:    result.IsTruncated,
+	}
+	for _, contents := range result.Contents {
+		if !isInternal(contents.Key) {
+			filtered.Contents = append(filtered.Contents, contents)
+		}
+	}
+	for _, cp := range result.CommonPrefixes {
+		if !isInternal(cp.Prefix) {
+			filtered.CommonPrefixes = append(filtered.CommonPrefixes, cp)
+		}
+	}
+	return filtered
+}
+
+// listAll lists every object in a bucket with the given prefix, using the
+// wrapped controller
+func (c *Controller) listAll(r *http.Request, bucket, prefix string) ([]*s2.Contents, error) {
+	var all []*s2.Contents
+	marker := ""
+	for {
+		result, err := c.bucket.ListObjects(r, bucket, prefix, marker, "", listPageSize)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, result.Contents...)
+		if !result.IsTruncated || len(result.Contents) == 0 {
+			return all, nil
+		}
+		marker = result.Contents[len(result.Contents)-1].Key
+	}
+}
+
+// commonPrefix gets the common prefix that a key is rolled up into by a
+// delimiter, or an empty string if it isn't
+func commonPrefix(key, prefix, delimiter string) string {
+	if delimiter == "" {
+		return ""
+	}
+	i := strings.Index(key[len(prefix):], delimiter)
+	if i < 0 {
+		return ""
+	}
+	return key[:len(prefix)+i+len(delimiter)]
+}
+
+// ListObjectVersions lists all versions and delete markers, ordered by key,
+// then newest first. Versions are listed from the version metadata of keys,
+// and from the objects without any, which have a single "null" version.
+// This lists every key with the prefix from the wrapped controller, so it
+// can be slow for large buckets. As with `memory`, keys that would be
+// rolled up by the delimiter are omitted.
+func (c *Controller) ListObjectVersions(r *http.Request, bucket, prefix, keyMarker, versionMarker string, delimiter string, maxKeys int) (*s2.ListObjectVersionsResult, error) {
+	objects, err := c.listAll(r, bucket, prefix)
+	if err != nil {
+		return nil, err
+	}
+	metas, err := c.listAll(r, bucket, keysPrefix+prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	// keys with version metadata are loaded as they're listed; others are
+	// described by their listing
+	plain := map[string]*s2.Contents{}
+	for _, contents := range objects {
+		if !isInternal(contents.Key) {
+			plain[contents.Key] = contents
+		}
+	}
+	stored := map[string]bool{}
+	for _, contents := range metas {
+		if strings.HasSuffix(contents.Key, metaSuffix) {
+			key := strings.TrimSuffix(strings.TrimPrefix(contents.Key, keysPrefix), metaSuffix)
+			stored[key] = true
+		}
+	}
+	keys := make([]string, 0, len(plain)+len(stored))
+	for key := range plain {
+		if !stored[key] {
+			keys = append(keys, key)
+		}
+	}
+	for key := range stored {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	result := s2.ListObjectVersionsResult{
+		Versions:      []*s2.Version{},
+		DeleteMarkers: []*s2.DeleteMarker{},
+	}
+
+	for _, key := range keys {
+		if key < keyMarker || commonPrefix(key, prefix, delimiter) != "" {
+			continue
+		}
+
+		var vs versions
+		if stored[key] {
+			vs, _, err = c.load(r, bucket, key)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			contents := plain[key]
+			vs = versions{{
+				ID:      nullVersion,
+				ETag:    contents.ETag,
+				ModTime: contents.LastModified,
+				Size:    int64(contents.Size),
+			}}
+		}
+
+		start := len(vs) - 1
+		if key == keyMarker {
+			// S3 resumes after the version marker, or after the whole key
+			// if there isn't one
+			start = -1
+			if versionMarker != "" {
+				if i := vs.find(versionMarker); i >= 0 {
+					start = i - 1
+				}
+			}
+		}
+
+		for i := start; i >= 0; i-- {
+			if len(result.Versions)+len(result.DeleteMarkers) >= maxKeys {
+				result.IsTruncated = maxKeys > 0
+				return &result, nil
+			}
+
+			v := vs[i]
+			if v.DeleteMarker {
+				result.DeleteMarkers = append(result.DeleteMarkers, &s2.DeleteMarker{
+					Key:          key,
+					Version:      v.ID,
+					IsLatest:     i == len(vs)-1,
+					LastModified: v.ModTime,
+				})
+			} else {
+				result.Versions = append(result.Versions, &s2.Version{
+					Key:          key,
+					Version:      v.ID,
+					IsLatest:     i == len(vs)-1,
+					LastModified: v.ModTime,
+					ETag:         v.ETag,
+					Size:         uint64(v.Size),
+					StorageClass: StorageClass,
+				})
+			}
+			result.NextKeyMarker = key
+			result.NextVersionIDMarker = v.ID
+		}
+	}
+
+	return &result, nil
+}
+
+// CreateBucket creates a bucket using the wrapped controller
+func (c *Controller) CreateBucket(r *http.Request, bucket string, options *s2.CreateBucketOptions) error {
+	c.configLock.Lock()
+	delete(c.configs, bucket)
+	c.configLock.Unlock()
+	return c.bucket.CreateBucket(r, bucket, options)
+}
+
+// DeleteBucket deletes a bucket using the wrapped controller, once it has
+// no objects or versions. The hidden versioning configuration is removed
+// first.
+func (c *Controller) DeleteBucket(r *http.Request, bucket string) error {
+	result, err := c.ListObjects(r, bucket, "", "", "", 1)
+	if err != nil {
+		return err
+	}
+	if len(result.Contents) > 0 {
+		return s2.BucketNotEmptyError(r)
+	}
+	result, err = c.bucket.ListObjects(r, bucket, keysPrefix, "", "", 1)
+	if err != nil {
+		return err
+	}
+	if len(result.Contents) > 0 {
+		return s2.BucketNotEmptyError(r)
+	}
+
+	c.configLock.Lock()
+	delete(c.configs, bucket)
+	c.configLock.Unlock()
+
+	if _, err := c.object.DeleteObject(r, bucket, configKey, ""); err != nil && !isErrorCode(err, "NoSuchKey") {
+		return err
+	}
+	return c.bucket.DeleteBucket(r, bucket)
+}
+
+// GetBucketVersioning gets the versioning status of a bucket
+func (c *Controller) GetBucketVersioning(r *http.Request, bucket string) (string, error) {
+	return c.status(r, bucket)
+}
+
+// SetBucketVersioning sets the versioning status of a bucket. As with S3,
+// versioning can only be suspended, not disabled, once it's been enabled.
+func (c *Controller) SetBucketVersioning(r *http.Request, bucket, status string) error {
+	current, err := c.status(r, bucket)
+	if err != nil {
+		return err
+	}
+	if status == s2.VersioningDisabled {
+		if current != s2.VersioningDisabled {
+			return s2.IllegalVersioningConfigurationError(r)
+		}
+		return nil
+	}
+
+	if _, err := c.object.PutObject(putRequest(r, int64(len(status))), bucket, configKey, strings.NewReader(status), nil); err != nil {
+		return err
+	}
+	c.configLock.Lock()
+	c.configs[bucket] = status
+	c.configLock.Unlock()
+	return nil
+}
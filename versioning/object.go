@@ -0,0 +1,389 @@
+package versioning
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/pachyderm/s2"
+)
+
+// putRequest derives a request for writing content of the given length to a
+// hidden key, so that wrapped controllers that look at the request's
+// headers don't mistake it for the client's write
+func putRequest(r *http.Request, length int64) *http.Request {
+	put := r.WithContext(r.Context())
+	put.Header = http.Header{}
+	for name, values := range r.Header {
+		if strings.HasPrefix(strings.ToLower(name), "x-amz-copy-source") {
+			continue
+		}
+		put.Header[name] = values
+	}
+	put.Header.Del("x-amz-decoded-content-length")
+	put.Header.Set("Content-Length", strconv.FormatInt(length, 10))
+	put.ContentLength = length
+	put.Body = http.NoBody
+	return put
+}
+
+// countingReader counts the bytes read from a reader
+type countingReader struct {
+	io.Reader
+	n int64
+}
+
+func (r *countingReader) Read(b []byte) (int, error) {
+	n, err := r.Reader.Read(b)
+	r.n += int64(n)
+	return n, err
+}
+
+// GetObject gets the latest version of an object, or a specific version
+func (c *Controller) GetObject(r *http.Request, bucket, key, versionID string) (*s2.GetObjectResult, error) {
+	if isInternal(key) {
+		return nil, s2.NoSuchKeyError(r)
+	}
+	status, err := c.status(r, bucket)
+	if err != nil {
+		return nil, err
+	}
+	lock := c.lock(bucket, key)
+	lock.RLock()
+	defer lock.RUnlock()
+
+	vs, _, err := c.load(r, bucket, key)
+	if err != nil {
+		return nil, err
+	}
+
+	i := len(vs) - 1
+	if versionID != "" {
+		if i = vs.find(versionID); i < 0 {
+			return nil, s2.NoSuchVersionError(r)
+		}
+	} else if i < 0 {
+		return nil, s2.NoSuchKeyError(r)
+	}
+
+	v := vs[i]
+	result := &s2.GetObjectResult{
+		ETag:         v.ETag,
+		DeleteMarker: v.DeleteMarker,
+		ModTime:      v.ModTime,
+		PartSizes:    v.PartSizes,
+	}
+	if status != s2.VersioningDisabled {
+		result.Version = v.ID
+	}
+	if v.DeleteMarker {
+		return result, nil
+	}
+
+	contentKey := key
+	if i < len(vs)-1 {
+		contentKey = versionKey(key, v.ID)
+	}
+	content, err := c.object.GetObject(r, bucket, contentKey, "")
+	if err != nil {
+		return nil, err
+	}
+	result.Content = content.Content
+	return result, nil
+}
+
+// write writes a new version of an object, respecting the bucket's
+// versioning status. `write` does the actual write of the content to the
+// object's key, returning its ETag and size. It returns the version ID that
+// should be reported to the client.
+func (c *Controller) write(r *http.Request, bucket, key string, preconditions *s2.Preconditions, write func() (etag string, size int64, partSizes []int64, err error)) (string, string, error) {
+	status, err := c.status(r, bucket)
+	if err != nil {
+		return "", "", err
+	}
+	lock := c.lock(bucket, key)
+	lock.Lock()
+	defer lock.Unlock()
+
+	vs, stored, err := c.load(r, bucket, key)
+	if err != nil {
+		return "", "", err
+	}
+	latest := vs.latest()
+	if latest == nil || latest.DeleteMarker {
+		err = preconditions.Check(r, false, "")
+	} else {
+		err = preconditions.Check(r, true, latest.ETag)
+	}
+	if err != nil {
+		return "", "", err
+	}
+
+	if status == s2.VersioningDisabled {
+		etag, _, _, err := write()
+		return etag, "", err
+	}
+
+	id := newID()
+	if status == s2.VersioningSuspended {
+		id = nullVersion
+	}
+	archived, err := c.archive(r, bucket, key, vs, id)
+	if err != nil {
+		return "", "", err
+	}
+
+	etag, size, partSizes, err := write()
+	if err != nil {
+		c.discard(r, bucket, archived)
+		return "", "", err
+	}
+	if vs, err = c.retire(r, bucket, key, vs, id); err != nil {
+		return "", "", err
+	}
+	vs = append(vs, &version{
+		ID:        id,
+		ETag:      etag,
+		ModTime:   now(),
+		Size:      size,
+		PartSizes: partSizes,
+	})
+	if err := c.save(r, bucket, key, vs, stored); err != nil {
+		return "", "", err
+	}
+	return etag, id, nil
+}
+
+// archive prepares for a new latest version with the given ID to be
+// written, by copying the content of the current latest version to its
+// version key. The content is left in place until the new version is
+// written over it, so that it's kept if the write fails. It returns the
+// key that was copied to, if any. The key's lock must be held.
+func (c *Controller) archive(r *http.Request, bucket, key string, vs versions, id string) (string, error) {
+	latest := vs.latest()
+	if latest == nil || latest.DeleteMarker || latest.ID == id {
+		return "", nil
+	}
+	archived := versionKey(key, latest.ID)
+	if err := c.copy(r, bucket, key, archived); err != nil {
+		return "", err
+	}
+	return archived, nil
+}
+
+// discard removes the copy made by `archive` after a failed write. It's
+// best effort, since a leftover copy is hidden, and overwritten by the
+// next write.
+func (c *Controller) discard(r *http.Request, bucket, archived string) {
+	if archived != "" {
+		c.object.DeleteObject(r, bucket, archived, "")
+	}
+}
+
+// retire removes any existing version with the same ID as a newly written
+// latest version (i.e. the "null" version when versioning is suspended)
+// from `vs`, along with its archived content. The key's lock must be held.
+func (c *Controller) retire(r *http.Request, bucket, key string, vs versions, id string) (versions, error) {
+	i := vs.find(id)
+	if i < 0 {
+		return vs, nil
+	}
+	if !vs[i].DeleteMarker && i < len(vs)-1 {
+		if _, err := c.object.DeleteObject(r, bucket, versionKey(key, id), ""); err != nil {
+			return nil, err
+		}
+	}
+	return vs.remove(i), nil
+}
+
+// CopyObject copies an object into a new version of the destination
+func (c *Controller) CopyObject(r *http.Request, srcBucket, srcKey string, getResult *s2.GetObjectResult, destBucket, destKey string) (string, error) {
+	if isInternal(destKey) {
+		return "", s2.AccessDeniedError(r)
+	}
+	_, id, err := c.write(r, destBucket, destKey, nil, func() (string, int64, []int64, error) {
+		size, err := contentSize(getResult)
+		if err != nil {
+			return "", 0, nil, err
+		}
+		if _, err := c.object.CopyObject(r, srcBucket, srcKey, getResult, destBucket, destKey); err != nil {
+			return "", 0, nil, err
+		}
+		return getResult.ETag, size, nil, nil
+	})
+	return id, err
+}
+
+// PutObject writes a new version of an object, checking `preconditions`
+// against the latest version
+func (c *Controller) PutObject(r *http.Request, bucket, key string, reader io.Reader, preconditions *s2.Preconditions) (*s2.PutObjectResult, error) {
+	if isInternal(key) {
+		return nil, s2.AccessDeniedError(r)
+	}
+	etag, id, err := c.write(r, bucket, key, preconditions, func() (string, int64, []int64, error) {
+		counter := &countingReader{Reader: reader}
+		result, err := c.object.PutObject(r, bucket, key, counter, nil)
+		if err != nil {
+			return "", 0, nil, err
+		}
+		return result.ETag, counter.n, nil, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &s2.PutObjectResult{ETag: etag, Version: id}, nil
+}
+
+// DeleteObject deletes an object. If no version is specified and
+// versioning is enabled or suspended, a delete marker is written instead,
+// as in S3. Deleting a specific version removes it permanently, and
+// restores the previous version if it was the latest.
+func (c *Controller) DeleteObject(r *http.Request, bucket, key, versionID string) (*s2.DeleteObjectResult, error) {
+	if isInternal(key) {
+		return nil, s2.AccessDeniedError(r)
+	}
+	status, err := c.status(r, bucket)
+	if err != nil {
+		return nil, err
+	}
+	if versionID != "" {
+		return c.deleteVersion(r, bucket, key, versionID)
+	}
+	if status == s2.VersioningDisabled {
+		return c.object.DeleteObject(r, bucket, key, "")
+	}
+
+	lock := c.lock(bucket, key)
+	lock.Lock()
+	defer lock.Unlock()
+
+	vs, stored, err := c.load(r, bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	id := newID()
+	if status == s2.VersioningSuspended {
+		id = nullVersion
+	}
+	archived, err := c.archive(r, bucket, key, vs, id)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := c.object.DeleteObject(r, bucket, key, ""); err != nil && !isErrorCode(err, "NoSuchKey") {
+		c.discard(r, bucket, archived)
+		return nil, err
+	}
+	if vs, err = c.retire(r, bucket, key, vs, id); err != nil {
+		return nil, err
+	}
+	vs = append(vs, &version{
+		ID:           id,
+		ModTime:      now(),
+		DeleteMarker: true,
+	})
+	if err := c.save(r, bucket, key, vs, stored); err != nil {
+		return nil, err
+	}
+	return &s2.DeleteObjectResult{Version: id, DeleteMarker: true}, nil
+}
+
+// deleteVersion permanently deletes a version of an object
+func (c *Controller) deleteVersion(r *http.Request, bucket, key, versionID string) (*s2.DeleteObjectResult, error) {
+	lock := c.lock(bucket, key)
+	lock.Lock()
+	defer lock.Unlock()
+
+	vs, stored, err := c.load(r, bucket, key)
+	if err != nil {
+		return nil, err
+	}
+
+	// deleting a version that doesn't exist is a no-op
+	result := &s2.DeleteObjectResult{Version: versionID}
+	i := vs.find(versionID)
+	if i < 0 {
+		return result, nil
+	}
+	v := vs[i]
+	result.DeleteMarker = v.DeleteMarker
+	isLatest := i == len(vs)-1
+	vs = vs.remove(i)
+
+	if !v.DeleteMarker {
+		contentKey := versionKey(key, v.ID)
+		if isLatest {
+			contentKey = key
+		}
+		if _, err := c.object.DeleteObject(r, bucket, contentKey, ""); err != nil {
+			return nil, err
+		}
+	}
+	if latest := vs.latest(); isLatest && latest != nil && !latest.DeleteMarker {
+		if err := c.move(r, bucket, versionKey(key, latest.ID), key); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := c.save(r, bucket, key, vs, stored); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// WrapMultipart wraps a multipart controller, so that completing a
+// multipart upload writes a new version of the object
+func (c *Controller) WrapMultipart(controller s2.MultipartController) s2.MultipartController {
+	return &multipartController{MultipartController: controller, versioning: c}
+}
+
+// multipartController writes the objects created by a wrapped multipart
+// controller as new versions
+type multipartController struct {
+	s2.MultipartController
+	versioning *Controller
+}
+
+func (c *multipartController) InitMultipart(r *http.Request, bucket, key string) (string, error) {
+	if isInternal(key) {
+		return "", s2.AccessDeniedError(r)
+	}
+	return c.MultipartController.InitMultipart(r, bucket, key)
+}
+
+func (c *multipartController) CompleteMultipart(r *http.Request, bucket, key, uploadID string, parts []*s2.Part, preconditions *s2.Preconditions) (*s2.CompleteMultipartResult, error) {
+	var result *s2.CompleteMultipartResult
+	_, id, err := c.versioning.write(r, bucket, key, preconditions, func() (string, int64, []int64, error) {
+		var err error
+		result, err = c.MultipartController.CompleteMultipart(r, bucket, key, uploadID, parts, nil)
+		if err != nil {
+			return "", 0, nil, err
+		}
+
+		// the size and part sizes are only known by reading the object back
+		object, err := c.versioning.object.GetObject(r, bucket, key, "")
+		if err != nil {
+			return "", 0, nil, err
+		}
+		defer closeContent(object)
+		size, err := contentSize(object)
+		if err != nil {
+			return "", 0, nil, err
+		}
+		return result.ETag, size, object.PartSizes, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	result.Version = id
+	return result, nil
+}
+
+// GetMultipartChunk uses the wrapped controller's `GetMultipartChunk`, if
+// it implements `s2.MultipartChunkController`
+func (c *multipartController) GetMultipartChunk(r *http.Request, bucket, key, uploadID string, partNumber int) (io.ReadSeeker, error) {
+	if controller, ok := c.MultipartController.(s2.MultipartChunkController); ok {
+		return controller.GetMultipartChunk(r, bucket, key, uploadID, partNumber)
+	}
+	return nil, s2.NotImplementedError(r)
+}
@@ -0,0 +1,296 @@
+// Package versioning emulates S3 versioning on top of controllers that
+// don't support it, so that simple backends can offer version IDs, delete
+// markers, suspended versioning and version listings:
+//
+//	v := versioning.New(backend, backend)
+//	s.Bucket = v
+//	s.Object = v
+//	s.Multipart = v.WrapMultipart(backend)
+//
+// The wrapped controllers only ever see unversioned requests. The latest
+// version of each object is stored under its own key, so that the wrapped
+// controllers can still list and serve it, while everything else is stored
+// under hidden keys in the same bucket:
+//
+//	.s2-versions/config               the bucket's versioning status
+//	.s2-versions/keys/<key>/meta      JSON metadata of the key's versions
+//	.s2-versions/keys/<key>/v/<id>    content of noncurrent versions
+//
+// Objects that were written before versioning was enabled are treated as
+// having a single "null" version. Hidden keys aren't listed, and can't be
+// read or written through the wrapper. Buckets must only be written to
+// through the wrapper, which serializes writes to each key.
+package versioning
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pachyderm/s2"
+)
+
+const (
+	// internalPrefix is the prefix of every hidden key
+	internalPrefix = ".s2-versions/"
+	// configKey is the hidden key that stores a bucket's versioning status
+	configKey = internalPrefix + "config"
+	// keysPrefix is the prefix of the hidden keys that store the versions
+	// of each key
+	keysPrefix = internalPrefix + "keys/"
+	// metaSuffix is the suffix of the hidden keys that store version
+	// metadata
+	metaSuffix = "/meta"
+	// nullVersion is the version ID S3 gives to objects written while
+	// versioning is disabled or suspended
+	nullVersion = "null"
+	// StorageClass is the storage class reported for all versions
+	StorageClass = "STANDARD"
+	// lockStripes is the number of locks that writes to keys are spread
+	// across
+	lockStripes = 64
+	// listPageSize is the number of keys requested per call when listing
+	// the wrapped bucket controller
+	listPageSize = 1000
+)
+
+// version is a single version of an object, or a delete marker
+type version struct {
+	ID           string    `json:"id"`
+	ETag         string    `json:"etag,omitempty"`
+	ModTime      time.Time `json:"modTime"`
+	Size         int64     `json:"size"`
+	DeleteMarker bool      `json:"deleteMarker,omitempty"`
+	PartSizes    []int64   `json:"partSizes,omitempty"`
+}
+
+// versions are the versions of a key, oldest first
+type versions []*version
+
+// latest returns the latest version, or nil if there are none
+func (vs versions) latest() *version {
+	if len(vs) == 0 {
+		return nil
+	}
+	return vs[len(vs)-1]
+}
+
+// find returns the index of the given version, or -1 if it doesn't exist
+func (vs versions) find(id string) int {
+	for i, v := range vs {
+		if v.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// remove returns the versions without the one at the given index
+func (vs versions) remove(i int) versions {
+	return append(vs[:i:i], vs[i+1:]...)
+}
+
+// Controller is an `s2.BucketController` and `s2.ObjectController` that
+// emulates versioning on top of wrapped, unversioned controllers
+type Controller struct {
+	bucket s2.BucketController
+	object s2.ObjectController
+
+	// locks serialize writes to each key
+	locks [lockStripes]sync.RWMutex
+
+	// configLock protects configs, which caches the versioning status of
+	// buckets
+	configLock sync.Mutex
+	configs    map[string]string
+}
+
+// New creates a controller that emulates versioning on top of the given
+// bucket and object controllers
+func New(bucket s2.BucketController, object s2.ObjectController) *Controller {
+	return &Controller{
+		bucket:  bucket,
+		object:  object,
+		configs: map[string]string{},
+	}
+}
+
+// lock gets the lock that serializes writes to a key
+func (c *Controller) lock(bucket, key string) *sync.RWMutex {
+	hash := fnv.New32a()
+	hash.Write([]byte(bucket))
+	hash.Write([]byte{0})
+	hash.Write([]byte(key))
+	return &c.locks[hash.Sum32()%lockStripes]
+}
+
+// isInternal returns whether a key is hidden
+func isInternal(key string) bool {
+	return strings.HasPrefix(key, internalPrefix)
+}
+
+// metaKey gets the hidden key that stores the metadata of a key's versions
+func metaKey(key string) string {
+	return keysPrefix + key + metaSuffix
+}
+
+// versionKey gets the hidden key that stores the content of a noncurrent
+// version of a key
+func versionKey(key, id string) string {
+	return keysPrefix + key + "/v/" + id
+}
+
+// newID generates a random version ID
+func newID() string {
+	var buf [16]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		panic(fmt.Sprintf("could not generate random ID: %v", err))
+	}
+	return hex.EncodeToString(buf[:])
+}
+
+// now returns the current time, rounded to S3's millisecond precision
+func now() time.Time {
+	return time.Now().UTC().Round(time.Millisecond)
+}
+
+// isErrorCode returns whether an error is an S3 error with the given code
+func isErrorCode(err error, code string) bool {
+	s3Err, ok := err.(*s2.Error)
+	return ok && s3Err.Code == code
+}
+
+// closeContent closes the content of a `GetObject` result, if it's closable
+func closeContent(result *s2.GetObjectResult) {
+	if closer, ok := result.Content.(io.Closer); ok {
+		closer.Close()
+	}
+}
+
+// contentSize gets the size of the content of a `GetObject` result, leaving
+// it at the start
+func contentSize(result *s2.GetObjectResult) (int64, error) {
+	size, err := result.Content.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := result.Content.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return size, nil
+}
+
+// status gets the versioning status of a bucket
+func (c *Controller) status(r *http.Request, bucket string) (string, error) {
+	c.configLock.Lock()
+	status, ok := c.configs[bucket]
+	c.configLock.Unlock()
+	if ok {
+		return status, nil
+	}
+
+	status = s2.VersioningDisabled
+	result, err := c.object.GetObject(r, bucket, configKey, "")
+	if err == nil {
+		defer closeContent(result)
+		content, err := ioutil.ReadAll(result.Content)
+		if err != nil {
+			return "", err
+		}
+		status = string(content)
+	} else if !isErrorCode(err, "NoSuchKey") {
+		return "", err
+	}
+
+	c.configLock.Lock()
+	c.configs[bucket] = status
+	c.configLock.Unlock()
+	return status, nil
+}
+
+// load gets the versions of a key. Keys without version metadata have a
+// single "null" version if they exist. `stored` reports whether there's
+// version metadata.
+func (c *Controller) load(r *http.Request, bucket, key string) (vs versions, stored bool, err error) {
+	result, err := c.object.GetObject(r, bucket, metaKey(key), "")
+	if err == nil {
+		defer closeContent(result)
+		if err := json.NewDecoder(result.Content).Decode(&vs); err != nil {
+			return nil, false, err
+		}
+		return vs, true, nil
+	}
+	if !isErrorCode(err, "NoSuchKey") {
+		return nil, false, err
+	}
+
+	result, err = c.object.GetObject(r, bucket, key, "")
+	if err != nil {
+		if isErrorCode(err, "NoSuchKey") {
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+	defer closeContent(result)
+	if result.DeleteMarker {
+		return nil, false, nil
+	}
+	size, err := contentSize(result)
+	if err != nil {
+		return nil, false, err
+	}
+	return versions{{
+		ID:        nullVersion,
+		ETag:      result.ETag,
+		ModTime:   result.ModTime,
+		Size:      size,
+		PartSizes: result.PartSizes,
+	}}, false, nil
+}
+
+// save stores the versions of a key
+func (c *Controller) save(r *http.Request, bucket, key string, vs versions, stored bool) error {
+	if len(vs) == 0 {
+		if !stored {
+			return nil
+		}
+		_, err := c.object.DeleteObject(r, bucket, metaKey(key), "")
+		return err
+	}
+
+	content, err := json.Marshal(vs)
+	if err != nil {
+		return err
+	}
+	_, err = c.object.PutObject(putRequest(r, int64(len(content))), bucket, metaKey(key), bytes.NewReader(content), nil)
+	return err
+}
+
+// copy copies content from one key to another within a bucket
+func (c *Controller) copy(r *http.Request, bucket, srcKey, destKey string) error {
+	result, err := c.object.GetObject(r, bucket, srcKey, "")
+	if err != nil {
+		return err
+	}
+	defer closeContent(result)
+	_, err = c.object.CopyObject(r, bucket, srcKey, result, bucket, destKey)
+	return err
+}
+
+// move moves content from one key to another within a bucket
+func (c *Controller) move(r *http.Request, bucket, srcKey, destKey string) error {
+	if err := c.copy(r, bucket, srcKey, destKey); err != nil {
+		return err
+	}
+	_, err := c.object.DeleteObject(r, bucket, srcKey, "")
+	return err
+}
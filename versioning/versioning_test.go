@@ -0,0 +1,319 @@
+package versioning
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/pachyderm/s2"
+	"github.com/pachyderm/s2/memory"
+	"github.com/pachyderm/s2/s2test"
+	"github.com/sirupsen/logrus"
+)
+
+func TestConformance(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	s2test.RunConformance(t, func() *s2.S2 {
+		// the memory backend is unversioned, since versioning is never
+		// enabled on its buckets
+		backend := memory.New()
+		v := New(backend, backend)
+		s := backend.S2(logrus.NewEntry(logger))
+		s.Bucket = v
+		s.Object = v
+		s.Multipart = v.WrapMultipart(backend)
+		return s
+	})
+}
+
+func TestEmulation(t *testing.T) {
+	backend := memory.New()
+	v := New(backend, backend)
+	r := httptest.NewRequest("PUT", "/", nil)
+	if err := v.CreateBucket(r, "bucket", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	put := func(content string) string {
+		t.Helper()
+		result, err := v.PutObject(r, "bucket", "key", strings.NewReader(content), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return result.Version
+	}
+	expectBackendContent := func(expected string) {
+		t.Helper()
+		result, err := backend.GetObject(r, "bucket", "key", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := ioutil.ReadAll(result.Content)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(content) != expected {
+			t.Fatalf("expected the backend to have %q, got %q", expected, content)
+		}
+	}
+
+	// objects written before versioning is enabled get the null version
+	put("before")
+	if err := v.SetBucketVersioning(r, "bucket", s2.VersioningEnabled); err != nil {
+		t.Fatal(err)
+	}
+	id := put("after")
+	expectBackendContent("after")
+	if versioning, err := backend.GetBucketVersioning(r, "bucket"); err != nil || versioning != s2.VersioningDisabled {
+		t.Fatalf("expected the backend to stay unversioned, got %q, %v", versioning, err)
+	}
+
+	listed, err := v.ListObjects(r, "bucket", "", "", "", 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listed.Contents) != 1 || listed.Contents[0].Key != "key" {
+		t.Fatalf("expected hidden keys not to be listed, got %+v", listed.Contents)
+	}
+	if _, err := v.GetObject(r, "bucket", configKey, ""); err == nil {
+		t.Fatal("expected hidden keys not to be readable")
+	}
+
+	versions, err := v.ListObjectVersions(r, "bucket", "", "", "", "", 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions.Versions) != 2 || versions.Versions[0].Version != id || versions.Versions[1].Version != nullVersion {
+		t.Fatalf("expected the new and null versions, got %+v", versions.Versions)
+	}
+
+	// deleting the latest version restores the previous one
+	if _, err := v.DeleteObject(r, "bucket", "key", id); err != nil {
+		t.Fatal(err)
+	}
+	expectBackendContent("before")
+	result, err := v.GetObject(r, "bucket", "key", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Version != nullVersion {
+		t.Fatalf("expected the null version to be restored, got %q", result.Version)
+	}
+}
+
+func TestSuspended(t *testing.T) {
+	backend := memory.New()
+	v := New(backend, backend)
+	r := httptest.NewRequest("PUT", "/", nil)
+	if err := v.CreateBucket(r, "bucket", nil); err != nil {
+		t.Fatal(err)
+	}
+	setVersioning := func(status string) {
+		t.Helper()
+		if err := v.SetBucketVersioning(r, "bucket", status); err != nil {
+			t.Fatal(err)
+		}
+	}
+	put := func(content string) string {
+		t.Helper()
+		result, err := v.PutObject(r, "bucket", "key", strings.NewReader(content), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return result.Version
+	}
+	// expectVersions checks the versions of the key, oldest first, and
+	// that only the noncurrent versions have archived content
+	expectVersions := func(expected ...string) {
+		t.Helper()
+		vs, _, err := v.load(r, "bucket", "key")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids := []string{}
+		archived := map[string]bool{}
+		for i, version := range vs {
+			ids = append(ids, version.ID)
+			if i < len(vs)-1 && !version.DeleteMarker {
+				archived[versionKey("key", version.ID)] = true
+			}
+		}
+		if strings.Join(ids, " ") != strings.Join(expected, " ") {
+			t.Fatalf("expected versions %v, got %v", expected, ids)
+		}
+		listed, err := backend.ListObjects(r, "bucket", keysPrefix+"key/v/", "", "", 1000)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(listed.Contents) != len(archived) {
+			t.Fatalf("expected %d archived versions, got %d", len(archived), len(listed.Contents))
+		}
+		for _, object := range listed.Contents {
+			if !archived[object.Key] {
+				t.Fatalf("unexpected archived content %s", object.Key)
+			}
+		}
+	}
+	expectContent := func(version, expected string) {
+		t.Helper()
+		result, err := v.GetObject(r, "bucket", "key", version)
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := ioutil.ReadAll(result.Content)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(content) != expected {
+			t.Fatalf("expected version %q to have %q, got %q", version, expected, content)
+		}
+	}
+
+	setVersioning(s2.VersioningEnabled)
+	first := put("first")
+	setVersioning(s2.VersioningSuspended)
+
+	// writes while suspended get the null version, and replace each other
+	if id := put("null 1"); id != nullVersion {
+		t.Fatalf("expected the null version, got %q", id)
+	}
+	expectVersions(first, nullVersion)
+	put("null 2")
+	expectVersions(first, nullVersion)
+	expectContent("", "null 2")
+	expectContent(nullVersion, "null 2")
+	expectContent(first, "first")
+
+	// deletes while suspended replace the null version with a delete marker
+	deleted, err := v.DeleteObject(r, "bucket", "key", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !deleted.DeleteMarker || deleted.Version != nullVersion {
+		t.Fatalf("expected a null delete marker, got %+v", deleted)
+	}
+	expectVersions(first, nullVersion)
+	result, err := v.GetObject(r, "bucket", "key", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.DeleteMarker {
+		t.Fatal("expected the latest version to be a delete marker")
+	}
+	put("null 3")
+	expectVersions(first, nullVersion)
+	expectContent("", "null 3")
+
+	// once versioning is enabled again, the null version is kept until
+	// it's replaced by a later suspended write, even if it's noncurrent
+	setVersioning(s2.VersioningEnabled)
+	second := put("second")
+	expectVersions(first, nullVersion, second)
+	expectContent(nullVersion, "null 3")
+	setVersioning(s2.VersioningSuspended)
+	put("null 4")
+	expectVersions(first, second, nullVersion)
+	expectContent(second, "second")
+	expectContent("", "null 4")
+
+	// deleting the null version restores the previous one
+	if _, err := v.DeleteObject(r, "bucket", "key", nullVersion); err != nil {
+		t.Fatal(err)
+	}
+	expectVersions(first, second)
+	expectContent("", "second")
+}
+
+// failingReader fails after its content has been read
+type failingReader struct {
+	io.Reader
+}
+
+func (r failingReader) Read(b []byte) (int, error) {
+	n, err := r.Reader.Read(b)
+	if err == io.EOF {
+		err = errors.New("client disconnected")
+	}
+	return n, err
+}
+
+func TestFailedWrites(t *testing.T) {
+	backend := memory.New()
+	v := New(backend, backend)
+	r := httptest.NewRequest("PUT", "/", nil)
+	if err := v.CreateBucket(r, "bucket", nil); err != nil {
+		t.Fatal(err)
+	}
+	setVersioning := func(status string) {
+		t.Helper()
+		if err := v.SetBucketVersioning(r, "bucket", status); err != nil {
+			t.Fatal(err)
+		}
+	}
+	put := func(content string) string {
+		t.Helper()
+		result, err := v.PutObject(r, "bucket", "key", strings.NewReader(content), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return result.Version
+	}
+	putFailing := func() {
+		t.Helper()
+		if _, err := v.PutObject(r, "bucket", "key", failingReader{strings.NewReader("failed")}, nil); err == nil {
+			t.Fatal("expected the write to fail")
+		}
+	}
+	expectContent := func(version, expected string) {
+		t.Helper()
+		result, err := v.GetObject(r, "bucket", "key", version)
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := ioutil.ReadAll(result.Content)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(content) != expected {
+			t.Fatalf("expected version %q to have %q, got %q", version, expected, content)
+		}
+	}
+	expectArchived := func(n int) {
+		t.Helper()
+		listed, err := backend.ListObjects(r, "bucket", keysPrefix+"key/v/", "", "", 1000)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(listed.Contents) != n {
+			t.Fatalf("expected %d archived versions, got %d", n, len(listed.Contents))
+		}
+	}
+
+	// a failed write keeps the object written before versioning was
+	// enabled
+	put("before")
+	setVersioning(s2.VersioningEnabled)
+	putFailing()
+	expectContent("", "before")
+	expectArchived(0)
+
+	// and the latest version, once there are versions
+	first := put("first")
+	putFailing()
+	expectContent("", "first")
+	expectContent(nullVersion, "before")
+	expectArchived(1)
+
+	// and the noncurrent null version that a suspended write would replace
+	setVersioning(s2.VersioningSuspended)
+	putFailing()
+	expectContent("", "first")
+	expectContent(nullVersion, "before")
+	expectContent(first, "first")
+	expectArchived(1)
+}